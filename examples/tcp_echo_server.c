@@ -0,0 +1,306 @@
+/**
+ * @file tcp_echo_server.c
+ * @brief TCP echo server over tiny-yamux
+ *
+ * This example accepts TCP connections one at a time, runs a yamux server
+ * session on each, and echoes back everything received on every stream the
+ * client opens. It shows the intended event loop: wait for the socket to
+ * become readable, let yamux_process handle one frame, accept new streams,
+ * then service the streams that have data or an unfinished echo.
+ *
+ * The socket is non-blocking. yamux expects a read callback to return a
+ * whole header or payload, so once a frame has started arriving the read
+ * callback waits for the rest of it; the event loop only calls yamux_process
+ * when the socket is readable, so a frame has always started by then.
+ *
+ * Streams stay open until the client disconnects, at which point the session
+ * and every stream are released. Ctrl-C ends the server after sending what is
+ * held on each stream and a FIN, using yamux_destroy_flush.
+ *
+ * Usage: tcp_echo_server [port]   (default port 7777)
+ */
+
+#include "../include/yamux.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <poll.h>
+#include <signal.h>
+#include <unistd.h>
+#include <arpa/inet.h>
+#include <netinet/in.h>
+#include <sys/socket.h>
+
+#define DEFAULT_PORT        7777
+#define MAX_ECHO_STREAMS    64      /* Streams served per connection */
+#define ECHO_BUFFER_SIZE    4096    /* Bytes read from a stream at a time */
+#define IO_TIMEOUT_MS       5000    /* Longest wait for the rest of a frame */
+#define IDLE_POLL_MS        100     /* Event loop wait when nothing is pending */
+
+/* Connection context passed to the yamux IO callbacks */
+typedef struct {
+    int fd;
+} connection_t;
+
+/* A stream being echoed, with the bytes not yet written back */
+typedef struct {
+    void *stream;
+    uint8_t pending[ECHO_BUFFER_SIZE];
+    size_t pending_len;
+    size_t pending_off;
+} echo_stream_t;
+
+static volatile sig_atomic_t stop_requested = 0;
+
+static void handle_stop(int sig) {
+    (void)sig;
+    stop_requested = 1;
+}
+
+/* Wait until fd is ready for events; returns 1 when ready, 0 on timeout, -1 on error */
+static int wait_fd(int fd, short events, int timeout_ms) {
+    struct pollfd pfd;
+    int result;
+
+    pfd.fd = fd;
+    pfd.events = events;
+    pfd.revents = 0;
+
+    do {
+        result = poll(&pfd, 1, timeout_ms);
+    } while (result < 0 && errno == EINTR && !stop_requested);
+
+    return (result < 0) ? -1 : (result > 0);
+}
+
+/* Read callback: delivers exactly len bytes, waiting for any that are still in flight */
+static int fd_read(void *ctx, uint8_t *buf, size_t len) {
+    connection_t *conn = (connection_t *)ctx;
+    size_t got = 0;
+    ssize_t n;
+
+    while (got < len) {
+        n = recv(conn->fd, buf + got, len - got, 0);
+        if (n > 0) {
+            got += (size_t)n;
+            continue;
+        }
+        if (n == 0) {
+            return -1;  /* Client closed the connection */
+        }
+        if (errno == EINTR) {
+            continue;
+        }
+        if ((errno != EAGAIN && errno != EWOULDBLOCK) ||
+            wait_fd(conn->fd, POLLIN, IO_TIMEOUT_MS) <= 0) {
+            return -1;
+        }
+    }
+
+    return (int)got;
+}
+
+/* Write callback: writes all len bytes, waiting while the socket buffer is full */
+static int fd_write(void *ctx, const uint8_t *buf, size_t len) {
+    connection_t *conn = (connection_t *)ctx;
+    size_t sent = 0;
+    ssize_t n;
+
+    while (sent < len) {
+        n = send(conn->fd, buf + sent, len - sent, MSG_NOSIGNAL);
+        if (n > 0) {
+            sent += (size_t)n;
+            continue;
+        }
+        if (n < 0 && errno == EINTR) {
+            continue;
+        }
+        if (n == 0 || (errno != EAGAIN && errno != EWOULDBLOCK) ||
+            wait_fd(conn->fd, POLLOUT, IO_TIMEOUT_MS) <= 0) {
+            return -1;
+        }
+    }
+
+    return (int)sent;
+}
+
+/**
+ * Echo what a stream has received
+ *
+ * Bytes that could not be written back (no send window yet) are kept and
+ * retried on the next pass; nothing more is read from the stream until they
+ * are gone, so a slow reader on the client side slows its own stream only.
+ *
+ * @return 0 to keep the stream, -1 if it was reset or failed
+ */
+static int echo_stream(echo_stream_t *echo) {
+    int result;
+
+    while (echo->pending_off < echo->pending_len) {
+        result = yamux_write(echo->stream, echo->pending + echo->pending_off,
+                             echo->pending_len - echo->pending_off);
+        if (result == YAMUX_ERR_NO_WINDOW || result == YAMUX_ERR_WOULD_BLOCK) {
+            return 0;
+        }
+        if (result < 0) {
+            return -1;
+        }
+        echo->pending_off += (size_t)result;
+    }
+
+    result = yamux_read(echo->stream, echo->pending, sizeof(echo->pending));
+    if (result < 0) {
+        return -1;
+    }
+    echo->pending_len = (size_t)result;
+    echo->pending_off = 0;
+
+    return 0;
+}
+
+/* Run a yamux session on a connected socket until the client leaves or Ctrl-C */
+static void serve_connection(int fd) {
+    connection_t conn;
+    void *session;
+    void *stream;
+    echo_stream_t *echoes[MAX_ECHO_STREAMS];
+    size_t count = 0;
+    size_t i;
+    int busy = 0;
+    int ready;
+
+    conn.fd = fd;
+    fcntl(fd, F_SETFL, fcntl(fd, F_GETFL, 0) | O_NONBLOCK);
+
+    session = yamux_init(fd_read, fd_write, &conn, 0);
+    if (!session) {
+        printf("Server: Failed to initialize yamux session\n");
+        return;
+    }
+
+    while (!stop_requested) {
+        /* Wait for input, or only poll if an echo is waiting for window */
+        ready = wait_fd(fd, POLLIN, busy ? 1 : IDLE_POLL_MS);
+        if (ready < 0) {
+            break;
+        }
+        if (ready > 0 && yamux_process(session) < 0) {
+            printf("Server: Connection closed\n");
+            break;
+        }
+
+        /* Accept every stream the client has opened */
+        while ((stream = yamux_accept_stream(session)) != NULL) {
+            if (count == MAX_ECHO_STREAMS) {
+                yamux_close_stream(stream, 1);
+                continue;
+            }
+            echoes[count] = (echo_stream_t *)calloc(1, sizeof(echo_stream_t));
+            if (!echoes[count]) {
+                yamux_close_stream(stream, 1);
+                continue;
+            }
+            echoes[count]->stream = stream;
+            printf("Server: Accepted stream %u\n", yamux_get_stream_id(stream));
+            count++;
+        }
+
+        /* Echo on every stream, dropping the ones the client reset */
+        busy = 0;
+        i = 0;
+        while (i < count) {
+            if (echo_stream(echoes[i]) < 0) {
+                printf("Server: Stream %u ended\n", yamux_get_stream_id(echoes[i]->stream));
+                yamux_close_stream(echoes[i]->stream, 1);
+                free(echoes[i]);
+                echoes[i] = echoes[--count];
+                continue;
+            }
+            if (echoes[i]->pending_off < echoes[i]->pending_len) {
+                busy = 1;
+            }
+            i++;
+        }
+    }
+
+    /* On Ctrl-C end each stream with a FIN; a departed client gets nothing */
+    if (stop_requested) {
+        yamux_destroy_flush(session, IO_TIMEOUT_MS);
+    } else {
+        yamux_destroy(session);
+    }
+
+    /* The handles were detached by the destroy; closing them releases them */
+    for (i = 0; i < count; i++) {
+        yamux_close_stream(echoes[i]->stream, 0);
+        free(echoes[i]);
+    }
+}
+
+int main(int argc, char **argv) {
+    struct sockaddr_in addr;
+    struct sigaction sa;
+    int port = DEFAULT_PORT;
+    int listen_fd;
+    int client_fd;
+    int opt = 1;
+
+    if (argc > 1) {
+        port = atoi(argv[1]);
+        if (port <= 0 || port > 65535) {
+            fprintf(stderr, "Usage: %s [port]\n", argv[0]);
+            return 1;
+        }
+    }
+
+    /* Let Ctrl-C interrupt accept() and poll() instead of restarting them */
+    memset(&sa, 0, sizeof(sa));
+    sa.sa_handler = handle_stop;
+    sigemptyset(&sa.sa_mask);
+    sigaction(SIGINT, &sa, NULL);
+    sigaction(SIGTERM, &sa, NULL);
+    signal(SIGPIPE, SIG_IGN);
+
+    listen_fd = socket(AF_INET, SOCK_STREAM, 0);
+    if (listen_fd < 0) {
+        perror("socket");
+        return 1;
+    }
+    setsockopt(listen_fd, SOL_SOCKET, SO_REUSEADDR, &opt, sizeof(opt));
+
+    memset(&addr, 0, sizeof(addr));
+    addr.sin_family = AF_INET;
+    addr.sin_addr.s_addr = htonl(INADDR_ANY);
+    addr.sin_port = htons((uint16_t)port);
+
+    if (bind(listen_fd, (struct sockaddr *)&addr, sizeof(addr)) < 0 ||
+        listen(listen_fd, 5) < 0) {
+        perror("bind/listen");
+        close(listen_fd);
+        return 1;
+    }
+
+    printf("Server: Listening on port %d\n", port);
+
+    while (!stop_requested) {
+        client_fd = accept(listen_fd, NULL, NULL);
+        if (client_fd < 0) {
+            if (errno == EINTR) {
+                continue;
+            }
+            perror("accept");
+            break;
+        }
+
+        printf("Server: Client connected\n");
+        serve_connection(client_fd);
+        close(client_fd);
+    }
+
+    printf("Server: Shutting down\n");
+    close(listen_fd);
+
+    return 0;
+}
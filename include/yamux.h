@@ -69,13 +69,63 @@ typedef struct {
  * Configuration structure
  */
 typedef struct {
-    uint32_t accept_backlog;
+    uint32_t accept_backlog; /* Streams waiting for accept before accept_overflow_policy applies, 0 for no limit */
     uint32_t enable_keepalive;
     uint32_t connection_write_timeout;
     uint32_t keepalive_interval;
-    uint32_t max_stream_window_size;
+    uint32_t max_stream_window_size; /* Receive window advertised for each stream, whichever side opens it */
+    uint32_t verify_stream_id_parity; /* Reject SYNs with the wrong ID parity for the peer's role */
+    uint32_t accept_initial_window_bonus; /* Extra window granted to the opener in our SYN-ACK */
+    uint32_t small_frame_threshold; /* Merge writes shorter than this into one DATA frame, 0 to disable */
+    uint32_t window_stall_timeout_ms; /* Reset a stream whose writes wait this long for window, 0 to disable */
+    uint32_t max_stream_open_rate; /* Inbound stream opens allowed per second, 0 for no limit */
+    uint32_t on_window_violation; /* yamux_window_violation_t: reaction to data beyond our window */
+    uint32_t max_send_buffer_per_stream; /* Most unsent bytes held per stream, 0 for no limit */
+    uint32_t auto_flush; /* Send held writes after every write and process call, trading batching for latency */
+    uint32_t frame_buffer_pool_size; /* Frame-sized scratch buffers preallocated at creation, 0 for none */
+    uint32_t reject_data_on_syn; /* Reset streams the peer opens with a DATA frame carrying a payload */
+    uint32_t max_send_buffer_age_ms; /* Send held writes once the oldest has waited this long, 0 for no limit */
+    uint32_t accept_overflow_policy; /* yamux_accept_overflow_t: reaction to SYNs beyond accept_backlog */
+    uint32_t max_session_memory; /* Most bytes the session and its streams may hold, 0 for no limit */
+    uint32_t max_inflight_per_stream; /* Most bytes sent and not yet granted back per stream, 0 for no limit */
+    uint32_t max_trace_events_per_sec; /* Frame trace callbacks per second of the yamux_session_keepalive clock, extras dropped, 0 for no limit; unlimited until that clock is set */
+    uint32_t on_unknown_fin; /* yamux_unknown_fin_t: reaction to FIN for a stream we have no record of */
+    uint32_t max_num_streams; /* Most streams open at once, ours and the peer's, 0 for YAMUX_MAX_STREAMS */
+    uint32_t keepalive_timeout_ms; /* Fail the session when a keepalive ping waits this long, 0 for one keepalive_interval */
 } yamux_config_t;
 
+/**
+ * Reaction to a peer sending more data than the window we advertised
+ */
+typedef enum {
+    YAMUX_WINDOW_VIOLATION_CLOSE_SESSION = 0, /* GoAway with PROTOCOL_ERROR, as the spec requires */
+    YAMUX_WINDOW_VIOLATION_RESET_STREAM  = 1  /* Drop the frame and reset only the offending stream */
+} yamux_window_violation_t;
+
+/**
+ * Reaction to a SYN arriving while accept_backlog streams await accept
+ */
+typedef enum {
+    YAMUX_ACCEPT_OVERFLOW_RESET     = 0, /* Refuse the stream with RST */
+    YAMUX_ACCEPT_OVERFLOW_DEFER_ACK = 1, /* Queue the stream but withhold its SYN-ACK until the backlog has room */
+    YAMUX_ACCEPT_OVERFLOW_CLOSE_SESSION = 2 /* GoAway with PROTOCOL_ERROR; the peer ignored the backlog */
+} yamux_accept_overflow_t;
+
+/**
+ * Reaction to a FIN for a stream the session does not know, usually one
+ * already closed and reaped before the peer's FIN arrived
+ */
+typedef enum {
+    YAMUX_UNKNOWN_FIN_IGNORE        = 0, /* Drop the frame and carry on */
+    YAMUX_UNKNOWN_FIN_CLOSE_SESSION = 1  /* GoAway with PROTOCOL_ERROR, for strict peers */
+} yamux_unknown_fin_t;
+
+/**
+ * Bounds applied by yamux_recommended_window
+ */
+#define YAMUX_MIN_RECOMMENDED_WINDOW (16 * 1024)         /* One full DATA frame */
+#define YAMUX_MAX_RECOMMENDED_WINDOW (16 * 1024 * 1024)  /* 16 MB */
+
 /**
  * Session structure (opaque)
  */
@@ -105,7 +155,14 @@ typedef enum {
  * @note PORTING REQUIRED: These are platform-dependent I/O callbacks that must be implemented
  * for your specific system (e.g., socket, UART, etc.).
  * - read: Should return number of bytes read, 0 for EOF, or -1 for error
- * - write: Should return number of bytes written or -1 for error
+ * - write: Should return number of bytes written or -1 for error; a count
+ *   larger than len is treated as a transport failure
+ * - Nonblocking transports may return YAMUX_ERR_WOULD_BLOCK from either when
+ *   nothing can be transferred now
+ * - Either may return YAMUX_ERR_CONN_RESET instead of -1 when the connection
+ *   was reset (e.g. ECONNRESET), so the application can tell an abnormal end
+ *   from a clean one
+ * - ctx: Passed to both; see yamux_session_set_io_contexts to split it
  */
 typedef struct {
     int (*read)(void *ctx, uint8_t *buf, size_t len);
@@ -126,9 +183,52 @@ typedef enum {
     YAMUX_ERR_PROTOCOL        = -6,
     YAMUX_ERR_INTERNAL        = -7,
     YAMUX_ERR_INVALID_STREAM  = -8,
-    YAMUX_ERR_WOULD_BLOCK     = -9
+    YAMUX_ERR_WOULD_BLOCK     = -9,
+    YAMUX_ERR_REMOTE_GOAWAY   = -10, /* Peer sent GoAway; it accepts no new streams */
+    YAMUX_ERR_INTERRUPTED     = -11, /* Cancelled by yamux_stream_interrupt */
+    YAMUX_ERR_NO_WINDOW       = -12, /* Peer has granted no send credit */
+    YAMUX_ERR_RESET           = -13, /* Stream was reset, see yamux_stream_get_reset_reason */
+    YAMUX_ERR_CONN_RESET      = -14, /* Transport was reset rather than closed cleanly */
+    YAMUX_ERR_STREAMS_EXHAUSTED = -15, /* Stream limit reached; close a stream to open another */
+    YAMUX_ERR_ACK_BACKLOG_EXCEEDED = -16, /* Peer opened streams beyond accept_backlog */
+    YAMUX_ERR_SESSION_SHUTDOWN = -17 /* We sent GoAway; no new streams from this side */
 } yamux_result_t;
 
+/**
+ * Why a stream was reset
+ *
+ * Yamux RST frames carry no error code, so the reason records what the
+ * stream was doing when it was reset and which side reset it.
+ */
+typedef enum {
+    YAMUX_RESET_NONE,        /* Stream has not been reset */
+    YAMUX_RESET_REFUSED,     /* Peer sent RST in reply to our SYN, e.g. at its stream limit */
+    YAMUX_RESET_PEER,        /* Peer reset the stream after it was set up */
+    YAMUX_RESET_INTERNAL,    /* We reset the stream after an internal error such as running out of memory */
+    YAMUX_RESET_TIMEOUT,     /* We reset the stream after the peer withheld window updates too long */
+    YAMUX_RESET_FLOW_CONTROL /* We reset the stream after the peer sent more than its window allowed */
+} yamux_reset_reason_t;
+
+/**
+ * Per-stream send statistics
+ */
+typedef struct {
+    size_t largest_write;    /* Most bytes one write accepted without blocking */
+    uint32_t window_splits;  /* Writes cut short because the send window ran out */
+} yamux_stream_stats_t;
+
+/**
+ * Session health summary, see yamux_session_health
+ */
+typedef struct {
+    int is_closed;                 /* Closed locally, or the transport failed */
+    int has_remote_goaway;         /* Peer sent GoAway */
+    uint32_t pending_pings;        /* Pings sent and not yet answered */
+    uint32_t last_activity_ms_ago; /* Time since a frame last arrived, on the keepalive clock */
+    size_t num_streams;            /* Streams the session tracks, including unaccepted ones */
+    size_t buffered_bytes;         /* Received bytes not yet read plus writes held for sending */
+} yamux_health_t;
+
 /**
  * Default configuration
  */
@@ -155,10 +255,38 @@ void* yamux_init(
 /**
  * Destroy a yamux session created with yamux_init
  * 
+ * Open streams are reset and freed, so the peer may discard data it has
+ * not read yet; use yamux_destroy_flush to avoid that. Stream handles the
+ * application still holds are detached: other calls on them fail, and
+ * yamux_close_stream releases them. No callback fires once teardown has
+ * started. When called from inside a callback, teardown is deferred until
+ * the enclosing yamux_process returns, and that call reports
+ * YAMUX_ERR_CLOSED.
+ * 
  * @param session Session handle returned by yamux_init
  */
 void yamux_destroy(void *session);
 
+/**
+ * Destroy a yamux session created with yamux_init without losing sent data
+ * 
+ * yamux_destroy resets open streams, and a peer that receives an RST may
+ * discard data it has not read yet. This variant first sends any writes
+ * held for coalescing, then a FIN on every open stream, so the peer can read
+ * everything up to the end of each stream. It then destroys the session as
+ * yamux_destroy does.
+ * 
+ * If the transport is full, held data is retried while the wait callback
+ * set with yamux_set_wait reports room to write, for up to timeout_ms in
+ * total. Without a wait callback one attempt is made.
+ * 
+ * @param session Session handle returned by yamux_init
+ * @param timeout_ms How long to wait for a full transport to drain
+ * @return Number of held bytes that could not be sent (0 if nothing was
+ *         lost), or YAMUX_ERR_INVALID if session is NULL
+ */
+int yamux_destroy_flush(void *session, uint32_t timeout_ms);
+
 /**
  * Process incoming data for a session
  * 
@@ -167,6 +295,19 @@ void yamux_destroy(void *session);
  */
 int yamux_process(void *session);
 
+/**
+ * Compute a receive window sized to the link's bandwidth-delay product
+ * 
+ * window = bandwidth_kbps * 1000 / 8 * rtt_ms / 1000 = bandwidth_kbps * rtt_ms / 8 bytes,
+ * clamped to [YAMUX_MIN_RECOMMENDED_WINDOW, YAMUX_MAX_RECOMMENDED_WINDOW].
+ * Suitable for yamux_config_t.max_stream_window_size.
+ * 
+ * @param bandwidth_kbps Link bandwidth in kilobits per second
+ * @param rtt_ms Round-trip time in milliseconds
+ * @return Recommended window size in bytes
+ */
+uint32_t yamux_recommended_window(uint32_t bandwidth_kbps, uint32_t rtt_ms);
+
 /**
  * Create a new yamux session (low-level API)
  * 
@@ -185,6 +326,35 @@ yamux_result_t yamux_session_create(
     yamux_session_t **session
 );
 
+/**
+ * Replace a session's configuration while it runs
+ *
+ * Either the whole configuration is applied or, on error, none of it.
+ * Every field can be changed except frame_buffer_pool_size, which sizes
+ * memory allocated at creation; a different value is rejected. The role
+ * is not part of the configuration and never changes.
+ *
+ * Changes take effect from the next frame or call that consults them:
+ * - keepalive_interval counts from the last ping; turning keepalive on
+ *   restarts its clock at the next yamux_session_keepalive call
+ * - max_stream_window_size and accept_initial_window_bonus apply to
+ *   streams opened afterwards; existing windows are kept
+ * - max_stream_open_rate keeps the tokens already earned, up to the new
+ *   burst size
+ * - lowering a limit (accept_backlog, max_session_memory,
+ *   max_send_buffer_per_stream, max_inflight_per_stream) refuses further
+ *   growth but does not shed what is already held
+ *
+ * @param session Session
+ * @param config New configuration
+ * @return YAMUX_OK on success, YAMUX_ERR_INVALID for a NULL argument or a
+ *         change to an immutable field
+ */
+yamux_result_t yamux_session_set_config(
+    yamux_session_t *session,
+    const yamux_config_t *config
+);
+
 /**
  * Close a yamux session
  * 
@@ -197,13 +367,39 @@ yamux_result_t yamux_session_close(
     yamux_error_t err
 );
 
+/**
+ * Start a graceful shutdown
+ * 
+ * Sends GoAway with the given code but keeps the session running: streams
+ * already open carry on, PINGs are answered and keepalive continues, while
+ * new streams are refused on both sides (the peer's SYNs get an RST, local
+ * opens fail with YAMUX_ERR_SESSION_SHUTDOWN). Keep calling
+ * yamux_session_process until the streams have finished, then call
+ * yamux_session_close, which sends no second GoAway. Only the first call
+ * sends a frame; later calls leave the announced code as it was.
+ * 
+ * @param session Session to drain
+ * @param code GoAway code: YAMUX_NORMAL, YAMUX_PROTOCOL_ERROR or
+ *        YAMUX_INTERNAL_ERROR
+ * @return YAMUX_OK on success, YAMUX_ERR_CLOSED if the session is already
+ *         closed, error code otherwise
+ */
+yamux_result_t yamux_session_go_away(
+    yamux_session_t *session,
+    yamux_error_t code
+);
+
 /**
  * Open a new stream
  * 
  * @param session Session
  * @param stream_id Stream ID (0 for auto-assign)
  * @param stream Output parameter for the created stream
- * @return YAMUX_OK on success, error code otherwise
+ * @return YAMUX_OK on success, YAMUX_ERR_REMOTE_GOAWAY if the peer has sent
+ *         GoAway (no SYN is sent; reconnect to open more streams),
+ *         YAMUX_ERR_SESSION_SHUTDOWN if yamux_session_go_away was called,
+ *         YAMUX_ERR_STREAMS_EXHAUSTED if max_num_streams streams are open,
+ *         error code otherwise
  */
 yamux_result_t yamux_stream_open_detailed(
     yamux_session_t *session, 
@@ -211,6 +407,25 @@ yamux_result_t yamux_stream_open_detailed(
     yamux_stream_t **stream
 );
 
+/**
+ * Open several streams with a single write
+ * 
+ * Allocates n streams and sends all of their SYN frames in one io.write
+ * call. If max_num_streams streams are open or stream IDs run out
+ * part-way, the streams opened so far are still announced and returned.
+ * 
+ * @param session Session
+ * @param n Number of streams to open
+ * @param out Array of at least n entries receiving the opened streams
+ * @return Number of streams opened (less than n if a limit was hit), or a
+ *         negative yamux_result_t if none could be opened
+ */
+int yamux_open_streams(
+    yamux_session_t *session, 
+    size_t n, 
+    yamux_stream_t **out
+);
+
 /**
  * Accept a new stream (server only)
  * 
@@ -223,9 +438,87 @@ yamux_result_t yamux_stream_accept(
     yamux_stream_t **stream
 );
 
+/**
+ * Accept a new stream, waiting up to a timeout for one to arrive
+ * 
+ * While the accept queue is empty, waits for input with the callback set by
+ * yamux_set_wait_callback and processes each frame that arrives, returning
+ * as soon as a stream can be accepted. Without a wait callback this does not
+ * block and behaves like yamux_stream_accept.
+ * 
+ * @param session Session
+ * @param timeout_ms Maximum time to wait in milliseconds
+ * @param stream Output parameter for the accepted stream
+ * @return YAMUX_OK on success, YAMUX_ERR_TIMEOUT if no stream arrived in
+ *         time, error code otherwise
+ */
+yamux_result_t yamux_accept_stream_timeout(
+    yamux_session_t *session, 
+    uint32_t timeout_ms, 
+    yamux_stream_t **stream
+);
+
+/**
+ * Callback assigning an accept priority to an inbound stream
+ *
+ * Runs once per stream, the first time yamux_accept_stream_priority finds
+ * it waiting, so data the peer sent with its SYN may already be buffered.
+ * The callback may inspect the stream but must not close it.
+ *
+ * @param ctx User context passed to yamux_set_accept_classify_callback
+ * @param stream Stream waiting to be accepted
+ * @return Priority of the stream; higher is accepted first
+ */
+typedef int (*yamux_accept_classify_callback_t)(void *ctx, yamux_stream_t *stream);
+
+/**
+ * Set the callback that assigns accept priorities
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to give every stream priority 0
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_accept_classify_callback(
+    yamux_session_t *session,
+    yamux_accept_classify_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Accept the highest-priority waiting stream at or above a level
+ * 
+ * Streams waiting to be accepted are classified with the callback set by
+ * yamux_set_accept_classify_callback. This accepts the one with the highest
+ * priority, the earliest to arrive among equals, provided that priority is
+ * at least min_priority. Lower-priority streams keep waiting, so a server
+ * can service control streams ahead of bulk ones under load.
+ * yamux_stream_accept still takes streams strictly in arrival order.
+ * 
+ * @param session Session
+ * @param min_priority Lowest priority to accept
+ * @param stream Output parameter for the accepted stream
+ * @return YAMUX_OK on success, YAMUX_ERR_TIMEOUT if no waiting stream has
+ *         at least min_priority, error code otherwise
+ */
+yamux_result_t yamux_accept_stream_priority(
+    yamux_session_t *session,
+    int min_priority,
+    yamux_stream_t **stream
+);
+
 /**
  * Close a stream
  * 
+ * If both sides close at once, each side's FIN completes the other's close
+ * and the stream ends CLOSED on both without an RST.
+ * 
+ * A reset, or a normal close after the peer's FIN, frees the stream. A
+ * normal close before the peer's FIN leaves it FIN_SENT so the rest of the
+ * peer's data can still be read. Close it again once done with it: the
+ * stream is freed then if it is CLOSED, or when the peer's FIN arrives.
+ * Closing a stream the peer or the session has reset also frees it.
+ * 
  * @param stream Stream to close
  * @param reset True to reset the stream, false for normal close
  * @return YAMUX_OK on success, error code otherwise
@@ -238,11 +531,15 @@ yamux_result_t yamux_stream_close(
 /**
  * Read data from a stream
  * 
+ * Data the peer sent before its FIN can still be read once the stream is
+ * closed; YAMUX_ERR_CLOSED is returned only after it has been consumed.
+ * 
  * @param stream Stream to read from
  * @param buf Buffer to store data
  * @param len Maximum number of bytes to read
  * @param bytes_read Number of bytes actually read
- * @return YAMUX_OK on success, error code otherwise
+ * @return YAMUX_OK on success, YAMUX_ERR_TIMEOUT if a read timeout passed
+ *         with no data, error code otherwise
  */
 yamux_result_t yamux_stream_read(
     yamux_stream_t *stream, 
@@ -251,6 +548,119 @@ yamux_result_t yamux_stream_read(
     size_t *bytes_read
 );
 
+/**
+ * Set how long each read on a stream waits for data
+ *
+ * The timeout is relative and starts afresh with every yamux_stream_read
+ * call. While the stream has nothing to read, the read waits with the
+ * callback set by yamux_set_wait_callback and processes each frame that
+ * arrives. It returns YAMUX_ERR_TIMEOUT if no data arrived in time, or at
+ * once if no wait callback is set. EOF still returns 0 bytes without
+ * waiting. By default reads do not wait and return 0 bytes when empty.
+ *
+ * @param stream Stream to configure
+ * @param ms Timeout per read in milliseconds, 0 to not wait
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_set_read_timeout(
+    yamux_stream_t *stream,
+    uint32_t ms
+);
+
+/**
+ * Read one length-prefixed message from a stream
+ *
+ * Reads a prefix_bytes-wide unsigned length, then exactly that many bytes
+ * of message body into buf. Frames are processed as needed while waiting,
+ * within the stream's read timeout (see yamux_stream_set_read_timeout),
+ * which covers the whole message rather than each wait.
+ *
+ * The prefix is checked before anything is consumed: a message longer than
+ * cap is left unread and *msg_len reports its length, so the caller can
+ * retry with a larger buffer. A failure once the body is being read, such
+ * as a timeout, leaves the message partly consumed and the stream out of
+ * step with its framing; the caller should then reset the stream.
+ *
+ * @param stream Stream to read from
+ * @param buf Buffer to store the message body
+ * @param cap Size of buf in bytes
+ * @param msg_len Length of the message, set as soon as the prefix is read
+ * @param prefix_bytes Size of the length prefix, 1 to 4 bytes
+ * @param big_endian Nonzero if the prefix is big-endian (network order)
+ * @return YAMUX_OK on success, YAMUX_ERR_NOMEM if the message is longer
+ *         than cap, YAMUX_ERR_CLOSED if the peer finished sending between
+ *         messages, YAMUX_ERR_PROTOCOL if it finished inside one,
+ *         YAMUX_ERR_TIMEOUT if the message did not arrive in time, error
+ *         code otherwise
+ */
+yamux_result_t yamux_stream_read_message(
+    yamux_stream_t *stream,
+    uint8_t *buf,
+    size_t cap,
+    size_t *msg_len,
+    int prefix_bytes,
+    int big_endian
+);
+
+/**
+ * Read one TLV (type-length-value) record from a stream
+ *
+ * A record is a 1-byte type, a 4-byte big-endian value length, and the
+ * value, as written by yamux_stream_write_tlv. Partial frames, the read
+ * timeout and a value longer than cap are handled as by
+ * yamux_stream_read_message: a value that does not fit is left unread with
+ * its length in *val_len.
+ *
+ * @param stream Stream to read from
+ * @param type Output parameter for the record type
+ * @param buf Buffer to store the value
+ * @param cap Size of buf in bytes
+ * @param val_len Length of the value, set as soon as the header is read
+ * @return YAMUX_OK on success, YAMUX_ERR_NOMEM if the value is longer than
+ *         cap, YAMUX_ERR_CLOSED if the peer finished sending between
+ *         records, YAMUX_ERR_PROTOCOL if it finished inside one,
+ *         YAMUX_ERR_TIMEOUT if the record did not arrive in time, error
+ *         code otherwise
+ */
+yamux_result_t yamux_stream_read_tlv(
+    yamux_stream_t *stream,
+    uint8_t *type,
+    uint8_t *buf,
+    size_t cap,
+    size_t *val_len
+);
+
+/**
+ * Write one TLV (type-length-value) record to a stream
+ *
+ * Writes the 1-byte type, the value length as 4 bytes big-endian, then the
+ * value. A record longer than the send window is written in pieces, and
+ * frames are processed with the session's wait callback while waiting for
+ * window updates, within timeout_ms, which covers the whole record. The
+ * stream's read timeout plays no part.
+ *
+ * With a timeout of 0 nothing waits: a record that does not fit the send
+ * window now is refused before any of it is written. A failure once the
+ * record is partly written, such as a timeout, leaves the stream out of
+ * step with its framing; the caller should then reset the stream.
+ *
+ * @param stream Stream to write to
+ * @param type Record type
+ * @param val Value bytes, may be NULL if len is 0
+ * @param len Length of the value
+ * @param timeout_ms Longest time to wait for window, 0 to not wait
+ * @return YAMUX_OK on success, YAMUX_ERR_NO_WINDOW or YAMUX_ERR_WOULD_BLOCK
+ *         if the record was refused whole, YAMUX_ERR_TIMEOUT if room did not
+ *         come in time, error code otherwise
+ */
+yamux_result_t yamux_stream_write_tlv(
+    yamux_stream_t *stream,
+    uint8_t type,
+    const uint8_t *val,
+    size_t len,
+    uint32_t timeout_ms
+);
+
 /**
  * Write data to a stream
  * 
@@ -258,7 +668,13 @@ yamux_result_t yamux_stream_read(
  * @param buf Buffer containing data to write
  * @param len Number of bytes to write
  * @param bytes_written Number of bytes actually written
- * @return YAMUX_OK on success, error code otherwise
+ * @return YAMUX_OK on success (possibly a short write; a zero-length write
+ *         sends nothing and returns YAMUX_OK with 0 bytes written),
+ *         YAMUX_ERR_NO_WINDOW if the peer has granted no send credit (wait
+ *         for a window update), YAMUX_ERR_WOULD_BLOCK if the transport
+ *         accepted nothing (wait for it to drain), YAMUX_ERR_RESET at once
+ *         if the stream was reset, with nothing sent or held (see
+ *         yamux_stream_get_reset_reason), error code otherwise
  */
 yamux_result_t yamux_stream_write(
     yamux_stream_t *stream, 
@@ -267,11 +683,60 @@ yamux_result_t yamux_stream_write(
     size_t *bytes_written
 );
 
+/**
+ * Check whether a write would be accepted whole, without writing
+ * 
+ * Has no side effects: nothing is sent, held or flushed, and a pending
+ * interrupt is left in place. Makes the same checks as yamux_stream_write,
+ * but the transport is not asked, so a write reported ready can still
+ * return YAMUX_ERR_WOULD_BLOCK if the transport itself is full.
+ * 
+ * @param stream Stream to check
+ * @param len Number of bytes the caller wants to write
+ * @return YAMUX_OK if len bytes would be accepted, YAMUX_ERR_NO_WINDOW if
+ *         the send window is smaller than len (wait for a window update),
+ *         YAMUX_ERR_WOULD_BLOCK if the data held for the stream is at
+ *         max_send_buffer_per_stream and the transport refused it when it
+ *         was last sent, YAMUX_ERR_INTERRUPTED if an interrupt is pending,
+ *         YAMUX_ERR_TIMEOUT if keepalive found the peer dead,
+ *         YAMUX_ERR_RESET or YAMUX_ERR_CLOSED if the stream can no longer
+ *         be written, error code otherwise
+ */
+yamux_result_t yamux_stream_write_ready(
+    yamux_stream_t *stream,
+    size_t len
+);
+
+/**
+ * Send writes held for coalescing on a stream
+ *
+ * With small_frame_threshold set in the config, writes shorter than the
+ * threshold are held and sent as one DATA frame once they add up to the
+ * threshold. They are also sent before a larger write, before a FIN, and at
+ * the start of each yamux_session_process call. Call this to send them
+ * sooner, or set auto_flush in the config to send them after every write and
+ * at the end of every yamux_session_process call as well. The send window is
+ * taken when a write is held.
+ *
+ * @param stream Stream to flush
+ * @return YAMUX_OK on success (including when nothing is held),
+ *         YAMUX_ERR_WOULD_BLOCK if the transport is full, YAMUX_ERR_RESET
+ *         (or YAMUX_ERR_TIMEOUT) if the stream was reset, error code otherwise
+ */
+yamux_result_t yamux_stream_flush(
+    yamux_stream_t *stream
+);
+
 /**
  * Process incoming data
  * 
+ * Handles at most one frame and never retries, so it returns promptly even
+ * when the transport is blocked both ways: held writes the transport
+ * refuses stay held for the next call.
+ * 
  * @param session Session
- * @return YAMUX_OK on success, error code otherwise
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if the read callback
+ *         had nothing to read, error code otherwise
  */
 yamux_result_t yamux_session_process(
     yamux_session_t *session
@@ -307,6 +772,102 @@ uint32_t yamux_stream_get_send_window(
     yamux_stream_t *stream
 );
 
+/**
+ * Get the bytes sent on a stream that the peer has not yet granted back
+ *
+ * Counts data written, including writes held for coalescing, less the
+ * credit returned by the peer's window updates since. Unlike the send
+ * window, this grows while a slow reader leaves data unconsumed, whatever
+ * window it started with. max_inflight_per_stream caps it.
+ *
+ * @param stream Stream to query
+ * @return Bytes in flight, or 0 for a NULL stream
+ */
+uint32_t yamux_stream_inflight_bytes(
+    yamux_stream_t *stream
+);
+
+/**
+ * Get the number of received bytes waiting to be read from a stream
+ *
+ * @param stream Stream to query
+ * @return Bytes buffered for the next read, or 0 if stream is NULL
+ */
+size_t yamux_stream_get_buffered(
+    yamux_stream_t *stream
+);
+
+/**
+ * Name a stream for logs and stats
+ *
+ * The label is local metadata and is never sent to the peer. It is copied
+ * into the stream and truncated to YAMUX_STREAM_LABEL_SIZE - 1 characters.
+ *
+ * @param stream Stream to label
+ * @param label Label to copy, or NULL to clear it
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_set_label(
+    yamux_stream_t *stream,
+    const char *label
+);
+
+/**
+ * Get the label set with yamux_stream_set_label
+ *
+ * @param stream Stream to query
+ * @return The stream's label, or an empty string if it has none
+ */
+const char *yamux_stream_get_label(
+    yamux_stream_t *stream
+);
+
+/**
+ * Get the initial receive window the peer advertised for a stream
+ *
+ * The value comes from the peer's SYN (streams it opened) or SYN-ACK
+ * (streams we opened) and does not change as data flows; use
+ * yamux_stream_get_send_window for the current credit.
+ *
+ * @param stream Stream to query
+ * @param window Output parameter for the advertised window
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if the peer has not
+ *         acknowledged the stream yet, error code otherwise
+ */
+yamux_result_t yamux_stream_peer_window(
+    yamux_stream_t *stream,
+    uint32_t *window
+);
+
+/**
+ * Get the reason a stream was reset
+ *
+ * Reads and writes on a reset stream fail with YAMUX_ERR_RESET, or with
+ * YAMUX_ERR_TIMEOUT for YAMUX_RESET_TIMEOUT. Closing it releases it.
+ *
+ * @param stream Stream to query
+ * @return Reset reason, or YAMUX_RESET_NONE if the stream was not reset
+ */
+yamux_reset_reason_t yamux_stream_get_reset_reason(
+    yamux_stream_t *stream
+);
+
+/**
+ * Get a stream's send statistics
+ *
+ * A write that the send window cuts short counts as a window split; its
+ * accepted part still counts towards the largest write. Writes refused
+ * with YAMUX_ERR_NO_WINDOW or stopped by a full transport are not counted.
+ *
+ * @param stream Stream to query
+ * @param stats Output parameter for the statistics
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_get_stats(
+    yamux_stream_t *stream,
+    yamux_stream_stats_t *stats
+);
+
 /**
  * Update the send window for a stream
  *
@@ -319,6 +880,76 @@ yamux_result_t yamux_stream_update_window(
     uint32_t increment
 );
 
+/**
+ * Interrupt a pending read and write on a stream
+ *
+ * A read or write blocked in the wait callback, as with a read timeout or
+ * yamux_stream_write_tlv, returns YAMUX_ERR_INTERRUPTED. The wake callback
+ * is called so the wait ends promptly; without one, the blocked call
+ * notices once its wait returns. If nothing is blocked, the next
+ * yamux_stream_read and the next yamux_stream_write on the stream each
+ * return YAMUX_ERR_INTERRUPTED once, so a worker retrying on
+ * YAMUX_ERR_NO_WINDOW, YAMUX_ERR_WOULD_BLOCK or empty reads can be cancelled
+ * too. Neither closes the stream or session. Safe to call from another
+ * thread.
+ *
+ * @param stream Stream to interrupt
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_interrupt(
+    yamux_stream_t *stream
+);
+
+/**
+ * Stop granting the peer receive window on a stream
+ *
+ * Reads keep working, but no WINDOW_UPDATE is sent for the data they free,
+ * so the peer's send window runs down and it stops sending. At most one
+ * window of data is buffered meanwhile.
+ *
+ * @param stream Stream to pause
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_pause_recv(
+    yamux_stream_t *stream
+);
+
+/**
+ * Resume granting the peer receive window on a stream
+ *
+ * Window freed by reads while paused is granted at once, so a peer that
+ * was held back can send again. With a data callback set, data buffered
+ * while paused is delivered to it first.
+ *
+ * @param stream Stream to resume
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_resume_recv(
+    yamux_stream_t *stream
+);
+
+/**
+ * Discard inbound data until the peer finishes sending
+ *
+ * For a stream the application is done reading from but wants to close
+ * with a FIN rather than an RST. Buffered and newly arriving data is
+ * thrown away and its window granted back, so the peer can send the rest
+ * and its FIN. While the peer is still sending, waits for input with the
+ * callback set by yamux_set_wait_callback and processes each frame that
+ * arrives. A paused stream is resumed. Once this returns YAMUX_OK, close
+ * the stream normally.
+ *
+ * @param stream Stream to drain
+ * @param timeout_ms Maximum time to wait in milliseconds
+ * @return YAMUX_OK once the peer has sent FIN, YAMUX_ERR_TIMEOUT if it has
+ *         not in time (or there is no wait callback), YAMUX_ERR_RESET if the
+ *         stream was reset, error code otherwise
+ */
+yamux_result_t yamux_stream_drain_recv(
+    yamux_stream_t *stream,
+    uint32_t timeout_ms
+);
+
 /**
  * Ping the remote endpoint
  * 
@@ -329,6 +960,662 @@ yamux_result_t yamux_session_ping(
     yamux_session_t *session
 );
 
+/**
+ * Drive keepalive from the application's clock
+ * 
+ * Call periodically with a millisecond timestamp (any epoch; wraparound is
+ * handled). The first call starts the clock, and a ping is sent once
+ * keepalive_interval has passed with no frame from the peer and no other
+ * keepalive ping. If that ping is still unanswered after
+ * keepalive_timeout_ms (by default one keepalive_interval), the peer is
+ * treated as dead: every locally opened stream still waiting for its
+ * SYN-ACK fails with YAMUX_ERR_CLOSED, reads and writes on the other streams
+ * return YAMUX_ERR_TIMEOUT once their buffered data is read, new opens are
+ * refused, and the application should close the session.
+ * 
+ * This is also the clock for the window watchdog: with
+ * window_stall_timeout_ms set, a stream whose writes have waited that long
+ * for the peer to grant window is reset, and its reads and writes then fail
+ * with YAMUX_ERR_TIMEOUT. The watchdog runs even if keepalive is disabled.
+ * 
+ * With max_send_buffer_age_ms set, it also sends small writes that have
+ * been held for coalescing that long, so they do not wait for the next
+ * yamux_session_process call.
+ * 
+ * @param session Session
+ * @param now_ms Current time in milliseconds
+ * @return YAMUX_OK, YAMUX_ERR_TIMEOUT once the peer is considered dead,
+ *         or another error code if the ping could not be sent
+ */
+yamux_result_t yamux_session_keepalive(
+    yamux_session_t *session,
+    uint32_t now_ms
+);
+
+/**
+ * Get the number of inbound streams waiting to be accepted
+ *
+ * @param session Session
+ * @return Number of streams in the accept queue, or 0 if session is NULL
+ */
+int yamux_session_pending_accepts(
+    yamux_session_t *session
+);
+
+/**
+ * Get the role a session was created with
+ *
+ * @param session Session
+ * @return 1 for a client session, 0 for a server session or if session is NULL
+ */
+int yamux_session_is_client(
+    yamux_session_t *session
+);
+
+/**
+ * Get the round-trip time of the last answered ping
+ *
+ * Pings are timed with the clock reported through yamux_session_keepalive
+ * (see yamux_session_now_ms), so the result is only as fine-grained as the
+ * application's calls to it. If several pings are outstanding, the oldest
+ * is timed.
+ *
+ * @param session Session
+ * @param rtt_ms Output parameter for the round-trip time in milliseconds
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if no ping has been
+ *         answered yet, error code otherwise
+ */
+yamux_result_t yamux_session_rtt(
+    yamux_session_t *session,
+    uint32_t *rtt_ms
+);
+
+/**
+ * Ping the remote endpoint and wait for the answer
+ *
+ * The ping carries a 4-byte tag, and only an ACK echoing that tag ends the
+ * wait, so a late or duplicate answer to another ping cannot be mistaken
+ * for it. Frames are processed with the session's wait callback while
+ * waiting, and the round-trip time is the sum of the times the callback
+ * reports having waited. Inbound pings are answered as usual meanwhile.
+ *
+ * With timeout_ms 0 or no wait callback, the ping is only sent and
+ * YAMUX_ERR_WOULD_BLOCK returned. Its answer is then timed on the keepalive
+ * clock when yamux_session_process reads it, and yamux_session_rtt returns
+ * the result. A ping that times out is forgotten, and its ACK is ignored if
+ * it turns up later.
+ *
+ * @param session Session
+ * @param timeout_ms Maximum time to wait in milliseconds
+ * @param rtt_ms Output parameter for the round-trip time in milliseconds
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if the ping was sent
+ *         without waiting, YAMUX_ERR_TIMEOUT if no answer came in time,
+ *         error code otherwise
+ */
+yamux_result_t yamux_session_ping_rtt(
+    yamux_session_t *session,
+    uint32_t timeout_ms,
+    uint32_t *rtt_ms
+);
+
+/**
+ * Get the current time as the library sees it
+ *
+ * The library has no clock of its own. Its notion of time is the now_ms
+ * most recently passed to yamux_session_keepalive, which is what keepalive
+ * decisions are based on.
+ *
+ * @param session Session
+ * @return Latest time reported by the application in milliseconds, or 0
+ *         if none has been reported or session is NULL
+ */
+uint64_t yamux_session_now_ms(
+    yamux_session_t *session
+);
+
+/**
+ * Get the error code from the GoAway the peer sent
+ *
+ * The code is returned as received. Codes other than yamux_error_t values,
+ * e.g. from a newer peer, are kept as they are and still close the session
+ * gracefully.
+ *
+ * @param session Session
+ * @param code Output parameter for the peer's GoAway code
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if the peer has not
+ *         sent GoAway, error code otherwise
+ */
+yamux_result_t yamux_session_remote_go_away(
+    yamux_session_t *session,
+    uint32_t *code
+);
+
+/**
+ * Get the error that closed the session
+ *
+ * Once the session has closed itself, yamux_session_process only returns
+ * YAMUX_ERR_CLOSED; this keeps the original cause. It is the most specific
+ * cause known, e.g. YAMUX_ERR_ACK_BACKLOG_EXCEEDED rather than
+ * YAMUX_ERR_PROTOCOL when the peer opened streams beyond accept_backlog.
+ * A close with GoAway code PROTOCOL_ERROR or INTERNAL_ERROR, ours or the
+ * application's, is reported as YAMUX_ERR_PROTOCOL or YAMUX_ERR_INTERNAL.
+ *
+ * @param session Session
+ * @return The error, YAMUX_OK if the session is open or closed normally,
+ *         YAMUX_ERR_INVALID if session is NULL
+ */
+yamux_result_t yamux_session_last_error(
+    yamux_session_t *session
+);
+
+/**
+ * Get the highest locally opened stream ID the peer has ACKed
+ *
+ * GoAway carries no last-stream-id, so this is how an application learns
+ * which of its streams the peer received before it went away. The peer
+ * handles SYNs in order, so a stream above this ID that is still waiting
+ * for its SYN-ACK was never accepted and can be retried on a new session.
+ *
+ * @param session Session
+ * @param id Output parameter for the stream ID
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if the peer has not
+ *         ACKed any stream, error code otherwise
+ */
+yamux_result_t yamux_session_last_acked_stream(
+    yamux_session_t *session,
+    uint32_t *id
+);
+
+/**
+ * Get a summary of session health in one call
+ *
+ * Meant for monitoring, in place of combining several accessors. Activity
+ * is timed with the clock reported through yamux_session_keepalive, from
+ * the first report if no frame has arrived since, so last_activity_ms_ago
+ * stays 0 until the application reports the time.
+ *
+ * @param session Session
+ * @param out Output parameter for the summary
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_session_health(
+    yamux_session_t *session,
+    yamux_health_t *out
+);
+
+/**
+ * Get the memory a session currently holds
+ *
+ * Counts the session and stream structures, the stream table, the receive
+ * scratch buffer, the frame buffer pool and every stream's receive and
+ * held-write buffers. This is the figure max_session_memory bounds.
+ *
+ * @param session Session
+ * @return Bytes held, or 0 for a NULL session
+ */
+size_t yamux_session_memory_used(
+    yamux_session_t *session
+);
+
+/**
+ * Re-advertise the full receive window on every stream
+ *
+ * A last-resort recovery tool, not for normal operation. If window
+ * accounting has gone wrong and credit was lost, transfers toward us can
+ * stall for good. This grants each stream's peer whatever it takes to
+ * restore the full window, less the data still unread, as the peer would
+ * get it after a complete read. Paused streams and streams the peer has
+ * finished sending on are skipped. Yamux windows only grow, so our own
+ * send windows are left as they are; the peer can make the same call.
+ *
+ * @param session Session
+ * @return YAMUX_OK on success, YAMUX_ERR_CLOSED for a closed session,
+ *         YAMUX_ERR_IO if an update could not be written
+ */
+yamux_result_t yamux_session_reset_windows(
+    yamux_session_t *session
+);
+
+/**
+ * Callback invoked for each stream by yamux_session_foreach_stream
+ *
+ * @param ctx User context passed to yamux_session_foreach_stream
+ * @param stream Stream being visited
+ * @return 0 to continue, non-zero to stop iterating
+ */
+typedef int (*yamux_stream_visit_callback_t)(void *ctx, yamux_stream_t *stream);
+
+/**
+ * Invoke a callback for each stream in a session
+ *
+ * Visits every stream the session still tracks, including reset streams the
+ * application has not closed yet, in no particular order. The callback may
+ * close the stream it is given; streams opened during the iteration may or
+ * may not be visited. Closing the session from the callback is deferred
+ * until the iteration ends.
+ *
+ * @param session Session
+ * @param cb Callback function
+ * @param ctx User context passed to the callback
+ * @return 0 after visiting every stream, the callback's non-zero return
+ *         value if it stopped the iteration, or YAMUX_ERR_INVALID if
+ *         session or cb is NULL
+ */
+int yamux_session_foreach_stream(
+    yamux_session_t *session,
+    yamux_stream_visit_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Callback invoked when the peer half-closes a stream (sends FIN)
+ *
+ * Fires exactly once per stream, after all data the peer sent before its FIN
+ * has been buffered, while our write side is still open.
+ *
+ * @param ctx User context passed to yamux_set_stream_peer_fin_callback
+ * @param stream Stream the peer has finished sending on
+ */
+typedef void (*yamux_peer_fin_callback_t)(void *ctx, yamux_stream_t *stream);
+
+/**
+ * Set the callback for peer half-close (FIN) notifications
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to disable
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_stream_peer_fin_callback(
+    yamux_session_t *session,
+    yamux_peer_fin_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Callback invoked for each frame header received
+ *
+ * Fires before the frame is handled, once its header has been decoded.
+ * raw holds the YAMUX_HEADER_SIZE bytes exactly as read from the
+ * transport, in network byte order, so tools can check the wire encoding
+ * and flag bits that header does not name.
+ *
+ * It runs on the yamux_session_process path, so it must be fast: time
+ * spent here delays every stream. max_trace_events_per_sec bounds how
+ * often it runs, and yamux_session_trace_dropped counts the events the
+ * budget dropped. The budget is timed by the clock passed to
+ * yamux_session_keepalive and does not apply until that is first called,
+ * so an application that wants it must report the time even with
+ * keepalive disabled.
+ *
+ * @param ctx User context passed to yamux_set_frame_trace_callback
+ * @param header Decoded header
+ * @param raw The header bytes as received
+ */
+typedef void (*yamux_frame_trace_callback_t)(void *ctx, const yamux_header_t *header, const uint8_t *raw);
+
+/**
+ * Set the callback for received frame headers
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to disable
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_frame_trace_callback(
+    yamux_session_t *session,
+    yamux_frame_trace_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Get the number of frame trace events dropped over budget
+ *
+ * Frames whose trace event was dropped are still processed as usual. The
+ * budget follows the clock passed to yamux_session_keepalive, so without
+ * that call it is never refilled.
+ *
+ * @param session Session
+ * @return Events dropped since the session was created, or 0 if session is NULL
+ */
+uint32_t yamux_session_trace_dropped(
+    yamux_session_t *session
+);
+
+/**
+ * Callback invoked for each window update the session sends
+ *
+ * Fires after a WINDOW_UPDATE frame granting credit on a stream has been
+ * written, so the coalescing of updates can be watched without decoding
+ * the wire. The window carried by SYN and SYN-ACK frames is not reported.
+ *
+ * @param ctx User context passed to yamux_set_window_update_callback
+ * @param stream_id Stream the credit was granted on
+ * @param increment Bytes of credit granted
+ */
+typedef void (*yamux_window_update_callback_t)(void *ctx, uint32_t stream_id, uint32_t increment);
+
+/**
+ * Set the callback for window updates sent
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to disable
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_window_update_callback(
+    yamux_session_t *session,
+    yamux_window_update_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Callback receiving data on the control stream
+ *
+ * The data has already been read from the stream, so the peer's window is
+ * returned as usual. The callback may write a reply on the stream or close
+ * it.
+ *
+ * @param ctx User context passed to yamux_set_control_stream
+ * @param stream The control stream
+ * @param data Data received
+ * @param len Number of bytes in data
+ */
+typedef void (*yamux_control_callback_t)(void *ctx, yamux_stream_t *stream, const uint8_t *data, size_t len);
+
+/**
+ * Reserve a stream ID as the control stream (server only)
+ *
+ * When the client opens the stream with this ID, it is accepted at once and
+ * never placed on the accept queue; everything it carries goes to cb
+ * instead of yamux_stream_read. All other streams are accepted as usual.
+ * The ID must be one the client opens, so it is odd; 1 reserves the client's
+ * first stream. The control stream belongs to the session, which frees it
+ * unless the application closes it first. A FIN on it is reported by the
+ * peer FIN callback.
+ *
+ * @param session Server session
+ * @param stream_id Stream ID to reserve
+ * @param cb Callback function, or NULL to stop reserving an ID
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, YAMUX_ERR_INVALID for a client session or a
+ *         stream ID the client cannot open, error code otherwise
+ */
+yamux_result_t yamux_set_control_stream(
+    yamux_session_t *session,
+    uint32_t stream_id,
+    yamux_control_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Callback receiving stream data as it arrives
+ *
+ * The data is still in the stream's receive buffer; the callback returns
+ * how much of it it took, and only that much is removed and credited back
+ * to the peer. Taking less than len means the application is full: the
+ * stream is paused as by yamux_stream_pause_recv, the rest stays buffered,
+ * and nothing more is delivered until yamux_stream_resume_recv. The
+ * callback must not read the stream itself, but may write on it or close it.
+ *
+ * @param ctx User context passed to yamux_set_data_callback
+ * @param stream Stream the data arrived on
+ * @param data Data received
+ * @param len Number of bytes in data
+ * @return Number of bytes consumed, at most len
+ */
+typedef size_t (*yamux_data_callback_t)(void *ctx, yamux_stream_t *stream, const uint8_t *data, size_t len);
+
+/**
+ * Deliver stream data to a callback instead of waiting for reads
+ *
+ * Applies to every stream but the control stream, including streams not
+ * yet accepted. yamux_stream_read still returns whatever the callback
+ * leaves buffered.
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to go back to reads only
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_data_callback(
+    yamux_session_t *session,
+    yamux_data_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Callback that waits for the transport to become ready
+ *
+ * Used by functions that bound their blocking with a timeout.
+ * yamux_accept_stream_timeout and reads with a read timeout wait for input
+ * to read, and yamux_destroy_flush waits for room to write. The library has
+ * no clock, so the callback reports how long it actually waited. If a wake
+ * callback is set, a wait must also end early once that is called.
+ *
+ * @param ctx User context passed to yamux_set_wait_callback
+ * @param timeout_ms Maximum time to wait in milliseconds
+ * @param elapsed_ms Output parameter for the time actually waited
+ * @return 1 if the transport is ready, 0 if the timeout expired,
+ *         negative on error
+ */
+typedef int (*yamux_wait_callback_t)(void *ctx, uint32_t timeout_ms, uint32_t *elapsed_ms);
+
+/**
+ * Set the callback used to wait for the transport
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to never wait
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_wait_callback(
+    yamux_session_t *session,
+    yamux_wait_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Callback that ends a wait early
+ *
+ * Called by yamux_stream_interrupt, possibly from another thread, so a read
+ * or write blocked in the wait callback returns. It should make the wait in
+ * progress, or the next one if none is, return at once, e.g. by writing a
+ * byte to a self-pipe the wait callback polls. The interrupt is reported
+ * whatever the wait then returns.
+ *
+ * @param ctx User context passed to yamux_set_wake_callback
+ */
+typedef void (*yamux_wake_callback_t)(void *ctx);
+
+/**
+ * Set the callback used to end a wait early
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL if waits cannot be ended early
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_wake_callback(
+    yamux_session_t *session,
+    yamux_wake_callback_t cb,
+    void *ctx
+);
+
+/**
+ * Give the read and write callbacks separate contexts
+ *
+ * By default both callbacks receive the ctx from yamux_io_t. For transports
+ * that read and write through different handles, e.g. a pair of pipes or a
+ * UART with separate RX and TX drivers, this passes each callback its own
+ * context so it does not have to pick its half out of a shared one. Call it
+ * right after creating the session, before any IO.
+ *
+ * @param session Session
+ * @param read_ctx Context passed to the read callback
+ * @param write_ctx Context passed to the write callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_session_set_io_contexts(
+    yamux_session_t *session,
+    void *read_ctx,
+    void *write_ctx
+);
+
+/**
+ * Copy the session's recent diagnostic messages into a buffer
+ *
+ * Messages are written oldest first, one per line, and the buffer is always
+ * NUL-terminated. Messages that do not fit are omitted. When the library is
+ * built with YAMUX_MINIMAL, no messages are kept and the buffer is empty.
+ *
+ * @param session Session
+ * @param buf Buffer to receive the messages
+ * @param cap Capacity of buf in bytes
+ * @return Number of characters written, excluding the terminator
+ */
+size_t yamux_session_dump_diagnostics(
+    yamux_session_t *session,
+    char *buf,
+    size_t cap
+);
+
+/**
+ * Write one line of stats per stream into a buffer
+ *
+ * Each line gives the stream ID, its label in brackets if it has one, its
+ * state, the bytes buffered for reading and the send window. The buffer is
+ * always NUL-terminated, and streams that do not fit are omitted.
+ *
+ * @param session Session
+ * @param buf Buffer to receive the stats
+ * @param cap Capacity of buf in bytes
+ * @return Number of characters written, excluding the terminator
+ */
+size_t yamux_session_dump_streams(
+    yamux_session_t *session,
+    char *buf,
+    size_t cap
+);
+
+/**
+ * Write a readable summary of the whole session into a buffer
+ *
+ * The first line gives the role, stream count, streams awaiting accept,
+ * unanswered pings and GoAway status. One line per stream follows with
+ * its ID, state name, send and receive windows, unread bytes and held
+ * bytes. Meant for field debugging, e.g. of a hung session, and safe to
+ * call at any time, including from callbacks. The buffer is always
+ * NUL-terminated, and lines that do not fit are omitted.
+ *
+ * @param session Session
+ * @param buf Buffer to receive the dump
+ * @param cap Capacity of buf in bytes
+ * @return Number of characters written, excluding the terminator
+ */
+size_t yamux_session_debug_dump(
+    yamux_session_t *session,
+    char *buf,
+    size_t cap
+);
+
+/**
+ * Feed a captured frame log into a fresh session
+ *
+ * Reproduces a parser failure offline: pass the raw bytes a session read
+ * from its transport (e.g. recorded by wrapping its read callback) and the
+ * same frames are processed again by a new session with the default
+ * config. The session's role is inferred from the first SYN in the log.
+ * Anything the session writes goes to io->write, or is discarded if io is
+ * NULL.
+ *
+ * @param io Optional I/O whose write callback receives the session's output
+ * @param log Raw bytes the original session read from its transport
+ * @param len Length of log in bytes
+ * @return YAMUX_OK if the whole log was processed, otherwise the first error
+ *         returned by yamux_session_process
+ */
+yamux_result_t yamux_replay_frames(
+    yamux_io_t *io,
+    const uint8_t *log,
+    size_t len
+);
+
+/**
+ * Serialize a session's protocol state for a hot restart
+ *
+ * Records the role, the next stream ID, GoAway status and, for every stream,
+ * its ID, state, windows and whether it awaits accept. A process that keeps
+ * the transport open can pass the snapshot to yamux_session_restore and carry
+ * on. Buffered data is not saved: every stream must have been read dry and
+ * flushed first, otherwise YAMUX_ERR_WOULD_BLOCK is returned. Callbacks,
+ * labels, stats and the keepalive clock are not saved either.
+ *
+ * Pass a NULL buf with cap 0 to learn the size needed.
+ *
+ * @param session Session to snapshot; it must not be used after a restore
+ * @param buf Buffer to receive the snapshot
+ * @param cap Capacity of buf in bytes
+ * @param written Output parameter for the snapshot length, or the length
+ *        needed if cap is too small
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if a stream holds
+ *         buffered data, YAMUX_ERR_NOMEM if cap is too small, error code
+ *         otherwise
+ */
+yamux_result_t yamux_session_snapshot(
+    yamux_session_t *session,
+    uint8_t *buf,
+    size_t cap,
+    size_t *written
+);
+
+/**
+ * Rebuild a session from a snapshot taken by yamux_session_snapshot
+ *
+ * Nothing is written to the transport. Streams that were waiting to be
+ * accepted are queued again in the same order; the rest can be found with
+ * yamux_session_foreach_stream. Callbacks, including the control stream's,
+ * must be set again.
+ *
+ * @param io I/O callbacks for the inherited transport
+ * @param config Configuration, or NULL for the default
+ * @param buf Snapshot
+ * @param len Length of the snapshot in bytes
+ * @param session Output parameter for the restored session
+ * @return YAMUX_OK on success, YAMUX_ERR_INVALID if the snapshot is
+ *         malformed, error code otherwise
+ */
+yamux_result_t yamux_session_restore(
+    yamux_io_t *io,
+    const yamux_config_t *config,
+    const uint8_t *buf,
+    size_t len,
+    yamux_session_t **session
+);
+
+/**
+ * Memory allocation functions used by the library
+ *
+ * All three have the semantics of the standard C functions of the same name.
+ */
+typedef struct {
+    void *(*malloc_fn)(size_t size);
+    void *(*realloc_fn)(void *ptr, size_t size);
+    void (*free_fn)(void *ptr);
+} yamux_allocator_t;
+
+/**
+ * Replace the allocator used for all library memory
+ *
+ * Set it before creating any session and keep it until every session is
+ * destroyed: memory is released with whichever allocator is current at the
+ * time. If an allocation fails while buffering received data, only the
+ * affected stream is reset and the session carries on.
+ *
+ * @param allocator Allocator to use (copied), or NULL to restore malloc/realloc/free
+ */
+void yamux_set_allocator(const yamux_allocator_t *allocator);
+
 /*
  * ----- High-level stream API (for use with yamux_init) -----
  */
@@ -336,6 +1623,9 @@ yamux_result_t yamux_session_ping(
 /**
  * Open a new stream
  * 
+ * @note Returns NULL without sending anything once the peer has sent GoAway;
+ *       use yamux_stream_open_detailed to get the YAMUX_ERR_REMOTE_GOAWAY code.
+ * 
  * @param session Session handle returned by yamux_init
  * @return Stream handle, or NULL on error
  */
@@ -352,6 +1642,9 @@ void* yamux_accept_stream(void *session);
 /**
  * Close a stream
  * 
+ * The handle is freed at once. After a normal close the stream itself lives
+ * on until the peer's FIN, then is freed by yamux_process.
+ * 
  * @param stream Stream handle returned by yamux_open_stream or yamux_accept_stream
  * @param reset True to forcibly reset the stream, false for normal close
  * @return 0 on success, negative value on error
@@ -374,7 +1667,9 @@ int yamux_read(void *stream, uint8_t *buf, size_t len);
  * @param stream Stream handle returned by yamux_open_stream or yamux_accept_stream
  * @param buf Buffer containing data to write
  * @param len Number of bytes to write
- * @return Number of bytes written, or negative value on error
+ * @return Number of bytes written (0 for a zero-length write, which sends
+ *         nothing), or negative value on error (YAMUX_ERR_NO_WINDOW and YAMUX_ERR_WOULD_BLOCK as for
+ *         yamux_stream_write)
  */
 int yamux_write(void *stream, const uint8_t *buf, size_t len);
 
@@ -386,6 +1681,18 @@ int yamux_write(void *stream, const uint8_t *buf, size_t len);
  */
 uint32_t yamux_get_stream_id(void *stream);
 
+/**
+ * Interrupt a pending read and write on a stream
+ * 
+ * A blocked yamux_read or yamux_write returns YAMUX_ERR_INTERRUPTED; if
+ * none is blocked, the next of each does, once. Safe to call from another
+ * thread.
+ * 
+ * @param stream Stream handle returned by yamux_open_stream or yamux_accept_stream
+ * @return 0 on success, negative value on error
+ */
+int yamux_interrupt_stream(void *stream);
+
 /**
  * Send a ping to the remote endpoint
  * 
@@ -394,6 +1701,32 @@ uint32_t yamux_get_stream_id(void *stream);
  */
 int yamux_ping(void *session);
 
+/**
+ * Set the callback used to wait for the transport
+ * 
+ * Handle-based counterpart of yamux_set_wait_callback; yamux_destroy_flush
+ * uses it to wait for room to write.
+ * 
+ * @param session Session handle returned by yamux_init
+ * @param cb Callback function, or NULL to never wait
+ * @param ctx User context passed to the callback
+ * @return 0 on success, negative value on error
+ */
+int yamux_set_wait(void *session, yamux_wait_callback_t cb, void *ctx);
+
+/**
+ * Set the callback used to end a wait early
+ * 
+ * Handle-based counterpart of yamux_set_wake_callback; yamux_interrupt_stream
+ * calls it to wake a blocked read or write.
+ * 
+ * @param session Session handle returned by yamux_init
+ * @param cb Callback function, or NULL if waits cannot be ended early
+ * @param ctx User context passed to the callback
+ * @return 0 on success, negative value on error
+ */
+int yamux_set_wake(void *session, yamux_wake_callback_t cb, void *ctx);
+
 #ifdef __cplusplus
 }
 #endif
@@ -56,12 +56,44 @@ void yamux_free(void *ptr);
 /**
  * Maximum stream configuration
  */
-/* Maximum number of concurrent streams per session */
+/* Maximum number of concurrent streams per session; raise it for high-fanout servers */
+#ifndef YAMUX_MAX_STREAMS
 #define YAMUX_MAX_STREAMS 1024
+#endif
+
+/* Tagged pings (yamux_session_ping_rtt) tracked at once; the oldest is forgotten beyond this */
+#ifndef YAMUX_MAX_TAGGED_PINGS
+#define YAMUX_MAX_TAGGED_PINGS 8
+#endif
 
 /* Maximum stream ID value */
 #define YAMUX_MAX_STREAM_ID 0x7FFFFFFF
 
+/* Maximum length of a stream label, including the terminator */
+#ifndef YAMUX_STREAM_LABEL_SIZE
+#define YAMUX_STREAM_LABEL_SIZE 16
+#endif
+
+/**
+ * Minimal build configuration
+ */
+/* Uncomment (or build with -DYAMUX_MINIMAL) to compile out optional
+ * features such as the diagnostics ring */
+/* #define YAMUX_MINIMAL */
+
+/**
+ * Diagnostics ring configuration (unused under YAMUX_MINIMAL)
+ */
+/* Number of recent diagnostic messages kept per session */
+#ifndef YAMUX_DIAG_RING_SIZE
+#define YAMUX_DIAG_RING_SIZE 16
+#endif
+
+/* Maximum length of one diagnostic message, including the terminator */
+#ifndef YAMUX_DIAG_MSG_SIZE
+#define YAMUX_DIAG_MSG_SIZE 96
+#endif
+
 /**
  * Debug configuration
  */
@@ -71,6 +103,7 @@ void yamux_free(void *ptr);
 #ifdef YAMUX_DEBUG
 /**
  * Define your own debug logging function
+ * Receives every diagnostic message, in addition to the diagnostics ring
  */
 void yamux_debug_log(const char *format, ...);
 #endif
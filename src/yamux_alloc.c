@@ -0,0 +1,62 @@
+/**
+ * @file yamux_alloc.c
+ * @brief Pluggable memory allocation for yamux
+ */
+
+#include "../include/yamux.h"
+#include "yamux_internal.h"
+#include <stdlib.h>
+
+/* Allocator in use; the standard library unless replaced */
+static yamux_allocator_t yamux_allocator = { malloc, realloc, free };
+
+/**
+ * Replace the allocator used for all library memory
+ *
+ * @param allocator Allocator to use (copied), or NULL to restore malloc/realloc/free
+ */
+void yamux_set_allocator(const yamux_allocator_t *allocator)
+{
+    if (allocator && allocator->malloc_fn && allocator->realloc_fn && allocator->free_fn) {
+        yamux_allocator = *allocator;
+    } else {
+        yamux_allocator.malloc_fn = malloc;
+        yamux_allocator.realloc_fn = realloc;
+        yamux_allocator.free_fn = free;
+    }
+}
+
+/**
+ * Allocate memory with the current allocator
+ *
+ * @param size Number of bytes
+ * @return Allocated memory, or NULL on failure
+ */
+void *yamux_mem_alloc(size_t size)
+{
+    return yamux_allocator.malloc_fn(size);
+}
+
+/**
+ * Resize memory with the current allocator
+ *
+ * @param ptr Memory to resize, or NULL
+ * @param size New size in bytes
+ * @return Resized memory, or NULL on failure (ptr is left untouched)
+ */
+void *yamux_mem_realloc(void *ptr, size_t size)
+{
+    return yamux_allocator.realloc_fn(ptr, size);
+}
+
+/**
+ * Release memory with the current allocator
+ *
+ * @param ptr Memory to release, or NULL
+ */
+void yamux_mem_free(void *ptr)
+{
+    if (ptr) {
+        yamux_allocator.free_fn(ptr);
+    }
+}
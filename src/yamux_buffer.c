@@ -7,6 +7,20 @@
 #include <stdlib.h>
 #include <string.h>
 
+/**
+ * Move a buffer's size and keep its byte count in step
+ *
+ * @param buffer Buffer being resized
+ * @param new_size Size after the change
+ */
+static void yamux_buffer_set_size(yamux_buffer_t *buffer, size_t new_size)
+{
+    if (buffer->account) {
+        *buffer->account = *buffer->account - buffer->size + new_size;
+    }
+    buffer->size = new_size;
+}
+
 /**
  * Initialize a buffer with an initial size
  *
@@ -21,14 +35,15 @@ yamux_result_t yamux_buffer_init(yamux_buffer_t *buffer, size_t initial_size)
     }
     
     /* Allocate buffer */
-    buffer->data = (uint8_t *)malloc(initial_size);
+    buffer->data = (uint8_t *)yamux_mem_alloc(initial_size);
     if (!buffer->data) {
         return YAMUX_ERR_NOMEM;
     }
     
-    /* Initialize buffer */
+    /* Initialize buffer; it is counted once its stream joins a session */
     buffer->size = initial_size;
     buffer->used = 0;
+    buffer->account = NULL;
     buffer->pos = 0;
     
     return YAMUX_OK;
@@ -42,9 +57,9 @@ yamux_result_t yamux_buffer_init(yamux_buffer_t *buffer, size_t initial_size)
 void yamux_buffer_free(yamux_buffer_t *buffer)
 {
     if (buffer) {
-        free(buffer->data);
+        yamux_mem_free(buffer->data);
         buffer->data = NULL;
-        buffer->size = 0;
+        yamux_buffer_set_size(buffer, 0);
         buffer->used = 0;
         buffer->pos = 0;
     }
@@ -76,14 +91,14 @@ yamux_result_t yamux_buffer_write(yamux_buffer_t *buffer, const uint8_t *data, s
         }
         
         /* Resize buffer */
-        new_data = (uint8_t *)realloc(buffer->data, new_size);
+        new_data = (uint8_t *)yamux_mem_realloc(buffer->data, new_size);
         if (!new_data) {
             return YAMUX_ERR_NOMEM;
         }
         
         /* Update buffer */
         buffer->data = new_data;
-        buffer->size = new_size;
+        yamux_buffer_set_size(buffer, new_size);
     }
     
     /* Copy data to buffer */
@@ -93,6 +108,30 @@ yamux_result_t yamux_buffer_write(yamux_buffer_t *buffer, const uint8_t *data, s
     return YAMUX_OK;
 }
 
+/**
+ * Get the bytes a write would add to a buffer's allocation
+ *
+ * @param buffer Buffer to be written
+ * @param len Length of the write
+ * @return Bytes the buffer would grow by, 0 if the write fits
+ */
+size_t yamux_buffer_growth(const yamux_buffer_t *buffer, size_t len)
+{
+    size_t new_size;
+    
+    if (buffer->used + len <= buffer->size) {
+        return 0;
+    }
+    
+    /* Mirrors the growth policy of yamux_buffer_write */
+    new_size = buffer->size * 2;
+    if (new_size < buffer->used + len) {
+        new_size = buffer->used + len;
+    }
+    
+    return new_size - buffer->size;
+}
+
 /**
  * Read data from a buffer
  *
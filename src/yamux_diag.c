@@ -0,0 +1,392 @@
+/**
+ * @file yamux_diag.c
+ * @brief Bounded in-memory ring of recent diagnostic messages, frame replay
+ *
+ * Lets targets without a console retrieve recent internal events, e.g. over
+ * a debug command. The ring is compiled out when YAMUX_MINIMAL is defined.
+ * Captured frame logs can be replayed into a fresh session to reproduce a
+ * failure on a development machine.
+ */
+
+#include "../include/yamux.h"
+#include "yamux_internal.h"
+#include <stdarg.h>
+#include <stdio.h>
+#include <string.h>
+
+#ifndef YAMUX_MINIMAL
+/**
+ * Record a diagnostic message in the session's ring
+ *
+ * The oldest message is overwritten once the ring is full. If YAMUX_DEBUG is
+ * defined, the message is also passed to yamux_debug_log.
+ *
+ * @param session Session
+ * @param format printf-style format string
+ */
+void yamux_diag(yamux_session_t *session, const char *format, ...)
+{
+    va_list args;
+    char *slot;
+    
+    if (!session || !format) {
+        return;
+    }
+    
+    slot = session->diag_ring[session->diag_next];
+    
+    va_start(args, format);
+    vsnprintf(slot, YAMUX_DIAG_MSG_SIZE, format, args);
+    va_end(args);
+    
+    session->diag_next = (session->diag_next + 1) % YAMUX_DIAG_RING_SIZE;
+    if (session->diag_count < YAMUX_DIAG_RING_SIZE) {
+        session->diag_count++;
+    }
+    
+#ifdef YAMUX_DEBUG
+    yamux_debug_log("%s", slot);
+#endif
+}
+#endif /* YAMUX_MINIMAL */
+
+/**
+ * Copy the session's recent diagnostic messages into a buffer
+ *
+ * @param session Session
+ * @param buf Buffer to receive the messages
+ * @param cap Capacity of buf in bytes
+ * @return Number of characters written, excluding the terminator
+ */
+size_t yamux_session_dump_diagnostics(
+    yamux_session_t *session,
+    char *buf,
+    size_t cap)
+{
+    size_t written = 0;
+    
+    if (!buf || cap == 0) {
+        return 0;
+    }
+    buf[0] = '\0';
+    
+    if (!session) {
+        return 0;
+    }
+    
+#ifndef YAMUX_MINIMAL
+    {
+        size_t i;
+        size_t oldest = (session->diag_next + YAMUX_DIAG_RING_SIZE - session->diag_count)
+                        % YAMUX_DIAG_RING_SIZE;
+        
+        for (i = 0; i < session->diag_count; i++) {
+            const char *msg = session->diag_ring[(oldest + i) % YAMUX_DIAG_RING_SIZE];
+            size_t len = strlen(msg);
+            
+            /* Keep whole lines only: message + newline + terminator */
+            if (written + len + 2 > cap) {
+                break;
+            }
+            
+            memcpy(buf + written, msg, len);
+            written += len;
+            buf[written++] = '\n';
+        }
+        buf[written] = '\0';
+    }
+#endif
+    
+    return written;
+}
+
+/**
+ * Write one line of stats per stream into a buffer
+ *
+ * @param session Session
+ * @param buf Buffer to receive the stats
+ * @param cap Capacity of buf in bytes
+ * @return Number of characters written, excluding the terminator
+ */
+size_t yamux_session_dump_streams(
+    yamux_session_t *session,
+    char *buf,
+    size_t cap)
+{
+    char line[96 + YAMUX_STREAM_LABEL_SIZE];
+    yamux_stream_t *stream;
+    size_t written = 0;
+    size_t i;
+    int len;
+    
+    if (!buf || cap == 0) {
+        return 0;
+    }
+    buf[0] = '\0';
+    
+    if (!session) {
+        return 0;
+    }
+    
+    for (i = 0; i < session->stream_count; i++) {
+        stream = session->streams[i];
+        if (!stream) {
+            continue;
+        }
+        
+        len = snprintf(line, sizeof(line), "stream %lu%s%s%s state %d buffered %lu window %lu",
+                       (unsigned long)stream->id,
+                       stream->label[0] ? " [" : "", stream->label, stream->label[0] ? "]" : "",
+                       (int)stream->state,
+                       (unsigned long)(stream->recvbuf.used - stream->recvbuf.pos),
+                       (unsigned long)stream->send_window);
+        if (len < 0) {
+            break;
+        }
+        
+        /* Keep whole lines only: line + newline + terminator */
+        if (written + (size_t)len + 2 > cap) {
+            break;
+        }
+        
+        memcpy(buf + written, line, (size_t)len);
+        written += (size_t)len;
+        buf[written++] = '\n';
+    }
+    buf[written] = '\0';
+    
+    return written;
+}
+
+/**
+ * Get a stream state's name for dumps
+ *
+ * @param state Stream state
+ * @return Name of the state
+ */
+static const char *yamux_dump_state_name(yamux_stream_state_t state)
+{
+    switch (state) {
+        case YAMUX_STREAM_IDLE:        return "IDLE";
+        case YAMUX_STREAM_SYN_SENT:    return "SYN_SENT";
+        case YAMUX_STREAM_SYN_RECV:    return "SYN_RECV";
+        case YAMUX_STREAM_ESTABLISHED: return "ESTABLISHED";
+        case YAMUX_STREAM_FIN_SENT:    return "FIN_SENT";
+        case YAMUX_STREAM_FIN_RECV:    return "FIN_RECV";
+        case YAMUX_STREAM_CLOSED:      return "CLOSED";
+    }
+    
+    return "UNKNOWN";
+}
+
+/**
+ * Append one line to a dump if it fits whole
+ *
+ * @param buf Dump buffer
+ * @param cap Capacity of buf in bytes
+ * @param written Characters already in buf, updated on success
+ * @param line Line to append, without newline
+ * @param len Length of line as returned by snprintf
+ * @return 1 if the line was appended, 0 if it did not fit
+ */
+static int yamux_dump_append(char *buf, size_t cap, size_t *written, const char *line, int len)
+{
+    /* Keep whole lines only: line + newline + terminator */
+    if (len < 0 || *written + (size_t)len + 2 > cap) {
+        return 0;
+    }
+    
+    memcpy(buf + *written, line, (size_t)len);
+    *written += (size_t)len;
+    buf[(*written)++] = '\n';
+    buf[*written] = '\0';
+    
+    return 1;
+}
+
+/**
+ * Write a readable summary of the whole session into a buffer
+ *
+ * @param session Session
+ * @param buf Buffer to receive the dump
+ * @param cap Capacity of buf in bytes
+ * @return Number of characters written, excluding the terminator
+ */
+size_t yamux_session_debug_dump(
+    yamux_session_t *session,
+    char *buf,
+    size_t cap)
+{
+    char line[160];
+    yamux_stream_t *stream;
+    size_t written = 0;
+    size_t streams = 0;
+    size_t pending = 0;
+    size_t i;
+    int len;
+    
+    if (!buf || cap == 0) {
+        return 0;
+    }
+    buf[0] = '\0';
+    
+    if (!session) {
+        return 0;
+    }
+    
+    for (i = 0; i < session->stream_count; i++) {
+        if (session->streams[i]) {
+            streams++;
+        }
+    }
+    for (stream = session->accept_queue; stream; stream = stream->next) {
+        pending++;
+    }
+    
+    len = snprintf(line, sizeof(line),
+                   "session %s streams %lu pending_accept %lu pings %lu goaway sent %s received %s code %lu%s",
+                   session->client ? "client" : "server",
+                   (unsigned long)streams, (unsigned long)pending,
+                   (unsigned long)session->pings_pending,
+                   session->go_away_sent ? "yes" : "no",
+                   session->go_away_received ? "yes" : "no",
+                   (unsigned long)session->go_away_code,
+                   session->shutdown || session->transport_failed ? " closed" : "");
+    if (!yamux_dump_append(buf, cap, &written, line, len)) {
+        return written;
+    }
+    
+    for (i = 0; i < session->stream_count; i++) {
+        stream = session->streams[i];
+        if (!stream) {
+            continue;
+        }
+        
+        len = snprintf(line, sizeof(line),
+                       "stream %lu %s send_window %lu recv_window %lu buffered %lu held %lu%s",
+                       (unsigned long)stream->id, yamux_dump_state_name(stream->state),
+                       (unsigned long)stream->send_window, (unsigned long)stream->recv_window,
+                       (unsigned long)(stream->recvbuf.used - stream->recvbuf.pos),
+                       (unsigned long)(stream->sendbuf.used - stream->sendbuf.pos),
+                       stream->reset_reason != YAMUX_RESET_NONE ? " reset" : "");
+        if (!yamux_dump_append(buf, cap, &written, line, len)) {
+            break;
+        }
+    }
+    
+    return written;
+}
+
+/* Reader over a captured frame log; writes go to the caller's I/O, if any */
+typedef struct {
+    const uint8_t *log;
+    size_t len;
+    size_t pos;
+    yamux_io_t *out;
+} yamux_replay_ctx_t;
+
+static int yamux_replay_read(void *ctx, uint8_t *buf, size_t len)
+{
+    yamux_replay_ctx_t *replay = (yamux_replay_ctx_t *)ctx;
+    size_t available = replay->len - replay->pos;
+    
+    if (len > available) {
+        len = available;
+    }
+    memcpy(buf, replay->log + replay->pos, len);
+    replay->pos += len;
+    
+    return (int)len;
+}
+
+static int yamux_replay_write(void *ctx, const uint8_t *buf, size_t len)
+{
+    yamux_replay_ctx_t *replay = (yamux_replay_ctx_t *)ctx;
+    
+    if (replay->out && replay->out->write) {
+        return replay->out->write(replay->out->ctx, buf, len);
+    }
+    
+    return (int)len;
+}
+
+/**
+ * Infer the role of the session that received a log
+ *
+ * The first SYN in the log was sent by the peer, so an odd stream ID means
+ * we were the server.
+ *
+ * @param log Captured frames
+ * @param len Length of log in bytes
+ * @return 1 if the receiving session was a client, 0 otherwise
+ */
+static int yamux_replay_is_client(const uint8_t *log, size_t len)
+{
+    yamux_header_t header;
+    size_t pos = 0;
+    
+    while (len - pos >= YAMUX_HEADER_SIZE &&
+           yamux_decode_header(log + pos, len - pos, &header) == YAMUX_OK) {
+        if ((header.type == YAMUX_DATA || header.type == YAMUX_WINDOW_UPDATE) &&
+            (header.flags & YAMUX_FLAG_SYN) && !(header.flags & YAMUX_FLAG_ACK)) {
+            return (header.stream_id & 1) == 0;
+        }
+        if (header.length > len - pos - YAMUX_HEADER_SIZE) {
+            break;
+        }
+        pos += YAMUX_HEADER_SIZE + header.length;
+    }
+    
+    return 0;
+}
+
+/**
+ * Feed a captured frame log into a fresh session
+ *
+ * @param io Optional I/O whose write callback receives the session's output
+ * @param log Raw bytes the original session read from its transport
+ * @param len Length of log in bytes
+ * @return YAMUX_OK if the whole log was processed, otherwise the first error
+ *         returned by yamux_session_process
+ */
+yamux_result_t yamux_replay_frames(
+    yamux_io_t *io,
+    const uint8_t *log,
+    size_t len)
+{
+    yamux_replay_ctx_t replay;
+    yamux_io_t replay_io;
+    yamux_session_t *session;
+    yamux_result_t result;
+    
+    if (!log && len > 0) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    replay.log = log;
+    replay.len = len;
+    replay.pos = 0;
+    replay.out = io;
+    
+    replay_io.read = yamux_replay_read;
+    replay_io.write = yamux_replay_write;
+    replay_io.ctx = &replay;
+    
+    result = yamux_session_create(&replay_io, yamux_replay_is_client(log, len), NULL, &session);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    
+    while (replay.pos < replay.len) {
+        result = yamux_session_process(session);
+        if (result != YAMUX_OK) {
+            break;
+        }
+    }
+    
+    /* The GoAway and resets sent on teardown were not part of the capture */
+    replay.out = NULL;
+    yamux_session_free(session);
+    
+    return result;
+}
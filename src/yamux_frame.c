@@ -95,3 +95,29 @@ yamux_result_t yamux_decode_header(const uint8_t *buffer, size_t buffer_len, yam
     
     return YAMUX_OK;
 }
+
+/**
+ * Encode a 32-bit value in network byte order
+ * 
+ * @param value Value to encode
+ * @param buffer Output buffer (must be at least 4 bytes)
+ */
+void yamux_encode_u32(uint32_t value, uint8_t *buffer)
+{
+    buffer[0] = (value >> 24) & 0xFF;
+    buffer[1] = (value >> 16) & 0xFF;
+    buffer[2] = (value >> 8) & 0xFF;
+    buffer[3] = value & 0xFF;
+}
+
+/**
+ * Decode a 32-bit value stored in network byte order
+ * 
+ * @param buffer Input buffer (must be at least 4 bytes)
+ * @return Decoded value
+ */
+uint32_t yamux_decode_u32(const uint8_t *buffer)
+{
+    return ((uint32_t)buffer[0] << 24) | ((uint32_t)buffer[1] << 16) |
+           ((uint32_t)buffer[2] << 8) | (uint32_t)buffer[3];
+}
@@ -7,9 +7,237 @@
 #include "yamux_internal.h"
 #include "yamux_defs.h"
 #include <stdlib.h>
-#include <stdio.h>
 #include <string.h>
 
+/**
+ * Apply the FIN flag of a DATA or WINDOW_UPDATE frame to the stream state
+ *
+ * A FIN that completes our own close frees the stream if the application
+ * has already let go of it. A FIN is never answered, and one for a stream
+ * that is already closed, or was reset, changes nothing.
+ *
+ * @param session Session context
+ * @param stream Stream the frame belongs to
+ * @param header Frame header
+ */
+static void yamux_handle_fin(yamux_session_t *session, yamux_stream_t *stream, const yamux_header_t *header) {
+    if (!(header->flags & YAMUX_FLAG_FIN)) {
+        return;
+    }
+    
+    /* The opener never ACKs our SYN-ACK, so accepted streams may still be SYN_RECV */
+    if (stream->state == YAMUX_STREAM_ESTABLISHED ||
+        stream->state == YAMUX_STREAM_SYN_RECV ||
+        stream->state == YAMUX_STREAM_SYN_SENT) {
+        stream->state = YAMUX_STREAM_FIN_RECV;
+        /* Our write side is still open: tell the application the peer is done */
+        yamux_notify_peer_fin(session, stream);
+    } else if (stream->state == YAMUX_STREAM_FIN_SENT) {
+        stream->state = YAMUX_STREAM_CLOSED;
+        (void)yamux_stream_reap(session, stream);
+    }
+}
+
+/**
+ * Read and drop a frame payload so the next header is read from the right place
+ *
+ * @param session Session context
+ * @param len Payload length
+ * @return YAMUX_OK on success, YAMUX_ERR_IO if the payload could not be read
+ */
+static yamux_result_t yamux_discard_payload(yamux_session_t *session, uint32_t len) {
+    uint8_t scratch[32];
+    size_t chunk;
+
+    while (len > 0) {
+        chunk = len < sizeof(scratch) ? len : sizeof(scratch);
+        if (session->io.read(session->read_ctx, scratch, chunk) != (int)chunk) {
+            return YAMUX_ERR_IO;
+        }
+        len -= (uint32_t)chunk;
+    }
+
+    return YAMUX_OK;
+}
+
+/**
+ * Send an RST for a stream ID, ignoring write errors
+ *
+ * @param session Session context
+ * @param stream_id Stream to reset
+ */
+static void yamux_send_rst(yamux_session_t *session, uint32_t stream_id) {
+    yamux_header_t rst;
+    uint8_t frame[YAMUX_HEADER_SIZE];
+
+    memset(&rst, 0, sizeof(rst));
+    rst.version = YAMUX_PROTO_VERSION;
+    rst.type = YAMUX_WINDOW_UPDATE;
+    rst.flags = YAMUX_FLAG_RST;
+    rst.stream_id = stream_id;
+    yamux_encode_header(&rst, frame);
+    (void)session->io.write(session->write_ctx, frame, sizeof(frame));
+}
+
+/**
+ * Acknowledge a stream the peer opened
+ *
+ * The SYN-ACK carries our initial receive window for the stream.
+ *
+ * @param session Session context
+ * @param stream Stream to acknowledge
+ * @return YAMUX_OK on success, YAMUX_ERR_IO if the frame could not be written
+ */
+yamux_result_t yamux_send_syn_ack(yamux_session_t *session, yamux_stream_t *stream) {
+    yamux_header_t header;
+    uint8_t frame[YAMUX_HEADER_SIZE + 4];
+
+    header.version = YAMUX_PROTO_VERSION;
+    header.type = YAMUX_WINDOW_UPDATE;
+    header.flags = YAMUX_FLAG_SYN | YAMUX_FLAG_ACK;
+    header.stream_id = stream->id;
+    header.length = 4; /* Payload is our initial window size */
+    yamux_encode_header(&header, frame);
+    yamux_encode_u32(stream->recv_window, frame + YAMUX_HEADER_SIZE);
+
+    if (session->io.write(session->write_ctx, frame, sizeof(frame)) != sizeof(frame)) {
+        YAMUX_DIAG(session, "window: stream %u SYN-ACK write failed", stream->id);
+        return YAMUX_ERR_IO;
+    }
+
+    return YAMUX_OK;
+}
+
+/**
+ * Reset a stream from our side
+ *
+ * The stream is marked closed and its buffers released, but it stays in the
+ * session so pointers the application holds remain valid until the stream
+ * is closed or the session is destroyed.
+ *
+ * @param session Session context
+ * @param stream Stream to reset
+ * @param reason Why the stream is being reset
+ */
+void yamux_reset_stream(yamux_session_t *session, yamux_stream_t *stream, yamux_reset_reason_t reason) {
+    yamux_send_rst(session, stream->id);
+    stream->state = YAMUX_STREAM_CLOSED;
+    stream->reset_reason = reason;
+    stream->window_stalled = 0;
+    yamux_buffer_free(&stream->recvbuf);
+    yamux_buffer_free(&stream->sendbuf);
+}
+
+/**
+ * Reset a stream whose received data could not be stored
+ *
+ * @param session Session context
+ * @param stream Stream to reset
+ */
+static void yamux_reset_stream_nomem(yamux_session_t *session, yamux_stream_t *stream) {
+    YAMUX_DIAG(session, "data: stream %u reset, out of memory (internal error %d)",
+               stream->id, YAMUX_INTERNAL_ERROR);
+    yamux_reset_stream(session, stream, YAMUX_RESET_INTERNAL);
+}
+
+/**
+ * Apply an RST from the peer to a stream
+ *
+ * Like a local reset, the stream stays in the session until the application
+ * closes it, so its pointer remains valid and the reason can be read.
+ *
+ * @param session Session context
+ * @param stream Stream the peer reset
+ */
+static void yamux_handle_peer_reset(yamux_session_t *session, yamux_stream_t *stream) {
+    /* Already reset, or closed normally: nothing left to tear down */
+    if (stream->reset_reason != YAMUX_RESET_NONE || stream->state == YAMUX_STREAM_CLOSED) {
+        return;
+    }
+    
+    if (stream->state == YAMUX_STREAM_SYN_SENT) {
+        YAMUX_DIAG(session, "stream %u refused by peer", stream->id);
+        stream->reset_reason = YAMUX_RESET_REFUSED;
+    } else {
+        YAMUX_DIAG(session, "stream %u reset by peer", stream->id);
+        stream->reset_reason = YAMUX_RESET_PEER;
+    }
+    stream->state = YAMUX_STREAM_CLOSED;
+    yamux_buffer_free(&stream->recvbuf);
+    yamux_buffer_free(&stream->sendbuf);
+    
+    /* Nobody is left to read the reason of a stream the application let go of */
+    (void)yamux_stream_reap(session, stream);
+}
+
+/**
+ * React to a FIN for a stream not in the table
+ *
+ * The stream was most likely closed and reaped locally before the peer's
+ * FIN crossed on the wire, so the default is to drop the frame without an
+ * RST. The payload, if any, must already have been consumed.
+ *
+ * @param session Session context
+ * @param stream_id Stream ID the FIN named
+ * @return YAMUX_OK if ignored, YAMUX_ERR_PROTOCOL if the session was closed
+ */
+static yamux_result_t yamux_handle_unknown_fin(yamux_session_t *session, uint32_t stream_id) {
+    (void)stream_id; /* Only named in diagnostics */
+    
+    if (session->config.on_unknown_fin == YAMUX_UNKNOWN_FIN_CLOSE_SESSION) {
+        YAMUX_DIAG(session, "FIN for unknown stream %u (protocol error %d)",
+                   stream_id, YAMUX_PROTOCOL_ERROR);
+        yamux_session_close(session, YAMUX_PROTOCOL_ERROR);
+        return YAMUX_ERR_PROTOCOL;
+    }
+    
+    YAMUX_DIAG(session, "FIN for unknown stream %u ignored", stream_id);
+    return YAMUX_OK;
+}
+
+/**
+ * Hand the control stream's buffered data to the control callback
+ *
+ * The data is read through yamux_stream_read so the peer gets its window
+ * back as for any other stream. A pool buffer serves as the chunk buffer
+ * if there is one, or else the session's receive scratch buffer, which is
+ * free again by now.
+ *
+ * @param session Session context
+ * @param stream The control stream
+ * @return The stream, or NULL if the callback closed and freed it
+ */
+static yamux_stream_t *yamux_deliver_control_data(yamux_session_t *session, yamux_stream_t *stream) {
+    uint8_t *pooled = yamux_frame_buffer_take(session, YAMUX_MAX_DATA_FRAME_SIZE);
+    uint8_t *chunk;
+    size_t chunk_size;
+    uint32_t id = stream->id;
+    size_t bytes;
+    
+    for (;;) {
+        /* A nested process call may have grown the scratch buffer */
+        chunk = pooled ? pooled : session->recv_buf;
+        chunk_size = pooled ? YAMUX_MAX_DATA_FRAME_SIZE : session->recv_buf_size;
+        if (!session->control_cb ||
+            yamux_stream_read_available(stream, chunk, chunk_size, &bytes) != YAMUX_OK ||
+            bytes == 0) {
+            break;
+        }
+        
+        session->callback_depth++;
+        session->control_cb(session->control_ctx, stream, chunk, bytes);
+        session->callback_depth--;
+        
+        stream = yamux_get_stream(session, id);
+        if (!stream) {
+            break;
+        }
+    }
+    
+    yamux_frame_buffer_give(session, pooled);
+    return stream;
+}
+
 /**
  * Handle a DATA frame
  * 
@@ -20,6 +248,8 @@
 yamux_result_t yamux_handle_data(yamux_session_t *session, const yamux_header_t *header) {
     yamux_stream_t *stream;
     yamux_result_t result;
+    uint8_t *pooled;
+    uint8_t *payload;
     int bytes_read;
     
     /* Validate session and header */
@@ -30,96 +260,201 @@ yamux_result_t yamux_handle_data(yamux_session_t *session, const yamux_header_t
     /* Find the stream */
     stream = yamux_get_stream(session, header->stream_id);
     if (!stream) {
+        /* A strict server refuses a stream opened with data before any handshake */
+        if (!session->client && session->config.reject_data_on_syn &&
+            (header->flags & YAMUX_FLAG_SYN) && !(header->flags & YAMUX_FLAG_ACK) &&
+            header->length > 0) {
+            result = yamux_discard_payload(session, header->length);
+            if (result == YAMUX_OK) {
+                YAMUX_DIAG(session, "data: stream %u refused, data on SYN (protocol error %d)",
+                           header->stream_id, YAMUX_PROTOCOL_ERROR);
+                yamux_send_rst(session, header->stream_id);
+            }
+            return result;
+        }
+        
+        /* Drop the payload so the next header is read from the right place */
+        result = yamux_discard_payload(session, header->length);
+        if (result != YAMUX_OK) {
+            return result;
+        }
+        if (header->flags & YAMUX_FLAG_RST) {
+            YAMUX_DIAG(session, "data: RST for unknown stream %u", header->stream_id);
+            return YAMUX_OK;
+        }
+        if (header->flags & YAMUX_FLAG_FIN) {
+            return yamux_handle_unknown_fin(session, header->stream_id);
+        }
         return YAMUX_ERR_INVALID_STREAM;
     }
     
+    /* The peer may reset with a DATA frame too */
+    if (header->flags & YAMUX_FLAG_RST) {
+        result = yamux_discard_payload(session, header->length);
+        yamux_handle_peer_reset(session, stream);
+        return result;
+    }
+    
+    /* Data the peer sent before seeing our RST is dropped */
+    if (stream->reset_reason != YAMUX_RESET_NONE) {
+        return yamux_discard_payload(session, header->length);
+    }
+    
     /* Check if the stream is readable */
     if (stream->state == YAMUX_STREAM_CLOSED || 
         stream->state == YAMUX_STREAM_FIN_RECV) {
         return YAMUX_ERR_CLOSED;
     }
     
-    /* Check for FIN flag */
-    if (header->flags & YAMUX_FLAG_FIN) {
-        if (stream->state == YAMUX_STREAM_ESTABLISHED) {
-            stream->state = YAMUX_STREAM_FIN_RECV;
-        } else if (stream->state == YAMUX_STREAM_FIN_SENT) {
-            stream->state = YAMUX_STREAM_CLOSED;
-        }
-    }
-    
-    /* If there's no data, we're done */
+    /* If there's no data, only the FIN flag needs handling */
     if (header->length == 0) {
+        yamux_handle_fin(session, stream, header);
         return YAMUX_OK;
     }
     
-    /* Allocate a buffer for the data if needed */
-    if (header->length > session->recv_buf_size) {
-        uint8_t *new_buf = realloc(session->recv_buf, header->length);
+    /* Data beyond the window we advertised is a flow-control violation */
+    if (header->length > stream->recv_window) {
+        YAMUX_DIAG(session, "data: stream %u overran its window by %u bytes",
+                   stream->id, header->length - stream->recv_window);
+        if (session->config.on_window_violation == YAMUX_WINDOW_VIOLATION_RESET_STREAM) {
+            result = yamux_discard_payload(session, header->length);
+            if (result == YAMUX_OK) {
+                yamux_reset_stream(session, stream, YAMUX_RESET_FLOW_CONTROL);
+            }
+            return result;
+        }
+        yamux_session_close(session, YAMUX_PROTOCOL_ERROR);
+        return YAMUX_ERR_PROTOCOL;
+    }
+    
+    /* A pool buffer spares the allocator; otherwise the scratch buffer grows to fit */
+    pooled = yamux_frame_buffer_take(session, header->length);
+    if (!pooled && header->length > session->recv_buf_size) {
+        uint8_t *new_buf = NULL;
+        if (yamux_session_memory_allows(session, header->length - session->recv_buf_size)) {
+            new_buf = yamux_mem_realloc(session->recv_buf, header->length);
+        }
         if (!new_buf) {
-            return YAMUX_ERR_NOMEM;
+            result = yamux_discard_payload(session, header->length);
+            if (result == YAMUX_OK) {
+                yamux_reset_stream_nomem(session, stream);
+            }
+            return result;
         }
         session->recv_buf = new_buf;
         session->recv_buf_size = header->length;
     }
     
+    payload = pooled ? pooled : session->recv_buf;
+    
     /* Read the data from the connection */
-    bytes_read = session->io.read(session->io.ctx, session->recv_buf, header->length);
+    bytes_read = session->io.read(session->read_ctx, payload, header->length);
     if (bytes_read < 0) {
-        return YAMUX_ERR_IO;
+        yamux_frame_buffer_give(session, pooled);
+        return yamux_session_io_error(session, bytes_read);
     }
     
     /* Check if we got all the data */
     if ((size_t)bytes_read < header->length) {
         /* Partial read, not enough data */
+        yamux_frame_buffer_give(session, pooled);
         return YAMUX_ERR_IO;
     }
     
-    /* Write the data to the stream's receive buffer */
-    result = yamux_buffer_write(&stream->recvbuf, session->recv_buf, bytes_read);
+    /* Write the data to the stream's receive buffer, within the session's memory cap */
+    if (yamux_session_memory_allows(session, yamux_buffer_growth(&stream->recvbuf, (size_t)bytes_read))) {
+        result = yamux_buffer_write(&stream->recvbuf, payload, bytes_read);
+    } else {
+        result = YAMUX_ERR_NOMEM;
+    }
+    yamux_frame_buffer_give(session, pooled);
+    if (result == YAMUX_ERR_NOMEM) {
+        yamux_reset_stream_nomem(session, stream);
+        return YAMUX_OK;
+    }
     if (result != YAMUX_OK) {
         return result;
     }
     
-    /* Update the receive window */
+    /* Consume receive window; credit is returned as the application reads */
     stream->recv_window -= bytes_read;
     
-    /* Send a window update if needed */
-    if (stream->recv_window < YAMUX_WINDOW_UPDATE_THRESHOLD) {
-        /* Implement window update inline since the function might not be defined yet */
-        yamux_header_t update;
-        uint8_t frame[12];  /* 8-byte header + 4-byte window size */
-        yamux_session_t *sess = stream->session;
-        
-        /* Create window update frame */
-        memset(&update, 0, sizeof(update));
-        update.version = YAMUX_PROTO_VERSION;
-        update.type = YAMUX_WINDOW_UPDATE;
-        update.flags = 0;
-        update.stream_id = stream->id;
-        update.length = 4;  /* Window update is a 32-bit value */
-        
-        /* Encode header */
-        yamux_encode_header(&update, frame);
-        
-        /* Encode window update (big-endian) */
-        frame[8] = (YAMUX_DEFAULT_WINDOW_SIZE >> 24) & 0xFF;
-        frame[9] = (YAMUX_DEFAULT_WINDOW_SIZE >> 16) & 0xFF;
-        frame[10] = (YAMUX_DEFAULT_WINDOW_SIZE >> 8) & 0xFF;
-        frame[11] = YAMUX_DEFAULT_WINDOW_SIZE & 0xFF;
-        
-        /* Send frame */
-        if (sess->io.write(sess->io.ctx, frame, sizeof(frame)) != sizeof(frame)) {
-            return YAMUX_ERR_IO;
-        }
-        
-        /* Update the window */
-        stream->recv_window = YAMUX_DEFAULT_WINDOW_SIZE;
+    /* The control stream's data goes to its callback ahead of any FIN */
+    if (stream->control) {
+        stream = yamux_deliver_control_data(session, stream);
+    } else if (session->data_cb) {
+        stream = yamux_stream_deliver_data(stream);
     }
+    if (!stream) {
+        return YAMUX_OK;
+    }
+    
+    /* Process FIN only once the payload it trails is buffered */
+    yamux_handle_fin(session, stream, header);
     
     return YAMUX_OK;
 }
 
+/**
+ * Add window granted by the peer to a stream's send window
+ *
+ * Updates are cumulative, so redundant ones simply add up. A zero increment
+ * changes nothing, and the window saturates rather than wrapping.
+ *
+ * @param session Session context
+ * @param stream Stream the window is granted for
+ * @param increment Window increment from the frame
+ */
+static void yamux_grant_send_window(yamux_session_t *session, yamux_stream_t *stream, uint32_t increment) {
+    if (increment == 0) {
+        return;
+    }
+    
+    if (increment > UINT32_MAX - stream->send_window) {
+        YAMUX_DIAG(session, "window: stream %u update of %u overflows, capped", stream->id, increment);
+        stream->send_window = UINT32_MAX;
+    } else {
+        stream->send_window += increment;
+    }
+    stream->inflight -= increment < stream->inflight ? increment : stream->inflight;
+    stream->window_stalled = 0;
+}
+
+/**
+ * Take a token for an inbound stream open
+ *
+ * Opens are limited with a token bucket holding one second's worth of
+ * max_stream_open_rate, refilled at that rate from the clock passed to
+ * yamux_session_keepalive. Tokens are kept in thousandths so slow rates
+ * refill smoothly.
+ *
+ * @param session Session context
+ * @return 1 if the open may proceed, 0 if it exceeds the rate
+ */
+static int yamux_take_open_token(yamux_session_t *session) {
+    uint32_t rate = session->config.max_stream_open_rate;
+    uint64_t capacity, refill;
+    
+    if (rate == 0) {
+        return 1;
+    }
+    
+    capacity = (uint64_t)rate * 1000;
+    refill = (uint64_t)(session->now_ms - session->open_refill_ms) * rate;
+    session->open_refill_ms = session->now_ms;
+    if (refill >= capacity - session->open_tokens) {
+        session->open_tokens = capacity;
+    } else {
+        session->open_tokens += refill;
+    }
+    
+    if (session->open_tokens < 1000) {
+        return 0;
+    }
+    session->open_tokens -= 1000;
+    return 1;
+}
+
 /**
  * Handle a WINDOW_UPDATE frame
  * 
@@ -128,47 +463,37 @@ yamux_result_t yamux_handle_data(yamux_session_t *session, const yamux_header_t
  * @return YAMUX_OK on success, error code otherwise
  */
 yamux_result_t yamux_handle_window_update(yamux_session_t *session, const yamux_header_t *header) {
-    printf("CASCADE_DEBUG_V7_ENTRY (yamux_handle_window_update): Handling WINDOW_UPDATE for stream %u, flags: 0x%x, length: %u\n", header->stream_id, header->flags, header->length);
-
     uint32_t window_val_payload = 0; // Initialize, used if payload is present and read
 
     // Logic to determine if payload should be read and its expected length based on flags
     if (header->flags & YAMUX_FLAG_SYN && !(header->flags & YAMUX_FLAG_ACK)) { // Client is opening a stream with SYN
         if (header->length == 0) {
-            printf("DEBUG (yamux_handle_window_update): Client SYN with length 0. Peer will use its default initial window or server assumes one.\n");
             // window_val_payload remains 0, server will set its send_window for this stream to a default.
         } else if (header->length == 4) {
-            printf("DEBUG (yamux_handle_window_update): Client SYN with length 4. Reading initial window from payload.\n");
             uint8_t payload_buf[4];
-            int read_len = session->io.read(session->io.ctx, payload_buf, 4);
+            int read_len = session->io.read(session->read_ctx, payload_buf, 4);
             if (read_len != 4) {
-                printf("ERROR (yamux_handle_window_update): Failed to read 4-byte payload for SYN (len 4). Read %d.\n", read_len);
+                YAMUX_DIAG(session, "window: stream %u short SYN payload read (%d)", header->stream_id, read_len);
                 return YAMUX_ERR_IO;
             }
-            memcpy(&window_val_payload, payload_buf, sizeof(uint32_t));
-            window_val_payload = ntohl(window_val_payload);
-            printf("DEBUG (yamux_handle_window_update): Client SYN, read payload_window_value: %u\n", window_val_payload);
+            window_val_payload = yamux_decode_u32(payload_buf);
         } else {
-            printf("ERROR (yamux_handle_window_update): Invalid header length %u for client SYN. Expected 0 or 4.\n", header->length);
+            YAMUX_DIAG(session, "window: stream %u bad SYN length %u", header->stream_id, header->length);
             return YAMUX_ERR_PROTOCOL;
         }
     } else if (header->flags & (YAMUX_FLAG_FIN | YAMUX_FLAG_RST)) { // FIN or RST frame
         if (header->length == 0) {
-            printf("DEBUG (yamux_handle_window_update): FIN/RST with length 0.\n");
             // No payload for typical FIN/RST
         } else if (header->length == 4 && (header->flags & YAMUX_FLAG_ACK)) { // e.g. FIN|ACK with payload - less common
-            printf("DEBUG (yamux_handle_window_update): FIN/RST with ACK and length 4. Reading payload.\n");
             uint8_t payload_buf[4];
-            int read_len = session->io.read(session->io.ctx, payload_buf, 4);
+            int read_len = session->io.read(session->read_ctx, payload_buf, 4);
             if (read_len != 4) {
-                printf("ERROR (yamux_handle_window_update): Failed to read 4-byte payload for FIN/RST+ACK (len 4). Read %d.\n", read_len);
+                YAMUX_DIAG(session, "window: stream %u short FIN/RST payload read (%d)", header->stream_id, read_len);
                 return YAMUX_ERR_IO;
             }
-            memcpy(&window_val_payload, payload_buf, sizeof(uint32_t));
-            window_val_payload = ntohl(window_val_payload);
-            printf("DEBUG (yamux_handle_window_update): FIN/RST+ACK, read payload_window_value: %u\n", window_val_payload);
+            window_val_payload = yamux_decode_u32(payload_buf);
         } else {
-            printf("ERROR (yamux_handle_window_update): Invalid header length %u for FIN/RST. Expected 0, or 4 if ACK also set. Flags: 0x%x\n", header->length, header->flags);
+            YAMUX_DIAG(session, "window: stream %u bad FIN/RST length %u flags 0x%x", header->stream_id, header->length, header->flags);
             return YAMUX_ERR_PROTOCOL;
         }
     } else { // This covers: Pure Window Update (no other significant flags), or ACK frames (including SYN+ACK, etc.)
@@ -177,44 +502,89 @@ yamux_result_t yamux_handle_window_update(yamux_session_t *session, const yamux_
         if (header->length != 4) {
             if (header->length == 0) {
                 // Go implementation commonly sends length 0 frames for ACK and other control scenarios
-                printf("DEBUG (yamux_handle_window_update): Received frame with flags 0x%x and length 0 (Go compatibility mode)\n", header->flags);
                 window_val_payload = 0; // No window update in this case
             } else {
                 // Still reject lengths other than 0 or 4
-                printf("CASCADE_ERROR_V7_ELSE_BLOCK (yamux_handle_window_update): Invalid header length %u. Expected 4 or 0 for flags 0x%x.\n", header->length, header->flags);
+                YAMUX_DIAG(session, "window: stream %u bad length %u flags 0x%x", header->stream_id, header->length, header->flags);
                 return YAMUX_ERR_PROTOCOL;
             }
         }
         // Only read payload if length is 4 (skip if we already handled length 0 case above)
         if (header->length == 4) {
-            printf("DEBUG (yamux_handle_window_update): Reading 4-byte payload for Window Update or SYN+ACK.\n");
             uint8_t payload_buf[4];
-            int read_len = session->io.read(session->io.ctx, payload_buf, 4);
+            int read_len = session->io.read(session->read_ctx, payload_buf, 4);
             if (read_len != 4) {
-                printf("ERROR (yamux_handle_window_update): Failed to read 4-byte payload. Read %d.\n", read_len);
+                YAMUX_DIAG(session, "window: stream %u short payload read (%d)", header->stream_id, read_len);
                 return YAMUX_ERR_IO;
             }
-            memcpy(&window_val_payload, payload_buf, sizeof(uint32_t));
-            window_val_payload = ntohl(window_val_payload);
-            printf("DEBUG (yamux_handle_window_update): Read payload_window_value: %u\n", window_val_payload);
+            window_val_payload = yamux_decode_u32(payload_buf);
         }
     }
 
     yamux_stream_t *stream = yamux_get_stream(session, header->stream_id);
 
     if (header->flags & YAMUX_FLAG_SYN) {
-        printf("DEBUG (yamux_handle_window_update): SYN flag set.\n");
         if (!session->client) { // Server side: received SYN from client
-            printf("DEBUG (yamux_handle_window_update): Server received SYN for stream %u\n", header->stream_id);
             if (stream) {
-                printf("ERROR (yamux_handle_window_update): Stream %u already exists on server.\n", header->stream_id);
+                YAMUX_DIAG(session, "window: duplicate SYN for stream %u", header->stream_id);
                 // This might be a duplicate SYN, could RST or ignore.
                 return YAMUX_ERR_PROTOCOL; 
             }
 
+            /* After our GoAway the peer should open nothing new */
+            if (session->go_away_sent) {
+                YAMUX_DIAG(session, "window: stream %u refused, session is draining", header->stream_id);
+                yamux_send_rst(session, header->stream_id);
+                return YAMUX_OK;
+            }
+            
+            /* A peer may not hold more streams open than max_num_streams */
+            if (!yamux_session_stream_allowed(session)) {
+                YAMUX_DIAG(session, "window: stream %u refused, stream limit", header->stream_id);
+                yamux_send_rst(session, header->stream_id);
+                return YAMUX_OK;
+            }
+            
+            /* Refuse opens beyond max_stream_open_rate until the bucket refills */
+            if (!yamux_take_open_token(session)) {
+                YAMUX_DIAG(session, "window: stream %u refused, open rate limit", header->stream_id);
+                yamux_send_rst(session, header->stream_id);
+                return YAMUX_OK;
+            }
+            
+            /* Beyond accept_backlog the stream is refused, or queued without its SYN-ACK */
+            int defer_ack = 0;
+            if (!(session->control_cb && header->stream_id == session->control_stream_id) &&
+                yamux_accept_queue_full(session)) {
+                if (session->config.accept_overflow_policy == YAMUX_ACCEPT_OVERFLOW_CLOSE_SESSION) {
+                    YAMUX_DIAG(session, "window: stream %u beyond accept backlog of %u (protocol error %d)",
+                               header->stream_id, session->config.accept_backlog, YAMUX_PROTOCOL_ERROR);
+                    session->close_error = YAMUX_ERR_ACK_BACKLOG_EXCEEDED;
+                    yamux_session_close(session, YAMUX_PROTOCOL_ERROR);
+                    return YAMUX_ERR_ACK_BACKLOG_EXCEEDED;
+                }
+                if (session->config.accept_overflow_policy != YAMUX_ACCEPT_OVERFLOW_DEFER_ACK) {
+                    YAMUX_DIAG(session, "window: stream %u refused, accept queue full", header->stream_id);
+                    yamux_send_rst(session, header->stream_id);
+                    return YAMUX_OK;
+                }
+                YAMUX_DIAG(session, "window: stream %u queued unacknowledged, accept queue full", header->stream_id);
+                defer_ack = 1;
+            }
+
             // Create a new stream structure for the incoming client stream
-            stream = (yamux_stream_t *)malloc(sizeof(yamux_stream_t));
-            if (!stream) return YAMUX_ERR_NOMEM;
+            if (!yamux_session_memory_allows(session, sizeof(yamux_stream_t) + YAMUX_INITIAL_BUFFER_SIZE)) {
+                YAMUX_DIAG(session, "window: stream %u refused, memory limit", header->stream_id);
+                yamux_send_rst(session, header->stream_id);
+                return YAMUX_OK;
+            }
+            stream = (yamux_stream_t *)yamux_mem_alloc(sizeof(yamux_stream_t));
+            if (!stream) {
+                /* Refuse the stream but keep the session */
+                YAMUX_DIAG(session, "window: stream %u refused, out of memory", header->stream_id);
+                yamux_send_rst(session, header->stream_id);
+                return YAMUX_OK;
+            }
             memset(stream, 0, sizeof(yamux_stream_t));
 
             stream->session = session;
@@ -227,46 +597,52 @@ yamux_result_t yamux_handle_window_update(yamux_session_t *session, const yamux_
             stream->send_window = (header->length == 0 && (header->flags & YAMUX_FLAG_SYN) && !(header->flags & YAMUX_FLAG_ACK)) 
                                    ? session->config.max_stream_window_size 
                                    : window_val_payload;
-            stream->recv_window = session->config.max_stream_window_size; // Our initial recv_window for the client
-
-            printf("DEBUG (yamux_handle_window_update): New stream %u created (server). send_window: %u, recv_window: %u\n", 
-                   stream->id, stream->send_window, stream->recv_window);
+            stream->peer_window = stream->send_window;
+            stream->peer_window_known = 1;
+            // Our initial recv_window for the client, plus any bonus so uploads can ramp before the first update
+            stream->recv_window = session->config.max_stream_window_size;
+            stream->recv_window_max = stream->recv_window ? stream->recv_window : YAMUX_DEFAULT_WINDOW_SIZE;
+            if (session->config.accept_initial_window_bonus > UINT32_MAX - stream->recv_window) {
+                stream->recv_window = UINT32_MAX;
+            } else {
+                stream->recv_window += session->config.accept_initial_window_bonus;
+            }
 
             if (yamux_buffer_init(&stream->recvbuf, YAMUX_INITIAL_BUFFER_SIZE) != YAMUX_OK) {
-                free(stream);
-                return YAMUX_ERR_NOMEM;
+                YAMUX_DIAG(session, "window: stream %u refused, out of memory", header->stream_id);
+                yamux_mem_free(stream);
+                yamux_send_rst(session, header->stream_id);
+                return YAMUX_OK;
             }
-            if (yamux_add_stream(session, stream) != YAMUX_OK) {
+            yamux_result_t add_result = yamux_add_stream(session, stream);
+            if (add_result != YAMUX_OK) {
                 yamux_buffer_free(&stream->recvbuf);
-                free(stream);
+                yamux_mem_free(stream);
+                if (add_result == YAMUX_ERR_NOMEM) {
+                    YAMUX_DIAG(session, "window: stream %u refused, out of memory", header->stream_id);
+                    yamux_send_rst(session, header->stream_id);
+                    return YAMUX_OK;
+                }
                 return YAMUX_ERR_INTERNAL;
             }
 
-            // Send SYN-ACK back to client
-            yamux_header_t resp_header;
-            resp_header.version = YAMUX_PROTO_VERSION;
-            resp_header.type = YAMUX_WINDOW_UPDATE;
-            resp_header.flags = YAMUX_FLAG_SYN | YAMUX_FLAG_ACK;
-            resp_header.stream_id = stream->id;
-            resp_header.length = 4; // Payload is our initial window size (4 bytes)
-
-            uint8_t frame_buf[YAMUX_HEADER_SIZE + 4];
-            yamux_encode_header(&resp_header, frame_buf);
-            
-            /* Use the server's recv_window (which is non-zero) in the payload */
-            uint32_t net_recv_window = htonl(stream->recv_window);
-            memcpy(frame_buf + YAMUX_HEADER_SIZE, &net_recv_window, sizeof(net_recv_window));
-
-            printf("DEBUG (yamux_handle_window_update): Server sending SYN-ACK for stream %u, payload_window: %u\n", stream->id, stream->recv_window);
-            if (session->io.write(session->io.ctx, frame_buf, sizeof(frame_buf)) != sizeof(frame_buf)) {
-                printf("ERROR (yamux_handle_window_update): io.write failed for SYN-ACK\n");
+            // Send SYN-ACK back to client, unless it waits for room in the accept queue
+            if (defer_ack) {
+                stream->ack_deferred = 1;
+            } else if (yamux_send_syn_ack(session, stream) != YAMUX_OK) {
                 // Error sending SYN-ACK, cleanup stream?
                 yamux_remove_stream(session, stream->id); // This will free buffer and stream
                 return YAMUX_ERR_IO;
             }
             /* Keep stream state as SYN_RECV until we receive ACK from client */
             /* stream state should remain at YAMUX_STREAM_SYN_RECV (set at line 221) */
-            printf("DEBUG (yamux_handle_window_update): Server stream %u SYN_RECV after sending SYN-ACK.\n", stream->id);
+
+            /* The reserved control stream is accepted here rather than queued */
+            if (session->control_cb && stream->id == session->control_stream_id) {
+                YAMUX_DIAG(session, "window: stream %u opened as the control stream", stream->id);
+                stream->control = 1;
+                return YAMUX_OK;
+            }
 
             // Enqueue for accept by application if not already handled by a direct accept call
             // This logic might need refinement based on how yamux_accept_stream is used
@@ -276,92 +652,63 @@ yamux_result_t yamux_handle_window_update(yamux_session_t *session, const yamux_
 
         } else { // Client side: This case should not happen if SYN is only sent by client opening stream
                  // However, if it's a SYN-ACK (SYN|ACK), it will be handled below.
-            printf("WARN (yamux_handle_window_update): Client received a frame with only SYN flag. This is unexpected.\n");
+            YAMUX_DIAG(session, "window: unexpected SYN for stream %u on client", header->stream_id);
         }
     }
 
     // Handle ACK flag (part of SYN-ACK for client, or standalone ACK for other purposes if defined)
     if (header->flags & YAMUX_FLAG_ACK) {
-        printf("DEBUG (yamux_handle_window_update): ACK flag set.\n");
         if (stream) {
             if (session->client && stream->state == YAMUX_STREAM_SYN_SENT && (header->flags & YAMUX_FLAG_SYN)) { // Client received SYN-ACK
-                printf("DEBUG (yamux_handle_window_update): Client received SYN-ACK for stream %u\n", stream->id);
                 stream->send_window = window_val_payload; // Server's initial recv_window is our send_window
+                stream->peer_window = window_val_payload;
+                stream->peer_window_known = 1;
                 stream->state = YAMUX_STREAM_ESTABLISHED;
-                printf("DEBUG (yamux_handle_window_update): Client stream %u ESTABLISHED. send_window updated to %u.\n", stream->id, stream->send_window);
+                if (stream->id > session->last_acked_stream_id) {
+                    session->last_acked_stream_id = stream->id;
+                }
             } else if (!session->client && stream->state == YAMUX_STREAM_SYN_RECV && !(header->flags & YAMUX_FLAG_SYN)) { // Server received ACK (after sending SYN-ACK)
-                printf("DEBUG (yamux_handle_window_update): Server received ACK for stream %u\n", stream->id);
                 stream->state = YAMUX_STREAM_ESTABLISHED;
-                printf("DEBUG (yamux_handle_window_update): Server stream %u ESTABLISHED after receiving ACK.\n", stream->id);
-            } else if (stream->state == YAMUX_STREAM_FIN_SENT && (header->flags & YAMUX_FLAG_FIN)) {
-                 // Handle FIN-ACK for stream closing
-                 printf("DEBUG (yamux_handle_window_update): FIN-ACK received for stream %u. Changing state to CLOSED.\n", stream->id);
-                 stream->state = YAMUX_STREAM_CLOSED;
-                 // yamux_remove_stream might be called later by a cleanup task or when all data is read
             } else {
                 // Other ACK scenarios, if any (e.g., ACK for data, though Yamux doesn't use explicit data ACKs like TCP)
-                printf("DEBUG (yamux_handle_window_update): Received ACK for stream %u in state %d. No specific action taken.\n", stream->id, stream->state);
             }
         } else {
-            printf("WARN (yamux_handle_window_update): Received ACK for non-existent stream %u\n", header->stream_id);
+            YAMUX_DIAG(session, "window: ACK for unknown stream %u", header->stream_id);
             // Potentially send RST if an ACK is for an unknown stream
         }
     }
 
-    // Handle regular window update (no SYN, no ACK or ACK already processed)
-    // This is when the remote party is granting more send window to us.
-    if (!(header->flags & YAMUX_FLAG_SYN) && !(header->flags & YAMUX_FLAG_ACK)) {
+    // Handle regular window update, including one that carries an ACK for the stream.
+    // This is when the remote party is granting more send window to us; a SYN-ACK
+    // sets the initial window above instead.
+    if (!(header->flags & YAMUX_FLAG_SYN)) {
         if (stream) {
-            stream->send_window += window_val_payload;
-            printf("DEBUG (yamux_handle_window_update): Stream %u send_window increased by %u to %u\n", 
-                   stream->id, window_val_payload, stream->send_window);
+            yamux_grant_send_window(session, stream, window_val_payload);
         } else {
-            printf("WARN (yamux_handle_window_update): Window update for non-existent stream %u\n", header->stream_id);
+            YAMUX_DIAG(session, "window: update for unknown stream %u", header->stream_id);
             // Potentially send RST
         }
     }
     
-    // If FIN flag is set (and not part of SYN-ACK or other combined flags handled above)
-    if (header->flags & YAMUX_FLAG_FIN && !(header->flags & YAMUX_FLAG_ACK) && !(header->flags & YAMUX_FLAG_SYN)) {
-        printf("DEBUG (yamux_handle_window_update): FIN flag set (standalone).\n");
+    // A FIN closes the peer's side just as on a DATA frame, with or without an ACK. A SYN|FIN
+    // opens the stream above and half-closes it at once: the peer opened a stream and has
+    // nothing to send.
+    if (header->flags & YAMUX_FLAG_FIN) {
         if (stream) {
-            stream->state = YAMUX_STREAM_FIN_RECV;
-            printf("DEBUG (yamux_handle_window_update): Stream %u received FIN. State changed to FIN_RECV.\n", stream->id);
-            // Application should see EOF on read. Send FIN-ACK back.
-            yamux_header_t resp_header;
-            resp_header.version = YAMUX_PROTO_VERSION;
-            resp_header.type = YAMUX_WINDOW_UPDATE; // Or PING type with FIN|ACK as per some implementations
-            resp_header.flags = YAMUX_FLAG_FIN | YAMUX_FLAG_ACK;
-            resp_header.stream_id = stream->id;
-            resp_header.length = 0; // FIN-ACK typically has no payload
-
-            uint8_t frame_buf[YAMUX_HEADER_SIZE];
-            yamux_encode_header(&resp_header, frame_buf);
-
-            printf("DEBUG (yamux_handle_window_update): Sending FIN-ACK for stream %u\n", stream->id);
-            if (session->io.write(session->io.ctx, frame_buf, sizeof(frame_buf)) != sizeof(frame_buf)) {
-                printf("ERROR (yamux_handle_window_update): io.write failed for FIN-ACK\n");
-                return YAMUX_ERR_IO;
-            }
-            // If we also sent FIN previously, and now received FIN, then can move to CLOSED.
-            // This part of state machine needs careful review with yamux_close behavior.
-        } else {
-            printf("WARN (yamux_handle_window_update): FIN for non-existent stream %u\n", header->stream_id);
+            yamux_handle_fin(session, stream, header);
+            // The peer FIN callback may have closed the stream, or the FIN freed it
+            stream = yamux_get_stream(session, header->stream_id);
+        } else if (yamux_handle_unknown_fin(session, header->stream_id) != YAMUX_OK) {
+            return YAMUX_ERR_PROTOCOL;
         }
     }
 
     // Handle RST flag
     if (header->flags & YAMUX_FLAG_RST) {
-        printf("DEBUG (yamux_handle_window_update): RST flag set.\n");
         if (stream) {
-            printf("DEBUG (yamux_handle_window_update): Stream %u received RST. Closing stream.\n", stream->id);
-            stream->state = YAMUX_STREAM_CLOSED; // Or a specific RST state
-            // Notify application, cleanup stream resources.
-            // Consider calling yamux_remove_stream or marking for removal.
-            // For now, just change state. The test might not cover RST fully.
-            yamux_remove_stream(session, stream->id); // Proactively remove and free
+            yamux_handle_peer_reset(session, stream);
         } else {
-            printf("WARN (yamux_handle_window_update): RST for non-existent stream %u\n", header->stream_id);
+            YAMUX_DIAG(session, "window: RST for unknown stream %u", header->stream_id);
         }
     }
 
@@ -376,8 +723,13 @@ yamux_result_t yamux_handle_window_update(yamux_session_t *session, const yamux_
  * @return YAMUX_OK on success, error code otherwise
  */
 yamux_result_t yamux_handle_ping(yamux_session_t *session, const yamux_header_t *header) {
-    uint8_t ping_data[8] = {0};
-    int bytes_read;
+    uint8_t echo[32];
+    uint8_t response_buf[YAMUX_HEADER_SIZE];
+    yamux_header_t response;
+    uint32_t remaining;
+    uint32_t sent_ms;
+    uint32_t tag;
+    size_t chunk;
     
     /* Validate session and header */
     if (!session || !header) {
@@ -385,42 +737,62 @@ yamux_result_t yamux_handle_ping(yamux_session_t *session, const yamux_header_t
     }
     
     /* Check if it's a ping request or response */
-    if (header->flags & YAMUX_FLAG_ACK) {
-        /* Ping response, nothing to do */
+    if ((header->flags & YAMUX_FLAG_ACK) && header->length == 4) {
+        /* Response to a tagged ping; an unknown or repeated tag changes nothing */
+        if (session->io.read(session->read_ctx, echo, 4) != 4) {
+            return YAMUX_ERR_IO;
+        }
+        tag = yamux_decode_u32(echo);
+        if (!yamux_ping_tag_take(session, tag, &sent_ms)) {
+            YAMUX_DIAG(session, "ping: stray ACK for tag %u ignored", tag);
+            return YAMUX_OK;
+        }
+        session->ping_outstanding = 0;
+        session->last_rtt_ms = session->now_ms - sent_ms;
+        session->rtt_known = 1;
         return YAMUX_OK;
     }
-    
-    /* Ping request, read the data if any */
-    if (header->length > 0) {
-        bytes_read = session->io.read(session->io.ctx, ping_data, (header->length < 8) ? header->length : 8);
-        if (bytes_read < 0) {
-            return YAMUX_ERR_IO;
+    if (header->flags & YAMUX_FLAG_ACK) {
+        /* Ping response: the peer is alive */
+        session->ping_outstanding = 0;
+        if (session->pings_pending > 0) {
+            session->pings_pending--;
+        }
+        if (session->ping_timing) {
+            session->ping_timing = 0;
+            session->last_rtt_ms = session->now_ms - session->ping_sent_ms;
+            session->rtt_known = 1;
         }
+        
+        /* Our pings carry no data, but drop any echo so the next header lines up */
+        return yamux_discard_payload(session, header->length);
     }
     
     /* Send a ping response */
-    yamux_header_t response = {
-        .version = YAMUX_PROTO_VERSION,
-        .type = YAMUX_PING,
-        .flags = YAMUX_FLAG_ACK,
-        .stream_id = 0,
-        .length = header->length
-    };
+    memset(&response, 0, sizeof(response));
+    response.version = YAMUX_PROTO_VERSION;
+    response.type = YAMUX_PING;
+    response.flags = YAMUX_FLAG_ACK;
+    response.stream_id = 0;
+    response.length = header->length;
     
     /* Encode the header */
-    yamux_encode_header(&response, session->recv_buf);
+    yamux_encode_header(&response, response_buf);
     
     /* Send the header */
-    if (session->io.write(session->io.ctx, session->recv_buf, 8) != 8) {
+    if (session->io.write(session->write_ctx, response_buf, YAMUX_HEADER_SIZE) != YAMUX_HEADER_SIZE) {
         return YAMUX_ERR_IO;
     }
     
-    /* Send the ping data if any */
-    if (header->length > 0) {
-        ssize_t written = session->io.write(session->io.ctx, ping_data, header->length);
-        if (written < 0 || (size_t)written != header->length) {
+    /* Reflect the ping data, if any, a piece at a time */
+    remaining = header->length;
+    while (remaining > 0) {
+        chunk = remaining < sizeof(echo) ? remaining : sizeof(echo);
+        if (session->io.read(session->read_ctx, echo, chunk) != (int)chunk ||
+            session->io.write(session->write_ctx, echo, chunk) != (int)chunk) {
             return YAMUX_ERR_IO;
         }
+        remaining -= (uint32_t)chunk;
     }
     
     return YAMUX_OK;
@@ -434,8 +806,8 @@ yamux_result_t yamux_handle_ping(yamux_session_t *session, const yamux_header_t
  * @return YAMUX_OK on success, error code otherwise
  */
 yamux_result_t yamux_handle_go_away(yamux_session_t *session, const yamux_header_t *header) {
+    uint8_t reason_buf[4];
     int bytes_read;
-    /* Parse reason code but we don't need to use it */
     
     /* Validate session and header */
     if (!session || !header) {
@@ -448,7 +820,7 @@ yamux_result_t yamux_handle_go_away(yamux_session_t *session, const yamux_header
     }
     
     /* Read the reason */
-    bytes_read = session->io.read(session->io.ctx, session->recv_buf, 4);
+    bytes_read = session->io.read(session->read_ctx, reason_buf, sizeof(reason_buf));
     if (bytes_read < 0) {
         return YAMUX_ERR_IO;
     }
@@ -459,11 +831,14 @@ yamux_result_t yamux_handle_go_away(yamux_session_t *session, const yamux_header
         return YAMUX_ERR_IO;
     }
     
-    /* Parse the reason (big-endian), but we don't need to store it
-     * We just need to read the reason bytes from the socket */
-    
-    /* Mark the session as going away */
+    /* Mark the session as going away; codes we do not know still mean a graceful close */
     session->go_away_received = 1;
+    session->go_away_code = yamux_decode_u32(reason_buf);
+    if (session->go_away_code > YAMUX_INTERNAL_ERROR) {
+        YAMUX_DIAG(session, "go away: peer sent GoAway with unknown code 0x%08x", session->go_away_code);
+    } else {
+        YAMUX_DIAG(session, "go away: peer sent GoAway (code %u)", session->go_away_code);
+    }
     
     return YAMUX_OK;
 }
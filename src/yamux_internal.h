@@ -8,6 +8,37 @@
 
 // #include "../include/yamux.h" // Removed to avoid opaque type conflict
 #include "yamux_defs.h"
+#include "../include/yamux_config.h"
+#include <signal.h>
+
+/*
+ * Flags another thread may set, such as a stream's interrupt. GCC and Clang
+ * builtins or C11 atomics make them safe to share between threads; other
+ * compilers get a volatile flag, which only an interrupt handler on the
+ * same core may set safely.
+ */
+#if defined(__GNUC__) || defined(__clang__)
+typedef int yamux_atomic_t;
+#define YAMUX_ATOMIC_SET(flag)  __atomic_store_n(&(flag), 1, __ATOMIC_SEQ_CST)
+#define YAMUX_ATOMIC_GET(flag)  __atomic_load_n(&(flag), __ATOMIC_SEQ_CST)
+#define YAMUX_ATOMIC_TAKE(flag) __atomic_exchange_n(&(flag), 0, __ATOMIC_SEQ_CST)
+#elif defined(__STDC_VERSION__) && __STDC_VERSION__ >= 201112L && !defined(__STDC_NO_ATOMICS__)
+#include <stdatomic.h>
+typedef atomic_int yamux_atomic_t;
+#define YAMUX_ATOMIC_SET(flag)  atomic_store(&(flag), 1)
+#define YAMUX_ATOMIC_GET(flag)  atomic_load(&(flag))
+#define YAMUX_ATOMIC_TAKE(flag) atomic_exchange(&(flag), 0)
+#else
+typedef volatile sig_atomic_t yamux_atomic_t;
+#define YAMUX_ATOMIC_SET(flag)  ((flag) = 1)
+#define YAMUX_ATOMIC_GET(flag)  (flag)
+#define YAMUX_ATOMIC_TAKE(flag) yamux_atomic_take(&(flag))
+static inline int yamux_atomic_take(yamux_atomic_t *flag) {
+    int was = *flag;
+    *flag = 0;
+    return was;
+}
+#endif
 
 /* Forward declarations */
 struct yamux_stream;
@@ -15,25 +46,90 @@ struct yamux_stream;
 /* Session structure */
 struct yamux_session {
     yamux_io_t io;                  /* I/O callbacks */
+    void *read_ctx;                 /* Context passed to io.read */
+    void *write_ctx;                /* Context passed to io.write */
     int client;                     /* 1 if client mode, 0 if server mode */
     
     uint32_t next_stream_id;        /* Next stream ID to use */
     uint32_t remote_window;         /* Remote receive window size */
     uint32_t go_away_received;      /* Whether go away has been received */
+    uint32_t go_away_code;          /* Raw error code from the peer's GoAway */
+    int shutdown;                   /* Whether the session was closed locally */
+    yamux_result_t close_error;     /* Why the session closed with an error, YAMUX_OK if it did not */
+    int go_away_sent;               /* GoAway sent; open streams may still finish */
+    int transport_failed;           /* Transport read or write failed; no further IO is attempted */
+    int transport_reset;            /* The transport failed by being reset */
+    uint32_t last_acked_stream_id;  /* Highest locally opened stream the peer ACKed, 0 if none */
     
     yamux_stream_t **streams;       /* Array of active streams */
     size_t stream_count;            /* Number of active streams */
     size_t stream_capacity;         /* Capacity of streams array */
+    size_t stream_live;             /* Streams in the array, not counting empty slots */
+    uint32_t *stream_index;         /* Open-addressed map from stream ID to streams slot + 1, 0 if empty */
+    size_t stream_index_size;       /* Entries in stream_index, twice stream_capacity */
+    uint32_t *stream_free;          /* Stack of empty streams slots, stream_capacity entries; slots at or past stream_count are stale */
+    size_t stream_free_count;       /* Entries in stream_free */
+    yamux_stream_t *held_streams;   /* Streams that may have held writes, see yamux_held_list_add */
+    size_t stream_memory;           /* Bytes held by the streams in the table and their buffers */
     
     yamux_stream_t *accept_queue;   /* Queue of streams pending accept */
     
     yamux_config_t config;          /* Session configuration */
-    uint32_t last_ping_id;          /* ID of the last ping sent */
+    uint32_t last_ping_id;          /* Opaque value of the last tagged ping sent */
+    uint32_t ping_tags[YAMUX_MAX_TAGGED_PINGS];    /* Tagged pings awaiting ACK, oldest first */
+    uint32_t ping_tag_sent_ms[YAMUX_MAX_TAGGED_PINGS]; /* now_ms when each tagged ping was sent */
+    uint32_t ping_tag_count;        /* Entries in ping_tags */
     int keepalive_enabled;          /* Whether keepalive is enabled */
     uint32_t keepalive_interval;    /* Keepalive interval in milliseconds */
+    uint32_t keepalive_last_ms;     /* Time the last keepalive ping was due */
+    int keepalive_started;          /* Whether keepalive_last_ms is set */
+    int ping_outstanding;           /* A keepalive ping awaits its ACK */
+    int keepalive_failed;           /* Peer missed a keepalive ping */
+    uint32_t now_ms;                /* Latest time the application reported */
+    uint32_t ping_sent_ms;          /* now_ms when the timed ping was sent */
+    uint32_t pings_pending;         /* Pings sent and not yet answered */
+    uint32_t last_frame_ms;         /* now_ms when a frame last arrived */
+    int clock_started;              /* Whether now_ms has been reported */
+    int ping_timing;                /* A ping awaits its ACK for an RTT sample */
+    uint32_t last_rtt_ms;           /* Round-trip time of the last answered ping */
+    int rtt_known;                  /* Whether last_rtt_ms is set */
+    uint64_t open_tokens;           /* Inbound stream opens allowed now, in thousandths */
+    uint32_t open_refill_ms;        /* now_ms when open_tokens was last refilled */
     
     uint8_t *recv_buf;              /* Temporary receive buffer */
     size_t recv_buf_size;           /* Size of receive buffer */
+    uint8_t *frame_pool;            /* Preallocated frame buffers, YAMUX_MAX_DATA_FRAME_SIZE each */
+    uint8_t **frame_pool_free;      /* Stack of pool buffers not in use */
+    size_t frame_pool_available;    /* Number of entries in frame_pool_free */
+    
+    yamux_peer_fin_callback_t peer_fin_cb; /* Peer half-close callback */
+    void *peer_fin_ctx;             /* User context for peer_fin_cb */
+    yamux_frame_trace_callback_t trace_cb; /* Received frame header callback */
+    void *trace_ctx;                /* User context for trace_cb */
+    uint32_t trace_window_ms;       /* now_ms when the current trace budget second began */
+    uint32_t trace_events;          /* Trace events in that second, budget + 1 once dropping */
+    uint32_t trace_dropped;         /* Trace events dropped over the budget */
+    yamux_window_update_callback_t window_update_cb; /* Window update sent callback */
+    void *window_update_ctx;        /* User context for window_update_cb */
+    yamux_accept_classify_callback_t accept_classify_cb; /* Accept priority callback */
+    void *accept_classify_ctx;      /* User context for accept_classify_cb */
+    uint32_t control_stream_id;     /* Stream ID reserved for control_cb */
+    yamux_control_callback_t control_cb; /* Control stream data callback */
+    void *control_ctx;              /* User context for control_cb */
+    yamux_data_callback_t data_cb;  /* Push delivery of stream data, may be NULL */
+    void *data_ctx;                 /* User context for data_cb */
+    yamux_wait_callback_t wait_cb;  /* Waits for the transport, may be NULL */
+    void *wait_ctx;                 /* User context for wait_cb */
+    yamux_wake_callback_t wake_cb;  /* Ends a wait_cb early, may be NULL */
+    void *wake_ctx;                 /* User context for wake_cb */
+    int callback_depth;             /* Nesting of application callbacks in progress */
+    int teardown_pending;           /* Streams to free once callbacks return */
+    
+#ifndef YAMUX_MINIMAL
+    char diag_ring[YAMUX_DIAG_RING_SIZE][YAMUX_DIAG_MSG_SIZE]; /* Recent diagnostics */
+    size_t diag_next;               /* Ring slot for the next message */
+    size_t diag_count;              /* Number of messages in the ring */
+#endif
 };
 
 /* Yamux context structure (exposed via opaque pointer in public API) */
@@ -43,6 +139,7 @@ typedef struct yamux_context {
     yamux_io_t io;                /* I/O callbacks */
     int is_client;                /* Client or server mode */
     yamux_config_t config;        /* Configuration */
+    int destroy_pending;          /* yamux_destroy was called from a callback */
 } yamux_context_t;
 
 /* Stream structure */
@@ -55,6 +152,7 @@ typedef struct {
     size_t size;                  /* Total size of the buffer */
     size_t used;                  /* Used bytes in the buffer */
     size_t pos;                   /* Current read position */
+    size_t *account;              /* Byte count kept in step with size, NULL for none */
 } yamux_buffer_t;
 
 /* Stream structure */
@@ -64,15 +162,44 @@ struct yamux_stream {
     yamux_stream_state_t state;     /* Stream state */
     
     yamux_buffer_t recvbuf;        /* Receive buffer */
+    yamux_buffer_t sendbuf;        /* Small writes held until they fill a frame */
     uint32_t send_window;          /* Send window size */
+    uint32_t inflight;             /* Bytes sent that no window update has covered yet */
     uint32_t recv_window;          /* Receive window size */
+    uint32_t recv_window_max;      /* Window restored as the application reads */
+    uint32_t peer_window;          /* Initial window advertised by peer */
+    int peer_window_known;         /* Whether peer_window has been received */
+    int peer_fin_notified;         /* Whether peer FIN callback has fired */
+    int control;                   /* Data goes to the session's control callback */
+    yamux_reset_reason_t reset_reason; /* Why the stream was reset; late data is dropped */
+    int window_stalled;            /* A write is waiting for the peer to grant window */
+    uint32_t stall_since_ms;       /* Session now_ms when the write started waiting */
+    uint32_t held_since_ms;        /* Session now_ms when the oldest held write was made */
+    int flush_blocked;             /* The last attempt to send held data found the transport full */
+    int recv_paused;               /* Withhold window updates from the peer */
+    uint32_t read_timeout_ms;      /* How long each read waits for data, 0 to not wait */
+    int ack_deferred;              /* SYN-ACK withheld while the accept queue was full */
+    int accept_classified;         /* accept_priority has been assigned */
+    int accept_priority;           /* Priority from the accept classify callback */
+    size_t largest_write;          /* Most bytes accepted by one write */
+    uint32_t window_splits;        /* Writes cut short by the send window */
+    yamux_atomic_t interrupt_read;  /* Pending interrupt for next read, set from any thread */
+    yamux_atomic_t interrupt_write; /* Pending interrupt for next write, set from any thread */
+    struct yamux_stream **owner;   /* Handle slot cleared when the stream is freed */
+    int released;                  /* The application is done with it; freed once CLOSED */
+    char label[YAMUX_STREAM_LABEL_SIZE]; /* Application-defined name, may be empty */
     
     struct yamux_stream *next;     /* Next stream in accept queue */
+    struct yamux_stream *held_prev; /* Previous stream in the session's held-write list */
+    struct yamux_stream *held_next; /* Next stream in the session's held-write list */
+    int held_listed;               /* Whether the stream is in the held-write list */
 };
 
 /* Frame encoding/decoding functions */
 yamux_result_t yamux_encode_header(const yamux_header_t *header, uint8_t *buffer);
 yamux_result_t yamux_decode_header(const uint8_t *buffer, size_t buffer_len, yamux_header_t *header);
+void yamux_encode_u32(uint32_t value, uint8_t *buffer);
+uint32_t yamux_decode_u32(const uint8_t *buffer);
 
 /* Frame handling functions */
 yamux_result_t yamux_handle_data(struct yamux_session *session, const yamux_header_t *header);
@@ -82,13 +209,56 @@ yamux_result_t yamux_handle_go_away(struct yamux_session *session, const yamux_h
 
 /* Core session processing function */
 yamux_result_t yamux_session_process(yamux_session_t *session);
+yamux_result_t yamux_session_io_error(struct yamux_session *session, int io_result);
+uint8_t *yamux_frame_buffer_take(struct yamux_session *session, size_t len);
+void yamux_frame_buffer_give(struct yamux_session *session, uint8_t *buf);
 
 /* Stream management functions */
+yamux_result_t yamux_stream_new(struct yamux_session *session, uint32_t stream_id, yamux_stream_t **stream);
+yamux_result_t yamux_stream_index_init(struct yamux_session *session, size_t size);
 yamux_stream_t *yamux_get_stream(struct yamux_session *session, uint32_t stream_id);
 yamux_result_t yamux_add_stream(struct yamux_session *session, yamux_stream_t *stream);
 yamux_result_t yamux_remove_stream(struct yamux_session *session, uint32_t stream_id);
+void yamux_stream_destroy(struct yamux_session *session, yamux_stream_t *stream);
+int yamux_stream_reap(struct yamux_session *session, yamux_stream_t *stream);
+void yamux_held_list_add(struct yamux_session *session, yamux_stream_t *stream);
+void yamux_held_list_remove(struct yamux_session *session, yamux_stream_t *stream);
 yamux_result_t yamux_enqueue_stream(struct yamux_session *session, yamux_stream_t *stream);
 yamux_result_t yamux_enqueue_stream_for_accept(struct yamux_session *session, yamux_stream_t *stream);
+int yamux_accept_queue_full(struct yamux_session *session);
+void yamux_send_deferred_acks(struct yamux_session *session);
+yamux_result_t yamux_send_syn_ack(struct yamux_session *session, yamux_stream_t *stream);
+void yamux_notify_peer_fin(struct yamux_session *session, yamux_stream_t *stream);
+void yamux_reset_stream(struct yamux_session *session, yamux_stream_t *stream, yamux_reset_reason_t reason);
+yamux_stream_t *yamux_stream_deliver_data(yamux_stream_t *stream);
+yamux_result_t yamux_stream_read_available(yamux_stream_t *stream, uint8_t *buf, size_t len, size_t *bytes_read);
+yamux_result_t yamux_stream_grant_window(yamux_stream_t *stream, uint32_t delta);
+
+/* Memory accounting against max_session_memory */
+int yamux_session_memory_allows(struct yamux_session *session, size_t extra);
+int yamux_session_stream_allowed(struct yamux_session *session);
+
+/* Outstanding tagged pings */
+int yamux_ping_tag_pending(struct yamux_session *session, uint32_t tag);
+int yamux_ping_tag_take(struct yamux_session *session, uint32_t tag, uint32_t *sent_ms);
+
+/* Session teardown functions */
+void yamux_session_release_streams(struct yamux_session *session);
+size_t yamux_session_finish_streams(struct yamux_session *session, uint32_t timeout_ms);
+void yamux_session_free(struct yamux_session *session);
+
+/* Diagnostics functions (compiled out under YAMUX_MINIMAL) */
+#ifndef YAMUX_MINIMAL
+void yamux_diag(struct yamux_session *session, const char *format, ...);
+#define YAMUX_DIAG(...) yamux_diag(__VA_ARGS__)
+#else
+#define YAMUX_DIAG(session, ...) ((void)(session))
+#endif
+
+/* Memory functions routed through the allocator set by yamux_set_allocator */
+void *yamux_mem_alloc(size_t size);
+void *yamux_mem_realloc(void *ptr, size_t size);
+void yamux_mem_free(void *ptr);
 
 /* Buffer management functions */
 yamux_result_t yamux_buffer_init(yamux_buffer_t *buffer, size_t initial_size);
@@ -96,5 +266,6 @@ void yamux_buffer_free(yamux_buffer_t *buffer);
 yamux_result_t yamux_buffer_write(yamux_buffer_t *buffer, const uint8_t *data, size_t len);
 yamux_result_t yamux_buffer_read(yamux_buffer_t *buffer, uint8_t *data, size_t len, size_t *bytes_read);
 yamux_result_t yamux_buffer_compact(yamux_buffer_t *buffer);
+size_t yamux_buffer_growth(const yamux_buffer_t *buffer, size_t len);
 
 #endif /* YAMUX_INTERNAL_H */
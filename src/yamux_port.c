@@ -9,9 +9,9 @@
 
 #include "../include/yamux.h"
 #include "yamux_internal.h"
-#include <stdio.h>
 #include <stdlib.h>
 #include <string.h>
+#include <limits.h>
 
 /**
  * Stream context structure
@@ -44,7 +44,7 @@ void* yamux_init(
     yamux_result_t result;
     
     /* Allocate context structure */
-    ctx = (yamux_context_t *)malloc(sizeof(yamux_context_t));
+    ctx = (yamux_context_t *)yamux_mem_alloc(sizeof(yamux_context_t));
     if (!ctx) {
         return NULL;
     }
@@ -62,12 +62,9 @@ void* yamux_init(
     /* Create internal Yamux session */
     result = yamux_session_create(&ctx->io, is_client, &ctx->config, &ctx->session);
     if (result != YAMUX_OK) {
-        free(ctx);
+        yamux_mem_free(ctx);
         return NULL;
     }
-
-    fprintf(stderr, "DEBUG: yamux_init (in yamux_port.c): created ctx = %p, ctx->session = %p\n", (void*)ctx, (void*)ctx->session);
-    fflush(stderr);
     
     return ctx;
 }
@@ -75,6 +72,10 @@ void* yamux_init(
 /**
  * Destroy a Yamux session
  * 
+ * Streams are reset and freed; stream handles the application still holds
+ * are detached and must be released with yamux_close_stream. When called
+ * from a callback, teardown is deferred until yamux_process returns.
+ * 
  * @param session Session handle returned by yamux_init
  */
 void yamux_destroy(void *session)
@@ -85,13 +86,45 @@ void yamux_destroy(void *session)
         return;
     }
     
-    /* Close internal session */
-    if (ctx->session) {
+    /* A callback is on the stack: the handler still needs the session */
+    if (ctx->session && ctx->session->callback_depth > 0) {
+        ctx->destroy_pending = 1;
         yamux_session_close(ctx->session, YAMUX_NORMAL);
+        return;
+    }
+    
+    /* Close and free internal session */
+    if (ctx->session) {
+        yamux_session_free(ctx->session);
+        ctx->session = NULL;
     }
     
     /* Free resources */
-    free(ctx);
+    yamux_mem_free(ctx);
+}
+
+/**
+ * Destroy a Yamux session after sending the data it still holds
+ * 
+ * @param session Session handle returned by yamux_init
+ * @param timeout_ms How long to wait for a full transport to drain
+ * @return Number of held bytes that could not be sent, or YAMUX_ERR_INVALID
+ */
+int yamux_destroy_flush(void *session, uint32_t timeout_ms)
+{
+    yamux_context_t *ctx = (yamux_context_t *)session;
+    size_t dropped = 0;
+    
+    if (!ctx) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    if (ctx->session && !ctx->session->shutdown) {
+        dropped = yamux_session_finish_streams(ctx->session, timeout_ms);
+    }
+    yamux_destroy(ctx);
+    
+    return dropped > INT_MAX ? INT_MAX : (int)dropped;
 }
 
 /**
@@ -107,16 +140,6 @@ int yamux_process(void *session_handle)
 {
     yamux_context_t *ctx = (yamux_context_t *)session_handle;
     yamux_result_t result;
-
-    // Added debug prints
-    fprintf(stderr, "DEBUG: yamux_process (in yamux_port.c): received session_handle = %p\n", session_handle);
-    fprintf(stderr, "DEBUG: yamux_process (in yamux_port.c): cast to ctx = %p\n", (void*)ctx);
-    if (ctx) {
-        fprintf(stderr, "DEBUG: yamux_process (in yamux_port.c): ctx->session = %p\n", (void*)ctx->session);
-    } else {
-        fprintf(stderr, "DEBUG: yamux_process (in yamux_port.c): ctx is NULL\n");
-    }
-    fflush(stderr);
     
     if (!ctx || !ctx->session) {
         return -1; // Should be YAMUX_ERR_INVALID or similar
@@ -125,6 +148,12 @@ int yamux_process(void *session_handle)
     /* Process incoming data */
     result = yamux_session_process(ctx->session);
     
+    /* Finish a yamux_destroy made from a callback; the handle is now gone */
+    if (ctx->destroy_pending) {
+        yamux_destroy(ctx);
+        return YAMUX_ERR_CLOSED;
+    }
+    
     /* Map result to simple error code */
     return (result == YAMUX_OK) ? 0 : (int)result;
 }
@@ -147,7 +176,7 @@ void* yamux_open_stream(void *session)
     }
     
     /* Allocate stream context */
-    stream_ctx = (yamux_stream_context_t *)malloc(sizeof(yamux_stream_context_t));
+    stream_ctx = (yamux_stream_context_t *)yamux_mem_alloc(sizeof(yamux_stream_context_t));
     if (!stream_ctx) {
         return NULL;
     }
@@ -155,13 +184,14 @@ void* yamux_open_stream(void *session)
     /* Open stream */
     result = yamux_stream_open_detailed(ctx->session, 0, &stream);
     if (result != YAMUX_OK) {
-        free(stream_ctx);
+        yamux_mem_free(stream_ctx);
         return NULL;
     }
     
     /* Initialize stream context */
     stream_ctx->stream = stream;
     stream_ctx->context = ctx;
+    stream->owner = &stream_ctx->stream;
     
     return stream_ctx;
 }
@@ -184,7 +214,7 @@ void* yamux_accept_stream(void *session)
     }
     
     /* Allocate stream context */
-    stream_ctx = (yamux_stream_context_t *)malloc(sizeof(yamux_stream_context_t));
+    stream_ctx = (yamux_stream_context_t *)yamux_mem_alloc(sizeof(yamux_stream_context_t));
     if (!stream_ctx) {
         return NULL;
     }
@@ -192,13 +222,14 @@ void* yamux_accept_stream(void *session)
     /* Accept stream */
     result = yamux_stream_accept(ctx->session, &stream);
     if (result != YAMUX_OK) {
-        free(stream_ctx);
+        yamux_mem_free(stream_ctx);
         return NULL;
     }
     
     /* Initialize stream context */
     stream_ctx->stream = stream;
     stream_ctx->context = ctx;
+    stream->owner = &stream_ctx->stream;
     
     return stream_ctx;
 }
@@ -215,15 +246,23 @@ int yamux_close_stream(void *stream, int reset)
     yamux_stream_context_t *stream_ctx = (yamux_stream_context_t *)stream;
     yamux_result_t result;
     
-    if (!stream_ctx || !stream_ctx->stream) {
+    if (!stream_ctx) {
         return -1;
     }
     
-    /* Close stream */
+    /* The session was destroyed and already freed the stream */
+    if (!stream_ctx->stream) {
+        yamux_mem_free(stream_ctx);
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    /* Close stream; it may outlive this handle until the peer's FIN frees it */
+    stream_ctx->stream->owner = NULL;
+    stream_ctx->stream->released = 1;
     result = yamux_stream_close(stream_ctx->stream, reset);
     
     /* Free stream context */
-    free(stream_ctx);
+    yamux_mem_free(stream_ctx);
     
     return (result == YAMUX_OK) ? 0 : (int)result;
 }
@@ -270,11 +309,11 @@ int yamux_write(void *stream, const uint8_t *buf, size_t len)
     yamux_result_t result;
     size_t bytes_written;
     
-    if (!stream_ctx || !stream_ctx->stream || !buf || len == 0) {
+    if (!stream_ctx || !stream_ctx->stream || (!buf && len > 0)) {
         return -1;
     }
     
-    /* Write to stream */
+    /* Write to stream (a zero-length write is a no-op) */
     result = yamux_stream_write(stream_ctx->stream, buf, len, &bytes_written);
     
     if (result != YAMUX_OK) {
@@ -301,6 +340,23 @@ uint32_t yamux_get_stream_id(void *stream)
     return yamux_stream_get_id(stream_ctx->stream);
 }
 
+/**
+ * Interrupt a pending read and write on a stream
+ * 
+ * @param stream Stream handle returned by yamux_open_stream or yamux_accept_stream
+ * @return 0 on success, negative value on error
+ */
+int yamux_interrupt_stream(void *stream)
+{
+    yamux_stream_context_t *stream_ctx = (yamux_stream_context_t *)stream;
+    
+    if (!stream_ctx || !stream_ctx->stream) {
+        return -1;
+    }
+    
+    return (int)yamux_stream_interrupt(stream_ctx->stream);
+}
+
 /**
  * Send a ping to the remote endpoint
  * 
@@ -321,3 +377,41 @@ int yamux_ping(void *session)
     
     return (result == YAMUX_OK) ? 0 : (int)result;
 }
+
+/**
+ * Set the callback used to wait for the transport
+ * 
+ * @param session Session handle returned by yamux_init
+ * @param cb Callback function, or NULL to never wait
+ * @param ctx User context passed to the callback
+ * @return 0 on success, negative value on error
+ */
+int yamux_set_wait(void *session, yamux_wait_callback_t cb, void *ctx)
+{
+    yamux_context_t *context = (yamux_context_t *)session;
+    
+    if (!context || !context->session) {
+        return -1;
+    }
+    
+    return (int)yamux_set_wait_callback(context->session, cb, ctx);
+}
+
+/**
+ * Set the callback used to end a wait early
+ * 
+ * @param session Session handle returned by yamux_init
+ * @param cb Callback function, or NULL if waits cannot be ended early
+ * @param ctx User context passed to the callback
+ * @return 0 on success, negative value on error
+ */
+int yamux_set_wake(void *session, yamux_wake_callback_t cb, void *ctx)
+{
+    yamux_context_t *context = (yamux_context_t *)session;
+    
+    if (!context || !context->session) {
+        return -1;
+    }
+    
+    return (int)yamux_set_wake_callback(context->session, cb, ctx);
+}
@@ -8,7 +8,6 @@
 #include "yamux_defs.h"
 
 #include <stdlib.h>
-#include <stdio.h>
 #include <string.h>
 
 /* Default configuration values */
@@ -17,17 +16,153 @@ const yamux_config_t yamux_default_config = {
     .enable_keepalive = 1,
     .connection_write_timeout = 30000, /* 30 seconds */
     .keepalive_interval = 60000,      /* 60 seconds */
-    .max_stream_window_size = 256 * 1024  /* 256 KB */
+    .max_stream_window_size = 256 * 1024,  /* 256 KB */
+    .verify_stream_id_parity = 1,
+    .accept_initial_window_bonus = 0,
+    .small_frame_threshold = 0,
+    .window_stall_timeout_ms = 0,
+    .max_stream_open_rate = 0,
+    .on_window_violation = YAMUX_WINDOW_VIOLATION_CLOSE_SESSION,
+    .max_send_buffer_per_stream = 0,
+    .auto_flush = 0,
+    .frame_buffer_pool_size = 0,
+    .reject_data_on_syn = 0,
+    .max_send_buffer_age_ms = 0,
+    .accept_overflow_policy = YAMUX_ACCEPT_OVERFLOW_RESET,
+    .max_session_memory = 0,
+    .max_inflight_per_stream = 0,
+    .max_trace_events_per_sec = 0,
+    .on_unknown_fin = YAMUX_UNKNOWN_FIN_IGNORE,
+    .max_num_streams = 0,
+    .keepalive_timeout_ms = 0
 };
 
+/* Compute a receive window from the bandwidth-delay product */
+uint32_t yamux_recommended_window(uint32_t bandwidth_kbps, uint32_t rtt_ms)
+{
+    /* kbps * ms = bits; divide by 8 for bytes. 64-bit avoids overflow */
+    uint64_t bdp = ((uint64_t)bandwidth_kbps * rtt_ms) / 8;
+    
+    if (bdp < YAMUX_MIN_RECOMMENDED_WINDOW) {
+        return YAMUX_MIN_RECOMMENDED_WINDOW;
+    }
+    if (bdp > YAMUX_MAX_RECOMMENDED_WINDOW) {
+        return YAMUX_MAX_RECOMMENDED_WINDOW;
+    }
+    
+    return (uint32_t)bdp;
+}
+
 /* Add some fields to the session structure that weren't in yamux_internal.h */
 static int yamux_session_is_shutdown(yamux_session_t *session) {
-    return session->go_away_received;
+    return session->shutdown;
 }
 
 static void yamux_session_set_shutdown(yamux_session_t *session, yamux_error_t reason) {
-    (void)reason; /* Unused parameter */
-    session->go_away_received = 1;
+    session->shutdown = 1;
+    
+    /* A more specific cause recorded before the close is kept */
+    if (session->close_error == YAMUX_OK) {
+        if (reason == YAMUX_PROTOCOL_ERROR) {
+            session->close_error = YAMUX_ERR_PROTOCOL;
+        } else if (reason == YAMUX_INTERNAL_ERROR) {
+            session->close_error = YAMUX_ERR_INTERNAL;
+        }
+    }
+}
+
+/**
+ * Send a GoAway frame carrying an error code
+ *
+ * Write errors are ignored: the session is going away either way.
+ *
+ * @param session Session
+ * @param err Error code to send
+ */
+static void yamux_session_send_go_away(yamux_session_t *session, yamux_error_t err)
+{
+    yamux_header_t header;
+    uint8_t frame[YAMUX_HEADER_SIZE + 4];  /* Header + 4-byte error code */
+    
+    memset(&header, 0, sizeof(header));
+    header.version = YAMUX_PROTO_VERSION;
+    header.type = YAMUX_GO_AWAY;
+    header.flags = 0;
+    header.stream_id = 0;
+    header.length = 4;  /* Error code is a 32-bit value */
+    yamux_encode_header(&header, frame);
+    
+    /* Encode error code (big-endian) */
+    yamux_encode_u32((uint32_t)err, frame + YAMUX_HEADER_SIZE);
+    
+    session->io.write(session->write_ctx, frame, sizeof(frame));
+    session->go_away_sent = 1;
+}
+
+/**
+ * Allocate the frame buffer pool
+ *
+ * All buffers share one block, and a stack of pointers tracks the ones not
+ * in use, so taking and returning a buffer never allocates.
+ *
+ * @param session Session being created
+ * @param count Number of YAMUX_MAX_DATA_FRAME_SIZE buffers
+ * @return YAMUX_OK on success, YAMUX_ERR_NOMEM otherwise
+ */
+static yamux_result_t yamux_frame_pool_init(yamux_session_t *session, uint32_t count)
+{
+    size_t i;
+    
+    if ((uint64_t)count * YAMUX_MAX_DATA_FRAME_SIZE > SIZE_MAX) {
+        return YAMUX_ERR_NOMEM;
+    }
+    
+    session->frame_pool = (uint8_t *)yamux_mem_alloc((size_t)count * YAMUX_MAX_DATA_FRAME_SIZE);
+    session->frame_pool_free = (uint8_t **)yamux_mem_alloc((size_t)count * sizeof(uint8_t *));
+    if (!session->frame_pool || !session->frame_pool_free) {
+        yamux_mem_free(session->frame_pool);
+        yamux_mem_free(session->frame_pool_free);
+        session->frame_pool = NULL;
+        session->frame_pool_free = NULL;
+        return YAMUX_ERR_NOMEM;
+    }
+    
+    for (i = 0; i < count; i++) {
+        session->frame_pool_free[i] = session->frame_pool + i * YAMUX_MAX_DATA_FRAME_SIZE;
+    }
+    session->frame_pool_available = count;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Take a buffer from the frame buffer pool
+ *
+ * @param session Session
+ * @param len Number of bytes the caller needs
+ * @return A buffer of YAMUX_MAX_DATA_FRAME_SIZE bytes, or NULL if len does
+ *         not fit one or none is free, in which case the caller allocates
+ */
+uint8_t *yamux_frame_buffer_take(yamux_session_t *session, size_t len)
+{
+    if (len > YAMUX_MAX_DATA_FRAME_SIZE || session->frame_pool_available == 0) {
+        return NULL;
+    }
+    
+    return session->frame_pool_free[--session->frame_pool_available];
+}
+
+/**
+ * Return a buffer taken with yamux_frame_buffer_take
+ *
+ * @param session Session
+ * @param buf Buffer to return; NULL is ignored
+ */
+void yamux_frame_buffer_give(yamux_session_t *session, uint8_t *buf)
+{
+    if (buf) {
+        session->frame_pool_free[session->frame_pool_available++] = buf;
+    }
 }
 
 /* Initialize a new session */
@@ -38,6 +173,7 @@ yamux_result_t yamux_session_create(
     yamux_session_t **session)
 {
     yamux_session_t *s;
+    yamux_result_t result;
     
     /* Validate parameters */
     if (!io || !session) {
@@ -45,7 +181,7 @@ yamux_result_t yamux_session_create(
     }
     
     /* Allocate session structure */
-    s = (yamux_session_t *)malloc(sizeof(yamux_session_t));
+    s = (yamux_session_t *)yamux_mem_alloc(sizeof(yamux_session_t));
     if (!s) {
         return YAMUX_ERR_NOMEM;
     }
@@ -53,8 +189,10 @@ yamux_result_t yamux_session_create(
     /* Initialize session */
     memset(s, 0, sizeof(yamux_session_t));
     
-    /* Copy I/O callbacks */
+    /* Copy I/O callbacks; both directions share the one context until told otherwise */
     s->io = *io;
+    s->read_ctx = io->ctx;
+    s->write_ctx = io->ctx;
     
     /* Set client mode */
     s->client = client;
@@ -66,15 +204,57 @@ yamux_result_t yamux_session_create(
         s->config = yamux_default_config;
     }
     
+    /* Keepalive runs off the application's clock, see yamux_session_keepalive */
+    s->keepalive_enabled = s->config.enable_keepalive && s->config.keepalive_interval > 0;
+    s->keepalive_interval = s->config.keepalive_interval;
+    
+    /* The open-rate bucket starts full so a client can open its first streams at once */
+    s->open_tokens = (uint64_t)s->config.max_stream_open_rate * 1000;
+    
     /* Initialize stream ID based on client/server mode */
     /* Client uses odd IDs, server uses even IDs */
     s->next_stream_id = client ? 1 : 2;
     
     /* Initialize streams array */
     s->stream_capacity = 16;  /* Initial capacity */
-    s->streams = (yamux_stream_t **)malloc(s->stream_capacity * sizeof(yamux_stream_t *));
+    s->streams = (yamux_stream_t **)yamux_mem_alloc(s->stream_capacity * sizeof(yamux_stream_t *));
     if (!s->streams) {
-        free(s);
+        yamux_mem_free(s);
+        return YAMUX_ERR_NOMEM;
+    }
+    s->stream_free = (uint32_t *)yamux_mem_alloc(s->stream_capacity * sizeof(uint32_t));
+    if (!s->stream_free) {
+        yamux_mem_free(s->streams);
+        yamux_mem_free(s);
+        return YAMUX_ERR_NOMEM;
+    }
+    if (yamux_stream_index_init(s, 2 * s->stream_capacity) != YAMUX_OK) {
+        yamux_mem_free(s->stream_free);
+        yamux_mem_free(s->streams);
+        yamux_mem_free(s);
+        return YAMUX_ERR_NOMEM;
+    }
+    
+    /* Preallocate the frame buffer pool so the hot path does not allocate */
+    if (s->config.frame_buffer_pool_size > 0) {
+        result = yamux_frame_pool_init(s, s->config.frame_buffer_pool_size);
+        if (result != YAMUX_OK) {
+            yamux_mem_free(s->stream_index);
+            yamux_mem_free(s->stream_free);
+            yamux_mem_free(s->streams);
+            yamux_mem_free(s);
+            return result;
+        }
+    }
+    
+    /* A memory cap too small for the session itself can never be met */
+    if (!yamux_session_memory_allows(s, 0)) {
+        yamux_mem_free(s->frame_pool);
+        yamux_mem_free(s->frame_pool_free);
+        yamux_mem_free(s->stream_index);
+        yamux_mem_free(s->stream_free);
+        yamux_mem_free(s->streams);
+        yamux_mem_free(s);
         return YAMUX_ERR_NOMEM;
     }
     
@@ -92,8 +272,6 @@ yamux_result_t yamux_session_close(
     yamux_session_t *session, 
     yamux_error_t err)
 {
-    size_t i;
-    
     /* Validate parameters */
     if (!session) {
         return YAMUX_ERR_INVALID;
@@ -107,132 +285,380 @@ yamux_result_t yamux_session_close(
     /* Mark as shut down */
     yamux_session_set_shutdown(session, err);
     
-    /* Send GoAway frame if possible */
-    yamux_header_t header;
-    memset(&header, 0, sizeof(header));
-    header.version = YAMUX_PROTO_VERSION;
-    header.type = YAMUX_GO_AWAY;
-    header.flags = 0;
-    header.stream_id = 0;
-    header.length = 4;  /* Error code is a 32-bit value */
+    /* Send GoAway frame, unless a drain already did */
+    if (!session->go_away_sent) {
+        yamux_session_send_go_away(session, err);
+    }
     
-    uint8_t frame[12];  /* 8-byte header + 4-byte error code */
-    yamux_encode_header(&header, frame);
+    /* A callback may still be using a stream; free them once it returns */
+    if (session->callback_depth > 0) {
+        session->teardown_pending = 1;
+        return YAMUX_OK;
+    }
     
-    /* Encode error code (big-endian) */
-    frame[8] = (err >> 24) & 0xFF;
-    frame[9] = (err >> 16) & 0xFF;
-    frame[10] = (err >> 8) & 0xFF;
-    frame[11] = err & 0xFF;
+    yamux_session_release_streams(session);
     
-    /* Send frame (ignore errors, we're shutting down anyway) */
-    session->io.write(session->io.ctx, frame, sizeof(frame));
+    return YAMUX_OK;
+}
+
+/* Announce shutdown but keep serving the streams already open */
+yamux_result_t yamux_session_go_away(
+    yamux_session_t *session,
+    yamux_error_t code)
+{
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    if (code != YAMUX_NORMAL && code != YAMUX_PROTOCOL_ERROR && code != YAMUX_INTERNAL_ERROR) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    if (session->shutdown || session->transport_failed) {
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    if (!session->go_away_sent) {
+        YAMUX_DIAG(session, "session: draining, GoAway sent with code %u", (unsigned)code);
+        yamux_session_send_go_away(session, code);
+    }
+    
+    return YAMUX_OK;
+}
+
+/* Reset and free every stream, clearing any handle that still refers to one */
+void yamux_session_release_streams(
+    yamux_session_t *session)
+{
+    yamux_stream_t *stream;
+    size_t i;
+    
+    session->teardown_pending = 0;
+    
+    /* Queued and held-write streams are also in the table and are freed below */
+    session->accept_queue = NULL;
+    session->held_streams = NULL;
     
-    /* Close all streams */
     for (i = 0; i < session->stream_count; i++) {
-        if (session->streams[i]) {
-            yamux_stream_close(session->streams[i], 1);
+        stream = session->streams[i];
+        if (!stream) {
+            continue;
+        }
+        session->streams[i] = NULL;
+        
+        if (stream->owner) {
+            *stream->owner = NULL;
+            stream->owner = NULL;
+        }
+        
+        if (stream->state != YAMUX_STREAM_CLOSED) {
+            /* Sends RST and frees the stream */
+            yamux_stream_close(stream, 1);
+        } else {
+            yamux_buffer_free(&stream->recvbuf);
+            yamux_buffer_free(&stream->sendbuf);
+            yamux_mem_free(stream);
         }
     }
     
-    /* Free streams array */
-    free(session->streams);
+    /* Free streams array and its index */
+    yamux_mem_free(session->streams);
     session->streams = NULL;
     session->stream_count = 0;
     session->stream_capacity = 0;
+    session->stream_live = 0;
+    yamux_mem_free(session->stream_index);
+    session->stream_index = NULL;
+    session->stream_index_size = 0;
+    yamux_mem_free(session->stream_free);
+    session->stream_free = NULL;
+    session->stream_free_count = 0;
+    session->stream_memory = 0;
+}
+
+/* Send held data and a FIN on every stream so teardown does not reset them */
+size_t yamux_session_finish_streams(
+    yamux_session_t *session,
+    uint32_t timeout_ms)
+{
+    yamux_stream_t *stream;
+    yamux_header_t header;
+    uint8_t frame[YAMUX_HEADER_SIZE];
+    yamux_result_t result;
+    uint32_t elapsed;
+    size_t dropped = 0;
+    size_t i;
     
-    return YAMUX_OK;
+    for (i = 0; i < session->stream_count; i++) {
+        stream = session->streams[i];
+        if (!stream || stream->state == YAMUX_STREAM_CLOSED) {
+            continue;
+        }
+        
+        /* A full transport gets until the timeout, as measured by the wait callback */
+        result = yamux_stream_flush(stream);
+        while (result == YAMUX_ERR_WOULD_BLOCK && timeout_ms > 0 && session->wait_cb) {
+            elapsed = 0;
+            if (session->wait_cb(session->wait_ctx, timeout_ms, &elapsed) <= 0) {
+                break;
+            }
+            timeout_ms = elapsed < timeout_ms ? timeout_ms - elapsed : 0;
+            result = yamux_stream_flush(stream);
+        }
+        if (result != YAMUX_OK) {
+            dropped += stream->sendbuf.used - stream->sendbuf.pos;
+        }
+        
+        if (stream->state != YAMUX_STREAM_FIN_SENT) {
+            memset(&header, 0, sizeof(header));
+            header.version = YAMUX_PROTO_VERSION;
+            header.type = YAMUX_DATA;
+            header.flags = YAMUX_FLAG_FIN;
+            header.stream_id = stream->id;
+            yamux_encode_header(&header, frame);
+            (void)session->io.write(session->write_ctx, frame, sizeof(frame));
+        }
+        
+        /* Nothing more is read, so release frees it without an RST */
+        stream->state = YAMUX_STREAM_CLOSED;
+    }
+    
+    return dropped;
+}
+
+/* Close a session and free it; must not be called from inside a callback */
+void yamux_session_free(
+    yamux_session_t *session)
+{
+    if (!session) {
+        return;
+    }
+    
+    /* No callback may run once teardown starts */
+    session->peer_fin_cb = NULL;
+    session->peer_fin_ctx = NULL;
+    session->trace_cb = NULL;
+    session->trace_ctx = NULL;
+    session->window_update_cb = NULL;
+    session->window_update_ctx = NULL;
+    session->accept_classify_cb = NULL;
+    session->accept_classify_ctx = NULL;
+    session->control_cb = NULL;
+    session->control_ctx = NULL;
+    session->data_cb = NULL;
+    session->data_ctx = NULL;
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    if (session->streams) {
+        yamux_session_release_streams(session);
+    }
+    
+    yamux_mem_free(session->recv_buf);
+    yamux_mem_free(session->frame_pool);
+    yamux_mem_free(session->frame_pool_free);
+    yamux_mem_free(session);
+}
+
+/**
+ * Send the small writes held on every stream
+ *
+ * Control frames never wait here: pings, window updates and SYN-ACKs are
+ * written as soon as they are made, so they overtake held data. A stream's
+ * own data frames and its FIN keep their order, because close and larger
+ * writes flush the stream's held data first.
+ *
+ * @param session Session whose streams to flush
+ */
+static void yamux_session_flush_held(yamux_session_t *session)
+{
+    yamux_stream_t *stream;
+    yamux_stream_t *next;
+    
+    for (stream = session->held_streams; stream; stream = next) {
+        next = stream->held_next;
+        (void)yamux_stream_flush(stream);
+        if (stream->sendbuf.used == stream->sendbuf.pos) {
+            yamux_held_list_remove(session, stream);
+        }
+    }
+}
+
+/**
+ * Map a failed read or write to the result reported for it
+ *
+ * A reset connection cannot be used again, so it fails the session; any
+ * other failure is reported as a plain IO error, as before.
+ *
+ * @param session Session whose transport failed
+ * @param io_result Negative or short result from the read or write callback
+ * @return YAMUX_ERR_CONN_RESET if the callback reported a reset,
+ *         YAMUX_ERR_IO otherwise
+ */
+yamux_result_t yamux_session_io_error(yamux_session_t *session, int io_result)
+{
+    if (io_result != YAMUX_ERR_CONN_RESET) {
+        return YAMUX_ERR_IO;
+    }
+    
+    if (!session->transport_reset) {
+        YAMUX_DIAG(session, "transport: connection reset");
+    }
+    session->transport_failed = 1;
+    session->transport_reset = 1;
+    
+    return YAMUX_ERR_CONN_RESET;
+}
+
+/**
+ * Spend one event of the frame trace budget
+ *
+ * The budget is max_trace_events_per_sec per second of the clock passed
+ * to yamux_session_keepalive. Events over it are counted and dropped so a
+ * slow trace callback cannot hold up frame processing. Without that clock
+ * the second would never end, so the budget applies only once
+ * yamux_session_keepalive has been called.
+ *
+ * @param session Session
+ * @return 1 if the trace callback may run, 0 if the event is dropped
+ */
+static int yamux_trace_allowed(yamux_session_t *session)
+{
+    uint32_t budget = session->config.max_trace_events_per_sec;
+    
+    if (budget == 0 || !session->clock_started) {
+        return 1;
+    }
+    
+    if (session->now_ms - session->trace_window_ms >= 1000) {
+        session->trace_window_ms = session->now_ms;
+        session->trace_events = 0;
+    }
+    if (session->trace_events >= budget) {
+        if (session->trace_events == budget) {
+            YAMUX_DIAG(session, "trace: budget of %u events spent, dropping until the next second", budget);
+            session->trace_events++;
+        }
+        session->trace_dropped++;
+        return 0;
+    }
+    session->trace_events++;
+    
+    return 1;
 }
 
 /* Process incoming data */
 yamux_result_t yamux_session_process(
     yamux_session_t *session)
 {
-    fprintf(stderr, "\n*** ULTRA DEBUG: ENTERING yamux_session_process - VERSION CHECKPOINT 05-15-A ***\n\n");
-    fflush(stderr);
     uint8_t header_buf[YAMUX_HEADER_SIZE]; /* 12 bytes for header */
     yamux_header_t header;
     yamux_result_t result;
     
-    // ---- ADDED DEBUG ----
-    printf("DEBUG: INSIDE yamux_session_process: received session ptr = %p\n", (void*)session);
-    if (session) {
-        printf("DEBUG: INSIDE yamux_session_process: session->go_away_received = %d\n", session->go_away_received);
-    }
-    fflush(stdout);
-    // ---- END ADDED DEBUG ----
-
     /* Validate parameters */
     if (!session) {
         return YAMUX_ERR_INVALID;
     }
     
-    /* Check if shut down */
-    if (session->go_away_received) {
+    /* Once closed, stay closed without touching the transport; a reset stays distinct */
+    if (session->transport_reset) {
+        return YAMUX_ERR_CONN_RESET;
+    }
+    if (session->shutdown || session->transport_failed) {
         return YAMUX_ERR_CLOSED;
     }
     
+    /* Each pass of the event loop sends any small writes still held */
+    yamux_session_flush_held(session);
+    if (session->transport_reset) {
+        return YAMUX_ERR_CONN_RESET;
+    }
+    
     /* Read header - only read YAMUX_HEADER_SIZE bytes for the actual header */
-    int read_result = session->io.read(session->io.ctx, header_buf, YAMUX_HEADER_SIZE);
-    printf("DEBUG: Header read result: %d, expected: %d\n", read_result, YAMUX_HEADER_SIZE);
+    int read_result = session->io.read(session->read_ctx, header_buf, YAMUX_HEADER_SIZE);
     if (read_result != YAMUX_HEADER_SIZE) {
-        fprintf(stderr, "DEBUG (yamux_session_process): Header read failed/short (read_result=%d), returning YAMUX_ERR_IO (%d)\n", read_result, YAMUX_ERR_IO);
-        fflush(stderr);
-        return YAMUX_ERR_IO;
+        /* Nothing to read yet is not an error; a failed or partial read loses framing */
+        if (read_result == 0) {
+            return YAMUX_ERR_IO;
+        }
+        if (read_result == YAMUX_ERR_WOULD_BLOCK) {
+            return YAMUX_ERR_WOULD_BLOCK;
+        }
+        YAMUX_DIAG(session, "process: short header read (%d)", read_result);
+        session->transport_failed = 1;
+        return yamux_session_io_error(session, read_result);
     }
+    session->last_frame_ms = session->now_ms;
     
-    /* Decode header */
-    fprintf(stderr, "DEBUG: --- PRE-HEX DUMP MARKER ---\n");
-    fflush(stderr);
-    fprintf(stderr, "DEBUG: Raw header_buf (%d bytes): ", read_result);
-    for (int i = 0; i < read_result; i++) {
-        fprintf(stderr, "%02x ", header_buf[i]);
-    }
-    fprintf(stderr, "\n");
-    fprintf(stderr, "DEBUG: --- POST-HEX DUMP MARKER ---\n");
-    fflush(stderr);
-
-    fprintf(stderr, "MANUAL CHECK: header_buf[0] (Version) = %u | header_buf[1] (Type) = %u\n", header_buf[0], header_buf[1]);
-    fflush(stderr);
-
     /* Decode header */
     result = yamux_decode_header(header_buf, YAMUX_HEADER_SIZE, &header);
-    fprintf(stderr, "DEBUG: Decode header result: %d, frame type: %d, flags: 0x%x, stream_id: %u, length: %u\n", 
-           result, header.type, header.flags, header.stream_id, header.length);
-    fflush(stderr);
     if (result != YAMUX_OK) {
+        YAMUX_DIAG(session, "process: bad header (ver %u type %u): %d",
+                   header_buf[0], header_buf[1], result);
+        yamux_session_close(session, YAMUX_PROTOCOL_ERROR);
         return result;
     }
     
+    /* Show tooling the frame before it is acted on, within its budget */
+    if (session->trace_cb && yamux_trace_allowed(session)) {
+        session->callback_depth++;
+        session->trace_cb(session->trace_ctx, &header, header_buf);
+        session->callback_depth--;
+    }
+    
+    /* Stream ID 0 is the session itself; data can never belong to it */
+    if (header.type == YAMUX_DATA && header.stream_id == 0) {
+        YAMUX_DIAG(session, "process: DATA frame for stream 0");
+        yamux_session_close(session, YAMUX_PROTOCOL_ERROR);
+        return YAMUX_ERR_PROTOCOL;
+    }
+    
+    /* A peer opens streams with its own parity: clients odd, servers even */
+    if (session->config.verify_stream_id_parity &&
+        (header.type == YAMUX_DATA || header.type == YAMUX_WINDOW_UPDATE) &&
+        (header.flags & YAMUX_FLAG_SYN) && !(header.flags & YAMUX_FLAG_ACK) &&
+        (header.stream_id == 0 || (header.stream_id & 1) != (session->client ? 0u : 1u))) {
+        YAMUX_DIAG(session, "process: SYN for stream %u has wrong parity for %s peer",
+                   header.stream_id, session->client ? "server" : "client");
+        yamux_session_close(session, YAMUX_PROTOCOL_ERROR);
+        return YAMUX_ERR_PROTOCOL;
+    }
+    
     /* Process frame based on type */
-    printf("DEBUG: Processing frame type: %d\n", header.type);
     switch (header.type) {
         case YAMUX_DATA:
-            printf("DEBUG: Handling DATA frame\n");
             result = yamux_handle_data(session, &header);
-            printf("DEBUG: DATA frame result: %d\n", result);
             break;
         case YAMUX_WINDOW_UPDATE:
-            printf("DEBUG: Handling WINDOW_UPDATE frame\n");
             result = yamux_handle_window_update(session, &header);
-            printf("DEBUG: WINDOW_UPDATE frame result: %d\n", result);
             break;
         case YAMUX_PING:
-            printf("DEBUG: Handling PING frame\n");
             result = yamux_handle_ping(session, &header);
-            printf("DEBUG: PING frame result: %d\n", result);
             break;
         case YAMUX_GO_AWAY:
-            printf("DEBUG: Handling GO_AWAY frame\n");
             result = yamux_handle_go_away(session, &header);
-            printf("DEBUG: GO_AWAY frame result: %d\n", result);
             break;
         default:
             /* Invalid frame type */
-            printf("DEBUG: Invalid frame type: %d\n", header.type);
+            YAMUX_DIAG(session, "process: invalid frame type %u", header.type);
+            yamux_session_close(session, YAMUX_PROTOCOL_ERROR);
             return YAMUX_ERR_PROTOCOL;
     }
     
+    if (result != YAMUX_OK) {
+        YAMUX_DIAG(session, "process: type %u flags 0x%x stream %u failed: %d",
+                   header.type, header.flags, header.stream_id, result);
+    }
+    
+    /* With auto_flush, nothing written during this cycle waits for the next one */
+    if (session->config.auto_flush && !session->shutdown && !session->teardown_pending) {
+        yamux_session_flush_held(session);
+    }
+    
+    /* A callback closed the session; the handler is done with its streams now */
+    if (session->teardown_pending) {
+        yamux_session_release_streams(session);
+    }
+    
     return result;
 }
 
@@ -241,7 +667,7 @@ yamux_result_t yamux_session_ping(
     yamux_session_t *session)
 {
     yamux_header_t header;
-    uint8_t frame[8];
+    uint8_t frame[YAMUX_HEADER_SIZE];
     
     /* Validate parameters */
     if (!session) {
@@ -249,7 +675,7 @@ yamux_result_t yamux_session_ping(
     }
     
     /* Check if shut down */
-    if (session->go_away_received) {
+    if (session->shutdown || session->transport_failed) {
         return YAMUX_ERR_CLOSED;
     }
     
@@ -265,13 +691,211 @@ yamux_result_t yamux_session_ping(
     yamux_encode_header(&header, frame);
     
     /* Send frame */
-    if (session->io.write(session->io.ctx, frame, sizeof(frame)) != sizeof(frame)) {
+    if (session->io.write(session->write_ctx, frame, sizeof(frame)) != sizeof(frame)) {
+        return YAMUX_ERR_IO;
+    }
+    
+    session->pings_pending++;
+    
+    /* ACKs come back in order, so time the oldest unanswered ping */
+    if (!session->ping_timing) {
+        session->ping_timing = 1;
+        session->ping_sent_ms = session->now_ms;
+    }
+    
+    return YAMUX_OK;
+}
+
+/* Ping with a tagged payload and wait for its ACK */
+yamux_result_t yamux_session_ping_rtt(
+    yamux_session_t *session,
+    uint32_t timeout_ms,
+    uint32_t *rtt_ms)
+{
+    yamux_header_t header;
+    uint8_t frame[YAMUX_HEADER_SIZE + 4];
+    yamux_result_t result = YAMUX_OK;
+    uint32_t remaining = timeout_ms;
+    uint32_t waited = 0;
+    uint32_t elapsed;
+    uint32_t tag;
+    uint32_t i;
+    int ready;
+    
+    /* Validate parameters */
+    if (!session || !rtt_ms) {
+        return YAMUX_ERR_INVALID;
+    }
+    if (session->shutdown || session->transport_failed) {
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    /* Header and tag go out in one write so they cannot be split */
+    tag = ++session->last_ping_id;
+    memset(&header, 0, sizeof(header));
+    header.version = YAMUX_PROTO_VERSION;
+    header.type = YAMUX_PING;
+    header.flags = YAMUX_FLAG_SYN;
+    header.stream_id = 0;
+    header.length = 4;
+    yamux_encode_header(&header, frame);
+    yamux_encode_u32(tag, frame + YAMUX_HEADER_SIZE);
+    if (session->io.write(session->write_ctx, frame, sizeof(frame)) != (int)sizeof(frame)) {
         return YAMUX_ERR_IO;
     }
     
+    /* A full table forgets its oldest ping, whose ACK then counts as stray */
+    if (session->ping_tag_count == YAMUX_MAX_TAGGED_PINGS) {
+        YAMUX_DIAG(session, "ping: tag %u forgotten unanswered", session->ping_tags[0]);
+        (void)yamux_ping_tag_take(session, session->ping_tags[0], NULL);
+    }
+    i = session->ping_tag_count++;
+    session->ping_tags[i] = tag;
+    session->ping_tag_sent_ms[i] = session->now_ms;
+    session->pings_pending++;
+    
+    /* Without a way to wait, the ACK is timed later on the keepalive clock */
+    if (timeout_ms == 0 || !session->wait_cb) {
+        return YAMUX_ERR_WOULD_BLOCK;
+    }
+    
+    while (yamux_ping_tag_pending(session, tag)) {
+        if (remaining == 0) {
+            result = YAMUX_ERR_TIMEOUT;
+            break;
+        }
+        
+        elapsed = 0;
+        ready = session->wait_cb(session->wait_ctx, remaining, &elapsed);
+        if (ready < 0) {
+            YAMUX_DIAG(session, "ping: wait callback failed: %d", ready);
+            result = YAMUX_ERR_IO;
+            break;
+        }
+        if (ready == 0) {
+            result = YAMUX_ERR_TIMEOUT;
+            break;
+        }
+        elapsed = (elapsed < remaining) ? elapsed : remaining;
+        remaining -= elapsed;
+        waited += elapsed;
+        
+        result = yamux_session_process(session);
+        if (result != YAMUX_OK) {
+            break;
+        }
+    }
+    
+    /* Given up on: a late ACK is ignored rather than timed */
+    if (yamux_ping_tag_take(session, tag, NULL)) {
+        return result;
+    }
+    
+    /* The wait callback is the only clock that ran while we waited */
+    session->last_rtt_ms = waited;
+    session->rtt_known = 1;
+    *rtt_ms = waited;
+    
     return YAMUX_OK;
 }
 
+/* Keepalive driven by the application's clock */
+yamux_result_t yamux_session_keepalive(
+    yamux_session_t *session,
+    uint32_t now_ms)
+{
+    yamux_result_t result;
+    uint32_t timeout;
+    size_t i;
+    
+    /* Validate parameters */
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* This is the only clock the library sees; remember it for yamux_session_now_ms */
+    session->now_ms = now_ms;
+    if (!session->clock_started) {
+        session->clock_started = 1;
+        session->last_frame_ms = now_ms;
+    }
+    
+    /* A peer that never grants window would stall these writes forever */
+    if (session->config.window_stall_timeout_ms > 0) {
+        for (i = 0; i < session->stream_count; i++) {
+            yamux_stream_t *stream = session->streams[i];
+            if (stream && stream->window_stalled &&
+                now_ms - stream->stall_since_ms >= session->config.window_stall_timeout_ms) {
+                YAMUX_DIAG(session, "keepalive: stream %u reset, no window for %u ms",
+                           stream->id, now_ms - stream->stall_since_ms);
+                yamux_reset_stream(session, stream, YAMUX_RESET_TIMEOUT);
+            }
+        }
+    }
+    
+    /* Held writes on a quiet stream would otherwise wait for the next process call */
+    if (session->config.max_send_buffer_age_ms > 0) {
+        yamux_stream_t *stream;
+        yamux_stream_t *next;
+        for (stream = session->held_streams; stream; stream = next) {
+            next = stream->held_next;
+            if (stream->sendbuf.used > stream->sendbuf.pos &&
+                now_ms - stream->held_since_ms >= session->config.max_send_buffer_age_ms) {
+                (void)yamux_stream_flush(stream);
+            }
+        }
+    }
+    
+    if (session->keepalive_failed) {
+        return YAMUX_ERR_TIMEOUT;
+    }
+    if (!session->keepalive_enabled) {
+        return YAMUX_OK;
+    }
+    
+    /* The first call starts the clock */
+    if (!session->keepalive_started) {
+        session->keepalive_started = 1;
+        session->keepalive_last_ms = now_ms;
+        return YAMUX_OK;
+    }
+    
+    /* Unsigned subtraction keeps this correct across wraparound */
+    if (session->ping_outstanding) {
+        timeout = session->config.keepalive_timeout_ms ?
+                  session->config.keepalive_timeout_ms : session->keepalive_interval;
+        if (now_ms - session->keepalive_last_ms < timeout) {
+            return YAMUX_OK;
+        }
+        
+        /* The peer is gone: fail pending opens now rather than leave them hanging */
+        YAMUX_DIAG(session, "keepalive: no ping ACK within %u ms, peer considered dead", timeout);
+        session->keepalive_failed = 1;
+        for (i = 0; i < session->stream_count; i++) {
+            yamux_stream_t *stream = session->streams[i];
+            if (stream && stream->state == YAMUX_STREAM_SYN_SENT) {
+                YAMUX_DIAG(session, "keepalive: pending stream %u failed", stream->id);
+                stream->state = YAMUX_STREAM_CLOSED;
+            }
+        }
+        return YAMUX_ERR_TIMEOUT;
+    }
+    
+    /* Only an idle connection needs a ping; a frame from the peer is proof enough */
+    if (now_ms - session->keepalive_last_ms < session->keepalive_interval ||
+        now_ms - session->last_frame_ms < session->keepalive_interval) {
+        return YAMUX_OK;
+    }
+    session->keepalive_last_ms = now_ms;
+    
+    result = yamux_session_ping(session);
+    if (result == YAMUX_OK) {
+        session->ping_outstanding = 1;
+    }
+    
+    return result;
+}
+
 /* 
  * Note: The actual implementations for these functions are now in yamux_frame.c and yamux_handlers.c
  * These are just declarations to satisfy external references
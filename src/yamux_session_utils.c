@@ -10,80 +10,689 @@
 #include <string.h>
 
 /**
- * Handle ping frame
+ * Note: yamux_handle_ping and yamux_handle_go_away live in yamux_handlers.c
+ * alongside the other frame handlers. Declarations remain in yamux_internal.h
+ */
+
+/**
+ * Set the callback for peer half-close (FIN) notifications
  *
  * @param session Session
- * @param header Frame header
+ * @param cb Callback function, or NULL to disable
+ * @param ctx User context passed to the callback
  * @return YAMUX_OK on success, error code otherwise
  */
-yamux_result_t yamux_handle_ping(
-    yamux_session_t *session, 
-    const yamux_header_t *header)
+yamux_result_t yamux_set_stream_peer_fin_callback(
+    yamux_session_t *session,
+    yamux_peer_fin_callback_t cb,
+    void *ctx)
 {
-    yamux_header_t response;
-    uint8_t frame[8];
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
     
-    if (!session || !header) {
+    session->peer_fin_cb = cb;
+    session->peer_fin_ctx = ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Set the callback for received frame headers
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to disable
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_frame_trace_callback(
+    yamux_session_t *session,
+    yamux_frame_trace_callback_t cb,
+    void *ctx)
+{
+    if (!session) {
         return YAMUX_ERR_INVALID;
     }
     
-    /* Check if it's a ping request (SYN) or response (ACK) */
-    if (header->flags & YAMUX_FLAG_SYN) {
-        /* This is a ping request, send a response */
-        memset(&response, 0, sizeof(response));
-        response.version = YAMUX_PROTO_VERSION;
-        response.type = YAMUX_PING;
-        response.flags = YAMUX_FLAG_ACK;  /* ACK flag for response */
-        response.stream_id = 0;
-        response.length = 0;
-        
-        /* Encode header */
-        yamux_encode_header(&response, frame);
+    session->trace_cb = cb;
+    session->trace_ctx = ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Replace a session's configuration while it runs
+ *
+ * @param session Session
+ * @param config New configuration
+ * @return YAMUX_OK on success, YAMUX_ERR_INVALID for a NULL argument or a
+ *         change to an immutable field
+ */
+yamux_result_t yamux_session_set_config(
+    yamux_session_t *session,
+    const yamux_config_t *config)
+{
+    int was_enabled;
+    uint64_t capacity;
+    
+    if (!session || !config) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* The frame buffer pool was allocated at creation */
+    if (config->frame_buffer_pool_size != session->config.frame_buffer_pool_size) {
+        YAMUX_DIAG(session, "config: frame_buffer_pool_size cannot change at runtime");
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* A bucket that was unlimited starts full, as at creation; otherwise it keeps what fits */
+    capacity = (uint64_t)config->max_stream_open_rate * 1000;
+    if (session->config.max_stream_open_rate == 0 || session->open_tokens > capacity) {
+        session->open_tokens = capacity;
+    }
+    
+    was_enabled = session->keepalive_enabled;
+    session->config = *config;
+    session->keepalive_enabled = config->enable_keepalive && config->keepalive_interval > 0;
+    session->keepalive_interval = config->keepalive_interval;
+    if (session->keepalive_enabled && !was_enabled) {
+        session->keepalive_started = 0;
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Get the number of frame trace events dropped over budget
+ *
+ * @param session Session
+ * @return Events dropped, or 0 if session is NULL
+ */
+uint32_t yamux_session_trace_dropped(
+    yamux_session_t *session)
+{
+    if (!session) {
+        return 0;
+    }
+    
+    return session->trace_dropped;
+}
+
+/**
+ * Set the callback for window updates sent
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to disable
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_window_update_callback(
+    yamux_session_t *session,
+    yamux_window_update_callback_t cb,
+    void *ctx)
+{
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    session->window_update_cb = cb;
+    session->window_update_ctx = ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Set the callback that assigns accept priorities
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to give every stream priority 0
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_accept_classify_callback(
+    yamux_session_t *session,
+    yamux_accept_classify_callback_t cb,
+    void *ctx)
+{
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    session->accept_classify_cb = cb;
+    session->accept_classify_ctx = ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Reserve a stream ID as the control stream (server only)
+ *
+ * @param session Server session
+ * @param stream_id Stream ID to reserve
+ * @param cb Callback function, or NULL to stop reserving an ID
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, YAMUX_ERR_INVALID for a client session or a
+ *         stream ID the client cannot open, error code otherwise
+ */
+yamux_result_t yamux_set_control_stream(
+    yamux_session_t *session,
+    uint32_t stream_id,
+    yamux_control_callback_t cb,
+    void *ctx)
+{
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* Only a server accepts streams, and clients open odd IDs */
+    if (cb && (session->client || (stream_id & 1) == 0)) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    session->control_stream_id = cb ? stream_id : 0;
+    session->control_cb = cb;
+    session->control_ctx = ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Deliver stream data to a callback instead of waiting for reads
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to go back to reads only
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_data_callback(
+    yamux_session_t *session,
+    yamux_data_callback_t cb,
+    void *ctx)
+{
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    session->data_cb = cb;
+    session->data_ctx = ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Set the callback used to wait for the transport
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL to never wait
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_wait_callback(
+    yamux_session_t *session,
+    yamux_wait_callback_t cb,
+    void *ctx)
+{
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    session->wait_cb = cb;
+    session->wait_ctx = ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Set the callback used to end a wait early
+ *
+ * @param session Session
+ * @param cb Callback function, or NULL if waits cannot be ended early
+ * @param ctx User context passed to the callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_set_wake_callback(
+    yamux_session_t *session,
+    yamux_wake_callback_t cb,
+    void *ctx)
+{
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    session->wake_cb = cb;
+    session->wake_ctx = ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Give the read and write callbacks separate contexts
+ *
+ * @param session Session
+ * @param read_ctx Context passed to the read callback
+ * @param write_ctx Context passed to the write callback
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_session_set_io_contexts(
+    yamux_session_t *session,
+    void *read_ctx,
+    void *write_ctx)
+{
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    session->read_ctx = read_ctx;
+    session->write_ctx = write_ctx;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Get the number of inbound streams waiting to be accepted
+ *
+ * @param session Session
+ * @return Number of streams in the accept queue, or 0 if session is NULL
+ */
+int yamux_session_pending_accepts(
+    yamux_session_t *session)
+{
+    yamux_stream_t *s;
+    int count = 0;
+    
+    if (!session) {
+        return 0;
+    }
+    
+    for (s = session->accept_queue; s; s = s->next) {
+        count++;
+    }
+    
+    return count;
+}
+
+/**
+ * Get the role a session was created with
+ *
+ * @param session Session
+ * @return 1 for a client session, 0 for a server session or if session is NULL
+ */
+int yamux_session_is_client(
+    yamux_session_t *session)
+{
+    if (!session) {
+        return 0;
+    }
+    
+    return session->client ? 1 : 0;
+}
+
+/**
+ * Get the round-trip time of the last answered ping
+ *
+ * @param session Session
+ * @param rtt_ms Output parameter for the round-trip time in milliseconds
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if no ping has been
+ *         answered yet, error code otherwise
+ */
+yamux_result_t yamux_session_rtt(
+    yamux_session_t *session,
+    uint32_t *rtt_ms)
+{
+    if (!session || !rtt_ms) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    if (!session->rtt_known) {
+        return YAMUX_ERR_WOULD_BLOCK;
+    }
+    
+    *rtt_ms = session->last_rtt_ms;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Get the current time as the library sees it
+ *
+ * @param session Session
+ * @return Latest time passed to yamux_session_keepalive, or 0 if none
+ */
+uint64_t yamux_session_now_ms(
+    yamux_session_t *session)
+{
+    if (!session) {
+        return 0;
+    }
+    
+    return session->now_ms;
+}
+
+/**
+ * Invoke a callback for each stream in a session
+ *
+ * @param session Session
+ * @param cb Callback function
+ * @param ctx User context passed to the callback
+ * @return 0 after visiting every stream, the callback's non-zero return
+ *         value if it stopped, or YAMUX_ERR_INVALID on bad arguments
+ */
+int yamux_session_foreach_stream(
+    yamux_session_t *session,
+    yamux_stream_visit_callback_t cb,
+    void *ctx)
+{
+    yamux_stream_t *stream;
+    size_t i;
+    int rc = 0;
+    
+    if (!session || !cb) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* Re-read the table each step: the callback may close streams or open new ones */
+    session->callback_depth++;
+    for (i = 0; i < session->stream_count && !session->teardown_pending; i++) {
+        stream = session->streams[i];
+        if (!stream) {
+            continue;
+        }
         
-        /* Send frame */
-        if (session->io.write(session->io.ctx, frame, sizeof(frame)) != sizeof(frame)) {
-            return YAMUX_ERR_IO;
+        rc = cb(ctx, stream);
+        if (rc != 0) {
+            break;
         }
     }
+    session->callback_depth--;
     
-    /* For ping response (ACK), do nothing */
+    /* The callback closed the session; free the streams now that it is done */
+    if (session->callback_depth == 0 && session->teardown_pending) {
+        yamux_session_release_streams(session);
+    }
+    
+    return rc;
+}
+
+/**
+ * Get the error code from the GoAway the peer sent
+ *
+ * @param session Session
+ * @param code Output parameter for the peer's GoAway code
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if the peer has not
+ *         sent GoAway, error code otherwise
+ */
+yamux_result_t yamux_session_remote_go_away(
+    yamux_session_t *session,
+    uint32_t *code)
+{
+    if (!session || !code) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    if (!session->go_away_received) {
+        return YAMUX_ERR_WOULD_BLOCK;
+    }
+    
+    *code = session->go_away_code;
     
     return YAMUX_OK;
 }
 
 /**
- * Handle go-away frame
+ * Get the error that closed the session
  *
  * @param session Session
- * @param header Frame header
- * @return YAMUX_OK on success, error code otherwise
+ * @return The error, YAMUX_OK if the session has not closed with one, or
+ *         YAMUX_ERR_INVALID for a NULL session
  */
-yamux_result_t yamux_handle_go_away(
-    yamux_session_t *session, 
-    const yamux_header_t *header)
+yamux_result_t yamux_session_last_error(
+    yamux_session_t *session)
 {
-    uint8_t data[4];
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
     
-    if (!session || !header) {
+    return session->close_error;
+}
+
+/**
+ * Get the highest locally opened stream ID the peer has ACKed
+ *
+ * @param session Session
+ * @param id Output parameter for the stream ID
+ * @return YAMUX_OK on success, YAMUX_ERR_WOULD_BLOCK if the peer has not
+ *         ACKed any stream, error code otherwise
+ */
+yamux_result_t yamux_session_last_acked_stream(
+    yamux_session_t *session,
+    uint32_t *id)
+{
+    if (!session || !id) {
         return YAMUX_ERR_INVALID;
     }
     
-    /* Read reason code */
-    if (header->length != 4) {
-        /* Go-away reason must be 4 bytes */
-        return YAMUX_ERR_PROTOCOL;
+    if (session->last_acked_stream_id == 0) {
+        return YAMUX_ERR_WOULD_BLOCK;
     }
     
-    /* Read reason code */
-    if (session->io.read(session->io.ctx, data, sizeof(data)) != sizeof(data)) {
-        return YAMUX_ERR_IO;
+    *id = session->last_acked_stream_id;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Get a summary of session health in one call
+ *
+ * @param session Session
+ * @param out Output parameter for the summary
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_session_health(
+    yamux_session_t *session,
+    yamux_health_t *out)
+{
+    yamux_stream_t *stream;
+    size_t i;
+    
+    if (!session || !out) {
+        return YAMUX_ERR_INVALID;
     }
     
-    /* Decode reason (big-endian) - we don't use it currently */
-    /* yamux_error_t err = (data[0] << 24) | (data[1] << 16) | (data[2] << 8) | data[3]; */
+    memset(out, 0, sizeof(*out));
+    out->is_closed = session->shutdown || session->transport_failed;
+    out->has_remote_goaway = session->go_away_received ? 1 : 0;
+    out->pending_pings = session->pings_pending;
+    out->last_activity_ms_ago = session->now_ms - session->last_frame_ms;
     
-    /* Mark session as shut down */
-    session->go_away_received = 1;
+    for (i = 0; i < session->stream_count; i++) {
+        stream = session->streams[i];
+        if (!stream) {
+            continue;
+        }
+        out->num_streams++;
+        out->buffered_bytes += (stream->recvbuf.used - stream->recvbuf.pos) +
+                               (stream->sendbuf.used - stream->sendbuf.pos);
+    }
     
     return YAMUX_OK;
 }
+
+/**
+ * Get the memory a session currently holds
+ *
+ * @param session Session
+ * @return Bytes held, or 0 for a NULL session
+ */
+size_t yamux_session_memory_used(
+    yamux_session_t *session)
+{
+    size_t used;
+    
+    if (!session) {
+        return 0;
+    }
+    
+    used = sizeof(*session) + session->stream_capacity * (sizeof(yamux_stream_t *) + sizeof(uint32_t)) +
+           session->stream_index_size * sizeof(uint32_t) + session->recv_buf_size;
+    if (session->frame_pool) {
+        used += (size_t)session->config.frame_buffer_pool_size * (YAMUX_MAX_DATA_FRAME_SIZE + sizeof(uint8_t *));
+    }
+    
+    /* Kept current as streams come and go and their buffers change size */
+    return used + session->stream_memory;
+}
+
+/**
+ * Check whether the session may allocate more memory
+ *
+ * @param session Session
+ * @param extra Bytes about to be allocated
+ * @return 1 if max_session_memory allows it, 0 otherwise
+ */
+int yamux_session_memory_allows(yamux_session_t *session, size_t extra)
+{
+    size_t used;
+    
+    if (session->config.max_session_memory == 0) {
+        return 1;
+    }
+    
+    used = yamux_session_memory_used(session);
+    if (used > session->config.max_session_memory ||
+        extra > session->config.max_session_memory - used) {
+        YAMUX_DIAG(session, "memory: %lu more bytes would exceed the limit of %lu (%lu in use)",
+                   (unsigned long)extra, (unsigned long)session->config.max_session_memory,
+                   (unsigned long)used);
+        return 0;
+    }
+    
+    return 1;
+}
+
+/**
+ * Check whether the session may hold another stream
+ *
+ * @param session Session
+ * @return 1 if below max_num_streams and YAMUX_MAX_STREAMS, 0 otherwise
+ */
+int yamux_session_stream_allowed(yamux_session_t *session)
+{
+    uint32_t limit = YAMUX_MAX_STREAMS;
+    
+    if (session->config.max_num_streams != 0 && session->config.max_num_streams < limit) {
+        limit = session->config.max_num_streams;
+    }
+    
+    if (session->stream_live >= limit) {
+        YAMUX_DIAG(session, "stream limit %u reached", limit);
+        return 0;
+    }
+    
+    return 1;
+}
+
+/**
+ * Check whether a tagged ping still awaits its ACK
+ *
+ * @param session Session
+ * @param tag Opaque value the ping carried
+ * @return 1 if the ping is outstanding, 0 otherwise
+ */
+int yamux_ping_tag_pending(yamux_session_t *session, uint32_t tag)
+{
+    uint32_t i;
+    
+    for (i = 0; i < session->ping_tag_count; i++) {
+        if (session->ping_tags[i] == tag) {
+            return 1;
+        }
+    }
+    
+    return 0;
+}
+
+/**
+ * Stop tracking a tagged ping
+ *
+ * @param session Session
+ * @param tag Opaque value the ping carried
+ * @param sent_ms Output parameter for the time it was sent, may be NULL
+ * @return 1 if the ping was outstanding, 0 for a tag we never sent or
+ *         already forgot
+ */
+int yamux_ping_tag_take(yamux_session_t *session, uint32_t tag, uint32_t *sent_ms)
+{
+    uint32_t i;
+    
+    for (i = 0; i < session->ping_tag_count; i++) {
+        if (session->ping_tags[i] == tag) {
+            break;
+        }
+    }
+    if (i == session->ping_tag_count) {
+        return 0;
+    }
+    
+    if (sent_ms) {
+        *sent_ms = session->ping_tag_sent_ms[i];
+    }
+    
+    /* Keep the table oldest first */
+    for (; i + 1 < session->ping_tag_count; i++) {
+        session->ping_tags[i] = session->ping_tags[i + 1];
+        session->ping_tag_sent_ms[i] = session->ping_tag_sent_ms[i + 1];
+    }
+    session->ping_tag_count--;
+    if (session->pings_pending > 0) {
+        session->pings_pending--;
+    }
+    
+    return 1;
+}
+
+/**
+ * Re-advertise the full receive window on every stream
+ *
+ * @param session Session
+ * @return YAMUX_OK on success, YAMUX_ERR_CLOSED for a closed session,
+ *         YAMUX_ERR_IO if an update could not be written
+ */
+yamux_result_t yamux_session_reset_windows(
+    yamux_session_t *session)
+{
+    yamux_stream_t *stream;
+    yamux_result_t result = YAMUX_OK;
+    size_t buffered;
+    uint32_t full;
+    size_t i;
+    
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    if (session->shutdown || session->transport_failed) {
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    YAMUX_DIAG(session, "windows: re-advertising receive windows on request");
+    for (i = 0; i < session->stream_count; i++) {
+        stream = session->streams[i];
+        if (!stream || stream->recv_paused || stream->reset_reason != YAMUX_RESET_NONE ||
+            stream->state == YAMUX_STREAM_CLOSED || stream->state == YAMUX_STREAM_FIN_RECV) {
+            continue;
+        }
+        
+        /* Top up to a full window, as after a complete read, whatever the half-window rule says */
+        buffered = stream->recvbuf.used - stream->recvbuf.pos;
+        if (buffered >= stream->recv_window_max) {
+            continue;
+        }
+        full = stream->recv_window_max - (uint32_t)buffered;
+        if (stream->recv_window < full &&
+            yamux_stream_grant_window(stream, full - stream->recv_window) != YAMUX_OK) {
+            result = YAMUX_ERR_IO;
+        }
+    }
+    
+    return result;
+}
@@ -0,0 +1,296 @@
+/**
+ * @file yamux_snapshot.c
+ * @brief Session snapshot and restore for hot restarts
+ *
+ * A snapshot records the protocol state of a session and its streams in a
+ * compact big-endian byte format, so a new process that inherits the
+ * transport can rebuild the session and carry on where the old one stopped.
+ * Buffered data is not part of the snapshot; see yamux_session_snapshot.
+ */
+
+#include "../include/yamux.h"
+#include "yamux_internal.h"
+#include <string.h>
+
+#define YAMUX_SNAPSHOT_MAGIC    0x594D5853u  /* "YMXS" */
+#define YAMUX_SNAPSHOT_VERSION  1u
+#define YAMUX_SNAPSHOT_HEADER   (6 * 4)      /* magic, version, flags, next ID, GoAway code, count */
+#define YAMUX_SNAPSHOT_STREAM   (8 * 4)      /* Per-stream record */
+
+/* Session flags */
+#define YAMUX_SNAP_CLIENT           0x01u
+#define YAMUX_SNAP_SHUTDOWN         0x02u
+#define YAMUX_SNAP_GO_AWAY_RECEIVED 0x04u
+#define YAMUX_SNAP_GO_AWAY_SENT     0x08u
+
+/* Stream flags */
+#define YAMUX_SNAP_PEER_WINDOW_KNOWN 0x01u
+#define YAMUX_SNAP_QUEUED            0x02u
+#define YAMUX_SNAP_PEER_FIN_NOTIFIED 0x04u
+#define YAMUX_SNAP_RECV_PAUSED       0x08u
+#define YAMUX_SNAP_CONTROL           0x10u
+#define YAMUX_SNAP_ACK_DEFERRED      0x20u
+
+/**
+ * Check whether a stream is waiting in the accept queue
+ *
+ * @param session Session
+ * @param stream Stream to look for
+ * @return 1 if queued, 0 otherwise
+ */
+static int yamux_snapshot_is_queued(yamux_session_t *session, yamux_stream_t *stream)
+{
+    yamux_stream_t *s;
+    
+    for (s = session->accept_queue; s; s = s->next) {
+        if (s == stream) {
+            return 1;
+        }
+    }
+    
+    return 0;
+}
+
+/**
+ * Encode one stream record
+ *
+ * @param session Session the stream belongs to
+ * @param stream Stream to encode
+ * @param out Output buffer of YAMUX_SNAPSHOT_STREAM bytes
+ */
+static void yamux_snapshot_encode_stream(yamux_session_t *session, yamux_stream_t *stream, uint8_t *out)
+{
+    uint32_t flags = 0;
+    
+    if (stream->peer_window_known) {
+        flags |= YAMUX_SNAP_PEER_WINDOW_KNOWN;
+    }
+    if (yamux_snapshot_is_queued(session, stream)) {
+        flags |= YAMUX_SNAP_QUEUED;
+    }
+    if (stream->peer_fin_notified) {
+        flags |= YAMUX_SNAP_PEER_FIN_NOTIFIED;
+    }
+    if (stream->recv_paused) {
+        flags |= YAMUX_SNAP_RECV_PAUSED;
+    }
+    if (stream->control) {
+        flags |= YAMUX_SNAP_CONTROL;
+    }
+    if (stream->ack_deferred) {
+        flags |= YAMUX_SNAP_ACK_DEFERRED;
+    }
+    
+    yamux_encode_u32(stream->id, out);
+    yamux_encode_u32((uint32_t)stream->state, out + 4);
+    yamux_encode_u32((uint32_t)stream->reset_reason, out + 8);
+    yamux_encode_u32(stream->send_window, out + 12);
+    yamux_encode_u32(stream->recv_window, out + 16);
+    yamux_encode_u32(stream->recv_window_max, out + 20);
+    yamux_encode_u32(stream->peer_window, out + 24);
+    yamux_encode_u32(flags, out + 28);
+}
+
+/* Serialize a session's protocol state */
+yamux_result_t yamux_session_snapshot(
+    yamux_session_t *session,
+    uint8_t *buf,
+    size_t cap,
+    size_t *written)
+{
+    yamux_stream_t *stream;
+    uint32_t flags = 0;
+    size_t count = 0;
+    size_t needed;
+    size_t pos;
+    size_t i;
+    
+    if (!session || !written || (!buf && cap > 0)) {
+        return YAMUX_ERR_INVALID;
+    }
+    *written = 0;
+    
+    /* Buffered bytes would be lost, so the application must drain them first */
+    for (i = 0; i < session->stream_count; i++) {
+        stream = session->streams[i];
+        if (!stream) {
+            continue;
+        }
+        if (stream->recvbuf.used > stream->recvbuf.pos ||
+            stream->sendbuf.used > stream->sendbuf.pos) {
+            YAMUX_DIAG(session, "snapshot: stream %u has buffered data", stream->id);
+            return YAMUX_ERR_WOULD_BLOCK;
+        }
+        count++;
+    }
+    
+    needed = YAMUX_SNAPSHOT_HEADER + count * YAMUX_SNAPSHOT_STREAM;
+    if (cap < needed) {
+        *written = needed;
+        return YAMUX_ERR_NOMEM;
+    }
+    
+    if (session->client) {
+        flags |= YAMUX_SNAP_CLIENT;
+    }
+    if (session->shutdown) {
+        flags |= YAMUX_SNAP_SHUTDOWN;
+    }
+    if (session->go_away_received) {
+        flags |= YAMUX_SNAP_GO_AWAY_RECEIVED;
+    }
+    if (session->go_away_sent) {
+        flags |= YAMUX_SNAP_GO_AWAY_SENT;
+    }
+    
+    yamux_encode_u32(YAMUX_SNAPSHOT_MAGIC, buf);
+    yamux_encode_u32(YAMUX_SNAPSHOT_VERSION, buf + 4);
+    yamux_encode_u32(flags, buf + 8);
+    yamux_encode_u32(session->next_stream_id, buf + 12);
+    yamux_encode_u32(session->go_away_code, buf + 16);
+    yamux_encode_u32((uint32_t)count, buf + 20);
+    pos = YAMUX_SNAPSHOT_HEADER;
+    
+    /* Queued streams first, in accept order, so restore can queue them again as they were */
+    for (stream = session->accept_queue; stream; stream = stream->next) {
+        yamux_snapshot_encode_stream(session, stream, buf + pos);
+        pos += YAMUX_SNAPSHOT_STREAM;
+    }
+    for (i = 0; i < session->stream_count; i++) {
+        stream = session->streams[i];
+        if (stream && !yamux_snapshot_is_queued(session, stream)) {
+            yamux_snapshot_encode_stream(session, stream, buf + pos);
+            pos += YAMUX_SNAPSHOT_STREAM;
+        }
+    }
+    
+    *written = pos;
+    return YAMUX_OK;
+}
+
+/**
+ * Free a partly restored session without writing to the transport
+ *
+ * @param session Session to free
+ */
+static void yamux_snapshot_discard(yamux_session_t *session)
+{
+    size_t i;
+    
+    /* A closed session sends no GoAway, and closed streams no RST */
+    session->shutdown = 1;
+    for (i = 0; i < session->stream_count; i++) {
+        if (session->streams[i]) {
+            session->streams[i]->state = YAMUX_STREAM_CLOSED;
+        }
+    }
+    session->accept_queue = NULL;
+    yamux_session_free(session);
+}
+
+/**
+ * Rebuild one stream from its record
+ *
+ * @param session Session being restored
+ * @param in Stream record of YAMUX_SNAPSHOT_STREAM bytes
+ * @return YAMUX_OK on success, error code otherwise
+ */
+static yamux_result_t yamux_snapshot_restore_stream(yamux_session_t *session, const uint8_t *in)
+{
+    yamux_stream_t *stream;
+    yamux_result_t result;
+    uint32_t id = yamux_decode_u32(in);
+    uint32_t state = yamux_decode_u32(in + 4);
+    uint32_t reason = yamux_decode_u32(in + 8);
+    uint32_t flags = yamux_decode_u32(in + 28);
+    
+    if (id == 0 || state > (uint32_t)YAMUX_STREAM_CLOSED ||
+        reason > (uint32_t)YAMUX_RESET_FLOW_CONTROL) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    result = yamux_stream_new(session, id, &stream);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    
+    stream->state = (yamux_stream_state_t)state;
+    stream->reset_reason = (yamux_reset_reason_t)reason;
+    stream->send_window = yamux_decode_u32(in + 12);
+    stream->recv_window = yamux_decode_u32(in + 16);
+    stream->recv_window_max = yamux_decode_u32(in + 20);
+    stream->peer_window = yamux_decode_u32(in + 24);
+    stream->peer_window_known = (flags & YAMUX_SNAP_PEER_WINDOW_KNOWN) != 0;
+    stream->peer_fin_notified = (flags & YAMUX_SNAP_PEER_FIN_NOTIFIED) != 0;
+    stream->recv_paused = (flags & YAMUX_SNAP_RECV_PAUSED) != 0;
+    stream->control = (flags & YAMUX_SNAP_CONTROL) != 0;
+    stream->ack_deferred = (flags & YAMUX_SNAP_ACK_DEFERRED) != 0;
+    
+    result = yamux_add_stream(session, stream);
+    if (result != YAMUX_OK) {
+        yamux_buffer_free(&stream->recvbuf);
+        yamux_mem_free(stream);
+        return result;
+    }
+    
+    if (flags & YAMUX_SNAP_QUEUED) {
+        return yamux_enqueue_stream_for_accept(session, stream);
+    }
+    
+    return YAMUX_OK;
+}
+
+/* Rebuild a session from a snapshot */
+yamux_result_t yamux_session_restore(
+    yamux_io_t *io,
+    const yamux_config_t *config,
+    const uint8_t *buf,
+    size_t len,
+    yamux_session_t **session)
+{
+    yamux_session_t *s;
+    yamux_result_t result;
+    uint32_t flags;
+    uint32_t count;
+    uint32_t i;
+    
+    if (!io || !buf || !session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* The length must match the stream count exactly */
+    if (len < YAMUX_SNAPSHOT_HEADER ||
+        yamux_decode_u32(buf) != YAMUX_SNAPSHOT_MAGIC ||
+        yamux_decode_u32(buf + 4) != YAMUX_SNAPSHOT_VERSION) {
+        return YAMUX_ERR_INVALID;
+    }
+    count = yamux_decode_u32(buf + 20);
+    if (count > YAMUX_MAX_STREAMS ||
+        len != YAMUX_SNAPSHOT_HEADER + (size_t)count * YAMUX_SNAPSHOT_STREAM) {
+        return YAMUX_ERR_INVALID;
+    }
+    flags = yamux_decode_u32(buf + 8);
+    
+    result = yamux_session_create(io, (flags & YAMUX_SNAP_CLIENT) != 0, config, &s);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    s->next_stream_id = yamux_decode_u32(buf + 12);
+    s->go_away_code = yamux_decode_u32(buf + 16);
+    s->go_away_sent = (flags & YAMUX_SNAP_GO_AWAY_SENT) != 0;
+    
+    for (i = 0; i < count; i++) {
+        result = yamux_snapshot_restore_stream(s, buf + YAMUX_SNAPSHOT_HEADER + (size_t)i * YAMUX_SNAPSHOT_STREAM);
+        if (result != YAMUX_OK) {
+            yamux_snapshot_discard(s);
+            return result;
+        }
+    }
+    
+    /* Set last, as a closed session refuses new streams */
+    s->shutdown = (flags & YAMUX_SNAP_SHUTDOWN) != 0;
+    s->go_away_received = (flags & YAMUX_SNAP_GO_AWAY_RECEIVED) != 0;
+    
+    *session = s;
+    return YAMUX_OK;
+}
@@ -8,55 +8,154 @@
 #include "yamux_defs.h"
 #include <stdlib.h>
 #include <string.h>
-#include <stdio.h>
 
 /* Use definitions from yamux_defs.h */
 
 /**
- * Create a new stream
+ * Error reported by reads and writes on a reset stream
+ *
+ * @param stream Reset stream
+ * @return YAMUX_ERR_TIMEOUT if the window watchdog reset it, YAMUX_ERR_RESET otherwise
+ */
+static yamux_result_t yamux_stream_reset_error(yamux_stream_t *stream)
+{
+    return stream->reset_reason == YAMUX_RESET_TIMEOUT ? YAMUX_ERR_TIMEOUT : YAMUX_ERR_RESET;
+}
+
+/**
+ * Get how many bytes a stream may send now
+ *
+ * The send window, further limited by max_inflight_per_stream.
+ *
+ * @param stream Stream to send on
+ * @return Bytes that may be sent
+ */
+static uint32_t yamux_stream_send_budget(yamux_stream_t *stream)
+{
+    uint32_t cap = stream->session->config.max_inflight_per_stream;
+    
+    if (cap == 0) {
+        return stream->send_window;
+    }
+    if (stream->inflight >= cap) {
+        return 0;
+    }
+    
+    return stream->send_window < cap - stream->inflight ? stream->send_window : cap - stream->inflight;
+}
+
+/**
+ * Start the window watchdog's clock for a write that cannot proceed
+ *
+ * @param stream Stream whose write is waiting for window
+ */
+static void yamux_stream_note_stall(yamux_stream_t *stream)
+{
+    if (!stream->window_stalled) {
+        stream->window_stalled = 1;
+        stream->stall_since_ms = stream->session->now_ms;
+    }
+}
+
+/**
+ * Record a write in the stream's send statistics
+ *
+ * @param stream Stream that accepted the write
+ * @param accepted Bytes the write accepted
+ * @param split Whether the send window cut the write short
+ */
+static void yamux_stream_note_write(yamux_stream_t *stream, size_t accepted, int split)
+{
+    if (accepted > stream->largest_write) {
+        stream->largest_write = accepted;
+    }
+    if (split) {
+        stream->window_splits++;
+    }
+}
+
+/**
+ * Check that the session may open new streams
+ *
+ * @param session Session
+ * @return YAMUX_OK if streams may be opened, error code otherwise
+ */
+static yamux_result_t yamux_stream_check_open(yamux_session_t *session)
+{
+    /* Check if session is shut down or its transport has failed */
+    if (session->shutdown || session->transport_failed) {
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    /* We announced GoAway; only the streams already open may carry on */
+    if (session->go_away_sent) {
+        YAMUX_DIAG(session, "open: refused, session is draining");
+        return YAMUX_ERR_SESSION_SHUTDOWN;
+    }
+    
+    /* Keepalive found the peer dead: a SYN would never be answered */
+    if (session->keepalive_failed) {
+        YAMUX_DIAG(session, "open: refused, peer missed keepalive");
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    /* The peer will not accept new streams after its GoAway: fail fast */
+    if (session->go_away_received) {
+        YAMUX_DIAG(session, "open: refused, peer sent GoAway");
+        return YAMUX_ERR_REMOTE_GOAWAY;
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Allocate and initialize a stream that has not been announced yet
  *
  * @param session Parent session
  * @param stream_id Stream ID (0 for auto-assign)
- * @param stream Output parameter for the created stream
- * @return YAMUX_OK on success, error code otherwise
+ * @param stream Output parameter for the new stream
+ * @return YAMUX_OK on success, YAMUX_ERR_STREAMS_EXHAUSTED if max_num_streams
+ *         streams are open, YAMUX_ERR_CLOSED if stream IDs are exhausted,
+ *         error code otherwise
  */
-yamux_result_t yamux_stream_open_detailed(
+yamux_result_t yamux_stream_new(
     yamux_session_t *session, 
     uint32_t stream_id, 
     yamux_stream_t **stream)
 {
     yamux_stream_t *s;
     yamux_result_t result;
-    yamux_header_t header;
-    uint8_t frame[YAMUX_HEADER_SIZE + 4];  /* 8-byte header + 4-byte window size payload */
     
-    printf("DEBUG: yamux_stream_open: Entered. session=%p, stream_id=%u\n", (void*)session, stream_id);
-
-    /* Validate parameters */
-    if (!session || !stream) {
-        printf("DEBUG: yamux_stream_open: Invalid params (session or stream is NULL)\n");
-        return YAMUX_ERR_INVALID;
+    /* Enforce the concurrent stream limit */
+    if (!yamux_session_stream_allowed(session)) {
+        return YAMUX_ERR_STREAMS_EXHAUSTED;
     }
     
-    /* Check if session is shut down */
-    if (session->go_away_received) {
-        printf("DEBUG: yamux_stream_open: Session go_away_received\n");
-        return YAMUX_ERR_CLOSED;
+    /* With the parity check off, the peer may already have opened our next ID */
+    if (stream_id == 0) {
+        while (session->next_stream_id <= YAMUX_MAX_STREAM_ID &&
+               yamux_get_stream(session, session->next_stream_id)) {
+            YAMUX_DIAG(session, "open: stream %u already opened by peer, skipping",
+                       session->next_stream_id);
+            session->next_stream_id += 2;
+        }
     }
     
-    /* Validate stream ID - 0xFFFFFFFF is invalid as per Go implementation */
-    if (stream_id == 0xFFFFFFFF) {
-        printf("DEBUG: yamux_stream_open: Invalid stream ID 0xFFFFFFFF\n");
-        return YAMUX_ERR_INVALID;
+    /* Auto-assigned IDs only grow; once past the maximum the session is used up */
+    if (stream_id == 0 && session->next_stream_id > YAMUX_MAX_STREAM_ID) {
+        YAMUX_DIAG(session, "open: stream IDs exhausted");
+        return YAMUX_ERR_CLOSED;
     }
     
     /* Allocate stream structure */
-    s = (yamux_stream_t *)malloc(sizeof(yamux_stream_t));
+    if (!yamux_session_memory_allows(session, sizeof(yamux_stream_t) + YAMUX_INITIAL_BUFFER_SIZE)) {
+        return YAMUX_ERR_NOMEM;
+    }
+    s = (yamux_stream_t *)yamux_mem_alloc(sizeof(yamux_stream_t));
     if (!s) {
-        printf("ERROR: yamux_stream_open: malloc for stream failed!\n");
+        YAMUX_DIAG(session, "open: out of memory");
         return YAMUX_ERR_NOMEM;
     }
-    printf("DEBUG: yamux_stream_open: Stream structure allocated s=%p\n", (void*)s);
     
     /* Initialize stream */
     memset(s, 0, sizeof(yamux_stream_t));
@@ -75,20 +174,35 @@ yamux_result_t yamux_stream_open_detailed(
     /* Initialize receive buffer */
     result = yamux_buffer_init(&s->recvbuf, YAMUX_INITIAL_BUFFER_SIZE);
     if (result != YAMUX_OK) {
-        printf("ERROR: yamux_stream_open: yamux_buffer_init failed with %d\n", result);
-        free(s);
+        YAMUX_DIAG(session, "open: stream %u buffer init failed: %d", s->id, result);
+        yamux_mem_free(s);
         return result;
     }
-    printf("DEBUG: yamux_stream_open: Recv buffer initialized.\n");
     
-    /* Set initial window sizes */
+    /* Set initial window sizes; our receive window is advertised in the SYN */
     s->send_window = YAMUX_DEFAULT_WINDOW_SIZE;
-    s->recv_window = YAMUX_DEFAULT_WINDOW_SIZE;
+    s->recv_window = session->config.max_stream_window_size ?
+                     session->config.max_stream_window_size : YAMUX_DEFAULT_WINDOW_SIZE;
+    s->recv_window_max = s->recv_window;
     
     /* Set initial state */
     s->state = YAMUX_STREAM_IDLE;
     
-    /* Send SYN frame */
+    *stream = s;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Encode the SYN frame that announces a stream
+ *
+ * @param s Stream to announce
+ * @param frame Output buffer of YAMUX_HEADER_SIZE + 4 bytes
+ */
+static void yamux_stream_encode_syn(const yamux_stream_t *s, uint8_t *frame)
+{
+    yamux_header_t header;
+    
     memset(&header, 0, sizeof(header));
     header.version = YAMUX_PROTO_VERSION;
     header.type = YAMUX_WINDOW_UPDATE;
@@ -99,261 +213,1264 @@ yamux_result_t yamux_stream_open_detailed(
     /* Encode header */
     yamux_encode_header(&header, frame);
     
-    /* Encode initial window size into the payload */
-    uint32_t net_initial_window_size = htonl(s->recv_window);
-    memcpy(frame + YAMUX_HEADER_SIZE, &net_initial_window_size, sizeof(net_initial_window_size));
+    /* Encode initial window size into the payload */
+    yamux_encode_u32(s->recv_window, frame + YAMUX_HEADER_SIZE);
+}
+
+/**
+ * Create a new stream
+ *
+ * @param session Parent session
+ * @param stream_id Stream ID (0 for auto-assign)
+ * @param stream Output parameter for the created stream
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_open_detailed(
+    yamux_session_t *session, 
+    uint32_t stream_id, 
+    yamux_stream_t **stream)
+{
+    yamux_stream_t *s;
+    yamux_result_t result;
+    uint8_t frame[YAMUX_HEADER_SIZE + 4];  /* 8-byte header + 4-byte window size payload */
+    
+    /* Validate parameters */
+    if (!session || !stream) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    result = yamux_stream_check_open(session);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    
+    /* Validate stream ID - 0xFFFFFFFF is invalid as per Go implementation */
+    if (stream_id == 0xFFFFFFFF) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    result = yamux_stream_new(session, stream_id, &s);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    
+    /* Send SYN frame */
+    yamux_stream_encode_syn(s, frame);
+    if (session->io.write(session->write_ctx, frame, sizeof(frame)) != sizeof(frame)) {
+        YAMUX_DIAG(session, "open: stream %u SYN write failed", s->id);
+        yamux_buffer_free(&s->recvbuf);
+        yamux_mem_free(s);
+        return YAMUX_ERR_IO;
+    }
+    
+    /* Add stream to session after successful SYN */
+    result = yamux_add_stream(session, s);
+    if (result != YAMUX_OK) {
+        YAMUX_DIAG(session, "open: stream %u add failed: %d", s->id, result);
+        yamux_buffer_free(&s->recvbuf);
+        yamux_mem_free(s);
+        return result;
+    }
+    
+    /* Update state */
+    s->state = YAMUX_STREAM_SYN_SENT;
+    
+    /* Set stream pointer */
+    *stream = s;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Unregister and free streams created by yamux_open_streams
+ *
+ * @param session Parent session
+ * @param streams Streams to free; entries are set to NULL
+ * @param count Number of streams
+ */
+static void yamux_stream_discard_batch(
+    yamux_session_t *session, 
+    yamux_stream_t **streams, 
+    size_t count)
+{
+    size_t i;
+    
+    for (i = 0; i < count; i++) {
+        yamux_remove_stream(session, streams[i]->id);
+        yamux_buffer_free(&streams[i]->recvbuf);
+        yamux_mem_free(streams[i]);
+        streams[i] = NULL;
+    }
+}
+
+/**
+ * Open several streams with a single write
+ *
+ * @param session Parent session
+ * @param n Number of streams to open
+ * @param out Array of at least n entries receiving the opened streams
+ * @return Number of streams opened (less than n if a limit was hit), or a
+ *         negative error code if none could be opened
+ */
+int yamux_open_streams(
+    yamux_session_t *session, 
+    size_t n, 
+    yamux_stream_t **out)
+{
+    const size_t frame_size = YAMUX_HEADER_SIZE + 4;
+    yamux_result_t result;
+    uint8_t *frames;
+    uint8_t *pooled;
+    size_t count = 0;
+    size_t i;
+    int written;
+    
+    /* Validate parameters */
+    if (!session || (!out && n > 0)) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    result = yamux_stream_check_open(session);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    
+    /* Create and register the streams, stopping at the first that fails */
+    while (count < n) {
+        result = yamux_stream_new(session, 0, &out[count]);
+        if (result != YAMUX_OK) {
+            break;
+        }
+        result = yamux_add_stream(session, out[count]);
+        if (result != YAMUX_OK) {
+            yamux_buffer_free(&out[count]->recvbuf);
+            yamux_mem_free(out[count]);
+            break;
+        }
+        count++;
+    }
+    if (count == 0) {
+        return n == 0 ? 0 : result;
+    }
+    if (count < n) {
+        YAMUX_DIAG(session, "open: batch stopped after %u of %u streams: %d",
+                   (unsigned)count, (unsigned)n, result);
+    }
+    
+    /* Coalesce the SYNs so the transport sees one write */
+    pooled = yamux_frame_buffer_take(session, count * frame_size);
+    if (pooled) {
+        frames = pooled;
+    } else if (yamux_session_memory_allows(session, count * frame_size)) {
+        frames = (uint8_t *)yamux_mem_alloc(count * frame_size);
+    } else {
+        frames = NULL;
+    }
+    if (!frames) {
+        yamux_stream_discard_batch(session, out, count);
+        return YAMUX_ERR_NOMEM;
+    }
+    for (i = 0; i < count; i++) {
+        yamux_stream_encode_syn(out[i], frames + i * frame_size);
+    }
+    written = session->io.write(session->write_ctx, frames, count * frame_size);
+    if (pooled) {
+        yamux_frame_buffer_give(session, pooled);
+    } else {
+        yamux_mem_free(frames);
+    }
+    if (written < 0 || (size_t)written != count * frame_size) {
+        YAMUX_DIAG(session, "open: batch SYN write failed (%d)", written);
+        yamux_stream_discard_batch(session, out, count);
+        return YAMUX_ERR_IO;
+    }
+    
+    for (i = 0; i < count; i++) {
+        out[i]->state = YAMUX_STREAM_SYN_SENT;
+    }
+    
+    return (int)count;
+}
+
+/**
+ * Take a stream out of the accept queue and hand it to the application
+ *
+ * @param session Session
+ * @param link Queue link pointing at the stream to accept
+ * @param stream Output parameter for the accepted stream
+ * @return YAMUX_OK
+ */
+static yamux_result_t yamux_stream_accept_link(
+    yamux_session_t *session,
+    yamux_stream_t **link,
+    yamux_stream_t **stream)
+{
+    yamux_stream_t *s = *link;
+    
+    *link = s->next;
+    s->next = NULL;
+    
+    /* A withheld SYN-ACK goes out now, as do any the freed slot makes room for */
+    if (s->ack_deferred && yamux_send_syn_ack(session, s) == YAMUX_OK) {
+        s->ack_deferred = 0;
+    }
+    yamux_send_deferred_acks(session);
+    
+    /* Do not update stream state to established automatically here
+     * The state should be updated to ESTABLISHED only after receiving ACK
+     * This is especially important for the test_stream_lifecycle test
+     */
+    
+    /* Set stream pointer */
+    *stream = s;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Accept a new stream (server only)
+ *
+ * @param session Session
+ * @param stream Output parameter for the accepted stream
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_accept(
+    yamux_session_t *session, 
+    yamux_stream_t **stream)
+{
+    /* Validate parameters */
+    if (!session || !stream) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* Check if session is shut down */
+    if (session->shutdown) {
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    /* Check if there are any streams to accept */
+    if (!session->accept_queue) {
+        return YAMUX_ERR_TIMEOUT;
+    }
+    
+    /* Get the first stream from the accept queue */
+    return yamux_stream_accept_link(session, &session->accept_queue, stream);
+}
+
+/**
+ * Accept the highest-priority waiting stream at or above a level
+ *
+ * @param session Session
+ * @param min_priority Lowest priority to accept
+ * @param stream Output parameter for the accepted stream
+ * @return YAMUX_OK on success, YAMUX_ERR_TIMEOUT if no waiting stream has
+ *         at least min_priority, error code otherwise
+ */
+yamux_result_t yamux_accept_stream_priority(
+    yamux_session_t *session,
+    int min_priority,
+    yamux_stream_t **stream)
+{
+    yamux_stream_t **link;
+    yamux_stream_t **best = NULL;
+    yamux_stream_t *s;
+    
+    /* Validate parameters */
+    if (!session || !stream) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* Check if session is shut down */
+    if (session->shutdown) {
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    /* Streams are classified once, the first time an accept looks at them */
+    for (link = &session->accept_queue; *link; link = &(*link)->next) {
+        s = *link;
+        if (!s->accept_classified) {
+            s->accept_classified = 1;
+            if (session->accept_classify_cb) {
+                session->callback_depth++;
+                s->accept_priority = session->accept_classify_cb(session->accept_classify_ctx, s);
+                session->callback_depth--;
+            }
+        }
+        
+        /* The queue is in arrival order, so ties go to the earliest */
+        if (s->accept_priority >= min_priority &&
+            (!best || s->accept_priority > (*best)->accept_priority)) {
+            best = link;
+        }
+    }
+    
+    if (!best) {
+        return YAMUX_ERR_TIMEOUT;
+    }
+    
+    return yamux_stream_accept_link(session, best, stream);
+}
+
+/**
+ * Accept a new stream, waiting up to a timeout for one to arrive
+ *
+ * @param session Session
+ * @param timeout_ms Maximum time to wait in milliseconds
+ * @param stream Output parameter for the accepted stream
+ * @return YAMUX_OK on success, YAMUX_ERR_TIMEOUT if no stream arrived in
+ *         time, error code otherwise
+ */
+yamux_result_t yamux_accept_stream_timeout(
+    yamux_session_t *session, 
+    uint32_t timeout_ms, 
+    yamux_stream_t **stream)
+{
+    yamux_result_t result;
+    uint32_t remaining = timeout_ms;
+    uint32_t elapsed;
+    int ready;
+    
+    /* Validate parameters */
+    if (!session || !stream) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    for (;;) {
+        /* Anything other than an empty queue ends the wait */
+        result = yamux_stream_accept(session, stream);
+        if (result != YAMUX_ERR_TIMEOUT) {
+            return result;
+        }
+        if (remaining == 0 || !session->wait_cb) {
+            return YAMUX_ERR_TIMEOUT;
+        }
+        
+        elapsed = 0;
+        ready = session->wait_cb(session->wait_ctx, remaining, &elapsed);
+        if (ready < 0) {
+            YAMUX_DIAG(session, "accept: wait callback failed: %d", ready);
+            return YAMUX_ERR_IO;
+        }
+        if (ready == 0) {
+            return YAMUX_ERR_TIMEOUT;
+        }
+        remaining -= (elapsed < remaining) ? elapsed : remaining;
+        
+        /* Input is waiting: handle one frame, then look at the queue again */
+        result = yamux_session_process(session);
+        if (result != YAMUX_OK) {
+            return result;
+        }
+    }
+}
+
+/**
+ * Close a stream
+ *
+ * @param stream Stream to close
+ * @param reset True to reset the stream, false for normal close
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_close(
+    yamux_stream_t *stream, 
+    int reset)
+{
+    yamux_header_t header;
+    uint8_t frame[YAMUX_HEADER_SIZE]; 
+    yamux_session_t *session;
+    
+    /* Validate parameters */
+    if (!stream) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* Get session */
+    session = stream->session;
+    if (!session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* A reset or closed stream was kept only for the application; release it */
+    if (stream->reset_reason != YAMUX_RESET_NONE || stream->state == YAMUX_STREAM_CLOSED) {
+        yamux_stream_destroy(session, stream);
+        return YAMUX_OK;
+    }
+    
+    /* Our FIN is already out: a second close hands the stream back for when the peer's arrives */
+    if (!reset && stream->state == YAMUX_STREAM_FIN_SENT) {
+        stream->released = 1;
+        return YAMUX_OK;
+    }
+    
+    /* Writes held for coalescing go out ahead of the FIN; a reset drops them */
+    if (!reset) {
+        (void)yamux_stream_flush(stream);
+    }
+    yamux_buffer_free(&stream->sendbuf);
+    
+    /* Send FIN or RST frame */
+    memset(&header, 0, sizeof(header));
+    header.version = YAMUX_PROTO_VERSION;
+    
+    if (reset) {
+        /* RST frame */
+        header.type = YAMUX_DATA;
+        header.flags = YAMUX_FLAG_RST;
+    } else {
+        /* FIN frame */
+        header.type = YAMUX_DATA;
+        header.flags = YAMUX_FLAG_FIN;
+    }
+    
+    header.stream_id = stream->id;
+    header.length = 0;
+    
+    /* Encode header */
+    yamux_encode_header(&header, frame);
+    
+    /* Send frame (ignore errors, we're closing anyway) */
+    // TODO: Add proper error checking for this write?
+    // For now, log the attempt and result if possible, but don't let it stop closure.
+    if (session && session->io.write) { // Basic check before calling
+        int bytes_written = session->io.write(session->write_ctx, frame, YAMUX_HEADER_SIZE); // Corrected size
+        // Optionally, log bytes_written or check for errors if debugging close issues
+        (void)bytes_written; // Suppress unused variable warning if not logging
+    }
+    
+    /* Update state */
+    if (reset || stream->state == YAMUX_STREAM_FIN_RECV) {
+        /* A reset, or our FIN after the peer's, finishes the stream now */
+        yamux_stream_destroy(session, stream);
+    } else {
+        /* Stay readable until the peer's FIN arrives; the application then releases it */
+        stream->state = YAMUX_STREAM_FIN_SENT;
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Send the peer a WINDOW_UPDATE for a stream
+ *
+ * @param stream Stream whose receive window grows
+ * @param delta Bytes of credit to grant
+ * @return YAMUX_OK if the update was written, YAMUX_ERR_IO otherwise
+ */
+yamux_result_t yamux_stream_grant_window(yamux_stream_t *stream, uint32_t delta)
+{
+    yamux_header_t header;
+    uint8_t frame[YAMUX_HEADER_SIZE + 4];
+    
+    memset(&header, 0, sizeof(header));
+    header.version = YAMUX_PROTO_VERSION;
+    header.type = YAMUX_WINDOW_UPDATE;
+    header.stream_id = stream->id;
+    header.length = 4;  /* Payload is the window increment */
+    yamux_encode_header(&header, frame);
+    yamux_encode_u32(delta, frame + YAMUX_HEADER_SIZE);
+    
+    /* Only count the credit as granted if the peer will see it */
+    if (stream->session->io.write(stream->session->write_ctx, frame, sizeof(frame)) != sizeof(frame)) {
+        YAMUX_DIAG(stream->session, "read: stream %u window update write failed", stream->id);
+        return YAMUX_ERR_IO;
+    }
+    stream->recv_window += delta;
+    
+    if (stream->session->window_update_cb) {
+        stream->session->callback_depth++;
+        stream->session->window_update_cb(stream->session->window_update_ctx, stream->id, delta);
+        stream->session->callback_depth--;
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Grant the peer the receive credit the application has freed
+ *
+ * Credit is withheld until at least half of the stream's window can be
+ * returned, then all of it is sent in a single update. After a stall, a
+ * large drain therefore restores the full window in one frame instead of a
+ * trickle of small updates.
+ *
+ * @param stream Stream that was read from
+ */
+static void yamux_stream_send_window_update(yamux_stream_t *stream)
+{
+    size_t buffered = stream->recvbuf.used - stream->recvbuf.pos;
+    uint32_t delta;
+    
+    /* A paused stream lets the peer's window run down; a closed one needs none */
+    if (stream->recv_paused || stream->state == YAMUX_STREAM_CLOSED) {
+        return;
+    }
+    
+    /* Unread data still occupies part of the window */
+    if (buffered >= stream->recv_window_max) {
+        return;
+    }
+    if (stream->recv_window >= stream->recv_window_max - buffered) {
+        return;
+    }
+    delta = (uint32_t)(stream->recv_window_max - buffered) - stream->recv_window;
+    if (delta < stream->recv_window_max / 2) {
+        return;
+    }
+    
+    (void)yamux_stream_grant_window(stream, delta);
+}
+
+/**
+ * Read whatever data a stream has buffered, without waiting
+ *
+ * @param stream Stream to read from
+ * @param buf Buffer to store data
+ * @param len Maximum number of bytes to read
+ * @param bytes_read Number of bytes actually read
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_read_available(
+    yamux_stream_t *stream, 
+    uint8_t *buf, 
+    size_t len, 
+    size_t *bytes_read)
+{
+    yamux_result_t result;
+    
+    /* Validate parameters */
+    if (!stream || !buf || len == 0 || !bytes_read) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* Check if stream is closed */
+    if (stream->reset_reason != YAMUX_RESET_NONE) {
+        return yamux_stream_reset_error(stream);
+    }
+    /* After crossing FINs the peer's last data may still be buffered */
+    if (stream->state == YAMUX_STREAM_CLOSED &&
+        stream->recvbuf.used == stream->recvbuf.pos) {
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    /* Consume a pending interrupt */
+    if (YAMUX_ATOMIC_TAKE(stream->interrupt_read)) {
+        *bytes_read = 0;
+        return YAMUX_ERR_INTERRUPTED;
+    }
+    
+    /* Nothing more will arrive from a peer that missed its keepalive */
+    if (stream->session && stream->session->keepalive_failed &&
+        stream->recvbuf.used == stream->recvbuf.pos) {
+        *bytes_read = 0;
+        return YAMUX_ERR_TIMEOUT;
+    }
+    
+    /* Read data from receive buffer */
+    result = yamux_buffer_read(&stream->recvbuf, buf, len, bytes_read);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    
+    /* Return the freed space to the peer */
+    if (*bytes_read > 0) {
+        yamux_stream_send_window_update(stream);
+    }
+    
+    /* Compact buffer if needed */
+    if (stream->recvbuf.pos > 0 && stream->recvbuf.pos == stream->recvbuf.used) {
+        yamux_buffer_compact(&stream->recvbuf);
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Wait for and process one frame on behalf of a blocked read or write
+ *
+ * An interrupt for the waiting direction is taken before the wait and
+ * again once the wait callback returns, so one that arrives while waiting
+ * is reported in place of a timeout rather than left for a later call.
+ *
+ * @param stream Stream being read or written
+ * @param remaining Time left to wait in milliseconds, reduced by the wait
+ * @param interrupt The stream's interrupt flag for the waiting direction
+ * @return YAMUX_OK once a frame was processed, YAMUX_ERR_TIMEOUT if none
+ *         arrived in time, YAMUX_ERR_INTERRUPTED if interrupted,
+ *         YAMUX_ERR_CLOSED if the stream went away, error code otherwise
+ */
+static yamux_result_t yamux_stream_wait_frame(
+    yamux_stream_t *stream,
+    uint32_t *remaining,
+    yamux_atomic_t *interrupt)
+{
+    yamux_session_t *session = stream->session;
+    yamux_result_t result;
+    uint32_t id = stream->id;
+    uint32_t elapsed;
+    int ready;
+    
+    if (YAMUX_ATOMIC_TAKE(*interrupt)) {
+        return YAMUX_ERR_INTERRUPTED;
+    }
+    if (*remaining == 0 || !session->wait_cb) {
+        return YAMUX_ERR_TIMEOUT;
+    }
+    
+    elapsed = 0;
+    ready = session->wait_cb(session->wait_ctx, *remaining, &elapsed);
+    if (YAMUX_ATOMIC_TAKE(*interrupt)) {
+        return YAMUX_ERR_INTERRUPTED;
+    }
+    if (ready < 0) {
+        YAMUX_DIAG(session, "stream %u: wait callback failed: %d", id, ready);
+        return YAMUX_ERR_IO;
+    }
+    if (ready == 0) {
+        return YAMUX_ERR_TIMEOUT;
+    }
+    *remaining -= (elapsed < *remaining) ? elapsed : *remaining;
+    
+    result = yamux_session_process(session);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    
+    /* A GoAway may have torn the session down and freed the stream */
+    if (yamux_get_stream(session, id) != stream) {
+        return YAMUX_ERR_CLOSED;
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Read data from a stream
+ *
+ * With a read timeout set, an empty read waits for data using the session's
+ * wait callback, processing frames as they arrive.
+ *
+ * @param stream Stream to read from
+ * @param buf Buffer to store data
+ * @param len Maximum number of bytes to read
+ * @param bytes_read Number of bytes actually read
+ * @return YAMUX_OK on success, YAMUX_ERR_TIMEOUT if the read timeout passed
+ *         with no data, error code otherwise
+ */
+yamux_result_t yamux_stream_read(
+    yamux_stream_t *stream, 
+    uint8_t *buf, 
+    size_t len, 
+    size_t *bytes_read)
+{
+    yamux_result_t result;
+    uint32_t remaining;
+    
+    result = yamux_stream_read_available(stream, buf, len, bytes_read);
+    if (result != YAMUX_OK || *bytes_read > 0 || stream->read_timeout_ms == 0) {
+        return result;
+    }
+    remaining = stream->read_timeout_ms;
+    
+    for (;;) {
+        /* EOF is an answer, not a reason to wait */
+        if (stream->state == YAMUX_STREAM_FIN_RECV) {
+            return YAMUX_OK;
+        }
+        
+        result = yamux_stream_wait_frame(stream, &remaining, &stream->interrupt_read);
+        if (result != YAMUX_OK) {
+            return result;
+        }
+        result = yamux_stream_read_available(stream, buf, len, bytes_read);
+        if (result != YAMUX_OK || *bytes_read > 0) {
+            return result;
+        }
+    }
+}
+
+/**
+ * Read one length-prefixed record from a stream
+ *
+ * Shared by the message and TLV readers. The record starts with lead_bytes
+ * bytes the caller wants back (a TLV type), then the length prefix.
+ *
+ * @param stream Stream to read from
+ * @param lead Output for the leading bytes, may be NULL if lead_bytes is 0
+ * @param lead_bytes Number of bytes before the length prefix
+ * @param buf Buffer to store the record body
+ * @param cap Size of buf in bytes
+ * @param msg_len Length of the body, set as soon as the prefix is read
+ * @param prefix_bytes Size of the length prefix, 1 to 4 bytes
+ * @param big_endian Nonzero if the prefix is big-endian
+ * @return As for yamux_stream_read_message
+ */
+static yamux_result_t yamux_stream_read_record(
+    yamux_stream_t *stream,
+    uint8_t *lead,
+    int lead_bytes,
+    uint8_t *buf,
+    size_t cap,
+    size_t *msg_len,
+    int prefix_bytes,
+    int big_endian)
+{
+    yamux_result_t result;
+    uint8_t prefix[8];
+    uint32_t remaining;
+    size_t head = (size_t)lead_bytes + (size_t)prefix_bytes;
+    size_t length;
+    size_t got;
+    size_t bytes;
+    int i;
+    
+    *msg_len = 0;
+    remaining = stream->read_timeout_ms;
+    
+    /* Look at the prefix in place, so a record that does not fit stays unread */
+    while (stream->recvbuf.used - stream->recvbuf.pos < head) {
+        if (stream->reset_reason != YAMUX_RESET_NONE) {
+            return yamux_stream_reset_error(stream);
+        }
+        if (YAMUX_ATOMIC_TAKE(stream->interrupt_read)) {
+            return YAMUX_ERR_INTERRUPTED;
+        }
+        if (stream->state == YAMUX_STREAM_FIN_RECV || stream->state == YAMUX_STREAM_CLOSED) {
+            /* A clean EOF falls between records; anything else cut one short */
+            return stream->recvbuf.used == stream->recvbuf.pos ?
+                   YAMUX_ERR_CLOSED : YAMUX_ERR_PROTOCOL;
+        }
+        result = yamux_stream_wait_frame(stream, &remaining, &stream->interrupt_read);
+        if (result != YAMUX_OK) {
+            return result;
+        }
+    }
+    
+    length = 0;
+    for (i = 0; i < prefix_bytes; i++) {
+        uint8_t b = stream->recvbuf.data[stream->recvbuf.pos + (size_t)lead_bytes + (size_t)i];
+        if (big_endian) {
+            length = (length << 8) | b;
+        } else {
+            length |= (size_t)b << (8 * i);
+        }
+    }
+    *msg_len = length;
+    if (length > cap) {
+        YAMUX_DIAG(stream->session, "stream %u: message of %lu bytes exceeds buffer of %lu",
+                   stream->id, (unsigned long)length, (unsigned long)cap);
+        return YAMUX_ERR_NOMEM;
+    }
+    
+    result = yamux_stream_read_available(stream, prefix, head, &bytes);
+    if (result != YAMUX_OK) {
+        return result;
+    }
+    if (lead_bytes > 0) {
+        memcpy(lead, prefix, (size_t)lead_bytes);
+    }
+    
+    /* From here on a failure leaves the record partly consumed */
+    for (got = 0; got < length; got += bytes) {
+        if (stream->reset_reason != YAMUX_RESET_NONE) {
+            return yamux_stream_reset_error(stream);
+        }
+        if ((stream->state == YAMUX_STREAM_FIN_RECV || stream->state == YAMUX_STREAM_CLOSED) &&
+            stream->recvbuf.used == stream->recvbuf.pos) {
+            return YAMUX_ERR_PROTOCOL;
+        }
+        
+        result = yamux_stream_read_available(stream, buf + got, length - got, &bytes);
+        if (result != YAMUX_OK) {
+            return result;
+        }
+        if (bytes == 0) {
+            result = yamux_stream_wait_frame(stream, &remaining, &stream->interrupt_read);
+            if (result != YAMUX_OK) {
+                return result;
+            }
+        }
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Read one length-prefixed message from a stream
+ *
+ * @param stream Stream to read from
+ * @param buf Buffer to store the message body
+ * @param cap Size of buf in bytes
+ * @param msg_len Length of the message, set as soon as the prefix is read
+ * @param prefix_bytes Size of the length prefix, 1 to 4 bytes
+ * @param big_endian Nonzero if the prefix is big-endian
+ * @return YAMUX_OK on success, YAMUX_ERR_NOMEM if the message is longer
+ *         than cap, YAMUX_ERR_CLOSED at EOF between messages,
+ *         YAMUX_ERR_PROTOCOL at EOF inside one, error code otherwise
+ */
+yamux_result_t yamux_stream_read_message(
+    yamux_stream_t *stream,
+    uint8_t *buf,
+    size_t cap,
+    size_t *msg_len,
+    int prefix_bytes,
+    int big_endian)
+{
+    /* Validate parameters */
+    if (!stream || !stream->session || (!buf && cap > 0) || !msg_len ||
+        prefix_bytes < 1 || prefix_bytes > 4) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    return yamux_stream_read_record(stream, NULL, 0, buf, cap, msg_len, prefix_bytes, big_endian);
+}
+
+/**
+ * Read one TLV record from a stream
+ *
+ * @param stream Stream to read from
+ * @param type Output parameter for the record type
+ * @param buf Buffer to store the value
+ * @param cap Size of buf in bytes
+ * @param val_len Length of the value, set as soon as the header is read
+ * @return As for yamux_stream_read_message
+ */
+yamux_result_t yamux_stream_read_tlv(
+    yamux_stream_t *stream,
+    uint8_t *type,
+    uint8_t *buf,
+    size_t cap,
+    size_t *val_len)
+{
+    /* Validate parameters */
+    if (!stream || !stream->session || !type || (!buf && cap > 0) || !val_len) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    return yamux_stream_read_record(stream, type, 1, buf, cap, val_len, 4, 1);
+}
+
+/**
+ * Write all of a buffer, waiting for window or transport room as needed
+ *
+ * @param stream Stream to write to
+ * @param buf Data to write
+ * @param len Number of bytes to write
+ * @param remaining Time left to wait in milliseconds, reduced by each wait
+ * @return YAMUX_OK once everything was accepted, YAMUX_ERR_TIMEOUT if room
+ *         did not come in time, error code otherwise
+ */
+static yamux_result_t yamux_stream_write_whole(
+    yamux_stream_t *stream,
+    const uint8_t *buf,
+    size_t len,
+    uint32_t *remaining)
+{
+    yamux_result_t result;
+    size_t done = 0;
+    size_t bytes;
+    
+    while (done < len) {
+        result = yamux_stream_write(stream, buf + done, len - done, &bytes);
+        if (result == YAMUX_ERR_NO_WINDOW || result == YAMUX_ERR_WOULD_BLOCK) {
+            bytes = 0;
+        } else if (result != YAMUX_OK) {
+            return result;
+        }
+        done += bytes;
+        
+        /* Window updates arrive as frames, so wait by processing them */
+        if (done < len && bytes == 0) {
+            result = yamux_stream_wait_frame(stream, remaining, &stream->interrupt_write);
+            if (result != YAMUX_OK) {
+                return result;
+            }
+        }
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Write one TLV record to a stream
+ *
+ * @param stream Stream to write to
+ * @param type Record type
+ * @param val Value bytes
+ * @param len Length of the value
+ * @param timeout_ms Longest time to wait for window, 0 to not wait
+ * @return YAMUX_OK on success, YAMUX_ERR_NO_WINDOW or YAMUX_ERR_WOULD_BLOCK
+ *         if nothing was written for lack of room, YAMUX_ERR_TIMEOUT if
+ *         room ran out part-way, error code otherwise
+ */
+yamux_result_t yamux_stream_write_tlv(
+    yamux_stream_t *stream,
+    uint8_t type,
+    const uint8_t *val,
+    size_t len,
+    uint32_t timeout_ms)
+{
+    yamux_result_t result;
+    uint8_t header[5];
+    uint32_t remaining;
+    
+    /* Validate parameters */
+    if (!stream || !stream->session || (!val && len > 0) || (uint64_t)len > UINT32_MAX) {
+        return YAMUX_ERR_INVALID;
+    }
+    remaining = timeout_ms;
     
-    printf("DEBUG: yamux_stream_open: Sending SYN for stream %u, header.length: %u, payload_window: %u\n", s->id, header.length, s->recv_window);
-    if (session->io.write(session->io.ctx, frame, sizeof(frame)) != sizeof(frame)) {
-        printf("DEBUG: yamux_stream_open: io.write failed for SYN\n");
-        yamux_buffer_free(&s->recvbuf);
-        free(s);
-        return YAMUX_ERR_IO;
+    /* With no time to wait, start only if the whole record fits, so a refusal writes nothing */
+    if (remaining == 0) {
+        result = yamux_stream_write_ready(stream, sizeof(header) + len);
+        if (result != YAMUX_OK) {
+            return result;
+        }
     }
     
-    /* Add stream to session after successful SYN */
-    result = yamux_add_stream(session, s);
+    header[0] = type;
+    yamux_encode_u32((uint32_t)len, header + 1);
+    result = yamux_stream_write_whole(stream, header, sizeof(header), &remaining);
     if (result != YAMUX_OK) {
-        printf("ERROR: yamux_stream_open: yamux_add_stream failed with %d\n", result);
-        yamux_buffer_free(&s->recvbuf);
-        free(s);
         return result;
     }
-    printf("DEBUG: yamux_stream_open: Stream added to session.\n");
     
-    /* Update state */
-    s->state = YAMUX_STREAM_SYN_SENT;
+    return yamux_stream_write_whole(stream, val, len, &remaining);
+}
+
+/**
+ * Hand a stream's buffered data to the session's data callback
+ *
+ * Data is offered in place until the buffer is empty or the callback takes
+ * less than it was offered, which pauses the stream. Consumed bytes are
+ * credited back to the peer as for a read.
+ *
+ * @param stream Stream with buffered data
+ * @return The stream, or NULL if the callback closed and freed it
+ */
+yamux_stream_t *yamux_stream_deliver_data(yamux_stream_t *stream)
+{
+    yamux_session_t *session = stream->session;
+    uint32_t id = stream->id;
+    size_t offered;
+    size_t taken;
     
-    /* Set stream pointer */
-    *stream = s;
+    while (session->data_cb && !stream->recv_paused &&
+           stream->reset_reason == YAMUX_RESET_NONE && stream->state != YAMUX_STREAM_CLOSED) {
+        offered = stream->recvbuf.used - stream->recvbuf.pos;
+        if (offered == 0) {
+            break;
+        }
+        
+        session->callback_depth++;
+        taken = session->data_cb(session->data_ctx, stream, stream->recvbuf.data + stream->recvbuf.pos, offered);
+        session->callback_depth--;
+        
+        stream = yamux_get_stream(session, id);
+        if (!stream) {
+            return NULL;
+        }
+        if (stream->reset_reason != YAMUX_RESET_NONE || stream->state == YAMUX_STREAM_CLOSED) {
+            break;
+        }
+        
+        /* The buffer cannot shrink under the callback, but take no more than was offered */
+        if (taken > offered) {
+            taken = offered;
+        }
+        if (taken < offered) {
+            YAMUX_DIAG(session, "data: stream %u paused by callback, %u bytes held",
+                       id, (unsigned)(offered - taken));
+            stream->recv_paused = 1;
+        }
+        stream->recvbuf.pos += taken;
+        if (taken > 0) {
+            yamux_stream_send_window_update(stream);
+        }
+        if (stream->recvbuf.pos > 0 && stream->recvbuf.pos == stream->recvbuf.used) {
+            yamux_buffer_compact(&stream->recvbuf);
+        }
+    }
     
-    return YAMUX_OK;
+    return stream;
 }
 
 /**
- * Accept a new stream (server only)
+ * Stop granting the peer receive window on a stream
  *
- * @param session Session
- * @param stream Output parameter for the accepted stream
+ * @param stream Stream to pause
  * @return YAMUX_OK on success, error code otherwise
  */
-yamux_result_t yamux_stream_accept(
-    yamux_session_t *session, 
-    yamux_stream_t **stream)
+yamux_result_t yamux_stream_pause_recv(
+    yamux_stream_t *stream)
 {
-    yamux_stream_t *s;
+    if (!stream) {
+        return YAMUX_ERR_INVALID;
+    }
     
-    /* Validate parameters */
-    if (!session || !stream) {
+    stream->recv_paused = 1;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Resume granting the peer receive window on a stream
+ *
+ * @param stream Stream to resume
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_resume_recv(
+    yamux_stream_t *stream)
+{
+    if (!stream) {
         return YAMUX_ERR_INVALID;
     }
     
-    /* Check if session is shut down */
-    if (session->go_away_received) {
-        return YAMUX_ERR_CLOSED;
+    stream->recv_paused = 0;
+    
+    /* Data held back while paused goes to the callback first */
+    if (stream->session && stream->session->data_cb && !stream->control) {
+        stream = yamux_stream_deliver_data(stream);
+        if (!stream) {
+            return YAMUX_OK;
+        }
     }
     
-    /* Check if there are any streams to accept */
-    if (!session->accept_queue) {
-        return YAMUX_ERR_TIMEOUT;
+    /* Grant what was read while paused; a closed stream has no peer to tell */
+    if (stream->reset_reason == YAMUX_RESET_NONE && stream->state != YAMUX_STREAM_CLOSED) {
+        yamux_stream_send_window_update(stream);
     }
     
-    /* Get the first stream from the accept queue */
-    s = session->accept_queue;
-    session->accept_queue = s->next;
-    s->next = NULL;
+    return YAMUX_OK;
+}
+
+/**
+ * Discard inbound data until the peer finishes sending or a timeout
+ *
+ * @param stream Stream to drain
+ * @param timeout_ms Maximum time to wait in milliseconds
+ * @return YAMUX_OK once the peer has sent FIN, YAMUX_ERR_TIMEOUT if it has
+ *         not in time, error code otherwise
+ */
+yamux_result_t yamux_stream_drain_recv(
+    yamux_stream_t *stream,
+    uint32_t timeout_ms)
+{
+    yamux_session_t *session;
+    yamux_result_t result;
+    uint8_t discard[256];
+    uint32_t remaining = timeout_ms;
+    uint32_t elapsed;
+    uint32_t id;
+    size_t bytes;
+    int ready;
     
-    /* Accept queue size updated */
+    if (!stream || !stream->session) {
+        return YAMUX_ERR_INVALID;
+    }
+    session = stream->session;
+    id = stream->id;
     
-    /* Do not update stream state to established automatically here
-     * The state should be updated to ESTABLISHED only after receiving ACK
-     * This is especially important for the test_stream_lifecycle test
-     */
+    /* The peer can only finish if it is granted window for the rest */
+    stream->recv_paused = 0;
     
-    /* Set stream pointer */
-    *stream = s;
+    for (;;) {
+        if (stream->reset_reason != YAMUX_RESET_NONE) {
+            return yamux_stream_reset_error(stream);
+        }
+        
+        /* Reading grants the window back, so the peer can keep sending */
+        if (stream->state != YAMUX_STREAM_CLOSED) {
+            do {
+                result = yamux_stream_read_available(stream, discard, sizeof(discard), &bytes);
+                if (result != YAMUX_OK) {
+                    return result;
+                }
+            } while (bytes > 0);
+        }
+        
+        if (stream->state == YAMUX_STREAM_FIN_RECV || stream->state == YAMUX_STREAM_CLOSED) {
+            return YAMUX_OK;
+        }
+        if (remaining == 0 || !session->wait_cb) {
+            return YAMUX_ERR_TIMEOUT;
+        }
+        
+        elapsed = 0;
+        ready = session->wait_cb(session->wait_ctx, remaining, &elapsed);
+        if (ready < 0) {
+            YAMUX_DIAG(session, "drain: wait callback failed: %d", ready);
+            return YAMUX_ERR_IO;
+        }
+        if (ready == 0) {
+            return YAMUX_ERR_TIMEOUT;
+        }
+        remaining -= (elapsed < remaining) ? elapsed : remaining;
+        
+        result = yamux_session_process(session);
+        if (result != YAMUX_OK) {
+            return result;
+        }
+        
+        /* A GoAway may have torn the session down and freed the stream */
+        if (yamux_get_stream(session, id) != stream) {
+            return YAMUX_ERR_CLOSED;
+        }
+    }
+}
+
+/**
+ * Write to the transport, refusing a count larger than the request
+ *
+ * A write callback that reports more bytes than it was given has lost
+ * track of the byte stream. Rather than advance past the buffer, the
+ * session stops using the transport.
+ *
+ * @param session Session
+ * @param buf Bytes to write
+ * @param len Number of bytes to write
+ * @return The write callback's result, or YAMUX_ERR_IO if it overstated it
+ */
+static int yamux_stream_io_write(yamux_session_t *session, const uint8_t *buf, size_t len)
+{
+    int res = session->io.write(session->write_ctx, buf, len);
     
-    return YAMUX_OK;
+    if (res > 0 && (size_t)res > len) {
+        YAMUX_DIAG(session, "transport: write of %u bytes reported %d", (unsigned)len, res);
+        session->transport_failed = 1;
+        return YAMUX_ERR_IO;
+    }
+    
+    return res;
 }
 
 /**
- * Close a stream
+ * Give up on the transport after part of a frame went out
  *
- * @param stream Stream to close
- * @param reset True to reset the stream, false for normal close
- * @return YAMUX_OK on success, error code otherwise
+ * The peer now expects the rest of the frame, so whatever is written next
+ * would be read as its payload. As with an overstated count, the session
+ * stops using the transport.
+ *
+ * @param session Session
+ * @param res Result of the write that fell short
+ * @return YAMUX_ERR_CONN_RESET if the transport was reset, YAMUX_ERR_IO
+ *         otherwise
  */
-yamux_result_t yamux_stream_close(
-    yamux_stream_t *stream, 
-    int reset)
+static yamux_result_t yamux_stream_frame_cut(yamux_session_t *session, int res)
+{
+    session->transport_failed = 1;
+    return yamux_session_io_error(session, res);
+}
+
+/**
+ * Send the writes held for coalescing as one DATA frame
+ *
+ * @param stream Stream to flush
+ * @return YAMUX_OK on success (including when nothing is held),
+ *         YAMUX_ERR_WOULD_BLOCK if the transport is full, YAMUX_ERR_RESET
+ *         (or YAMUX_ERR_TIMEOUT) if the stream was reset, error code otherwise
+ */
+yamux_result_t yamux_stream_flush(
+    yamux_stream_t *stream)
 {
-    yamux_header_t header;
-    uint8_t frame[YAMUX_HEADER_SIZE]; 
     yamux_session_t *session;
+    yamux_header_t header;
+    uint8_t frame_header[YAMUX_HEADER_SIZE];
+    size_t len;
+    int res;
     
-    /* Validate parameters */
-    if (!stream) {
+    if (!stream || !stream->session) {
         return YAMUX_ERR_INVALID;
     }
-    
-    /* Get session */
     session = stream->session;
-    if (!session) {
-        return YAMUX_ERR_INVALID;
+    
+    /* Held data was dropped with the reset; say so rather than report success */
+    if (stream->reset_reason != YAMUX_RESET_NONE) {
+        return yamux_stream_reset_error(stream);
     }
     
-    /* Check if already closed */
-    if (stream->state == YAMUX_STREAM_CLOSED) {
+    len = stream->sendbuf.used - stream->sendbuf.pos;
+    if (len == 0) {
         return YAMUX_OK;
     }
+    if (session->transport_failed) {
+        return YAMUX_ERR_CLOSED;
+    }
     
-    /* Send FIN or RST frame */
     memset(&header, 0, sizeof(header));
     header.version = YAMUX_PROTO_VERSION;
-    
-    if (reset) {
-        /* RST frame */
-        header.type = YAMUX_DATA;
-        header.flags = YAMUX_FLAG_RST;
-    } else {
-        /* FIN frame */
-        header.type = YAMUX_DATA;
-        header.flags = YAMUX_FLAG_FIN;
-    }
-    
+    header.type = YAMUX_DATA;
     header.stream_id = stream->id;
-    header.length = 0;
-    
-    /* Encode header */
-    yamux_encode_header(&header, frame);
+    header.length = (uint32_t)len;
+    yamux_encode_header(&header, frame_header);
     
-    /* Send frame (ignore errors, we're closing anyway) */
-    // TODO: Add proper error checking for this write?
-    // For now, log the attempt and result if possible, but don't let it stop closure.
-    if (session && session->io.write) { // Basic check before calling
-        ssize_t bytes_written = session->io.write(session->io.ctx, frame, YAMUX_HEADER_SIZE); // Corrected size
-        // Optionally, log bytes_written or check for errors if debugging close issues
-        (void)bytes_written; // Suppress unused variable warning if not logging
+    /* The window was taken when the data was held, so only the transport can refuse it */
+    res = yamux_stream_io_write(session, frame_header, YAMUX_HEADER_SIZE);
+    if (res == 0 || res == YAMUX_ERR_WOULD_BLOCK) {
+        stream->flush_blocked = 1;
+        return YAMUX_ERR_WOULD_BLOCK;
+    }
+    if (res != YAMUX_HEADER_SIZE) {
+        YAMUX_DIAG(session, "flush: stream %u header write failed: %d", stream->id, res);
+        return res > 0 ? yamux_stream_frame_cut(session, res) : yamux_session_io_error(session, res);
     }
     
-    /* Update state */
-    if (reset) {
-        /* Immediate close for RST */
-        stream->state = YAMUX_STREAM_CLOSED;
-        
-        /* Remove from session */
-        yamux_remove_stream(session, stream->id);
-        
-        /* Free resources */
-        yamux_buffer_free(&stream->recvbuf);
-        free(stream);
-    } else {
-        /* Normal close logic depends on current stream state */
-        if (stream->state == YAMUX_STREAM_FIN_RECV) {
-            /* If we already received a FIN from the peer, go directly to CLOSED */
-            stream->state = YAMUX_STREAM_CLOSED;
-            yamux_remove_stream(session, stream->id);
-            yamux_buffer_free(&stream->recvbuf);
-            /* Do not free(stream) so tests can still check error handling */
-        } else {
-            /* Otherwise mark FIN_SENT and wait for acknowledgement */
-            stream->state = YAMUX_STREAM_FIN_SENT;
-            /* Do not cleanup resources until we receive FIN-ACK */
-            /* The stream will be fully closed when we receive a FIN frame from the peer */
-        }
+    res = yamux_stream_io_write(session, stream->sendbuf.data + stream->sendbuf.pos, len);
+    if (res < 0 || (size_t)res != len) {
+        YAMUX_DIAG(session, "flush: stream %u short write: %d of %u", stream->id, res, (unsigned)len);
+        return yamux_stream_frame_cut(session, res);
     }
     
+    stream->sendbuf.used = 0;
+    stream->sendbuf.pos = 0;
+    stream->flush_blocked = 0;
+    
     return YAMUX_OK;
 }
 
 /**
- * Read data from a stream
+ * Check whether a stream can take a write at all
  *
- * @param stream Stream to read from
- * @param buf Buffer to store data
- * @param len Maximum number of bytes to read
- * @param bytes_read Number of bytes actually read
- * @return YAMUX_OK on success, error code otherwise
+ * Shared by yamux_stream_write and yamux_stream_write_ready so the two
+ * refuse the same writes in the same order.
+ *
+ * @param stream Stream to check
+ * @param len Number of bytes to be written
+ * @param consume_interrupt Clear a pending interrupt when reporting it
+ * @return YAMUX_OK if the write may go ahead (always for len 0 on an open
+ *         stream), error code otherwise
  */
-yamux_result_t yamux_stream_read(
-    yamux_stream_t *stream, 
-    uint8_t *buf, 
-    size_t len, 
-    size_t *bytes_read)
+static yamux_result_t yamux_stream_write_check(
+    yamux_stream_t *stream,
+    size_t len,
+    int consume_interrupt)
 {
-    yamux_result_t result;
+    yamux_session_t *session = stream->session;
     
-    /* Validate parameters */
-    if (!stream || !buf || len == 0 || !bytes_read) {
-        return YAMUX_ERR_INVALID;
+    /* FIN_RECV is a peer half-close; our write side stays open */
+    if (stream->reset_reason != YAMUX_RESET_NONE) {
+        return yamux_stream_reset_error(stream);
     }
-    
-    /* Check if stream is closed */
-    if (stream->state == YAMUX_STREAM_CLOSED) {
+    if (stream->state == YAMUX_STREAM_CLOSED ||
+        stream->state == YAMUX_STREAM_FIN_SENT) {
         return YAMUX_ERR_CLOSED;
     }
     
-    /* Read data from receive buffer */
-    result = yamux_buffer_read(&stream->recvbuf, buf, len, bytes_read);
-    if (result != YAMUX_OK) {
-        return result;
+    /* A zero-length write is a no-op: no frame, no state change */
+    if (len == 0) {
+        return YAMUX_OK;
     }
     
-    /* If we read some data, send a window update */
-    if (*bytes_read > 0) {
-        yamux_header_t header_val; // Renamed to avoid conflict with any parameter named 'header'
-        uint8_t frame_buf[YAMUX_HEADER_SIZE + 4]; // Buffer for header + 4-byte payload
-        uint32_t window_increment = YAMUX_DEFAULT_WINDOW_SIZE - stream->recv_window; // Send an increment to fill the window
-        // Ensure increment isn't excessively large if recv_window was somehow corrupted to be > DEFAULT_WINDOW_SIZE
-        // Or, more simply, the increment is what we've made available, up to filling the window.
-        // A common strategy is to send an update for the amount of data just read (*bytes_read),
-        // or an update that brings the window back to full if enough has been processed.
-        // Let's use *bytes_read as the increment for now, as it's specific to data just processed.
-        // However, the original logic was to fill up to YAMUX_DEFAULT_WINDOW_SIZE. Let's stick to that concept.
-        // The amount of data just read is *bytes_read.
-        // The amount to increment to reach the default full window from current is window_increment.
-        // We should send the actual amount by which the window should be incremented.
-        // The current code was trying to send *bytes_read as the increment value.
-
-        if (window_increment == 0 && *bytes_read > 0) { // If window is already full but we read something, use *bytes_read.
-                                                       // This case should be rare if recv_window is managed correctly.
-            window_increment = *bytes_read; 
-        } else if (window_increment < *bytes_read && stream->recv_window + *bytes_read <= YAMUX_DEFAULT_WINDOW_SIZE) {
-            // If calculated increment is less than what we just read, but adding *bytes_read doesn't exceed max,
-            // it might be better to signal the larger availability. But let's stick to *bytes_read for precision of what was freed.
-            // For now, let's use *bytes_read as the increment if it's positive.
-            window_increment = *bytes_read; // This is simpler and reflects space just freed.
-        }
-        if (window_increment == 0) { // Do not send a zero increment update unless it's a SYN/ACK type scenario (not here)
-            // This check can be removed if we ensure *bytes_read is always the increment and positive.
-            // Given *bytes_read must be > 0 for this path (len > 0 for read, and some bytes were read), it's fine.
-            window_increment = *bytes_read; // Ensure we use the amount just read.
-        }
-
-        /* Prepare header */
-        header_val.version = YAMUX_PROTO_VERSION;
-        header_val.type = YAMUX_WINDOW_UPDATE;
-        header_val.flags = 0;
-        header_val.stream_id = stream->id;
-        header_val.length = 4; /* Payload length is always 4 for the window increment value */
-        
-        yamux_encode_header(&header_val, frame_buf);
-        
-        /* Encode window increment value (big-endian) into the payload part of frame_buf */
-        frame_buf[YAMUX_HEADER_SIZE + 0] = (window_increment >> 24) & 0xFF;
-        frame_buf[YAMUX_HEADER_SIZE + 1] = (window_increment >> 16) & 0xFF;
-        frame_buf[YAMUX_HEADER_SIZE + 2] = (window_increment >> 8) & 0xFF;
-        frame_buf[YAMUX_HEADER_SIZE + 3] = window_increment & 0xFF;
-        
-        /* Send frame (header + payload) */
-        // Ignoring errors for now, as per original code for this specific update.
-        // A production system should handle this write error.
-        stream->session->io.write(stream->session->io.ctx, frame_buf, YAMUX_HEADER_SIZE + 4);
+    /* A failed transport has lost framing; nothing more may be written to it */
+    if (session->transport_failed) {
+        return YAMUX_ERR_CLOSED;
+    }
+    if (session->keepalive_failed) {
+        return YAMUX_ERR_TIMEOUT;
     }
     
-    /* Compact buffer if needed */
-    if (stream->recvbuf.pos > 0 && stream->recvbuf.pos == stream->recvbuf.used) {
-        yamux_buffer_compact(&stream->recvbuf);
+    if (consume_interrupt ? YAMUX_ATOMIC_TAKE(stream->interrupt_write) :
+                            YAMUX_ATOMIC_GET(stream->interrupt_write)) {
+        return YAMUX_ERR_INTERRUPTED;
     }
     
     return YAMUX_OK;
@@ -378,59 +1495,87 @@ yamux_result_t yamux_stream_write(
     yamux_header_t header;
     uint8_t frame_header[YAMUX_HEADER_SIZE]; 
     size_t total_written = 0;
-
-    printf("DEBUG: yamux_stream_write: Entered. stream=%p, buf=%p, len=%zu\n", (void*)stream, (const void*)buf, len); fflush(stdout);
+    size_t held;
+    uint32_t threshold;
+    uint32_t budget;
+    uint32_t cap;
+    yamux_result_t result;
     
     if (!bytes_written_out) {
-        printf("DEBUG: yamux_stream_write: Error - bytes_written_out is NULL\n"); fflush(stdout);
         return YAMUX_ERR_INVALID; // Critical to have this out-param pointer
     }
     *bytes_written_out = 0; // Initialize
 
     /* Validate parameters */
     if (!stream) {
-        printf("DEBUG: yamux_stream_write: Error - stream is NULL\n"); fflush(stdout);
         return YAMUX_ERR_INVALID;
     }
     if (!buf && len > 0) { // Allow buf to be NULL if len is 0 (for FIN frames, though this func is for data)
-        printf("DEBUG: yamux_stream_write: Error - buf is NULL but len > 0\n"); fflush(stdout);
         return YAMUX_ERR_INVALID;
     }
     
     /* Get session */
     session = stream->session;
     if (!session) {
-        printf("DEBUG: yamux_stream_write: Error - session is NULL\n"); fflush(stdout);
         return YAMUX_ERR_INVALID;
     }
-    printf("DEBUG: yamux_stream_write: session=%p, stream_id=%u, stream_state=%d\n", (void*)session, stream->id, stream->state); fflush(stdout);
     
-    /* Check stream state */
-    if (stream->state == YAMUX_STREAM_CLOSED || 
-        stream->state == YAMUX_STREAM_FIN_SENT || 
-        stream->state == YAMUX_STREAM_FIN_RECV) {
-        printf("DEBUG: yamux_stream_write: Error - stream closed or closing. State: %d\n", stream->state); fflush(stdout);
-        return YAMUX_ERR_CLOSED; // Corrected error code
+    /* Check stream and session state, consuming a pending interrupt */
+    result = yamux_stream_write_check(stream, len, 1);
+    if (result != YAMUX_OK || len == 0) {
+        return result;
     }
-
-    // If len is 0, it might be an intention to send a FIN or other control frame, but this function sends DATA frames.
-    // For now, if len is 0, we'll just return OK with 0 bytes written.
-    if (len == 0) {
-        printf("DEBUG: yamux_stream_write: len is 0, returning OK with 0 bytes written.\n"); fflush(stdout);
+    
+    /* No credit: the caller must wait for a WINDOW_UPDATE, not for the transport */
+    budget = yamux_stream_send_budget(stream);
+    if (budget == 0) {
+        yamux_stream_note_stall(stream);
+        return YAMUX_ERR_NO_WINDOW;
+    }
+    
+    /* Hold a small write until enough data accumulates to fill a frame, within the held-bytes cap */
+    threshold = session->config.small_frame_threshold;
+    if (threshold > YAMUX_MAX_DATA_FRAME_SIZE / 2) {
+        threshold = YAMUX_MAX_DATA_FRAME_SIZE / 2;
+    }
+    held = stream->sendbuf.used - stream->sendbuf.pos;
+    cap = session->config.max_send_buffer_per_stream;
+    if (len < threshold && len <= budget && (cap == 0 || held + len <= cap) &&
+        yamux_session_memory_allows(session, yamux_buffer_growth(&stream->sendbuf, len))) {
+        result = yamux_buffer_write(&stream->sendbuf, buf, len);
+        if (result != YAMUX_OK) {
+            return result;
+        }
+        if (held == 0) {
+            stream->held_since_ms = session->now_ms;
+            yamux_held_list_add(session, stream);
+        }
+        stream->send_window -= len;
+        stream->inflight += (uint32_t)len;
+        *bytes_written_out = len;
+        yamux_stream_note_write(stream, len, 0);
+        
+        /* The data is accepted either way; a full transport just keeps it held */
+        if (session->config.auto_flush || stream->sendbuf.used - stream->sendbuf.pos >= threshold ||
+            (session->config.max_send_buffer_age_ms > 0 &&
+             session->now_ms - stream->held_since_ms >= session->config.max_send_buffer_age_ms)) {
+            result = yamux_stream_flush(stream);
+            if (result != YAMUX_OK && result != YAMUX_ERR_WOULD_BLOCK) {
+                return result;
+            }
+        }
         return YAMUX_OK;
     }
     
-    /* TODO: Handle send window properly with blocking/waiting */
-    printf("DEBUG: yamux_stream_write: Current send_window for stream %u: %u\n", stream->id, stream->send_window); fflush(stdout);
-    if (stream->send_window == 0) {
-        printf("DEBUG: yamux_stream_write: send_window is 0 for stream %u. Returning YAMUX_ERR_WOULD_BLOCK (simulated).\n", stream->id); fflush(stdout);
-        return YAMUX_ERR_WOULD_BLOCK; // Simulate blocking if window is zero
+    /* Held data must reach the wire before anything written after it */
+    result = yamux_stream_flush(stream);
+    if (result != YAMUX_OK) {
+        return result;
     }
 
     size_t len_to_write = len;
-    if (len > stream->send_window) {
-        printf("WARNING: yamux_stream_write: Attempting to write %zu bytes but send_window is only %u for stream %u. Will write only %u bytes.\n", len, stream->send_window, stream->id, stream->send_window); fflush(stdout);
-        len_to_write = stream->send_window; // Only write up to current window allows
+    if (len > budget) {
+        len_to_write = budget; // Only write up to what the window and in-flight cap allow
     }
     
     /* Send data in chunks */
@@ -439,18 +1584,14 @@ yamux_result_t yamux_stream_write(
         if (chunk_size > YAMUX_MAX_DATA_FRAME_SIZE) {
             chunk_size = YAMUX_MAX_DATA_FRAME_SIZE;
         }
-        // Ensure chunk_size doesn't exceed remaining send_window (after previous chunks in this call)
-        // This is a more granular check within the loop, though the initial len_to_write already capped it.
-        if (chunk_size > (stream->send_window - total_written) && (stream->send_window - total_written) < YAMUX_MAX_DATA_FRAME_SIZE) {
-             chunk_size = stream->send_window - total_written;
+        // Ensure chunk_size doesn't exceed remaining send_window (already reduced by previous chunks in this call)
+        if (chunk_size > yamux_stream_send_budget(stream)) {
+             chunk_size = yamux_stream_send_budget(stream);
         }
 
         if (chunk_size == 0) { // Should not happen if len_to_write > 0 and send_window > 0 initially
-            printf("DEBUG: yamux_stream_write: chunk_size is 0, breaking loop. total_written=%zu\n", total_written); fflush(stdout);
             break; 
         }
-
-        printf("DEBUG: yamux_stream_write: Loop iter: total_written=%zu, chunk_size=%zu to send\n", total_written, chunk_size); fflush(stdout);
         
         /* Prepare header */
         memset(&header, 0, sizeof(header));
@@ -464,26 +1605,28 @@ yamux_result_t yamux_stream_write(
         yamux_encode_header(&header, frame_header);
         
         /* Send header */
-        printf("DEBUG: yamux_stream_write: Writing header (%zu bytes) for stream %u\n", (size_t)YAMUX_HEADER_SIZE, stream->id); fflush(stdout);
-        ssize_t header_write_res = session->io.write(session->io.ctx, frame_header, YAMUX_HEADER_SIZE);
-        printf("DEBUG: yamux_stream_write: Header write result: %zd\n", header_write_res); fflush(stdout);
+        int header_write_res = yamux_stream_io_write(session, frame_header, YAMUX_HEADER_SIZE);
+        if (header_write_res == 0 || header_write_res == YAMUX_ERR_WOULD_BLOCK) {
+            /* Transport is full and nothing of this frame went out */
+            *bytes_written_out = total_written;
+            return total_written > 0 ? YAMUX_OK : YAMUX_ERR_WOULD_BLOCK;
+        }
         if (header_write_res < 0 || (size_t)header_write_res != YAMUX_HEADER_SIZE) {
-            printf("ERROR: yamux_stream_write: Failed to write header. Expected %d, got %zd\n", YAMUX_HEADER_SIZE, header_write_res); fflush(stdout);
+            YAMUX_DIAG(session, "write: stream %u header write failed: %d", stream->id, header_write_res);
             *bytes_written_out = total_written; // Report what was written before failure
-            return YAMUX_ERR_IO;
+            return header_write_res > 0 ? yamux_stream_frame_cut(session, header_write_res) :
+                                          yamux_session_io_error(session, header_write_res);
         }
         
         /* Send data chunk */
-        printf("DEBUG: yamux_stream_write: Writing data chunk (%zu bytes) for stream %u\n", chunk_size, stream->id); fflush(stdout);
-        ssize_t chunk_write_res = session->io.write(session->io.ctx, buf + total_written, chunk_size);
-        printf("DEBUG: yamux_stream_write: Chunk write result: %zd\n", chunk_write_res); fflush(stdout);
+        int chunk_write_res = yamux_stream_io_write(session, buf + total_written, chunk_size);
         if (chunk_write_res < 0 || (size_t)chunk_write_res != chunk_size) {
-            printf("ERROR: yamux_stream_write: Failed to write chunk. Expected %zu, got %zd\n", chunk_size, chunk_write_res); fflush(stdout);
+            YAMUX_DIAG(session, "write: stream %u short chunk write: %d of %u", stream->id, chunk_write_res, (unsigned)chunk_size);
             *bytes_written_out = total_written; // Report what was written before failure
             // If some part of the chunk was written (chunk_write_res > 0), update total_written and stream->send_window
             if (chunk_write_res > 0) total_written += chunk_write_res;
             // stream->send_window -= total_written; // Decrement send_window by actual bytes SENT (header + data body)
-            return YAMUX_ERR_IO;
+            return yamux_stream_frame_cut(session, chunk_write_res);
         }
         
         total_written += chunk_size;
@@ -495,10 +1638,61 @@ yamux_result_t yamux_stream_write(
                                          // A more correct model is that stream->send_window is the peer's window size for us.
                                          // We decrement it as we send. It gets incremented by WINDOW_UPDATE from peer.
         stream->send_window -= chunk_size; // Simplified send window decrement.
+        stream->inflight += (uint32_t)chunk_size;
 
     }
     
+    /* The rest of the data is waiting for window */
+    if (total_written < len && yamux_stream_send_budget(stream) == 0) {
+        yamux_stream_note_stall(stream);
+    }
+    
+    yamux_stream_note_write(stream, total_written, len_to_write < len);
     *bytes_written_out = total_written;
-    printf("DEBUG: yamux_stream_write: Exiting successfully. total_written=%zu, remaining send_window=%u\n", total_written, stream->send_window); fflush(stdout);
+    return YAMUX_OK;
+}
+
+/**
+ * Check whether a write would be accepted whole, without writing
+ *
+ * @param stream Stream to check
+ * @param len Number of bytes the caller wants to write
+ * @return YAMUX_OK if ready, YAMUX_ERR_NO_WINDOW if the send window is
+ *         short, YAMUX_ERR_WOULD_BLOCK if held data is at its cap and the
+ *         transport last refused it, error code otherwise
+ */
+yamux_result_t yamux_stream_write_ready(
+    yamux_stream_t *stream,
+    size_t len)
+{
+    yamux_result_t result;
+    size_t held;
+    uint32_t cap;
+    
+    if (!stream || !stream->session) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    /* Same checks as yamux_stream_write, leaving an interrupt pending */
+    result = yamux_stream_write_check(stream, len, 0);
+    if (result != YAMUX_OK || len == 0) {
+        return result;
+    }
+    
+    /* A write beyond the window or in-flight cap would be cut short or refused */
+    if (len > yamux_stream_send_budget(stream)) {
+        return YAMUX_ERR_NO_WINDOW;
+    }
+    
+    /*
+     * Past the cap a write sends the held data first, as it does for a
+     * write too large to hold, so it only blocks if the transport does
+     */
+    held = stream->sendbuf.used - stream->sendbuf.pos;
+    cap = stream->session->config.max_send_buffer_per_stream;
+    if (cap != 0 && held > 0 && held + len > cap && stream->flush_blocked) {
+        return YAMUX_ERR_WOULD_BLOCK;
+    }
+    
     return YAMUX_OK;
 }
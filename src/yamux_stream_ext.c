@@ -5,6 +5,7 @@
 
 #include "../include/yamux.h"
 #include "yamux_internal.h"
+#include <string.h>
 
 /**
  * Get the current send window size for a stream
@@ -20,6 +21,87 @@ uint32_t yamux_stream_get_send_window(yamux_stream_t *stream) {
     return stream->send_window;
 }
 
+/**
+ * Get the bytes sent on a stream that the peer has not yet granted back
+ *
+ * @param stream Stream to query
+ * @return Bytes in flight
+ */
+uint32_t yamux_stream_inflight_bytes(yamux_stream_t *stream) {
+    if (!stream) {
+        return 0;
+    }
+    
+    return stream->inflight;
+}
+
+/**
+ * Get the number of received bytes waiting to be read from a stream
+ *
+ * @param stream Stream to query
+ * @return Bytes buffered for the next read
+ */
+size_t yamux_stream_get_buffered(yamux_stream_t *stream) {
+    if (!stream) {
+        return 0;
+    }
+    
+    return stream->recvbuf.used - stream->recvbuf.pos;
+}
+
+/**
+ * Name a stream for logs and stats
+ *
+ * @param stream Stream to label
+ * @param label Label to copy, or NULL to clear it
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_set_label(yamux_stream_t *stream, const char *label) {
+    if (!stream) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    if (!label) {
+        label = "";
+    }
+    
+    strncpy(stream->label, label, sizeof(stream->label) - 1);
+    stream->label[sizeof(stream->label) - 1] = '\0';
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Set how long each read on a stream waits for data
+ *
+ * @param stream Stream to configure
+ * @param ms Timeout per read in milliseconds, 0 to not wait
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_set_read_timeout(yamux_stream_t *stream, uint32_t ms) {
+    if (!stream) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    stream->read_timeout_ms = ms;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Get the label of a stream
+ *
+ * @param stream Stream to query
+ * @return The stream's label, or an empty string if it has none
+ */
+const char *yamux_stream_get_label(yamux_stream_t *stream) {
+    if (!stream) {
+        return "";
+    }
+    
+    return stream->label;
+}
+
 /**
  * Get the current state of a stream
  *
@@ -34,6 +116,59 @@ yamux_stream_state_t yamux_stream_get_state(yamux_stream_t *stream) {
     return stream->state;
 }
 
+/**
+ * Get the initial receive window the peer advertised for a stream
+ *
+ * @param stream Stream to query
+ * @param window Output parameter for the advertised window
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_peer_window(yamux_stream_t *stream, uint32_t *window) {
+    if (!stream || !window) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    if (!stream->peer_window_known) {
+        return YAMUX_ERR_WOULD_BLOCK;
+    }
+    
+    *window = stream->peer_window;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Get the reason a stream was reset
+ *
+ * @param stream Stream to query
+ * @return Reset reason, or YAMUX_RESET_NONE if the stream was not reset
+ */
+yamux_reset_reason_t yamux_stream_get_reset_reason(yamux_stream_t *stream) {
+    if (!stream) {
+        return YAMUX_RESET_NONE;
+    }
+    
+    return stream->reset_reason;
+}
+
+/**
+ * Get a stream's send statistics
+ *
+ * @param stream Stream to query
+ * @param stats Output parameter for the statistics
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_get_stats(yamux_stream_t *stream, yamux_stream_stats_t *stats) {
+    if (!stream || !stats) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    stats->largest_write = stream->largest_write;
+    stats->window_splits = stream->window_splits;
+    
+    return YAMUX_OK;
+}
+
 /**
  * Update the send window for a stream
  *
@@ -47,6 +182,29 @@ yamux_result_t yamux_stream_update_window(yamux_stream_t *stream, uint32_t incre
     }
     
     stream->send_window += increment;
+    stream->inflight -= increment < stream->inflight ? increment : stream->inflight;
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Interrupt a pending read and write on a stream
+ *
+ * @param stream Stream to interrupt
+ * @return YAMUX_OK on success, error code otherwise
+ */
+yamux_result_t yamux_stream_interrupt(yamux_stream_t *stream) {
+    if (!stream) {
+        return YAMUX_ERR_INVALID;
+    }
+    
+    YAMUX_ATOMIC_SET(stream->interrupt_read);
+    YAMUX_ATOMIC_SET(stream->interrupt_write);
+    
+    /* Cut short a wait the stream's reader or writer may be blocked in */
+    if (stream->session && stream->session->wake_cb) {
+        stream->session->wake_cb(stream->session->wake_ctx);
+    }
     
     return YAMUX_OK;
 }
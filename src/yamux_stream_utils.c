@@ -8,7 +8,6 @@
 #include "yamux_defs.h"
 #include <stdlib.h>
 #include <string.h>
-#include <stdio.h>
 
 /**
  * Get the stream ID
@@ -26,6 +25,137 @@ uint32_t yamux_stream_get_id(
     return stream->id;
 }
 
+/**
+ * Home position of a stream ID in the stream index
+ *
+ * IDs are mixed first so neither the fixed parity of each side's IDs nor
+ * IDs chosen by the peer to collide can crowd one part of the index.
+ *
+ * @param stream_id Stream ID
+ * @param size Entries in the index, a power of two
+ * @return Position where probing for the ID starts
+ */
+static size_t yamux_stream_index_home(uint32_t stream_id, size_t size)
+{
+    uint32_t h = stream_id >> 1;
+    
+    h ^= h >> 16;
+    h *= 0x45D9F3Bu;
+    h ^= h >> 16;
+    
+    return (size_t)h & (size - 1);
+}
+
+/**
+ * Record a streams slot in the stream index
+ *
+ * @param session Session
+ * @param slot Slot in the streams array holding the stream
+ */
+static void yamux_stream_index_put(yamux_session_t *session, size_t slot)
+{
+    size_t mask = session->stream_index_size - 1;
+    size_t pos = yamux_stream_index_home(session->streams[slot]->id, session->stream_index_size);
+    
+    while (session->stream_index[pos]) {
+        pos = (pos + 1) & mask;
+    }
+    session->stream_index[pos] = (uint32_t)(slot + 1);
+}
+
+/**
+ * Find where the stream index holds a stream ID
+ *
+ * @param session Session
+ * @param stream_id Stream ID to find
+ * @return Position in the index, or stream_index_size if absent
+ */
+static size_t yamux_stream_index_find(yamux_session_t *session, uint32_t stream_id)
+{
+    yamux_stream_t *stream;
+    size_t mask = session->stream_index_size - 1;
+    size_t pos;
+    
+    if (session->stream_index_size == 0) {
+        return 0;
+    }
+    
+    /* Teardown empties slots without touching the index, so skip those */
+    for (pos = yamux_stream_index_home(stream_id, session->stream_index_size);
+         session->stream_index[pos]; pos = (pos + 1) & mask) {
+        stream = session->streams[session->stream_index[pos] - 1];
+        if (stream && stream->id == stream_id) {
+            return pos;
+        }
+    }
+    
+    return session->stream_index_size;
+}
+
+/**
+ * Drop an entry from the stream index, closing the gap it leaves
+ *
+ * Later entries of the same probe run move back, so lookups never need
+ * tombstones and the index does not degrade as streams come and go.
+ *
+ * @param session Session
+ * @param pos Position of the entry in the index
+ */
+static void yamux_stream_index_drop(yamux_session_t *session, size_t pos)
+{
+    size_t mask = session->stream_index_size - 1;
+    size_t next = pos;
+    size_t home;
+    
+    session->stream_index[pos] = 0;
+    for (;;) {
+        next = (next + 1) & mask;
+        if (!session->stream_index[next]) {
+            return;
+        }
+        
+        /* An entry may fill the gap unless its home lies after the gap */
+        home = yamux_stream_index_home(session->streams[session->stream_index[next] - 1]->id,
+                                       session->stream_index_size);
+        if (pos <= next ? (pos < home && home <= next) : (pos < home || home <= next)) {
+            continue;
+        }
+        session->stream_index[pos] = session->stream_index[next];
+        session->stream_index[next] = 0;
+        pos = next;
+    }
+}
+
+/**
+ * Allocate the stream index and fill it from the streams array
+ *
+ * @param session Session
+ * @param size Entries in the new index, a power of two
+ * @return YAMUX_OK on success, YAMUX_ERR_NOMEM otherwise
+ */
+yamux_result_t yamux_stream_index_init(yamux_session_t *session, size_t size)
+{
+    uint32_t *index;
+    size_t i;
+    
+    index = (uint32_t *)yamux_mem_alloc(size * sizeof(uint32_t));
+    if (!index) {
+        return YAMUX_ERR_NOMEM;
+    }
+    memset(index, 0, size * sizeof(uint32_t));
+    
+    yamux_mem_free(session->stream_index);
+    session->stream_index = index;
+    session->stream_index_size = size;
+    for (i = 0; i < session->stream_count; i++) {
+        if (session->streams[i]) {
+            yamux_stream_index_put(session, i);
+        }
+    }
+    
+    return YAMUX_OK;
+}
+
 /**
  * Find a stream by ID
  *
@@ -37,20 +167,43 @@ yamux_stream_t *yamux_get_stream(
     yamux_session_t *session, 
     uint32_t stream_id)
 {
-    size_t i;
+    size_t pos;
     
     if (!session) {
         return NULL;
     }
     
-    /* Search for stream */
-    for (i = 0; i < session->stream_count; i++) {
-        if (session->streams[i] && session->streams[i]->id == stream_id) {
-            return session->streams[i];
-        }
+    pos = yamux_stream_index_find(session, stream_id);
+    if (pos == session->stream_index_size) {
+        return NULL;
     }
     
-    return NULL;
+    return session->streams[session->stream_index[pos] - 1];
+}
+
+/**
+ * Start or stop counting a stream against the session's memory
+ *
+ * Only streams in the table are counted. While counted, the stream's
+ * buffers keep stream_memory current as they grow and are freed.
+ *
+ * @param session Session
+ * @param stream Stream entering or leaving the table
+ * @param counted 1 when the stream enters the table, 0 when it leaves
+ */
+static void yamux_stream_account(yamux_session_t *session, yamux_stream_t *stream, int counted)
+{
+    size_t bytes = sizeof(*stream) + stream->recvbuf.size + stream->sendbuf.size;
+    
+    if (counted) {
+        session->stream_memory += bytes;
+        stream->recvbuf.account = &session->stream_memory;
+        stream->sendbuf.account = &session->stream_memory;
+    } else {
+        session->stream_memory -= bytes;
+        stream->recvbuf.account = NULL;
+        stream->sendbuf.account = NULL;
+    }
 }
 
 /**
@@ -65,6 +218,7 @@ yamux_result_t yamux_add_stream(
     yamux_stream_t *stream)
 {
     yamux_stream_t **new_streams;
+    uint32_t *new_free;
     size_t new_capacity;
     size_t i;
     
@@ -73,7 +227,7 @@ yamux_result_t yamux_add_stream(
     }
     
     /* Check if session is shut down */
-    if (session->go_away_received) {
+    if (session->shutdown || session->go_away_received) {
         return YAMUX_ERR_CLOSED;
     }
     
@@ -82,24 +236,44 @@ yamux_result_t yamux_add_stream(
         return YAMUX_ERR_INVALID;
     }
     
-    /* Find an empty slot */
-    for (i = 0; i < session->stream_count; i++) {
-        if (!session->streams[i]) {
+    /* The index must always keep free entries; an earlier regrowth may have failed */
+    if (session->stream_index_size < 2 * session->stream_capacity &&
+        yamux_stream_index_init(session, 2 * session->stream_capacity) != YAMUX_OK) {
+        return YAMUX_ERR_NOMEM;
+    }
+    
+    /* Reuse the most recently emptied slot, dropping any the table has shrunk past */
+    while (session->stream_free_count > 0) {
+        i = session->stream_free[--session->stream_free_count];
+        if (i < session->stream_count && !session->streams[i]) {
             session->streams[i] = stream;
+            session->stream_live++;
+            yamux_stream_index_put(session, i);
+            yamux_stream_account(session, stream, 1);
             return YAMUX_OK;
         }
     }
     
     /* Check if we need to resize the streams array */
     if (session->stream_count >= session->stream_capacity) {
-        /* Double the capacity */
+        /* Double the capacity, and the index with it */
         new_capacity = session->stream_capacity * 2;
-        new_streams = (yamux_stream_t **)realloc(
+        if (!yamux_session_memory_allows(session, session->stream_capacity *
+                                         (sizeof(yamux_stream_t *) + 3 * sizeof(uint32_t)))) {
+            return YAMUX_ERR_NOMEM;
+        }
+        /* The free-slot stack is empty here, so it is replaced rather than grown */
+        new_free = (uint32_t *)yamux_mem_alloc(new_capacity * sizeof(uint32_t));
+        if (!new_free) {
+            return YAMUX_ERR_NOMEM;
+        }
+        new_streams = (yamux_stream_t **)yamux_mem_realloc(
             session->streams, 
             new_capacity * sizeof(yamux_stream_t *)
         );
         
         if (!new_streams) {
+            yamux_mem_free(new_free);
             return YAMUX_ERR_NOMEM;
         }
         
@@ -111,11 +285,20 @@ yamux_result_t yamux_add_stream(
         /* Update session */
         session->streams = new_streams;
         session->stream_capacity = new_capacity;
+        yamux_mem_free(session->stream_free);
+        session->stream_free = new_free;
+        
+        if (yamux_stream_index_init(session, 2 * new_capacity) != YAMUX_OK) {
+            return YAMUX_ERR_NOMEM;
+        }
     }
     
     /* Add stream to the first empty slot */
     session->streams[session->stream_count] = stream;
+    yamux_stream_index_put(session, session->stream_count);
     session->stream_count++;
+    session->stream_live++;
+    yamux_stream_account(session, stream, 1);
     
     return YAMUX_OK;
 }
@@ -131,28 +314,136 @@ yamux_result_t yamux_remove_stream(
     yamux_session_t *session, 
     uint32_t stream_id)
 {
+    yamux_stream_t **link;
+    yamux_stream_t *stream;
+    size_t pos;
     size_t i;
     
     if (!session) {
         return YAMUX_ERR_INVALID;
     }
     
-    /* Search for stream */
-    for (i = 0; i < session->stream_count; i++) {
-        if (session->streams[i] && session->streams[i]->id == stream_id) {
-            /* Remove stream */
-            session->streams[i] = NULL;
-            
-            /* If it's the last stream, update stream count */
-            if (i == session->stream_count - 1) {
-                session->stream_count--;
-            }
-            
-            return YAMUX_OK;
+    /* Find the stream's slot */
+    pos = yamux_stream_index_find(session, stream_id);
+    if (pos == session->stream_index_size) {
+        return YAMUX_ERR_INVALID;
+    }
+    i = session->stream_index[pos] - 1;
+    stream = session->streams[i];
+    
+    /* A stream closed before it was accepted must leave the queue too */
+    for (link = &session->accept_queue; *link; link = &(*link)->next) {
+        if (*link == stream) {
+            *link = (*link)->next;
+            break;
         }
     }
     
-    return YAMUX_ERR_INVALID;
+    /* Remove stream */
+    yamux_held_list_remove(session, stream);
+    yamux_stream_account(session, stream, 0);
+    yamux_stream_index_drop(session, pos);
+    session->streams[i] = NULL;
+    session->stream_live--;
+    session->stream_free[session->stream_free_count++] = (uint32_t)i;
+    
+    /* Trim empty slots off the end so walks of the table stay short */
+    while (session->stream_count > 0 && !session->streams[session->stream_count - 1]) {
+        session->stream_count--;
+    }
+    
+    return YAMUX_OK;
+}
+
+/**
+ * Remove a stream from its session and free it
+ *
+ * @param session Session
+ * @param stream Stream to free; the pointer is invalid afterwards
+ */
+void yamux_stream_destroy(
+    yamux_session_t *session,
+    yamux_stream_t *stream)
+{
+    yamux_remove_stream(session, stream->id);
+    yamux_buffer_free(&stream->recvbuf);
+    yamux_buffer_free(&stream->sendbuf);
+    yamux_mem_free(stream);
+}
+
+/**
+ * Free a finished stream the application has already let go of
+ *
+ * A stream the application still holds stays in the table until it is
+ * closed again, as a reset stream does.
+ *
+ * @param session Session
+ * @param stream Stream that may have finished
+ * @return 1 if the stream was freed, 0 otherwise
+ */
+int yamux_stream_reap(
+    yamux_session_t *session,
+    yamux_stream_t *stream)
+{
+    if (!stream->released || stream->state != YAMUX_STREAM_CLOSED) {
+        return 0;
+    }
+    
+    yamux_stream_destroy(session, stream);
+    return 1;
+}
+
+/**
+ * Put a stream on the session's held-write list
+ *
+ * A stream joins when a write is held and leaves once its held data is
+ * sent or it is removed, so flushing touches only streams with data.
+ *
+ * @param session Session
+ * @param stream Stream that holds data; already listed is fine
+ */
+void yamux_held_list_add(
+    yamux_session_t *session,
+    yamux_stream_t *stream)
+{
+    if (stream->held_listed) {
+        return;
+    }
+    
+    stream->held_listed = 1;
+    stream->held_prev = NULL;
+    stream->held_next = session->held_streams;
+    if (session->held_streams) {
+        session->held_streams->held_prev = stream;
+    }
+    session->held_streams = stream;
+}
+
+/**
+ * Take a stream off the session's held-write list
+ *
+ * @param session Session
+ * @param stream Stream to take off; not listed is fine
+ */
+void yamux_held_list_remove(
+    yamux_session_t *session,
+    yamux_stream_t *stream)
+{
+    if (!stream->held_listed) {
+        return;
+    }
+    
+    if (stream->held_prev) {
+        stream->held_prev->held_next = stream->held_next;
+    } else {
+        session->held_streams = stream->held_next;
+    }
+    if (stream->held_next) {
+        stream->held_next->held_prev = stream->held_prev;
+    }
+    stream->held_prev = NULL;
+    stream->held_next = NULL;
+    stream->held_listed = 0;
 }
 
 /**
@@ -171,7 +462,7 @@ yamux_result_t yamux_enqueue_stream(
     }
     
     /* Check if session is shut down */
-    if (session->go_away_received) {
+    if (session->shutdown || session->go_away_received) {
         return YAMUX_ERR_CLOSED;
     }
     
@@ -220,10 +511,75 @@ yamux_result_t yamux_enqueue_stream_for_accept(yamux_session_t *session, yamux_s
     // TODO: Potentially signal or notify that a stream is ready for accept if using blocking accept.
     // For now, yamux_accept_stream will just pick it up on the next call.
 
-    printf("DEBUG: Enqueued stream %u for acceptance.\n", stream->id);
     return YAMUX_OK;
 }
 
+/**
+ * Check whether accept_backlog streams are already waiting for accept
+ *
+ * @param session The session.
+ * @return 1 if the queue is full, 0 otherwise
+ */
+int yamux_accept_queue_full(yamux_session_t *session) {
+    yamux_stream_t *s;
+    uint32_t queued = 0;
+
+    if (session->config.accept_backlog == 0) {
+        return 0;
+    }
+
+    for (s = session->accept_queue; s; s = s->next) {
+        if (++queued >= session->config.accept_backlog) {
+            return 1;
+        }
+    }
+
+    return 0;
+}
+
+/**
+ * Send the SYN-ACKs withheld from streams that now fit in the accept backlog
+ *
+ * @param session The session.
+ */
+void yamux_send_deferred_acks(yamux_session_t *session) {
+    yamux_stream_t *s;
+    uint32_t position = 0;
+
+    for (s = session->accept_queue; s; s = s->next) {
+        if (session->config.accept_backlog != 0 && position++ >= session->config.accept_backlog) {
+            break;
+        }
+        if (s->ack_deferred && yamux_send_syn_ack(session, s) == YAMUX_OK) {
+            s->ack_deferred = 0;
+        }
+    }
+}
+
+/**
+ * Notify the application that the peer has half-closed a stream
+ *
+ * Invokes the session's peer FIN callback at most once per stream. Callers
+ * must only call this after all of the peer's data has been buffered.
+ *
+ * @param session The session.
+ * @param stream The stream the peer sent FIN on.
+ */
+void yamux_notify_peer_fin(yamux_session_t *session, yamux_stream_t *stream) {
+    if (!session || !stream || stream->peer_fin_notified) {
+        return;
+    }
+    
+    stream->peer_fin_notified = 1;
+    
+    if (session->peer_fin_cb) {
+        /* While this is non-zero, closing the session defers freeing streams */
+        session->callback_depth++;
+        session->peer_fin_cb(session->peer_fin_ctx, stream);
+        session->callback_depth--;
+    }
+}
+
 /**
  * Note: yamux_handle_data and yamux_handle_window_update functions have been moved to yamux_handlers.c
  * to avoid duplicate symbols. Function declarations remain in yamux_internal.h
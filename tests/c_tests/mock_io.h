@@ -125,4 +125,31 @@ static MAYBE_UNUSED void mock_io_swap_buffers(mock_io_t *io1, mock_io_t *io2) {
     io2->read_pos = 0;
 }
 
+/* Append a raw frame to the mock's read buffer, as if sent by the peer */
+static MAYBE_UNUSED void mock_io_inject_frame(mock_io_t *io, uint8_t type, uint16_t flags,
+                                              uint32_t stream_id, const uint8_t *payload,
+                                              uint32_t length) {
+    yamux_header_t header;
+    size_t needed = io->read_buf_used + YAMUX_HEADER_SIZE + length;
+    
+    if (needed > io->read_buf_size) {
+        io->read_buf = realloc(io->read_buf, needed);
+        io->read_buf_size = needed;
+    }
+    
+    memset(&header, 0, sizeof(header));
+    header.version = YAMUX_PROTO_VERSION;
+    header.type = type;
+    header.flags = flags;
+    header.stream_id = stream_id;
+    header.length = length;
+    yamux_encode_header(&header, io->read_buf + io->read_buf_used);
+    io->read_buf_used += YAMUX_HEADER_SIZE;
+    
+    if (length > 0) {
+        memcpy(io->read_buf + io->read_buf_used, payload, length);
+        io->read_buf_used += length;
+    }
+}
+
 #endif /* MOCK_IO_H */
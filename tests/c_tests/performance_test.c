@@ -191,6 +191,133 @@ cleanup:
     free(read_buf);
 }
 
+/* Transport that accepts every write and reads only the peer FINs queued for it */
+typedef struct {
+    uint8_t frame[YAMUX_HEADER_SIZE];
+    size_t used;
+    size_t pos;
+} churn_peer_t;
+
+static int churn_write(void *ctx, const uint8_t *buf, size_t len) {
+    (void)ctx;
+    (void)buf;
+    return (int)len;
+}
+
+static int churn_read(void *ctx, uint8_t *buf, size_t len) {
+    churn_peer_t *peer = (churn_peer_t *)ctx;
+    
+    if (peer->pos == peer->used) {
+        return YAMUX_ERR_WOULD_BLOCK;
+    }
+    if (len > peer->used - peer->pos) {
+        len = peer->used - peer->pos;
+    }
+    memcpy(buf, peer->frame + peer->pos, len);
+    peer->pos += len;
+    return (int)len;
+}
+
+/* Queue the peer's FIN for a stream */
+static void churn_peer_fin(churn_peer_t *peer, uint32_t stream_id) {
+    yamux_header_t header;
+    
+    memset(&header, 0, sizeof(header));
+    header.version = YAMUX_PROTO_VERSION;
+    header.type = YAMUX_DATA;
+    header.flags = YAMUX_FLAG_FIN;
+    header.stream_id = stream_id;
+    yamux_encode_header(&header, peer->frame);
+    peer->used = YAMUX_HEADER_SIZE;
+    peer->pos = 0;
+}
+
+/* Open and close 50k short-lived streams alongside 900 long-lived ones */
+void test_stream_churn(void) {
+    yamux_session_t *session;
+    yamux_stream_t *live[900];
+    yamux_stream_t *pool[64];
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    yamux_result_t result;
+    churn_peer_t peer;
+    uint32_t victim_id;
+    
+    const int num_live = 900;
+    const int num_pool = 64;
+    const int num_batches = 5;
+    const int batch_size = 10000;
+    clock_t start, end;
+    double per_stream_us;
+    double first_us = 0;
+    uint32_t seed = 12345;
+    int victim;
+    
+    memset(&peer, 0, sizeof(peer));
+    io.read = churn_read;
+    io.write = churn_write;
+    io.ctx = &peer;
+    result = yamux_session_create(&io, 1, NULL, &session);
+    assert(result == YAMUX_OK);
+    
+    printf("Testing stream churn with %d live streams, %d x %d opened and closed\n",
+           num_live, num_batches, batch_size);
+    
+    for (int i = 0; i < num_live; i++) {
+        result = yamux_stream_open_detailed(session, 0, &live[i]);
+        assert(result == YAMUX_OK);
+    }
+    for (int i = 0; i < num_pool; i++) {
+        result = yamux_stream_open_detailed(session, 0, &pool[i]);
+        assert(result == YAMUX_OK);
+    }
+    
+    /*
+     * Each round opens a stream, looks it up as a frame would, and ends a
+     * random short-lived one so slots are freed out of order. Half end with
+     * a reset; the rest are closed, handed back, and freed by the peer's FIN
+     * as the event loop reads it. The loop then runs once with nothing to read.
+     */
+    for (int batch = 0; batch < num_batches; batch++) {
+        start = clock();
+        for (int i = 0; i < batch_size; i++) {
+            result = yamux_stream_open_detailed(session, 0, &stream);
+            assert(result == YAMUX_OK);
+            assert(yamux_get_stream(session, stream->id) == stream);
+            assert(yamux_get_stream(session, live[i % num_live]->id) == live[i % num_live]);
+            
+            seed = seed * 1103515245u + 12345u;
+            victim = (int)((seed >> 16) % (uint32_t)num_pool);
+            victim_id = pool[victim]->id;
+            if (i % 2 == 0) {
+                yamux_stream_close(pool[victim], 1);
+            } else {
+                yamux_stream_close(pool[victim], 0);
+                yamux_stream_close(pool[victim], 0);
+                churn_peer_fin(&peer, victim_id);
+            }
+            pool[victim] = stream;
+            
+            do {
+                result = yamux_session_process(session);
+            } while (result == YAMUX_OK);
+            assert(result == YAMUX_ERR_WOULD_BLOCK);
+            assert(yamux_get_stream(session, victim_id) == NULL);
+        }
+        end = clock();
+        
+        per_stream_us = ((double) (end - start)) / CLOCKS_PER_SEC * 1e6 / batch_size;
+        if (batch == 0) {
+            first_us = per_stream_us;
+        }
+        printf("Batch %d: %.3f us per stream (%.2fx first batch)\n",
+               batch + 1, per_stream_us, first_us > 0 ? per_stream_us / first_us : 1.0);
+    }
+    
+    yamux_session_close(session, 0);
+    yamux_session_free(session);
+}
+
 /* Test session creation and stream processing overhead */
 void test_session_overhead(void) {
     yamux_session_t *session;
@@ -259,6 +386,11 @@ void test_session_overhead(void) {
 int main(void) {
     printf("==== YAMUX PERFORMANCE TESTS ====\n\n");
     
+    /* Test stream table cost under churn */
+    test_stream_churn();
+    
+    printf("\n");
+    
     /* Test session overhead */
     test_session_overhead();
     
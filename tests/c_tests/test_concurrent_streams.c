@@ -4,9 +4,11 @@
 #include <stdlib.h>
 #include <assert.h>
 #include "mock_io.h"
+#include "test_transport.h"
 
 /* External assert function declaration */
 void assert_true(int condition, const char *message);
+void assert_int_equal(int a, int b, const char *message);
 
 /* Test concurrent streams */
 void test_concurrent_streams(void) {
@@ -150,14 +152,8 @@ void test_concurrent_streams(void) {
         assert_true(memcmp(data[i], read_buf, bytes_read) == 0, "Data mismatch");
     }
     
-    /* Exchange data server -> client for window updates */
-    mock_io_swap_buffers(server_mock, client_mock);
-    
-    /* Process all window update messages on client */
-    for (i = 0; i < num_streams; i++) {
-        result = yamux_session_process(client_session);
-        assert_true(result == YAMUX_OK, "Failed to process client session");
-    }
+    /* Small reads are below the window update threshold, so nothing goes back */
+    assert_true(server_mock->write_buf_used == 0, "Small reads should not send window updates");
     
     /* Now close all streams from both sides */
     for (i = 0; i < num_streams; i++) {
@@ -189,16 +185,15 @@ void test_concurrent_streams(void) {
         assert_true(result == YAMUX_OK, "Failed to process client session");
     }
     
-    /* All streams should be closed now */
+    /* All streams should be closed now; the server's close already freed its side */
     for (i = 0; i < num_streams; i++) {
         yamux_stream_state_t state = yamux_stream_get_state(client_streams[i]);
         assert_true(state == YAMUX_STREAM_CLOSED, 
                     "Client stream not in CLOSED state");
-        
-        state = yamux_stream_get_state(server_streams[i]);
-        assert_true(state == YAMUX_STREAM_CLOSED, 
-                    "Server stream not in CLOSED state");
+        assert_true(yamux_stream_close(client_streams[i], 0) == YAMUX_OK, "Failed to release client stream");
     }
+    assert_true(client_session->stream_count == 0 && server_session->stream_count == 0,
+                "Closed streams should leave both sessions");
     
     /* Clean up */
     result = yamux_session_close(client_session, 0);
@@ -206,7 +201,488 @@ void test_concurrent_streams(void) {
     
     result = yamux_session_close(server_session, 0);
     assert_true(result == YAMUX_OK, "Failed to close server session");
+    yamux_session_free(client_session);
+    yamux_session_free(server_session);
     
     mock_io_free(client_mock);
     mock_io_free(server_mock);
 }
+
+/* Counts write calls before passing them to the transport */
+typedef struct {
+    void *ctx;
+    int writes;
+} write_counter_t;
+
+static int counting_write(void *ctx, const uint8_t *buf, size_t len) {
+    write_counter_t *counter = (write_counter_t *)ctx;
+    counter->writes++;
+    return test_transport_write(counter->ctx, buf, len);
+}
+
+static int counting_read(void *ctx, uint8_t *buf, size_t len) {
+    return test_transport_read(((write_counter_t *)ctx)->ctx, buf, len);
+}
+
+/* Test that max_num_streams caps streams opened by either side */
+void test_max_num_streams(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_config_t config;
+    yamux_stream_t *streams[4];
+    yamux_stream_t *accepted[4];
+    yamux_stream_t *extra;
+    uint8_t buf[8];
+    size_t bytes;
+    int i;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    config = yamux_default_config;
+    config.max_num_streams = 3;
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+    
+    /* Our own opens stop at the limit */
+    for (i = 0; i < 3; i++) {
+        assert_true(yamux_stream_open_detailed(client, 0, &streams[i]) == YAMUX_OK, "Failed to open stream");
+    }
+    assert_true(yamux_stream_open_detailed(client, 0, &extra) == YAMUX_ERR_STREAMS_EXHAUSTED,
+                "Open beyond the limit should be refused");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    for (i = 0; i < 3; i++) {
+        assert_true(yamux_stream_accept(server, &accepted[i]) == YAMUX_OK, "Failed to accept stream");
+    }
+    
+    /* A peer without the limit is refused with RST rather than given a fourth stream */
+    client->config.max_num_streams = 0;
+    assert_true(yamux_stream_open_detailed(client, 0, &streams[3]) == YAMUX_OK, "Failed to open fourth stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN and RST");
+    assert_true(yamux_session_pending_accepts(server) == 0, "Server should not queue the fourth stream");
+    assert_true(yamux_get_stream(server, yamux_stream_get_id(streams[3])) == NULL,
+                "Server should not track the fourth stream");
+    assert_true(yamux_stream_get_reset_reason(streams[3]) == YAMUX_RESET_REFUSED,
+                "Fourth stream should be refused");
+    assert_true(yamux_stream_close(streams[3], 0) == YAMUX_OK, "Failed to close refused stream");
+    client->config.max_num_streams = 3;
+    
+    /* Releasing a stream on both sides makes room again */
+    assert_true(yamux_stream_close(streams[0], 1) == YAMUX_OK, "Failed to reset client stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver RST");
+    assert_true(yamux_stream_read(accepted[0], buf, sizeof(buf), &bytes) == YAMUX_ERR_RESET,
+                "Server should see the reset");
+    assert_true(yamux_stream_close(accepted[0], 0) == YAMUX_OK, "Failed to release server stream");
+    assert_true(yamux_stream_open_detailed(client, 0, &streams[0]) == YAMUX_OK, "Open should succeed after a close");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver SYN");
+    assert_true(yamux_stream_accept(server, &accepted[0]) == YAMUX_OK, "Server should accept the new stream");
+    
+    /* Streams closed gracefully make room too, so opens never run out */
+    for (i = 0; i < 12; i++) {
+        if (i >= 3) {
+            assert_true(yamux_stream_open_detailed(client, 0, &streams[i % 3]) == YAMUX_OK,
+                        "Open should succeed after graceful closes");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver SYN");
+            assert_true(yamux_stream_accept(server, &accepted[i % 3]) == YAMUX_OK, "Failed to accept stream");
+        }
+        
+        /* The opener closes and hands the stream back before the peer's FIN */
+        assert_true(yamux_stream_close(streams[i % 3], 0) == YAMUX_OK, "Failed to close client stream");
+        assert_true(yamux_stream_close(streams[i % 3], 0) == YAMUX_OK, "Failed to release client stream");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+        assert_true(yamux_stream_read(accepted[i % 3], buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 0,
+                    "Server should see EOF");
+        assert_true(yamux_stream_close(accepted[i % 3], 0) == YAMUX_OK, "Failed to close server stream");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+        if (i >= 2) {
+            assert_true(client->stream_live == 0 && server->stream_live == 0,
+                        "Closed streams should no longer count against the limit");
+        }
+    }
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Transport that accepts every write and never has anything to read */
+static int discard_write(void *ctx, const uint8_t *buf, size_t len) {
+    (void)ctx;
+    (void)buf;
+    return (int)len;
+}
+
+static int idle_read(void *ctx, uint8_t *buf, size_t len) {
+    (void)ctx;
+    (void)buf;
+    (void)len;
+    return YAMUX_ERR_WOULD_BLOCK;
+}
+
+/* Test that every live stream stays findable through heavy open/close churn */
+void test_stream_table_churn(void) {
+    yamux_session_t *session;
+    yamux_stream_t *live[512];
+    yamux_io_t io;
+    uint32_t seed = 12345;
+    uint32_t id;
+    size_t count;
+    size_t k;
+    int round;
+    
+    io.read = idle_read;
+    io.write = discard_write;
+    io.ctx = NULL;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    for (k = 0; k < 512; k++) {
+        assert_true(yamux_stream_open_detailed(session, 0, &live[k]) == YAMUX_OK, "Failed to open stream");
+    }
+    
+    /* Replace random streams; each removal must leave all the others reachable */
+    for (round = 1; round <= 20000; round++) {
+        seed = seed * 1103515245u + 12345u;
+        k = (seed >> 16) % 512;
+        id = yamux_stream_get_id(live[k]);
+        assert_true(yamux_stream_close(live[k], 1) == YAMUX_OK, "Failed to reset stream");
+        assert_true(yamux_get_stream(session, id) == NULL, "Removed stream should not be found");
+        assert_true(yamux_stream_open_detailed(session, 0, &live[k]) == YAMUX_OK, "Failed to open stream");
+        
+        if (round % 1000 == 0) {
+            for (k = 0; k < 512; k++) {
+                assert_true(yamux_get_stream(session, yamux_stream_get_id(live[k])) == live[k],
+                            "Live stream should be found by ID");
+            }
+        }
+    }
+    
+    /* Freed slots are reused, so the table stays sized for what is live */
+    count = 0;
+    for (k = 0; k < session->stream_count; k++) {
+        count += session->streams[k] != NULL;
+    }
+    assert_true(count == 512, "Table should hold exactly the live streams");
+    assert_true(session->stream_live == 512, "Live count should match the table");
+    assert_true(session->stream_capacity <= 1024, "Churn should not grow the table");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+}
+
+/* Test opening a batch of streams with one write */
+void test_open_streams_batch(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    write_counter_t counter;
+    static yamux_stream_t *streams[YAMUX_MAX_STREAMS + 8];
+    yamux_stream_t *accepted;
+    int opened, i;
+    const int batch = 8;
+    
+    transport = test_transport_pair(64 * 1024, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    counter.ctx = client_io.ctx;
+    counter.writes = 0;
+    client_io.read = counting_read;
+    client_io.write = counting_write;
+    client_io.ctx = &counter;
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    
+    /* One write for the whole batch, versus one per stream */
+    opened = yamux_open_streams(client, batch, streams);
+    assert_true(opened == batch, "Batch should open every stream");
+    assert_true(counter.writes == 1, "Batch should send its SYNs in a single write");
+    counter.writes = 0;
+    for (i = 0; i < batch; i++) {
+        assert_true(yamux_stream_open_detailed(client, 0, &streams[batch + i]) == YAMUX_OK,
+                    "Failed to open stream");
+    }
+    assert_true(counter.writes == batch, "Individual opens should write once each");
+    
+    /* The peer sees ordinary SYNs */
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    assert_true(yamux_session_pending_accepts(server) == 2 * batch, "Server should see every stream");
+    for (i = 0; i < batch; i++) {
+        assert_true(yamux_stream_get_id(streams[i]) == (uint32_t)(2 * i + 1), "Batch IDs should be sequential");
+        assert_true(yamux_stream_get_state(streams[i]) == YAMUX_STREAM_ESTABLISHED, "Batch stream should be established");
+    }
+    while (yamux_stream_accept(server, &accepted) == YAMUX_OK) {
+    }
+    
+    /* Partial success at the stream limit */
+    opened = yamux_open_streams(client, YAMUX_MAX_STREAMS, streams);
+    assert_true(opened == YAMUX_MAX_STREAMS - 2 * batch, "Batch should stop at the stream limit");
+    assert_true(yamux_open_streams(client, 1, streams) == YAMUX_ERR_STREAMS_EXHAUSTED,
+                "Batch at the limit should open nothing");
+    assert_true(yamux_stream_open_detailed(client, 0, &accepted) == YAMUX_ERR_STREAMS_EXHAUSTED,
+                "Single open at the limit should fail too");
+    
+    assert_true(yamux_open_streams(client, 0, NULL) == 0, "Empty batch should open nothing");
+    assert_true(yamux_open_streams(NULL, 1, streams) == YAMUX_ERR_INVALID, "NULL session should be invalid");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Totals gathered by sum_buffered */
+typedef struct {
+    size_t streams;
+    size_t buffered;
+    int stop_after;     /* Stop after this many streams, 0 to visit all */
+} stream_totals_t;
+
+static int sum_buffered(void *ctx, yamux_stream_t *stream) {
+    stream_totals_t *totals = (stream_totals_t *)ctx;
+    
+    totals->streams++;
+    totals->buffered += yamux_stream_get_buffered(stream);
+    
+    return (totals->stop_after > 0 && (int)totals->streams == totals->stop_after) ? 7 : 0;
+}
+
+static int close_stream_cb(void *ctx, yamux_stream_t *stream) {
+    (void)ctx;
+    yamux_stream_close(stream, 1);
+    return 0;
+}
+
+/* Test iterating over every stream in a session */
+void test_session_foreach_stream(void) {
+    printf("Testing stream iteration...\n");
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    stream_totals_t totals;
+    uint8_t window[4];
+    uint8_t payload[64];
+    uint8_t buf[16];
+    size_t bytes_read, injected = 0;
+    uint32_t id;
+    
+    memset(payload, 0xAB, sizeof(payload));
+    yamux_encode_u32(262144, window);
+    mock = mock_io_init(8192);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 0, NULL, &session) == YAMUX_OK, "Failed to create server session");
+    
+    assert_true(yamux_session_foreach_stream(NULL, sum_buffered, &totals) == YAMUX_ERR_INVALID,
+                "NULL session should be rejected");
+    assert_true(yamux_session_foreach_stream(session, NULL, &totals) == YAMUX_ERR_INVALID,
+                "NULL callback should be rejected");
+    
+    /* Streams 1, 3 and 5 each receive a different amount of data */
+    for (id = 1; id <= 5; id += 2) {
+        mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, id, window, 4);
+        assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN");
+        mock_io_inject_frame(mock, YAMUX_DATA, 0, id, payload, id * 8);
+        assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process DATA");
+        injected += id * 8;
+    }
+    
+    /* Reading from one stream lowers the total by the same amount */
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_read(stream, buf, 4, &bytes_read) == YAMUX_OK && bytes_read == 4,
+                "Failed to read from stream");
+    
+    memset(&totals, 0, sizeof(totals));
+    assert_true(yamux_session_foreach_stream(session, sum_buffered, &totals) == 0,
+                "Full iteration should return 0");
+    assert_true(totals.streams == 3, "Every stream should be visited");
+    assert_true(totals.buffered == injected - bytes_read,
+                "Per-stream buffered bytes should add up to the unread data");
+    
+    /* A non-zero return stops the iteration and is passed back */
+    memset(&totals, 0, sizeof(totals));
+    totals.stop_after = 2;
+    assert_true(yamux_session_foreach_stream(session, sum_buffered, &totals) == 7,
+                "Callback's stop value should be returned");
+    assert_true(totals.streams == 2, "Iteration should stop when the callback asks");
+    
+    /* The callback may close the stream it is visiting */
+    assert_true(yamux_session_foreach_stream(session, close_stream_cb, NULL) == 0,
+                "Closing streams during iteration should succeed");
+    memset(&totals, 0, sizeof(totals));
+    yamux_session_foreach_stream(session, sum_buffered, &totals);
+    assert_true(totals.streams == 0, "Closed streams should no longer be visited");
+    assert_true(yamux_session_pending_accepts(session) == 0, "Closed streams should leave the accept queue");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Open n streams, deliver the SYNs and replies, and count the refused ones */
+static int open_and_count_refused(test_transport_t *transport, yamux_session_t *client,
+                                  yamux_session_t *server, int n) {
+    yamux_stream_t *streams[8];
+    yamux_stream_t *accepted[8];
+    int i, count = 0, refused = 0;
+    
+    for (i = 0; i < n; i++) {
+        assert_true(yamux_stream_open_detailed(client, 0, &streams[i]) == YAMUX_OK, "Failed to open stream");
+    }
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    while (count < n && yamux_stream_accept(server, &accepted[count]) == YAMUX_OK) {
+        count++;
+    }
+    
+    /* Reset every stream from the client, then release the server's side */
+    for (i = 0; i < n; i++) {
+        if (yamux_stream_get_reset_reason(streams[i]) == YAMUX_RESET_REFUSED) {
+            refused++;
+        }
+        yamux_stream_close(streams[i], 1);
+    }
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver resets");
+    for (i = 0; i < count; i++) {
+        yamux_stream_close(accepted[i], 0);
+    }
+    assert_true(count + refused == n, "Every stream should be either accepted or refused");
+    
+    return refused;
+}
+
+/* Test that max_stream_open_rate refuses bursts but allows a steady rate */
+void test_stream_open_rate_limit(void) {
+    printf("Testing stream open rate limit...\n");
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_config_t config = yamux_default_config;
+    uint32_t now = 0;
+    int i;
+#ifndef YAMUX_MINIMAL
+    char dump[512];
+#endif
+    
+    config.max_stream_open_rate = 4;
+    transport = test_transport_pair(16384, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+    
+    /* A burst gets one second's worth of opens, the rest are reset */
+    yamux_session_keepalive(server, now);
+    assert_true(open_and_count_refused(transport, client, server, 8) == 4,
+                "Opens beyond the rate should be refused");
+#ifndef YAMUX_MINIMAL
+    yamux_session_dump_diagnostics(server, dump, sizeof(dump));
+    assert_true(strstr(dump, "open rate limit") != NULL, "Refusals should name the rate limit");
+#endif
+    
+    /* Opening at the configured rate always succeeds */
+    for (i = 0; i < 8; i++) {
+        now += 250;
+        yamux_session_keepalive(server, now);
+        assert_true(open_and_count_refused(transport, client, server, 1) == 0,
+                    "Opens at the configured rate should succeed");
+    }
+    
+    /* Slightly faster than the rate drains the bucket */
+    now += 200;
+    yamux_session_keepalive(server, now);
+    assert_true(open_and_count_refused(transport, client, server, 1) == 1,
+                "Opens faster than the rate should be refused once tokens run out");
+    
+    /* A long idle period refills the bucket only up to one second's worth */
+    now += 60000;
+    yamux_session_keepalive(server, now);
+    assert_true(open_and_count_refused(transport, client, server, 6) == 2,
+                "Idle time should not bank more than the bucket holds");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+#define DEMUX_STREAMS 50
+#define DEMUX_ROUNDS 8
+
+/* Byte at a given offset of a stream's data in the demux test */
+static uint8_t demux_byte(int index, size_t offset) {
+    return (uint8_t)(index * 31 + offset * 7);
+}
+
+/* Test that one read holding interleaved frames for many streams is demultiplexed exactly */
+void test_interleaved_frames_demux(void) {
+    printf("Testing interleaved frame demultiplexing...\n");
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    static uint8_t chunk[128];
+    static uint8_t buf[DEMUX_ROUNDS * 128];
+    size_t sent[DEMUX_STREAMS];
+    size_t bytes_read, total, i;
+    uint8_t window[4];
+    uint32_t len;
+    int round, n, index, accepted, frames = 0;
+    
+    mock = mock_io_init(16384);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 0, NULL, &session) == YAMUX_OK, "Failed to create server session");
+    
+    /* Every SYN and DATA frame is queued up front, as if delivered by one read */
+    yamux_encode_u32(262144, window);
+    for (index = 0; index < DEMUX_STREAMS; index++) {
+        mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, (uint32_t)(2 * index + 1), window, 4);
+        frames++;
+        sent[index] = 0;
+    }
+    for (round = 0; round < DEMUX_ROUNDS; round++) {
+        for (n = 0; n < DEMUX_STREAMS; n++) {
+            /* Alternate the order of streams and vary each frame's length */
+            index = (round & 1) ? DEMUX_STREAMS - 1 - n : n;
+            len = 1 + (uint32_t)((index * 7 + round * 13) % (int)sizeof(chunk));
+            for (i = 0; i < len; i++) {
+                chunk[i] = demux_byte(index, sent[index] + i);
+            }
+            mock_io_inject_frame(mock, YAMUX_DATA, 0, (uint32_t)(2 * index + 1), chunk, len);
+            sent[index] += len;
+            frames++;
+        }
+    }
+    
+    /* Each call handles exactly one frame and none is misrouted */
+    for (n = 0; n < frames; n++) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process interleaved frame");
+    }
+    assert_true(mock->read_pos == mock->read_buf_used, "Every frame should have been consumed");
+    
+    accepted = 0;
+    while (yamux_stream_accept(session, &stream) == YAMUX_OK) {
+        index = (int)(yamux_stream_get_id(stream) - 1) / 2;
+        assert_true(index >= 0 && index < DEMUX_STREAMS, "Unexpected stream accepted");
+        total = 0;
+        while (yamux_stream_read(stream, buf + total, sizeof(buf) - total, &bytes_read) == YAMUX_OK &&
+               bytes_read > 0) {
+            total += bytes_read;
+        }
+        assert_true(total == sent[index], "Stream should receive exactly its own bytes");
+        for (i = 0; i < total; i++) {
+            if (buf[i] != demux_byte(index, i)) {
+                break;
+            }
+        }
+        assert_true(i == total, "Stream should receive its bytes in order");
+        accepted++;
+    }
+    assert_int_equal(accepted, DEMUX_STREAMS, "Every stream should be accepted");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
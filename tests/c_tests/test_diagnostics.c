@@ -0,0 +1,430 @@
+/**
+ * @file test_diagnostics.c
+ * @brief Test for the session diagnostics ring
+ */
+
+#include "../../src/yamux_internal.h"
+#include <stdio.h>
+#include <string.h>
+#include "mock_io.h"
+#include "test_transport.h"
+
+/* External assert function declaration */
+void assert_true(int condition, const char *message);
+void assert_int_equal(int a, int b, const char *message);
+
+/* Test that diagnostics are captured and retrievable */
+void test_diagnostics(void) {
+    yamux_session_t *session;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_result_t result;
+    char dump[YAMUX_DIAG_RING_SIZE * YAMUX_DIAG_MSG_SIZE + 1];
+    size_t len;
+
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+
+    result = yamux_session_create(&io, 0, NULL, &session);
+    assert_true(result == YAMUX_OK, "Failed to create session");
+
+    /* Nothing recorded yet */
+    len = yamux_session_dump_diagnostics(session, dump, sizeof(dump));
+    assert_true(len == 0 && dump[0] == '\0', "Fresh session should have no diagnostics");
+
+    /* An invalid frame type is recorded */
+    mock_io_inject_frame(mock, 0x7, 0, 0, NULL, 0);
+    result = yamux_session_process(session);
+    assert_true(result == YAMUX_ERR_PROTOCOL, "Invalid frame type should be rejected");
+
+    len = yamux_session_dump_diagnostics(session, dump, sizeof(dump));
+#ifndef YAMUX_MINIMAL
+    assert_true(len == strlen(dump), "Returned length should match dump");
+    assert_true(strstr(dump, "type 7") != NULL,
+                "Rejected frame should be captured");
+
+    /* The ring is bounded: the oldest messages are dropped */
+    {
+        int i;
+        char expect[32];
+        char small[16];
+
+        for (i = 0; i < YAMUX_DIAG_RING_SIZE + 2; i++) {
+            yamux_diag(session, "event %d", i);
+        }
+        len = yamux_session_dump_diagnostics(session, dump, sizeof(dump));
+        assert_true(strstr(dump, "type 7") == NULL,
+                    "Oldest message should have been overwritten");
+        assert_true(strncmp(dump, "event 2\n", 8) == 0, "Dump should start with oldest kept message");
+        snprintf(expect, sizeof(expect), "event %d\n", YAMUX_DIAG_RING_SIZE + 1);
+        assert_true(len >= strlen(expect) && strcmp(dump + len - strlen(expect), expect) == 0,
+                    "Dump should end with newest message");
+
+        /* A small buffer holds only whole lines and stays terminated */
+        len = yamux_session_dump_diagnostics(session, small, 3);
+        assert_true(len == 0 && small[0] == '\0', "Too-small buffer should be empty");
+        len = yamux_session_dump_diagnostics(session, small, 8);
+        assert_true(len == 0, "Line plus terminator does not fit in 8 bytes");
+        len = yamux_session_dump_diagnostics(session, small, 9);
+        assert_true(len == 8 && strcmp(small, "event 2\n") == 0, "Exactly one line should fit");
+    }
+#else
+    assert_true(len == 0 && dump[0] == '\0', "Minimal build should keep no diagnostics");
+#endif
+
+    assert_true(yamux_session_dump_diagnostics(NULL, dump, sizeof(dump)) == 0,
+                "NULL session should dump nothing");
+
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Transport wrapper that records everything a session reads and writes */
+typedef struct {
+    yamux_io_t inner;
+    uint8_t in[2048];
+    size_t in_len;
+    uint8_t out[2048];
+    size_t out_len;
+} capture_io_t;
+
+static int capture_read(void *ctx, uint8_t *buf, size_t len) {
+    capture_io_t *cap = (capture_io_t *)ctx;
+    int n = cap->inner.read(cap->inner.ctx, buf, len);
+    
+    if (n > 0 && cap->in_len + (size_t)n <= sizeof(cap->in)) {
+        memcpy(cap->in + cap->in_len, buf, n);
+        cap->in_len += n;
+    }
+    return n;
+}
+
+static int capture_write(void *ctx, const uint8_t *buf, size_t len) {
+    capture_io_t *cap = (capture_io_t *)ctx;
+    
+    if (cap->out_len + len <= sizeof(cap->out)) {
+        memcpy(cap->out + cap->out_len, buf, len);
+        cap->out_len += len;
+    }
+    return cap->inner.write ? cap->inner.write(cap->inner.ctx, buf, len) : (int)len;
+}
+
+/* Test that replaying a captured log reproduces the original result */
+void test_replay_frames(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io, captured_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *stream;
+    capture_io_t live, replayed;
+    yamux_result_t live_result, result;
+    uint8_t data[] = "captured payload";
+    uint8_t bad_frame[YAMUX_HEADER_SIZE];
+    size_t bytes;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    
+    memset(&live, 0, sizeof(live));
+    live.inner = server_io;
+    captured_io.read = capture_read;
+    captured_io.write = capture_write;
+    captured_io.ctx = &live;
+    
+    result = yamux_session_create(&client_io, 1, NULL, &client);
+    assert_true(result == YAMUX_OK, "Failed to create client session");
+    result = yamux_session_create(&captured_io, 0, NULL, &server);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    
+    /* Normal traffic, then a frame with an unknown type breaks the server */
+    result = yamux_stream_open_detailed(client, 0, &stream);
+    assert_true(result == YAMUX_OK, "Failed to open stream");
+    result = yamux_stream_write(stream, data, sizeof(data), &bytes);
+    assert_true(result == YAMUX_OK, "Failed to write");
+    assert_true(yamux_session_ping(client) == YAMUX_OK, "Failed to ping");
+    memset(bad_frame, 0, sizeof(bad_frame));
+    bad_frame[1] = 0x9;
+    assert_true(client_io.write(client_io.ctx, bad_frame, sizeof(bad_frame)) == (int)sizeof(bad_frame),
+                "Failed to send bad frame");
+    
+    do {
+        live_result = yamux_session_process(server);
+    } while (live_result == YAMUX_OK);
+    assert_true(live_result == YAMUX_ERR_PROTOCOL, "Live session should reject the bad frame");
+    assert_true(live.in_len > YAMUX_HEADER_SIZE, "Frames should have been captured");
+    
+    /* Replay reproduces the same result and the same responses */
+    memset(&replayed, 0, sizeof(replayed));
+    captured_io.ctx = &replayed;
+    result = yamux_replay_frames(&captured_io, live.in, live.in_len);
+    assert_int_equal(result, live_result, "Replay should reproduce the parser result");
+    assert_true(replayed.out_len == live.out_len && memcmp(replayed.out, live.out, live.out_len) == 0,
+                "Replay should produce the same output as the live session");
+    
+    /* Output can be discarded, and an empty log is fine */
+    assert_int_equal(yamux_replay_frames(NULL, live.in, live.in_len), live_result,
+                     "Replay without I/O should give the same result");
+    assert_int_equal(yamux_replay_frames(NULL, NULL, 0), YAMUX_OK, "Empty log should replay cleanly");
+    assert_int_equal(yamux_replay_frames(NULL, NULL, 4), YAMUX_ERR_INVALID, "NULL log should be rejected");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that stream labels show up in the stream stats dump */
+void test_stream_labels(void) {
+    yamux_session_t *session;
+    yamux_stream_t *upload, *control;
+    yamux_io_t io;
+    mock_io_t *mock;
+    char dump[512];
+    char small[8];
+    size_t len;
+
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &upload) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(session, 0, &control) == YAMUX_OK, "Failed to open stream");
+
+    assert_true(yamux_stream_get_label(upload)[0] == '\0', "New stream should have no label");
+    assert_true(yamux_stream_set_label(NULL, "x") == YAMUX_ERR_INVALID, "NULL stream should be rejected");
+    assert_true(yamux_stream_set_label(upload, "upload") == YAMUX_OK, "Failed to set label");
+    assert_true(strcmp(yamux_stream_get_label(upload), "upload") == 0, "Label should be copied");
+
+    /* Long labels are truncated to fit */
+    assert_true(yamux_stream_set_label(control, "control-channel-with-a-long-name") == YAMUX_OK,
+                "Failed to set long label");
+    assert_int_equal((int)strlen(yamux_stream_get_label(control)), YAMUX_STREAM_LABEL_SIZE - 1,
+                     "Long label should be truncated");
+
+    len = yamux_session_dump_streams(session, dump, sizeof(dump));
+    assert_true(len == strlen(dump), "Returned length should match dump");
+    assert_true(strstr(dump, "stream 1 [upload] ") != NULL, "Label should appear in the stats dump");
+    assert_true(strstr(dump, "stream 3 [control-channel]") != NULL,
+                "Truncated label should appear in the stats dump");
+
+    /* Only whole lines are written */
+    len = yamux_session_dump_streams(session, small, sizeof(small));
+    assert_true(len == 0 && small[0] == '\0', "A line that does not fit should be omitted");
+
+    /* Clearing a label drops the brackets; closing removes the stream */
+    yamux_stream_set_label(control, NULL);
+    yamux_stream_close(upload, 1);
+    len = yamux_session_dump_streams(session, dump, sizeof(dump));
+    assert_true(strstr(dump, "upload") == NULL, "Closed stream should not be listed");
+    assert_true(strstr(dump, "stream 3 state") != NULL, "Cleared label should not be shown");
+
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that the debug dump reflects the session and each stream */
+void test_session_debug_dump(void) {
+    yamux_session_t *session;
+    yamux_stream_t *first, *second;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    char dump[1024];
+    char small[256];
+    size_t len, first_line;
+    size_t bytes;
+
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    config.small_frame_threshold = 64;
+    assert_true(yamux_session_create(&io, 1, &config, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &first) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(session, 0, &second) == YAMUX_OK, "Failed to open stream");
+
+    /* Stream 1 is answered and has data both ways; stream 3 never is */
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 1, window, 4);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, (const uint8_t *)"hello", 5);
+    while (mock->read_pos < mock->read_buf_used) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process frames");
+    }
+    assert_int_equal(yamux_session_ping(session), YAMUX_OK, "Failed to ping");
+    yamux_encode_u32(YAMUX_NORMAL, window);
+    mock_io_inject_frame(mock, YAMUX_GO_AWAY, 0, 0, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process GoAway");
+    assert_true(yamux_stream_write(first, (const uint8_t *)"abc", 3, &bytes) == YAMUX_OK, "Failed to hold a write");
+
+    len = yamux_session_debug_dump(session, dump, sizeof(dump));
+    assert_true(len == strlen(dump), "Returned length should match dump");
+    assert_true(strstr(dump, "session client streams 2 pending_accept 0 pings 1 goaway sent no received yes code 0\n") == dump,
+                "Session line should come first");
+    assert_true(strstr(dump, "stream 1 ESTABLISHED send_window 262141 recv_window 262139 buffered 5 held 3\n") != NULL,
+                "Answered stream should show its windows and buffers");
+    assert_true(strstr(dump, "stream 3 SYN_SENT ") != NULL, "Unanswered stream should show its state");
+
+    /* Truncation keeps whole lines only */
+    first_line = (size_t)(strchr(dump, '\n') - dump) + 1;
+    len = yamux_session_debug_dump(session, small, first_line + 1);
+    assert_true(len == first_line && strstr(small, "stream 1") == NULL, "Only the session line should fit");
+    len = yamux_session_debug_dump(session, small, first_line);
+    assert_true(len == 0 && small[0] == '\0', "A line that does not fit should be omitted");
+    assert_true(yamux_session_debug_dump(NULL, small, sizeof(small)) == 0 && small[0] == '\0',
+                "NULL session should give an empty dump");
+
+    yamux_session_close(session, YAMUX_NORMAL);
+    len = yamux_session_debug_dump(session, dump, sizeof(dump));
+    assert_true(strstr(dump, " closed\n") != NULL, "Closed session should say so");
+
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+typedef struct {
+    int frames;
+    yamux_header_t header;
+    uint8_t raw[YAMUX_HEADER_SIZE];
+} trace_capture_t;
+
+static void capture_trace(void *ctx, const yamux_header_t *header, const uint8_t *raw) {
+    trace_capture_t *capture = (trace_capture_t *)ctx;
+    
+    capture->frames++;
+    capture->header = *header;
+    memcpy(capture->raw, raw, YAMUX_HEADER_SIZE);
+}
+
+/* Test that the frame trace callback sees the raw header bytes */
+void test_frame_trace(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    trace_capture_t capture;
+    uint8_t window[4];
+    static const uint8_t expected[YAMUX_HEADER_SIZE] = {
+        0x00,                   /* Version */
+        0x01,                   /* Type: window update */
+        0x00, 0x03,             /* Flags: SYN | ACK */
+        0x01, 0x02, 0x03, 0x05, /* Stream ID */
+        0x00, 0x00, 0x00, 0x04  /* Length */
+    };
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_set_frame_trace_callback(NULL, capture_trace, &capture) == YAMUX_ERR_INVALID,
+                "NULL session should be rejected");
+    memset(&capture, 0, sizeof(capture));
+    assert_true(yamux_set_frame_trace_callback(session, capture_trace, &capture) == YAMUX_OK,
+                "Failed to set trace callback");
+    
+    /* A SYN-ACK for a stream ID whose bytes are all distinct */
+    assert_true(yamux_stream_open_detailed(session, 0x01020305, &stream) == YAMUX_OK, "Failed to open stream");
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 0x01020305, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN-ACK");
+    
+    assert_int_equal(capture.frames, 1, "Callback should fire once per frame");
+    assert_true(memcmp(capture.raw, expected, YAMUX_HEADER_SIZE) == 0,
+                "Raw header should match the network-order encoding");
+    assert_true(capture.header.type == YAMUX_WINDOW_UPDATE &&
+                capture.header.flags == (YAMUX_FLAG_SYN | YAMUX_FLAG_ACK) &&
+                capture.header.stream_id == 0x01020305 && capture.header.length == 4,
+                "Decoded header should match the raw bytes");
+    
+    /* Once cleared, frames are no longer reported */
+    assert_true(yamux_set_frame_trace_callback(session, NULL, NULL) == YAMUX_OK, "Failed to clear callback");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, 0, 0x01020305, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process window update");
+    assert_int_equal(capture.frames, 1, "Cleared callback should not fire");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Trace callback that takes a long time over each event */
+static void slow_trace(void *ctx, const yamux_header_t *header, const uint8_t *raw) {
+    volatile uint32_t spin;
+    
+    (void)header;
+    (void)raw;
+    for (spin = 0; spin < 200000; spin++) {
+    }
+    (*(int *)ctx)++;
+}
+
+/* Test that a trace budget keeps a slow trace callback off most frames */
+void test_frame_trace_budget(void) {
+    yamux_session_t *session;
+    yamux_config_t config = yamux_default_config;
+    yamux_header_t header;
+    yamux_io_t io;
+    mock_io_t *mock;
+    size_t pos;
+    int traced = 0;
+    int pongs;
+    int i;
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    config.enable_keepalive = 0;
+    config.max_trace_events_per_sec = 3;
+    assert_true(yamux_session_create(&io, 0, &config, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_set_frame_trace_callback(session, slow_trace, &traced) == YAMUX_OK,
+                "Failed to set trace callback");
+    assert_true(yamux_session_trace_dropped(NULL) == 0, "NULL session has dropped nothing");
+    
+    /* Until the application reports the time there is no second to count in */
+    for (i = 0; i < 5; i++) {
+        mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process ping");
+    }
+    assert_int_equal(traced, 5, "Without a clock every event should be traced");
+    assert_true(yamux_session_trace_dropped(session) == 0, "Without a clock nothing should be dropped");
+    assert_int_equal(yamux_session_keepalive(session, 0), YAMUX_OK, "Failed to start clock");
+    traced = 0;
+    mock->write_buf_used = 0;
+    
+    /* Ten pings in one second: three are traced, all are answered */
+    for (i = 0; i < 10; i++) {
+        mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+    }
+    while (mock->read_pos < mock->read_buf_used) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process ping");
+    }
+    pongs = 0;
+    for (pos = 0; pos + YAMUX_HEADER_SIZE <= mock->write_buf_used; pos += YAMUX_HEADER_SIZE) {
+        assert_true(yamux_decode_header(mock->write_buf + pos, YAMUX_HEADER_SIZE, &header) == YAMUX_OK,
+                    "Reply should be a valid header");
+        if (header.type == YAMUX_PING && (header.flags & YAMUX_FLAG_ACK)) {
+            pongs++;
+        }
+    }
+    assert_int_equal(pongs, 10, "Every ping should be answered despite the slow callback");
+    assert_int_equal(traced, 3, "Only the budget's worth should be traced");
+    assert_true(yamux_session_trace_dropped(session) == 7, "Dropped events should be counted");
+    
+    /* The next second of the keepalive clock brings a fresh budget */
+    assert_int_equal(yamux_session_keepalive(session, 1000), YAMUX_OK, "Failed to advance clock");
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process ping");
+    assert_int_equal(traced, 4, "A new second should trace again");
+    assert_true(yamux_session_trace_dropped(session) == 7, "Nothing more should be dropped");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
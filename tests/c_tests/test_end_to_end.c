@@ -0,0 +1,294 @@
+/**
+ * @file test_end_to_end.c
+ * @brief Client/server session tests over the in-memory transport
+ */
+
+#include "../../src/yamux_internal.h"
+#include <stdio.h>
+#include <string.h>
+#include "test_transport.h"
+
+/* External assert function declaration */
+void assert_true(int condition, const char *message);
+
+/* Test open, data, ping, close and GoAway between two sessions */
+void test_end_to_end(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream, *extra;
+    yamux_result_t result;
+    uint8_t request[] = "ping over yamux";
+    uint8_t reply[] = "pong";
+    uint8_t buf[64];
+    size_t bytes;
+
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+
+    result = yamux_session_create(&client_io, 1, NULL, &client);
+    assert_true(result == YAMUX_OK, "Failed to create client session");
+    result = yamux_session_create(&server_io, 0, NULL, &server);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+
+    /* Open */
+    result = yamux_stream_open_detailed(client, 0, &client_stream);
+    assert_true(result == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    result = yamux_stream_accept(server, &server_stream);
+    assert_true(result == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_get_id(server_stream) == yamux_stream_get_id(client_stream),
+                "Stream IDs should match");
+    assert_true(yamux_stream_get_state(client_stream) == YAMUX_STREAM_ESTABLISHED,
+                "Client stream should be established after SYN-ACK");
+
+    /* Data in both directions */
+    result = yamux_stream_write(client_stream, request, sizeof(request), &bytes);
+    assert_true(result == YAMUX_OK && bytes == sizeof(request), "Failed to write request");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver request");
+    result = yamux_stream_read(server_stream, buf, sizeof(buf), &bytes);
+    assert_true(result == YAMUX_OK && bytes == sizeof(request), "Failed to read request");
+    assert_true(memcmp(buf, request, sizeof(request)) == 0, "Request mismatch");
+
+    result = yamux_stream_write(server_stream, reply, sizeof(reply), &bytes);
+    assert_true(result == YAMUX_OK && bytes == sizeof(reply), "Failed to write reply");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver reply");
+    result = yamux_stream_read(client_stream, buf, sizeof(buf), &bytes);
+    assert_true(result == YAMUX_OK && bytes == sizeof(reply), "Failed to read reply");
+    assert_true(memcmp(buf, reply, sizeof(reply)) == 0, "Reply mismatch");
+
+    /* Ping is answered and both sides drain */
+    assert_true(yamux_session_ping(client) == YAMUX_OK, "Failed to send ping");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange ping");
+    assert_true(transport->a_to_b.count == 0 && transport->b_to_a.count == 0,
+                "Transport should be idle after ping");
+
+    /* Half-close from the client, then the server closes too */
+    assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to close client stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange FIN");
+    assert_true(yamux_stream_get_state(server_stream) == YAMUX_STREAM_FIN_RECV,
+                "Server stream should see peer FIN");
+    assert_true(yamux_stream_close(server_stream, 0) == YAMUX_OK, "Failed to close server stream");
+
+    /* GoAway from the server stops new streams on the client */
+    assert_true(yamux_session_close(server, YAMUX_NORMAL) == YAMUX_OK, "Failed to send GoAway");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to process GoAway");
+    assert_true(yamux_stream_get_state(client_stream) == YAMUX_STREAM_CLOSED,
+                "Client stream should be closed by the server's FIN");
+    result = yamux_stream_open_detailed(client, 0, &extra);
+    assert_true(result == YAMUX_ERR_REMOTE_GOAWAY, "Open after GoAway should fail");
+
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that a zero-length write sends nothing and changes nothing */
+void test_zero_length_write(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *stream, *accepted;
+    yamux_result_t result;
+    yamux_stream_state_t state;
+    uint8_t data[] = "x";
+    size_t bytes = 123;
+    uint32_t window;
+    void *ctx, *handle;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    result = yamux_session_create(&client_io, 1, NULL, &client);
+    assert_true(result == YAMUX_OK, "Failed to create client session");
+    result = yamux_session_create(&server_io, 0, NULL, &server);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    
+    result = yamux_stream_open_detailed(client, 0, &stream);
+    assert_true(result == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &accepted) == YAMUX_OK, "Failed to accept stream");
+    
+    state = yamux_stream_get_state(stream);
+    window = yamux_stream_get_send_window(stream);
+    
+    /* No frame, no window change, bytes reported as 0, NULL buffer allowed */
+    result = yamux_stream_write(stream, data, 0, &bytes);
+    assert_true(result == YAMUX_OK && bytes == 0, "Zero-length write should succeed with 0 bytes");
+    result = yamux_stream_write(stream, NULL, 0, &bytes);
+    assert_true(result == YAMUX_OK && bytes == 0, "Zero-length write should accept a NULL buffer");
+    assert_true(transport->a_to_b.count == 0, "Zero-length write must not emit a frame");
+    assert_true(yamux_stream_get_state(stream) == state, "Stream state should be unchanged");
+    assert_true(yamux_stream_get_send_window(stream) == window, "Send window should be unchanged");
+    
+    /* Nor does it consume a pending interrupt */
+    yamux_stream_interrupt(stream);
+    result = yamux_stream_write(stream, data, 0, &bytes);
+    assert_true(result == YAMUX_OK, "Zero-length write should ignore a pending interrupt");
+    result = yamux_stream_write(stream, data, sizeof(data), &bytes);
+    assert_true(result == YAMUX_ERR_INTERRUPTED, "Interrupt should still be pending");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+    
+    /* The handle API returns 0 bytes written */
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    ctx = yamux_init(client_io.read, client_io.write, client_io.ctx, 1);
+    assert_true(ctx != NULL, "Failed to init session");
+    handle = yamux_open_stream(ctx);
+    assert_true(handle != NULL, "Failed to open stream handle");
+    transport->a_to_b.count = 0;  /* Discard the SYN */
+    assert_true(yamux_write(handle, data, 0) == 0, "yamux_write of 0 bytes should return 0");
+    assert_true(yamux_write(handle, NULL, 0) == 0, "yamux_write of 0 bytes should accept NULL");
+    assert_true(transport->a_to_b.count == 0, "yamux_write of 0 bytes must not emit a frame");
+    
+    yamux_close_stream(handle, 1);
+    yamux_destroy(ctx);
+    test_transport_free(transport);
+}
+
+/* Test that pings are answered and timed between two sessions */
+void test_end_to_end_ping(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_config_t config = yamux_default_config;
+    uint32_t rtt;
+    
+    /* Keepalive off, so only the pings sent here are on the wire */
+    config.enable_keepalive = 0;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client session");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server session");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_ERR_WOULD_BLOCK, "No RTT before any ping");
+    
+    /* One ping, answered 40 ms later */
+    yamux_session_keepalive(client, 1000);
+    assert_true(yamux_session_ping(client) == YAMUX_OK, "Failed to send ping");
+    assert_true(transport->a_to_b.count == YAMUX_HEADER_SIZE, "Ping should be a bare header");
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Server failed to answer ping");
+    assert_true(transport->b_to_a.count == YAMUX_HEADER_SIZE, "Pong should be a bare header");
+    yamux_session_keepalive(client, 1040);
+    assert_true(yamux_session_process(client) == YAMUX_OK, "Client failed to take pong");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_OK && rtt == 40, "RTT should be 40 ms");
+    assert_true(yamux_session_rtt(server, &rtt) == YAMUX_ERR_WOULD_BLOCK, "Answering a ping gives no RTT");
+    
+    /* Two pings in flight: the first pong times the first ping, the second is not timed */
+    yamux_session_keepalive(client, 2000);
+    assert_true(yamux_session_ping(client) == YAMUX_OK, "Failed to send first ping");
+    yamux_session_keepalive(client, 2010);
+    assert_true(yamux_session_ping(client) == YAMUX_OK, "Failed to send second ping");
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Server failed to answer first ping");
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Server failed to answer second ping");
+    yamux_session_keepalive(client, 2050);
+    assert_true(yamux_session_process(client) == YAMUX_OK, "Client failed to take first pong");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_OK && rtt == 50, "First pong should time the first ping");
+    yamux_session_keepalive(client, 2090);
+    assert_true(yamux_session_process(client) == YAMUX_OK, "Client failed to take second pong");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_OK && rtt == 50, "Second pong should not be timed");
+    
+    /* The next ping is timed from scratch */
+    yamux_session_keepalive(client, 3000);
+    assert_true(yamux_session_ping(client) == YAMUX_OK, "Failed to send ping");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange ping");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_OK && rtt == 0, "Ping answered within one tick");
+    assert_true(transport->a_to_b.count == 0 && transport->b_to_a.count == 0,
+                "Transport should be idle after the pings");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Peer side of a wait: let the server answer, then report the time waited */
+typedef struct {
+    test_transport_t *transport;
+    yamux_session_t *server;
+    int answer;
+} ping_wait_t;
+
+static int ping_wait(void *ctx, uint32_t timeout_ms, uint32_t *elapsed_ms) {
+    ping_wait_t *wait = (ping_wait_t *)ctx;
+    
+    if (!wait->answer) {
+        *elapsed_ms = timeout_ms;
+        return 0;
+    }
+    while (wait->transport->a_to_b.count > 0) {
+        (void)yamux_session_process(wait->server);
+    }
+    *elapsed_ms = 15;
+    return wait->transport->b_to_a.count > 0 ? 1 : 0;
+}
+
+/* Test that a tagged ping waits for its own answer and ignores any other */
+void test_end_to_end_ping_rtt(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_config_t config = yamux_default_config;
+    yamux_health_t health;
+    ping_wait_t wait;
+    uint8_t stray[YAMUX_HEADER_SIZE + 4];
+    yamux_header_t header;
+    uint32_t rtt;
+    
+    config.enable_keepalive = 0;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client session");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server session");
+    wait.transport = transport;
+    wait.server = server;
+    wait.answer = 1;
+    assert_true(yamux_set_wait_callback(client, ping_wait, &wait) == YAMUX_OK, "Failed to set wait callback");
+    
+    /* Answered within one wait */
+    assert_true(yamux_session_ping_rtt(client, 1000, &rtt) == YAMUX_OK && rtt == 15, "RTT should be one wait");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_OK && rtt == 15, "Last RTT should agree");
+    
+    /* A pong for a tag we never sent arrives first and is ignored */
+    memset(&header, 0, sizeof(header));
+    header.version = YAMUX_PROTO_VERSION;
+    header.type = YAMUX_PING;
+    header.flags = YAMUX_FLAG_ACK;
+    header.length = 4;
+    yamux_encode_header(&header, stray);
+    yamux_encode_u32(0xdeadbeef, stray + YAMUX_HEADER_SIZE);
+    assert_true(server_io.write(server_io.ctx, stray, sizeof(stray)) == (int)sizeof(stray), "Failed to queue stray pong");
+    assert_true(yamux_session_ping_rtt(client, 1000, &rtt) == YAMUX_OK && rtt == 30,
+                "Stray pong should not end the wait");
+    assert_true(yamux_session_health(client, &health) == YAMUX_OK && health.pending_pings == 0,
+                "No ping should be left pending");
+    
+    /* Unanswered: the ping times out, and its late pong is ignored */
+    wait.answer = 0;
+    assert_true(yamux_session_ping_rtt(client, 100, &rtt) == YAMUX_ERR_TIMEOUT, "Unanswered ping should time out");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver late pong");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_OK && rtt == 30, "Late pong should not be timed");
+    assert_true(yamux_session_health(client, &health) == YAMUX_OK && health.pending_pings == 0,
+                "Timed-out ping should not stay pending");
+    
+    /* Without waiting, the pong is timed on the keepalive clock */
+    assert_true(yamux_set_wait_callback(client, NULL, NULL) == YAMUX_OK, "Failed to clear wait callback");
+    yamux_session_keepalive(client, 5000);
+    assert_true(yamux_session_ping_rtt(client, 1000, &rtt) == YAMUX_ERR_WOULD_BLOCK, "Ping should not wait");
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Server failed to answer ping");
+    yamux_session_keepalive(client, 5020);
+    assert_true(yamux_session_process(client) == YAMUX_OK, "Client failed to take pong");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_OK && rtt == 20, "RTT should come from the keepalive clock");
+    assert_true(yamux_session_ping_rtt(NULL, 0, &rtt) == YAMUX_ERR_INVALID, "NULL session should be invalid");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
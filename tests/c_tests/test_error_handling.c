@@ -3,6 +3,7 @@
 #include <string.h>
 #include <stdlib.h>
 #include <assert.h>
+#include "test_transport.h"
 
 /* External assert function declaration */
 void assert_true(int condition, const char *message);
@@ -20,14 +21,20 @@ typedef struct {
     
     int should_fail_read;
     int should_fail_write;
+    int fail_result;        /* Returned by a failing read or write */
+    int read_calls;         /* Calls to error_read */
+    int write_calls;        /* Calls to error_write */
+    int overstate;          /* Extra bytes a successful write claims to have written */
+    int write_limit;        /* Bytes accepted before writes block, -1 for no limit */
 } error_io_t;
 
 /* Read callback with error simulation */
 int error_read(void *ctx, uint8_t *buf, size_t len) {
     error_io_t *io = (error_io_t *)ctx;
     
+    io->read_calls++;
     if (io->should_fail_read) {
-        return -1;
+        return io->fail_result;
     }
     
     if (io->read_buf_used == 0 || io->read_pos >= io->read_buf_used) {
@@ -47,8 +54,20 @@ int error_read(void *ctx, uint8_t *buf, size_t len) {
 int error_write(void *ctx, const uint8_t *buf, size_t len) {
     error_io_t *io = (error_io_t *)ctx;
     
+    io->write_calls++;
     if (io->should_fail_write) {
-        return -1;
+        return io->fail_result;
+    }
+    
+    /* A full transport takes what fits and then blocks */
+    if (io->write_limit >= 0) {
+        if (io->write_limit == 0) {
+            return YAMUX_ERR_WOULD_BLOCK;
+        }
+        if (len > (size_t)io->write_limit) {
+            len = (size_t)io->write_limit;
+        }
+        io->write_limit -= (int)len;
     }
     
     if (io->write_buf_used + len > io->write_buf_size) {
@@ -65,7 +84,7 @@ int error_write(void *ctx, const uint8_t *buf, size_t len) {
     memcpy(io->write_buf + io->write_buf_used, buf, len);
     io->write_buf_used += len;
     
-    return len;
+    return (int)len + io->overstate;
 }
 
 /* Initialize error IO */
@@ -83,6 +102,11 @@ error_io_t *error_io_init(void) {
     
     io->should_fail_read = 0;
     io->should_fail_write = 0;
+    io->fail_result = -1;
+    io->read_calls = 0;
+    io->write_calls = 0;
+    io->overstate = 0;
+    io->write_limit = -1;
     
     return io;
 }
@@ -133,9 +157,417 @@ void test_error_handling(void) {
     result = yamux_stream_open_detailed(session, 0xFFFFFFFF, &stream);
     assert_true(result == YAMUX_ERR_INVALID, "Should fail with invalid stream ID 0xFFFFFFFF");
     
+    yamux_session_free(session);
+    
     /* Clean up IO resources */
     if (error_io) {
         error_io_free(error_io);
         error_io = NULL;
     }
 }
+
+/* Allocator that fails once its budget of allocations is spent */
+static int alloc_budget;
+static int alloc_failures;
+
+static void *budget_malloc(size_t size) {
+    if (alloc_budget <= 0) {
+        alloc_failures++;
+        return NULL;
+    }
+    alloc_budget--;
+    return malloc(size);
+}
+
+static void *budget_realloc(void *ptr, size_t size) {
+    if (alloc_budget <= 0) {
+        alloc_failures++;
+        return NULL;
+    }
+    alloc_budget--;
+    return realloc(ptr, size);
+}
+
+static const yamux_allocator_t budget_allocator = { budget_malloc, budget_realloc, free };
+
+/* Test that running out of memory for received data only resets that stream */
+void test_allocation_failure(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *victim, *survivor, *refused;
+    yamux_stream_t *victim_peer, *survivor_peer;
+    static uint8_t big[8 * 1024];
+    uint8_t data[] = "still here";
+    uint8_t buf[32];
+    size_t bytes;
+#ifndef YAMUX_MINIMAL
+    char dump[1024];
+#endif
+
+    transport = test_transport_pair(64 * 1024, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+
+    assert_true(yamux_stream_open_detailed(client, 0, &victim) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(client, 0, &survivor) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    assert_true(yamux_stream_accept(server, &victim_peer) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_accept(server, &survivor_peer) == YAMUX_OK, "Failed to accept stream");
+
+    /* More than the initial receive buffer, twice, so the second frame arrives after the reset */
+    memset(big, 0xA5, sizeof(big));
+    assert_true(yamux_stream_write(victim, big, sizeof(big), &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(yamux_stream_write(victim, big, sizeof(big), &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(yamux_stream_write(survivor, data, sizeof(data), &bytes) == YAMUX_OK, "Failed to write");
+
+    /* The session scratch buffer may grow, the stream buffer may not */
+    alloc_budget = 1;
+    alloc_failures = 0;
+    yamux_set_allocator(&budget_allocator);
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Allocation failure should not fail the session");
+    assert_true(alloc_failures > 0, "Allocator should have been asked to grow the stream buffer");
+    assert_true(yamux_stream_get_state(victim_peer) == YAMUX_STREAM_CLOSED, "Stream should be reset");
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Late data for a reset stream should be dropped");
+    assert_true(yamux_stream_read(victim_peer, buf, sizeof(buf), &bytes) == YAMUX_ERR_RESET,
+                "Read on a reset stream should report RESET");
+    assert_true(yamux_stream_get_reset_reason(victim_peer) == YAMUX_RESET_INTERNAL,
+                "Reset should be recorded as an internal error");
+#ifndef YAMUX_MINIMAL
+    yamux_session_dump_diagnostics(server, dump, sizeof(dump));
+    assert_true(strstr(dump, "out of memory") != NULL, "Reset should be recorded in diagnostics");
+#endif
+
+    /* Other streams keep working, even while allocations still fail */
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Failed to process data for other stream");
+    assert_true(yamux_stream_read(survivor_peer, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0,
+                "Other stream should receive its data");
+
+    /* A stream that cannot be allocated is refused with an RST */
+    yamux_set_allocator(NULL);
+    assert_true(yamux_stream_open_detailed(client, 0, &refused) == YAMUX_OK, "Failed to open stream");
+    alloc_budget = 0;
+    yamux_set_allocator(&budget_allocator);
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Refusing a stream should not fail the session");
+    assert_true(yamux_session_pending_accepts(server) == 0, "Refused stream should not be queued");
+    yamux_set_allocator(NULL);
+
+    /* The client sees both resets and can still talk on the surviving stream */
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver resets");
+    assert_true(yamux_stream_get_state(victim) == YAMUX_STREAM_CLOSED, "Client should see the reset");
+    assert_true(yamux_stream_get_state(refused) == YAMUX_STREAM_CLOSED, "Client should see the refusal");
+    assert_true(yamux_stream_get_reset_reason(victim) == YAMUX_RESET_PEER, "Client should see a peer reset");
+    assert_true(yamux_stream_get_reset_reason(refused) == YAMUX_RESET_REFUSED, "Client should see a refusal");
+    assert_true(yamux_stream_write(survivor_peer, data, sizeof(data), &bytes) == YAMUX_OK, "Failed to reply");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver reply");
+    assert_true(yamux_stream_read(survivor, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                "Client should receive the reply");
+
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Streams' share of yamux_session_memory_used, counted by walking the table */
+static size_t stream_memory_walked(yamux_session_t *session) {
+    size_t used = 0;
+    size_t i;
+    
+    for (i = 0; i < session->stream_count; i++) {
+        if (session->streams[i]) {
+            used += sizeof(yamux_stream_t) + session->streams[i]->recvbuf.size + session->streams[i]->sendbuf.size;
+        }
+    }
+    
+    return used;
+}
+
+/* Test that a session memory cap refuses streams and data instead of allocating */
+void test_session_memory_limit(void) {
+    test_transport_t *transport, *scratch;
+    yamux_io_t client_io, server_io, scratch_io, scratch_peer_io;
+    yamux_config_t config = yamux_default_config;
+    yamux_session_t *client, *server;
+    yamux_stream_t *first, *second, *refused, *first_peer, *second_peer, *extra;
+    const size_t stream_cost = sizeof(yamux_stream_t) + YAMUX_INITIAL_BUFFER_SIZE;
+    static uint8_t big[8 * 1024];
+    uint8_t data[] = "still here";
+    uint8_t buf[32];
+    size_t baseline, bytes;
+
+    transport = test_transport_pair(64 * 1024, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+
+    /* A cap the bare session does not fit in refuses the session itself */
+    config.max_session_memory = 64;
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_ERR_NOMEM,
+                "Session larger than its cap should not be created");
+
+    /* Room for the session and two streams, but not a third */
+    scratch = test_transport_pair(256, &scratch_io, &scratch_peer_io);
+    assert_true(scratch != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&scratch_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    baseline = yamux_session_memory_used(server);
+    assert_true(baseline > sizeof(yamux_stream_t), "Fresh session should count its own memory");
+    yamux_session_free(server);
+    test_transport_free(scratch);
+    config.max_session_memory = (uint32_t)(baseline + 2 * stream_cost + 1024);
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+
+    assert_true(yamux_stream_open_detailed(client, 0, &first) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(client, 0, &second) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(client, 0, &refused) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Refusal should not fail the session");
+    assert_true(yamux_session_pending_accepts(server) == 2, "Only streams within the cap should be queued");
+    assert_true(yamux_stream_get_reset_reason(refused) == YAMUX_RESET_REFUSED, "Client should see a refusal");
+    assert_true(yamux_stream_accept(server, &first_peer) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_accept(server, &second_peer) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_session_memory_used(server) <= config.max_session_memory, "Cap should hold");
+    assert_true(server->stream_memory == stream_memory_walked(server), "Running count should match the streams");
+
+    /* Our own opens are refused the same way */
+    assert_true(yamux_stream_open_detailed(server, 0, &extra) == YAMUX_ERR_NOMEM,
+                "Opening past the cap should report NOMEM");
+
+    /* Data that would grow a buffer past the cap resets only its stream */
+    memset(big, 0x5A, sizeof(big));
+    assert_true(yamux_stream_write(first, big, sizeof(big), &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(yamux_stream_write(second, data, sizeof(data), &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Over-cap data should not fail the session");
+    assert_true(yamux_stream_get_reset_reason(first_peer) == YAMUX_RESET_INTERNAL, "Stream should be reset");
+    assert_true(yamux_stream_get_reset_reason(first) == YAMUX_RESET_PEER, "Client should see the reset");
+    assert_true(yamux_stream_read(second_peer, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0,
+                "Other stream should receive its data");
+    assert_true(yamux_session_memory_used(server) <= config.max_session_memory, "Cap should hold");
+    assert_true(server->stream_memory == stream_memory_walked(server), "Running count should follow buffer changes");
+    assert_true(client->stream_memory == stream_memory_walked(client), "Running count should match on the sender");
+
+    /* Freed memory can be used again */
+    assert_true(yamux_stream_close(first_peer, 0) == YAMUX_OK, "Failed to release reset stream");
+    assert_true(yamux_stream_open_detailed(server, 0, &extra) == YAMUX_OK, "Released memory should be reusable");
+    assert_true(server->stream_memory == stream_memory_walked(server), "Running count should follow removals");
+    assert_true(yamux_session_memory_used(NULL) == 0, "NULL session should hold nothing");
+
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that a reset transport is reported apart from other IO failures */
+void test_connection_reset(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    error_io_t *error_io;
+    uint8_t data[] = "payload";
+    size_t bytes;
+    
+    error_io = error_io_init();
+    io.read = error_read;
+    io.write = error_write;
+    io.ctx = error_io;
+    
+    /* A generic read failure fails the session as a plain IO error */
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_session_process(session) == YAMUX_ERR_IO, "Nothing to read should report IO");
+    assert_true(!session->transport_failed, "Nothing to read should not fail the session");
+    error_io->should_fail_read = 1;
+    assert_true(yamux_session_process(session) == YAMUX_ERR_IO, "Failed read should report IO");
+    assert_true(yamux_session_process(session) == YAMUX_ERR_CLOSED, "Failed session should then be closed");
+    yamux_session_free(session);
+    
+    /* A reset read is reported as such, on every later call too */
+    error_io->fail_result = YAMUX_ERR_CONN_RESET;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_session_process(session) == YAMUX_ERR_CONN_RESET, "Reset read should report CONN_RESET");
+    assert_true(yamux_session_process(session) == YAMUX_ERR_CONN_RESET, "Reset should stay distinct");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_ERR_CLOSED,
+                "No stream can be opened on a reset transport");
+    yamux_session_free(session);
+    
+    /* A reset write fails the stream write and the session with it */
+    error_io->should_fail_read = 0;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    error_io->should_fail_write = 1;
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_ERR_CONN_RESET,
+                "Reset write should report CONN_RESET");
+    assert_true(yamux_session_process(session) == YAMUX_ERR_CONN_RESET, "Session should report the reset");
+    yamux_session_free(session);
+    
+    error_io_free(error_io);
+}
+
+/* Test that processing returns at once when the transport is blocked both ways */
+void test_process_both_blocked(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    error_io_t *error_io;
+    uint8_t data[] = "held";
+    size_t bytes;
+    int i;
+    
+    error_io = error_io_init();
+    io.read = error_read;
+    io.write = error_write;
+    io.ctx = error_io;
+    config.small_frame_threshold = 64;
+    assert_true(yamux_session_create(&io, 1, &config, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_OK, "Small write should be held");
+    
+    /* Nothing to read and no room to write: every call tries each direction once */
+    error_io->should_fail_read = 1;
+    error_io->should_fail_write = 1;
+    error_io->fail_result = YAMUX_ERR_WOULD_BLOCK;
+    error_io->read_calls = 0;
+    error_io->write_calls = 0;
+    for (i = 0; i < 1000; i++) {
+        assert_true(yamux_session_process(session) == YAMUX_ERR_WOULD_BLOCK,
+                    "Blocked transport should report would-block");
+    }
+    assert_true(error_io->read_calls == 1000, "Each call should read once");
+    assert_true(error_io->write_calls == 1000, "Each call should try the held data once");
+    assert_true(!session->transport_failed, "Blocking should not fail the session");
+    assert_true(stream->sendbuf.used - stream->sendbuf.pos == sizeof(data), "Refused data should stay held");
+    
+    /* Once the peer reads again, the held data leaves on the next call */
+    error_io->should_fail_write = 0;
+    error_io->write_buf_used = 0;
+    assert_true(yamux_session_process(session) == YAMUX_ERR_WOULD_BLOCK, "Read side is still blocked");
+    assert_true(error_io->write_buf_used == YAMUX_HEADER_SIZE + sizeof(data), "Held data should be sent");
+    
+    error_io->should_fail_read = 0;
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    error_io_free(error_io);
+}
+
+/* Test that a write callback claiming more bytes than it was given fails the session */
+void test_write_overstated(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    error_io_t *error_io;
+    uint8_t data[] = "payload";
+    size_t bytes;
+    int calls;
+    
+    error_io = error_io_init();
+    io.read = error_read;
+    io.write = error_write;
+    io.ctx = error_io;
+    
+    /* A direct write stops at the bad count instead of advancing past the buffer */
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    error_io->overstate = 100;
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_ERR_IO,
+                "Overstated write should report IO");
+    assert_true(bytes == 0, "Nothing should be reported written");
+    assert_true(session->transport_failed, "Overstated write should fail the transport");
+    
+    /* The transport is not used again */
+    calls = error_io->write_calls;
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_ERR_CLOSED,
+                "Writes on a failed transport should be refused");
+    assert_true(error_io->write_calls == calls, "Refused write should not reach the transport");
+    assert_true(yamux_session_process(session) == YAMUX_ERR_CLOSED, "Session should be closed");
+    yamux_session_free(session);
+    
+    /* Flushing held writes leaves them held */
+    error_io->overstate = 0;
+    config.small_frame_threshold = 64;
+    assert_true(yamux_session_create(&io, 1, &config, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                "Small write should be held");
+    error_io->overstate = 1;
+    assert_true(yamux_stream_flush(stream) == YAMUX_ERR_IO, "Overstated flush should report IO");
+    assert_true(session->transport_failed, "Overstated flush should fail the transport");
+    assert_true(stream->sendbuf.used - stream->sendbuf.pos == sizeof(data), "Held data should not be dropped");
+    assert_true(yamux_stream_flush(stream) == YAMUX_ERR_CLOSED, "Flush on a failed transport should be refused");
+    yamux_session_free(session);
+    
+    error_io_free(error_io);
+}
+
+/* Test that a frame cut short after its header went out fails the session */
+void test_write_cut_frame(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    error_io_t *error_io;
+    uint8_t data[1000];
+    size_t bytes;
+    size_t used;
+    
+    memset(data, 'x', sizeof(data));
+    error_io = error_io_init();
+    io.read = error_read;
+    io.write = error_write;
+    io.ctx = error_io;
+    
+    /* The header goes out and the body blocks: the peer now expects 1000 bytes */
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    error_io->write_limit = YAMUX_HEADER_SIZE;
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_ERR_IO,
+                "Blocked body should report IO");
+    assert_true(session->transport_failed, "A cut frame should fail the transport");
+    
+    /* Nothing more reaches the transport, so no second header lands inside the first frame */
+    error_io->write_limit = -1;
+    used = error_io->write_buf_used;
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_ERR_CLOSED,
+                "Writes after a cut frame should be refused");
+    assert_true(error_io->write_buf_used == used, "Refused write should not reach the transport");
+    assert_true(yamux_session_process(session) == YAMUX_ERR_CLOSED, "Session should be closed");
+    yamux_session_free(session);
+    
+    /* Part of a header is just as bad */
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    error_io->write_limit = 5;
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_ERR_IO,
+                "Partial header should report IO");
+    assert_true(session->transport_failed, "A partial header should fail the transport");
+    error_io->write_limit = -1;
+    yamux_session_free(session);
+    
+    /* A full transport before the header is only a full transport */
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    error_io->write_limit = 0;
+    assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_ERR_WOULD_BLOCK,
+                "Blocked header should report WOULD_BLOCK");
+    assert_true(!session->transport_failed, "Blocking before the header should not fail the transport");
+    error_io->write_limit = -1;
+    yamux_session_free(session);
+    
+    /* Flushing held writes is held to the same rule */
+    config.small_frame_threshold = 64;
+    assert_true(yamux_session_create(&io, 1, &config, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_write(stream, data, 8, &bytes) == YAMUX_OK && bytes == 8, "Small write should be held");
+    error_io->write_limit = YAMUX_HEADER_SIZE;
+    assert_true(yamux_stream_flush(stream) == YAMUX_ERR_IO, "Blocked held body should report IO");
+    assert_true(session->transport_failed, "A cut held frame should fail the transport");
+    error_io->write_limit = -1;
+    assert_true(yamux_stream_flush(stream) == YAMUX_ERR_CLOSED, "Flush after a cut frame should be refused");
+    yamux_session_free(session);
+    
+    error_io_free(error_io);
+}
@@ -3,6 +3,8 @@
 #include <string.h>
 #include <stdlib.h>
 #include <assert.h>
+#include "mock_io.h"
+#include "test_transport.h"
 
 /* Define yamux window size constants if not defined */
 #ifndef YAMUX_DEFAULT_WINDOW_SIZE
@@ -15,6 +17,7 @@ yamux_result_t yamux_stream_update_window(yamux_stream_t *stream, uint32_t incre
 
 /* External assert function declaration */
 void assert_true(int condition, const char *message);
+void assert_int_equal(int a, int b, const char *message);
 
 /* Mock IO context for flow control testing */
 typedef struct {
@@ -305,11 +308,13 @@ void test_flow_control(void) {
     fflush(stdout);
     
     result = yamux_close_stream(client_stream, 0);
+    client_stream = NULL; /* Handle is freed by yamux_close_stream */
     if (result < 0) {
         printf("ERROR: Failed to close client stream, result=%d\n", result);
     }
     
     result = yamux_close_stream(server_stream, 0);
+    server_stream = NULL;
     if (result < 0) {
         printf("ERROR: Failed to close server stream, result=%d\n", result);
     }
@@ -329,3 +334,1631 @@ cleanup:
     free(send_buffer);
     free(recv_buffer);
 }
+
+/* Test window recommendation from bandwidth-delay product */
+void test_recommended_window(void) {
+    /* Known BDP values (kbps * ms / 8) */
+    assert_true(yamux_recommended_window(8000, 100) == 100000, "8 Mbps x 100 ms should be 100000 bytes");
+    assert_true(yamux_recommended_window(80000, 50) == 500000, "80 Mbps x 50 ms should be 500000 bytes");
+    assert_true(yamux_recommended_window(100000, 20) == 250000, "100 Mbps x 20 ms should be 250000 bytes");
+    
+    /* Clamped to the lower bound */
+    assert_true(yamux_recommended_window(0, 0) == YAMUX_MIN_RECOMMENDED_WINDOW, "Zero link should clamp to minimum");
+    assert_true(yamux_recommended_window(100, 10) == YAMUX_MIN_RECOMMENDED_WINDOW, "Tiny BDP should clamp to minimum");
+    
+    /* Clamped to the upper bound, without overflow */
+    assert_true(yamux_recommended_window(1000000, 200) == YAMUX_MAX_RECOMMENDED_WINDOW, "1 Gbps x 200 ms should clamp to maximum");
+    assert_true(yamux_recommended_window(0xFFFFFFFF, 0xFFFFFFFF) == YAMUX_MAX_RECOMMENDED_WINDOW, "Huge inputs should clamp to maximum");
+}
+
+/* Test reporting the window advertised by a peer using a small window */
+void test_stream_peer_window(void) {
+    yamux_session_t *client, *server;
+    yamux_stream_t *stream;
+    yamux_io_t client_io, server_io;
+    mock_io_t *client_mock, *server_mock;
+    yamux_result_t result;
+    uint8_t payload[4];
+    uint8_t data[6000];
+    size_t bytes_written;
+    uint32_t window;
+    
+    client_mock = mock_io_init(8192);
+    client_io.read = mock_read;
+    client_io.write = mock_write;
+    client_io.ctx = client_mock;
+    server_mock = mock_io_init(8192);
+    server_io.read = mock_read;
+    server_io.write = mock_write;
+    server_io.ctx = server_mock;
+    
+    result = yamux_session_create(&client_io, 1, NULL, &client);
+    assert_true(result == YAMUX_OK, "Failed to create client session");
+    result = yamux_session_create(&server_io, 0, NULL, &server);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    
+    /* Stream we open: unknown until the peer's SYN-ACK arrives */
+    result = yamux_stream_open_detailed(client, 0, &stream);
+    assert_true(result == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_peer_window(stream, &window) == YAMUX_ERR_WOULD_BLOCK,
+                "Peer window should be unknown before SYN-ACK");
+    
+    yamux_encode_u32(4096, payload);
+    mock_io_inject_frame(client_mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK,
+                         yamux_stream_get_id(stream), payload, 4);
+    assert_true(yamux_session_process(client) == YAMUX_OK, "Failed to process SYN-ACK");
+    result = yamux_stream_peer_window(stream, &window);
+    assert_true(result == YAMUX_OK && window == 4096, "Peer window should match SYN-ACK");
+    
+    /* Sending consumes credit but leaves the advertised value alone */
+    memset(data, 'w', sizeof(data));
+    result = yamux_stream_write(stream, data, sizeof(data), &bytes_written);
+    assert_true(result == YAMUX_OK && bytes_written == 4096, "Write should stop at the peer window");
+    assert_true(yamux_stream_get_send_window(stream) == 0, "Send window should be exhausted");
+    result = yamux_stream_peer_window(stream, &window);
+    assert_true(result == YAMUX_OK && window == 4096, "Advertised window should not change");
+    
+    /* Stream the peer opens: known from its SYN */
+    yamux_encode_u32(2048, payload);
+    mock_io_inject_frame(server_mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, payload, 4);
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Failed to process SYN");
+    assert_true(yamux_stream_accept(server, &stream) == YAMUX_OK, "Failed to accept stream");
+    result = yamux_stream_peer_window(stream, &window);
+    assert_true(result == YAMUX_OK && window == 2048, "Peer window should match SYN");
+    
+    assert_true(yamux_stream_peer_window(NULL, &window) == YAMUX_ERR_INVALID, "NULL stream should be rejected");
+    assert_true(yamux_stream_peer_window(stream, NULL) == YAMUX_ERR_INVALID, "NULL output should be rejected");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    mock_io_free(client_mock);
+    mock_io_free(server_mock);
+}
+
+/* Test that a small configured window applies to streams opened from either side */
+void test_configured_stream_window(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    static uint8_t data[64 * 1024];
+    uint8_t buf[4096];
+    uint32_t window;
+    size_t bytes;
+    
+    transport = test_transport_pair(128 * 1024, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    config.max_stream_window_size = 16 * 1024;
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+    memset(data, 'w', sizeof(data));
+    
+    /* The opener advertises its configured window in the SYN */
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_peer_window(server_stream, &window) == YAMUX_OK && window == 16 * 1024,
+                "SYN should carry the opener's configured window");
+    assert_true(yamux_stream_write(server_stream, data, sizeof(data), &bytes) == YAMUX_OK &&
+                bytes == 16 * 1024, "Writes to the opener should stop at its window");
+    
+    /* The acceptor advertises the same in its SYN-ACK */
+    assert_true(yamux_stream_peer_window(client_stream, &window) == YAMUX_OK && window == 16 * 1024,
+                "SYN-ACK should carry the acceptor's configured window");
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK &&
+                bytes == 16 * 1024, "Writes to the acceptor should stop at its window");
+    
+    /* Reading the window's worth grants it back */
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    do {
+        assert_true(yamux_stream_read(client_stream, buf, sizeof(buf), &bytes) == YAMUX_OK, "Failed to read");
+    } while (bytes > 0);
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver update");
+    assert_true(yamux_stream_get_send_window(server_stream) == 16 * 1024, "Reader should restore the window");
+    
+    /* Without a config the 256 KB default still applies */
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_free(client);
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(client_stream->recv_window == YAMUX_DEFAULT_WINDOW_SIZE, "Default window should be 256 KB");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that a peer advertising a zero initial window gets no data until it grants credit */
+void test_zero_initial_window(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    uint8_t data[300];
+    uint32_t advertised;
+    size_t bytes, before;
+    int client;
+    
+    memset(data, 'z', sizeof(data));
+    for (client = 0; client <= 1; client++) {
+        mock = mock_io_init(1024);
+        io.read = mock_read;
+        io.write = mock_write;
+        io.ctx = mock;
+        assert_true(yamux_session_create(&io, client, NULL, &session) == YAMUX_OK, "Failed to create session");
+        
+        /* The peer opens, or answers our open, with a window of 0 */
+        yamux_encode_u32(0, window);
+        if (client) {
+            assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+            mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 1, window, 4);
+            assert_int_equal(yamux_session_process(session), YAMUX_OK, "Zero window SYN-ACK should be accepted");
+        } else {
+            mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+            assert_int_equal(yamux_session_process(session), YAMUX_OK, "Zero window SYN should be accepted");
+            assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept stream");
+        }
+        assert_true(yamux_stream_peer_window(stream, &advertised) == YAMUX_OK && advertised == 0,
+                    "Zero initial window should be recorded");
+        
+        /* Nothing may be sent yet */
+        before = mock->write_buf_used;
+        assert_int_equal(yamux_stream_write(stream, data, sizeof(data), &bytes), YAMUX_ERR_NO_WINDOW,
+                         "Write should wait for credit");
+        assert_true(mock->write_buf_used == before, "No data should be sent before the grant");
+        
+        /* The first grant lets exactly that much through */
+        yamux_encode_u32(100, window);
+        mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, 0, 1, window, 4);
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process window update");
+        assert_true(yamux_stream_write(stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == 100,
+                    "Write should be cut to the granted credit");
+        assert_true(mock->write_buf_used == before + YAMUX_HEADER_SIZE + 100, "Granted data should be sent");
+        assert_int_equal(yamux_stream_write(stream, data, sizeof(data), &bytes), YAMUX_ERR_NO_WINDOW,
+                         "Credit should be used up again");
+        
+        yamux_session_close(session, YAMUX_NORMAL);
+        yamux_session_free(session);
+        mock_io_free(mock);
+    }
+}
+
+/* Test that a zero send window and a full transport are reported differently */
+void test_write_no_window(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_result_t result;
+    uint8_t data[64];
+    uint8_t payload[4];
+    size_t bytes_written;
+    
+    memset(data, 'n', sizeof(data));
+    transport = test_transport_pair(64, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    result = yamux_session_create(&client_io, 1, NULL, &client);
+    assert_true(result == YAMUX_OK, "Failed to create client session");
+    result = yamux_session_create(&server_io, 0, NULL, &server);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    
+    result = yamux_stream_open_detailed(client, 0, &client_stream);
+    assert_true(result == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* Transport full: one 12-byte header plus 52 bytes fills the 64-byte ring */
+    result = yamux_stream_write(client_stream, data, 52, &bytes_written);
+    assert_true(result == YAMUX_OK && bytes_written == 52, "Failed to fill transport");
+    result = yamux_stream_write(client_stream, data, 8, &bytes_written);
+    assert_true(result == YAMUX_ERR_WOULD_BLOCK && bytes_written == 0,
+                "Full transport should report YAMUX_ERR_WOULD_BLOCK");
+    assert_true(yamux_stream_get_send_window(client_stream) > 0,
+                "Full transport must not consume send window");
+    
+    /* Draining the transport clears the condition */
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to drain transport");
+    result = yamux_stream_write(client_stream, data, 8, &bytes_written);
+    assert_true(result == YAMUX_OK && bytes_written == 8, "Write should succeed after drain");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    
+    /* Zero window: the transport is empty but the peer has granted no credit */
+    client_stream->send_window = 0;
+    result = yamux_stream_write(client_stream, data, 8, &bytes_written);
+    assert_true(result == YAMUX_ERR_NO_WINDOW && bytes_written == 0,
+                "Zero window should report YAMUX_ERR_NO_WINDOW");
+    assert_true(transport->a_to_b.count == 0, "Zero window write must not touch the transport");
+    
+    /* A window update clears the condition */
+    yamux_encode_u32(8, payload);
+    {
+        yamux_header_t header;
+        uint8_t frame[YAMUX_HEADER_SIZE + 4];
+        
+        memset(&header, 0, sizeof(header));
+        header.version = YAMUX_PROTO_VERSION;
+        header.type = YAMUX_WINDOW_UPDATE;
+        header.stream_id = yamux_stream_get_id(client_stream);
+        header.length = 4;
+        yamux_encode_header(&header, frame);
+        memcpy(frame + YAMUX_HEADER_SIZE, payload, 4);
+        assert_true(test_transport_write(&transport->b, frame, sizeof(frame)) == (int)sizeof(frame),
+                    "Failed to send window update");
+    }
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to process window update");
+    result = yamux_stream_write(client_stream, data, 8, &bytes_written);
+    assert_true(result == YAMUX_OK && bytes_written == 8, "Write should succeed after window update");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that the accept bonus is visible to the opener right after the SYN-ACK */
+void test_accept_window_bonus(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config;
+    yamux_result_t result;
+    uint32_t window;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    
+    config = yamux_default_config;
+    config.accept_initial_window_bonus = 64 * 1024;
+    result = yamux_session_create(&client_io, 1, NULL, &client);
+    assert_true(result == YAMUX_OK, "Failed to create client session");
+    result = yamux_session_create(&server_io, 0, &config, &server);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    
+    result = yamux_stream_open_detailed(client, 0, &client_stream);
+    assert_true(result == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    assert_true(yamux_stream_get_send_window(client_stream) == config.max_stream_window_size + 64 * 1024,
+                "Opener should see the bonus as soon as its SYN is ACKed");
+    result = yamux_stream_peer_window(client_stream, &window);
+    assert_true(result == YAMUX_OK && window == config.max_stream_window_size + 64 * 1024,
+                "Advertised window should include the bonus");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that the opener can send its request before the stream is accepted or read */
+void test_window_before_accept(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    uint8_t request[1000];
+    uint8_t buf[1000];
+    size_t bytes;
+    
+    memset(request, 'r', sizeof(request));
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    
+    /* The SYN-ACK already granted the full window, before any accept */
+    assert_true(yamux_stream_get_send_window(client_stream) == yamux_default_config.max_stream_window_size,
+                "Opener should have a full window before accept");
+    assert_true(yamux_stream_write(client_stream, request, sizeof(request), &bytes) == YAMUX_OK &&
+                bytes == sizeof(request), "Request should be sent before accept");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver request");
+    
+    /* Accepting sends nothing and finds the request waiting */
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(transport->b_to_a.count == 0, "Accept should not need to grant window");
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == sizeof(request) && memcmp(buf, request, sizeof(request)) == 0,
+                "Request should be waiting on accept");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that draining a stalled stream returns the whole window in one update */
+void test_window_update_after_stall(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_header_t header;
+    static uint8_t data[YAMUX_DEFAULT_WINDOW_SIZE + 1024];
+    static uint8_t buf[YAMUX_DEFAULT_WINDOW_SIZE];
+    uint8_t frame[YAMUX_HEADER_SIZE + 4];
+    size_t bytes, drained;
+    
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* Fill the window while the application is not reading */
+    memset(data, 0x5A, sizeof(data));
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK &&
+                bytes == YAMUX_DEFAULT_WINDOW_SIZE, "Write should stop at the window");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    assert_true(transport->b_to_a.count == 0, "Buffering data must not grant credit");
+    assert_true(yamux_stream_write(client_stream, data, 1, &bytes) == YAMUX_ERR_NO_WINDOW,
+                "Peer should stall with the window full");
+    
+    /* A small read is not worth an update */
+    assert_true(yamux_stream_read(server_stream, buf, 1024, &bytes) == YAMUX_OK && bytes == 1024,
+                "Failed to read");
+    assert_true(transport->b_to_a.count == 0, "Small read should not send a window update");
+    
+    /* Draining the rest sends one update for everything reclaimed */
+    drained = bytes;
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK, "Failed to drain");
+    drained += bytes;
+    assert_true(drained == YAMUX_DEFAULT_WINDOW_SIZE, "Whole window should be drained");
+    assert_true(transport->b_to_a.count == sizeof(frame), "Drain should send exactly one frame");
+    assert_true(test_transport_read(&transport->a, frame, sizeof(frame)) == (int)sizeof(frame),
+                "Failed to read window update");
+    assert_true(yamux_decode_header(frame, YAMUX_HEADER_SIZE, &header) == YAMUX_OK &&
+                header.type == YAMUX_WINDOW_UPDATE && header.length == 4, "Frame should be a window update");
+    assert_true(yamux_decode_u32(frame + YAMUX_HEADER_SIZE) == YAMUX_DEFAULT_WINDOW_SIZE,
+                "Update should restore the full window");
+    
+    /* The peer resumes at full speed */
+    assert_true(test_transport_write(&transport->b, frame, sizeof(frame)) == (int)sizeof(frame),
+                "Failed to forward window update");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to process window update");
+    assert_true(yamux_stream_get_send_window(client_stream) == YAMUX_DEFAULT_WINDOW_SIZE,
+                "Sender should get the full window back");
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK &&
+                bytes == YAMUX_DEFAULT_WINDOW_SIZE, "Sender should resume");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that in-flight bytes track data a slow reader has not granted back, and the cap on them */
+void test_stream_inflight_bytes(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_config_t client_config = yamux_default_config;
+    yamux_config_t server_config = yamux_default_config;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    static uint8_t data[16 * 1024];
+    static uint8_t buf[16 * 1024];
+    size_t bytes;
+    int capped;
+    
+    memset(data, 'i', sizeof(data));
+    server_config.max_stream_window_size = 8192;
+    for (capped = 0; capped <= 1; capped++) {
+        client_config.max_inflight_per_stream = capped ? 4096 : 0;
+        transport = test_transport_pair(64 * 1024, &client_io, &server_io);
+        assert_true(transport != NULL, "Failed to create transport pair");
+        assert_true(yamux_session_create(&client_io, 1, &client_config, &client) == YAMUX_OK, "Failed to create client");
+        assert_true(yamux_session_create(&server_io, 0, &server_config, &server) == YAMUX_OK, "Failed to create server");
+        assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+        assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+        assert_true(yamux_stream_inflight_bytes(client_stream) == 0, "Nothing should be in flight yet");
+        assert_true(yamux_stream_inflight_bytes(NULL) == 0, "NULL stream has nothing in flight");
+        
+        if (!capped) {
+            /* The slow reader holds everything sent until it reads */
+            assert_true(yamux_stream_write(client_stream, data, 6000, &bytes) == YAMUX_OK && bytes == 6000,
+                        "Failed to write");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+            assert_true(yamux_stream_inflight_bytes(client_stream) == 6000, "Unread data should be in flight");
+            
+            /* A read too small to trigger a window update changes nothing */
+            assert_true(yamux_stream_read(server_stream, buf, 1000, &bytes) == YAMUX_OK && bytes == 1000,
+                        "Failed to read");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump");
+            assert_true(yamux_stream_inflight_bytes(client_stream) == 6000, "Withheld credit stays in flight");
+            
+            /* Once the reader grants credit back, that much is no longer in flight */
+            assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 5000,
+                        "Failed to read");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver update");
+            assert_true(yamux_stream_inflight_bytes(client_stream) == 0, "Granted bytes should leave flight");
+            assert_true(yamux_stream_get_send_window(client_stream) == 8192, "Window should be whole again");
+        } else {
+            /* The cap stops the sender short of the window */
+            assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == 4096,
+                        "Write should stop at the in-flight cap");
+            assert_true(yamux_stream_get_send_window(client_stream) == 8192 - 4096, "Window is left unused");
+            assert_int_equal(yamux_stream_write_ready(client_stream, 1), YAMUX_ERR_NO_WINDOW,
+                             "Capped stream should not be write-ready");
+            assert_int_equal(yamux_stream_write(client_stream, data, sizeof(data), &bytes), YAMUX_ERR_NO_WINDOW,
+                             "Capped stream should not accept more");
+            
+            /* Reading frees the cap again */
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+            assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 4096,
+                        "Failed to read");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver update");
+            assert_true(yamux_stream_inflight_bytes(client_stream) == 0, "Read bytes should leave flight");
+            assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == 4096,
+                        "Sender should continue up to the cap");
+        }
+        
+        yamux_session_close(client, YAMUX_NORMAL);
+        yamux_session_close(server, YAMUX_NORMAL);
+        yamux_session_free(client);
+        yamux_session_free(server);
+        test_transport_free(transport);
+    }
+}
+
+/* Test that re-advertising windows recovers a transfer whose credit was lost */
+void test_session_reset_windows(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    static uint8_t data[2 * YAMUX_DEFAULT_WINDOW_SIZE];
+    static uint8_t buf[2 * YAMUX_DEFAULT_WINDOW_SIZE];
+    size_t sent = 0, received = 0, bytes, i;
+    yamux_result_t result;
+    int round;
+    
+    for (i = 0; i < sizeof(data); i++) {
+        data[i] = (uint8_t)(i * 11);
+    }
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* Credit lost on both sides: the sender has none and the receiver thinks it granted it */
+    client_stream->send_window = 0;
+    server_stream->recv_window = 0;
+    assert_int_equal(yamux_stream_write(client_stream, data, sizeof(data), &bytes), YAMUX_ERR_NO_WINDOW,
+                     "Sender should be stuck without credit");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump");
+    assert_int_equal(yamux_stream_write(client_stream, data, sizeof(data), &bytes), YAMUX_ERR_NO_WINDOW,
+                     "Nothing should grant credit on its own");
+    
+    /* Re-advertising restores the full window and the transfer completes */
+    assert_int_equal(yamux_session_reset_windows(NULL), YAMUX_ERR_INVALID, "NULL session should be rejected");
+    assert_int_equal(yamux_session_reset_windows(server), YAMUX_OK, "Failed to reset windows");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver update");
+    assert_true(yamux_stream_get_send_window(client_stream) == YAMUX_DEFAULT_WINDOW_SIZE,
+                "Sender should get a full window back");
+    for (round = 0; round < 32 && received < sizeof(data); round++) {
+        result = yamux_stream_write(client_stream, data + sent, sizeof(data) - sent, &bytes);
+        if (result == YAMUX_OK) {
+            sent += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+        while (yamux_stream_read(server_stream, buf + received, sizeof(buf) - received, &bytes) == YAMUX_OK &&
+               bytes > 0) {
+            received += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump");
+    }
+    assert_true(received == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0,
+                "Transfer should recover and arrive intact");
+    
+    /* With accounting back in order, a second call has nothing to grant */
+    transport->b_to_a.count = 0;
+    assert_int_equal(yamux_session_reset_windows(server), YAMUX_OK, "Failed to reset windows");
+    assert_true(transport->b_to_a.count == 0, "A full window should not be granted again");
+    
+    yamux_session_close(server, YAMUX_NORMAL);
+    assert_int_equal(yamux_session_reset_windows(server), YAMUX_ERR_CLOSED, "Closed session should be rejected");
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Count DATA frames with a payload buffered in one direction of a transport */
+static int count_data_frames(const test_ring_t *ring) {
+    uint8_t raw[YAMUX_HEADER_SIZE];
+    yamux_header_t header;
+    size_t offset = 0;
+    size_t i;
+    int frames = 0;
+    
+    while (offset + YAMUX_HEADER_SIZE <= ring->count) {
+        for (i = 0; i < YAMUX_HEADER_SIZE; i++) {
+            raw[i] = ring->data[(ring->head + offset + i) % ring->capacity];
+        }
+        if (yamux_decode_header(raw, sizeof(raw), &header) != YAMUX_OK) {
+            break;
+        }
+        if (header.type == YAMUX_DATA && header.length > 0) {
+            frames++;
+        }
+        offset += YAMUX_HEADER_SIZE + header.length;
+    }
+    
+    return frames;
+}
+
+/* Test that small writes are merged into fewer DATA frames */
+void test_small_write_coalescing(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    uint8_t data[100];
+    uint8_t buf[128];
+    uint32_t window;
+    size_t bytes, total;
+    int i;
+    
+    config.small_frame_threshold = 16;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* 100 one-byte writes leave in 16-byte frames, with the rest held */
+    window = yamux_stream_get_send_window(client_stream);
+    for (i = 0; i < (int)sizeof(data); i++) {
+        data[i] = (uint8_t)i;
+        assert_true(yamux_stream_write(client_stream, &data[i], 1, &bytes) == YAMUX_OK && bytes == 1,
+                    "Small write should be accepted");
+    }
+    assert_true(count_data_frames(&transport->a_to_b) == 6, "Full 16-byte frames should be sent");
+    assert_true(yamux_stream_get_send_window(client_stream) == window - sizeof(data),
+                "Held writes should take send window");
+    
+    /* Flushing sends the remainder as one more frame */
+    assert_true(yamux_stream_flush(client_stream) == YAMUX_OK, "Failed to flush");
+    assert_true(count_data_frames(&transport->a_to_b) == 7, "Remainder should go out as one frame");
+    assert_true(yamux_stream_flush(client_stream) == YAMUX_OK, "Flushing nothing should succeed");
+    
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    total = 0;
+    while (yamux_stream_read(server_stream, buf + total, sizeof(buf) - total, &bytes) == YAMUX_OK && bytes > 0) {
+        total += bytes;
+    }
+    assert_true(total == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0,
+                "Coalesced data should arrive intact and in order");
+    
+    /* A larger write sends held data first, then goes out on its own */
+    assert_true(yamux_stream_write(client_stream, data, 3, &bytes) == YAMUX_OK, "Small write failed");
+    assert_true(yamux_stream_write(client_stream, data, 40, &bytes) == YAMUX_OK && bytes == 40,
+                "Large write failed");
+    assert_true(count_data_frames(&transport->a_to_b) == 2, "Held data should precede the large write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 43,
+                "Server should receive both writes");
+    assert_true(memcmp(buf, data, 3) == 0 && memcmp(buf + 3, data, 40) == 0, "Order should be preserved");
+    
+    /* Processing the session sends what is still held */
+    assert_true(yamux_stream_write(client_stream, data, 5, &bytes) == YAMUX_OK, "Small write failed");
+    assert_true(count_data_frames(&transport->a_to_b) == 0, "Small write should be held");
+    (void)yamux_session_process(client);
+    assert_true(count_data_frames(&transport->a_to_b) == 1, "Processing should flush held data");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Check the frame at a position in a mock's output and step past it */
+static int next_frame_is(const mock_io_t *mock, size_t *pos, uint8_t type, uint16_t flags,
+                         uint32_t stream_id, uint32_t length) {
+    yamux_header_t header;
+    
+    if (*pos + YAMUX_HEADER_SIZE > mock->write_buf_used ||
+        yamux_decode_header(mock->write_buf + *pos, YAMUX_HEADER_SIZE, &header) != YAMUX_OK) {
+        return 0;
+    }
+    *pos += YAMUX_HEADER_SIZE + header.length;
+    return header.type == type && header.flags == flags && header.stream_id == stream_id &&
+           header.length == length;
+}
+
+/* Test that control frames go out ahead of held data, but a stream's FIN never does */
+void test_send_ordering(void) {
+    yamux_session_t *session;
+    yamux_stream_t *first, *second;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    mock_io_t *mock;
+    static uint8_t payload[16384];
+    uint8_t window[4];
+    uint8_t buf[4096];
+    size_t bytes, pos, total = 0;
+    int i;
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    config.small_frame_threshold = 64;
+    assert_true(yamux_session_create(&io, 1, &config, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &first) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(session, 0, &second) == YAMUX_OK, "Failed to open stream");
+    
+    /* Both streams are acknowledged, and the first has more than half a window to read */
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 1, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 3, window, 4);
+    for (i = 0; i < 9; i++) {
+        mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, payload, sizeof(payload));
+    }
+    while (mock->read_pos < mock->read_buf_used) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process frames");
+    }
+    
+    /* Small writes are held on both streams */
+    mock->write_buf_used = 0;
+    assert_true(yamux_stream_write(first, (const uint8_t *)"aaa", 3, &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(yamux_stream_write(second, (const uint8_t *)"bbb", 3, &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(mock->write_buf_used == 0, "Small writes should be held");
+    
+    /* A ping and a window update go out at once, ahead of the held data */
+    assert_int_equal(yamux_session_ping(session), YAMUX_OK, "Failed to ping");
+    while (yamux_stream_read(first, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes > 0) {
+        total += bytes;
+    }
+    assert_true(total == 9 * sizeof(payload), "Failed to read the first stream's data");
+    
+    /* Closing sends the stream's held data before its FIN; the other stream's waits */
+    assert_int_equal(yamux_stream_close(first, 0), YAMUX_OK, "Failed to close stream");
+    assert_int_equal(yamux_stream_flush(second), YAMUX_OK, "Failed to flush");
+    
+    pos = 0;
+    assert_true(next_frame_is(mock, &pos, YAMUX_PING, YAMUX_FLAG_SYN, 0, 0), "Ping should go first");
+    assert_true(next_frame_is(mock, &pos, YAMUX_WINDOW_UPDATE, 0, 1, 4), "Window update should pass held data");
+    assert_true(next_frame_is(mock, &pos, YAMUX_DATA, 0, 1, 3), "Held data should precede its stream's FIN");
+    assert_true(next_frame_is(mock, &pos, YAMUX_DATA, YAMUX_FLAG_FIN, 1, 0), "FIN should follow its data");
+    assert_true(next_frame_is(mock, &pos, YAMUX_DATA, 0, 3, 3), "Other stream's data should go when flushed");
+    assert_true(pos == mock->write_buf_used, "Nothing else should be sent");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that a stream starved of window is reset after the stall timeout */
+void test_window_stall_timeout(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    static uint8_t data[YAMUX_DEFAULT_WINDOW_SIZE];
+    static uint8_t buf[YAMUX_DEFAULT_WINDOW_SIZE];
+    size_t bytes, drained;
+    
+    config.enable_keepalive = 0;   /* The watchdog must not depend on keepalive */
+    config.window_stall_timeout_ms = 1000;
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    memset(data, 0x33, sizeof(data));
+    
+    /* Stall at t=0 */
+    yamux_session_keepalive(client, 0);
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK &&
+                bytes == sizeof(data), "Write should fill the window");
+    assert_true(yamux_stream_write(client_stream, data, 1, &bytes) == YAMUX_ERR_NO_WINDOW, "Window should be empty");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    
+    /* The peer reads at t=500 and grants window, which clears the stall */
+    yamux_session_keepalive(client, 500);
+    drained = 0;
+    while (yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes > 0) {
+        drained += bytes;
+    }
+    assert_true(drained == sizeof(data), "Peer should read everything");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver update");
+    assert_true(yamux_stream_get_send_window(client_stream) > 0, "Peer should grant window");
+    
+    /* Stall again at t=600; the peer stops granting window */
+    yamux_session_keepalive(client, 600);
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK, "Write failed");
+    assert_true(yamux_stream_get_send_window(client_stream) == 0, "Write should use up the window");
+    assert_true(yamux_stream_write(client_stream, data, 1, &bytes) == YAMUX_ERR_NO_WINDOW, "Window should be empty");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    
+    /* Counted from the second stall, not the first */
+    assert_true(yamux_session_keepalive(client, 1500) == YAMUX_OK, "Keepalive failed");
+    assert_true(yamux_stream_get_reset_reason(client_stream) == YAMUX_RESET_NONE, "Stall should not time out yet");
+    assert_true(yamux_session_keepalive(client, 1600) == YAMUX_OK, "Keepalive failed");
+    assert_true(yamux_stream_get_reset_reason(client_stream) == YAMUX_RESET_TIMEOUT,
+                "Starved stream should be reset after the timeout");
+    assert_true(yamux_stream_write(client_stream, data, 1, &bytes) == YAMUX_ERR_TIMEOUT,
+                "Write on a starved stream should report TIMEOUT");
+    
+    /* The peer is told with an RST */
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver RST");
+    assert_true(yamux_stream_get_reset_reason(server_stream) == YAMUX_RESET_PEER, "Peer should see the reset");
+    
+    yamux_stream_close(client_stream, 0);
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that zero and redundant window updates add up without errors */
+void test_redundant_window_updates(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    uint32_t id;
+    int i;
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    id = yamux_stream_get_id(stream);
+    
+    yamux_encode_u32(1000, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, id, window, 4);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN-ACK");
+    assert_true(yamux_stream_get_send_window(stream) == 1000, "SYN-ACK sets the initial window");
+    
+    /* Zero increments, with or without a payload, change nothing */
+    yamux_encode_u32(0, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, 0, id, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, 0, id, NULL, 0);
+    for (i = 0; i < 2; i++) {
+        assert_true(yamux_session_process(session) == YAMUX_OK, "Zero update should not be an error");
+    }
+    assert_true(yamux_stream_get_send_window(stream) == 1000, "Zero update should be a no-op");
+    
+    /* Repeated updates are cumulative, including ones flagged ACK */
+    yamux_encode_u32(500, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, 0, id, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, 0, id, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_ACK, id, window, 4);
+    for (i = 0; i < 3; i++) {
+        assert_true(yamux_session_process(session) == YAMUX_OK, "Redundant update should not be an error");
+    }
+    assert_true(yamux_stream_get_send_window(stream) == 2500, "Updates should add up");
+    
+    /* A duplicate SYN-ACK does not reset the window */
+    yamux_encode_u32(1000, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, id, window, 4);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Duplicate SYN-ACK should not be an error");
+    assert_true(yamux_stream_get_send_window(stream) == 2500, "Duplicate SYN-ACK should not change the window");
+    
+    /* The window saturates instead of wrapping */
+    yamux_encode_u32(UINT32_MAX - 1000, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, 0, id, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, 0, id, window, 4);
+    for (i = 0; i < 2; i++) {
+        assert_true(yamux_session_process(session) == YAMUX_OK, "Large update should not be an error");
+    }
+    assert_true(yamux_stream_get_send_window(stream) == UINT32_MAX, "Window should saturate");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Window updates seen by the callback below */
+typedef struct {
+    uint32_t stream_id;
+    uint32_t count;
+    uint32_t min_increment;
+    uint64_t total;
+} window_log_t;
+
+static void log_window_update(void *ctx, uint32_t stream_id, uint32_t increment) {
+    window_log_t *log = (window_log_t *)ctx;
+    
+    log->stream_id = stream_id;
+    log->count++;
+    if (log->count == 1 || increment < log->min_increment) {
+        log->min_increment = increment;
+    }
+    log->total += increment;
+}
+
+/* Test that the window update callback reports each update a bulk read sends */
+void test_window_update_callback(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    window_log_t log;
+    static uint8_t data[16384];
+    uint8_t buf[4096];
+    size_t sent = 0, received = 0;
+    size_t bytes;
+    
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_int_equal(yamux_set_window_update_callback(NULL, log_window_update, &log), YAMUX_ERR_INVALID,
+                     "NULL session should be rejected");
+    memset(&log, 0, sizeof(log));
+    assert_true(yamux_set_window_update_callback(server, log_window_update, &log) == YAMUX_OK,
+                "Failed to set window update callback");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(log.count == 0, "The SYN-ACK window should not be reported");
+    
+    /* Move four windows' worth, granting credit only as the server reads */
+    memset(data, 0xA5, sizeof(data));
+    while (received < 4 * YAMUX_DEFAULT_WINDOW_SIZE) {
+        if (sent < 4 * YAMUX_DEFAULT_WINDOW_SIZE &&
+            yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK) {
+            sent += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump");
+        assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK, "Failed to read");
+        received += bytes;
+    }
+    
+    assert_true(log.count >= 3, "Reading several windows should send several updates");
+    assert_true(log.stream_id == yamux_stream_get_id(server_stream), "Updates should name the stream");
+    assert_true(log.min_increment >= YAMUX_DEFAULT_WINDOW_SIZE / 2, "Updates should be coalesced");
+    assert_true(log.total <= received, "No more credit than was read should be granted");
+    assert_true(log.total + YAMUX_DEFAULT_WINDOW_SIZE >= sent, "Every byte sent needed credit");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that pausing receive stops the peer and resuming lets it finish */
+void test_stream_pause_recv(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    static uint8_t data[3 * YAMUX_DEFAULT_WINDOW_SIZE];
+    static uint8_t buf[3 * YAMUX_DEFAULT_WINDOW_SIZE];
+    size_t sent = 0, received = 0, bytes, i;
+    yamux_result_t result;
+    int round;
+    
+    for (i = 0; i < sizeof(data); i++) {
+        data[i] = (uint8_t)(i * 13);
+    }
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_pause_recv(NULL) == YAMUX_ERR_INVALID, "NULL stream should be rejected");
+    assert_true(yamux_stream_pause_recv(server_stream) == YAMUX_OK, "Failed to pause");
+    
+    /* While paused the receiver keeps reading, but the sender runs out of window */
+    for (round = 0; round < 8; round++) {
+        result = yamux_stream_write(client_stream, data + sent, sizeof(data) - sent, &bytes);
+        if (result == YAMUX_OK) {
+            sent += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+        while (yamux_stream_read(server_stream, buf + received, sizeof(buf) - received, &bytes) == YAMUX_OK &&
+               bytes > 0) {
+            received += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump");
+    }
+    assert_true(sent == YAMUX_DEFAULT_WINDOW_SIZE, "Sender should stop after one window");
+    assert_true(received == sent, "Everything sent should be readable while paused");
+    assert_int_equal(yamux_stream_write(client_stream, data + sent, 1, &bytes), YAMUX_ERR_NO_WINDOW,
+                     "Paused receiver should grant no more window");
+    
+    /* Resuming grants the window back and the rest flows as usual */
+    assert_true(yamux_stream_resume_recv(server_stream) == YAMUX_OK, "Failed to resume");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver update");
+    assert_true(yamux_stream_get_send_window(client_stream) > 0, "Resume should grant window");
+    for (round = 0; round < 32 && received < sizeof(data); round++) {
+        result = yamux_stream_write(client_stream, data + sent, sizeof(data) - sent, &bytes);
+        if (result == YAMUX_OK) {
+            sent += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+        while (yamux_stream_read(server_stream, buf + received, sizeof(buf) - received, &bytes) == YAMUX_OK &&
+               bytes > 0) {
+            received += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump");
+    }
+    assert_true(received == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0,
+                "All data should arrive intact after resume");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Push-model consumer that fills up on every fourth delivery */
+typedef struct {
+    uint8_t *buf;
+    size_t received;
+    int calls;
+    yamux_stream_t *paused;
+} push_consumer_t;
+
+static size_t push_consume(void *ctx, yamux_stream_t *stream, const uint8_t *data, size_t len) {
+    push_consumer_t *consumer = (push_consumer_t *)ctx;
+    size_t take = len;
+    
+    if (++consumer->calls % 4 == 0) {
+        take = len / 2;
+        consumer->paused = stream;
+    }
+    memcpy(consumer->buf + consumer->received, data, take);
+    consumer->received += take;
+    return take;
+}
+
+/* Test that a data callback can pause delivery until the application resumes */
+void test_data_callback_backpressure(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream;
+    static uint8_t data[4 * YAMUX_DEFAULT_WINDOW_SIZE];
+    static uint8_t buf[4 * YAMUX_DEFAULT_WINDOW_SIZE];
+    push_consumer_t consumer;
+    size_t sent = 0, bytes, i;
+    yamux_result_t result;
+    int round, drained = 0;
+    
+    for (i = 0; i < sizeof(data); i++) {
+        data[i] = (uint8_t)(i * 7);
+    }
+    memset(&consumer, 0, sizeof(consumer));
+    consumer.buf = buf;
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_set_data_callback(NULL, push_consume, &consumer) == YAMUX_ERR_INVALID,
+                "NULL session should be rejected");
+    assert_true(yamux_set_data_callback(server, push_consume, &consumer) == YAMUX_OK, "Failed to set data callback");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    
+    for (round = 0; round < 1000 && consumer.received < sizeof(data); round++) {
+        result = yamux_stream_write(client_stream, data + sent, sizeof(data) - sent, &bytes);
+        if (result == YAMUX_OK) {
+            sent += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+        if (!consumer.paused) {
+            continue;
+        }
+        
+        /* While paused nothing is delivered and no window is granted, so the sender stops */
+        bytes = consumer.received;
+        while (sent < sizeof(data) &&
+               yamux_stream_write(client_stream, data + sent, sizeof(data) - sent, &i) == YAMUX_OK) {
+            sent += i;
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+        }
+        assert_true(consumer.received == bytes, "Paused stream should get no deliveries");
+        if (sent < sizeof(data)) {
+            assert_true(yamux_stream_get_send_window(client_stream) == 0, "Sender's window should drain");
+            drained++;
+        }
+        
+        /* Resuming hands over what was held back and grants window again */
+        result = yamux_stream_resume_recv(consumer.paused);
+        consumer.paused = NULL;
+        assert_true(result == YAMUX_OK, "Failed to resume");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver update");
+    }
+    assert_true(drained >= 2, "Sender should have run out of window more than once");
+    assert_true(consumer.received == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0,
+                "All data should arrive intact and in order");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test the largest-write and window-split statistics against a known window */
+void test_stream_write_stats(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_stream_stats_t stats;
+    static uint8_t data[YAMUX_DEFAULT_WINDOW_SIZE];
+    size_t bytes;
+    
+    memset(data, 0x5A, sizeof(data));
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    assert_int_equal(yamux_stream_get_stats(client_stream, NULL), YAMUX_ERR_INVALID, "NULL stats should be rejected");
+    assert_true(yamux_stream_get_stats(client_stream, &stats) == YAMUX_OK, "Failed to get stats");
+    assert_true(stats.largest_write == 0 && stats.window_splits == 0, "A new stream should have empty stats");
+    
+    /* Writes that fit the window are recorded whole, small or large */
+    assert_true(yamux_stream_write(client_stream, data, 100, &bytes) == YAMUX_OK && bytes == 100, "Small write failed");
+    assert_true(yamux_stream_write(client_stream, data, 20000, &bytes) == YAMUX_OK && bytes == 20000, "Large write failed");
+    assert_true(yamux_stream_write(client_stream, data, 5000, &bytes) == YAMUX_OK && bytes == 5000, "Medium write failed");
+    assert_true(yamux_stream_get_stats(client_stream, &stats) == YAMUX_OK, "Failed to get stats");
+    assert_true(stats.largest_write == 20000, "Largest write should be the 20000-byte one");
+    assert_true(stats.window_splits == 0, "No write should have been split yet");
+    
+    /* A write beyond the remaining window is split; its accepted part is the new largest */
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK, "Window-limited write failed");
+    assert_true(bytes == YAMUX_DEFAULT_WINDOW_SIZE - 25100, "Write should stop at the window");
+    assert_true(yamux_stream_get_stats(client_stream, &stats) == YAMUX_OK, "Failed to get stats");
+    assert_true(stats.largest_write == YAMUX_DEFAULT_WINDOW_SIZE - 25100, "Largest write should be the split one");
+    assert_true(stats.window_splits == 1, "One write should have been split");
+    
+    /* A write refused outright is neither a split nor an accepted write */
+    assert_int_equal(yamux_stream_write(client_stream, data, 1, &bytes), YAMUX_ERR_NO_WINDOW, "Window should be exhausted");
+    assert_true(yamux_stream_get_stats(client_stream, &stats) == YAMUX_OK, "Failed to get stats");
+    assert_true(stats.window_splits == 1, "A refused write should not count as a split");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test the configured reaction to a peer overrunning the window we advertised */
+void test_window_violation(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_header_t header;
+    uint8_t window[4];
+    static uint8_t data[2048];
+    uint8_t buf[16];
+    size_t bytes, pos;
+    
+    memset(data, 'v', sizeof(data));
+    yamux_encode_u32(YAMUX_DEFAULT_WINDOW_SIZE, window);
+    config.max_stream_window_size = 1024;
+    
+    /* Default: the session is closed with PROTOCOL_ERROR */
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 0, &config, &session) == YAMUX_OK, "Failed to create session");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept stream");
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, data, 1000);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Data within the window should be accepted");
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, data, 100);
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_PROTOCOL, "Overrun should be a protocol error");
+    assert_true(session->shutdown, "Overrun should close the session");
+    header.type = YAMUX_DATA;
+    for (pos = 0; pos + YAMUX_HEADER_SIZE <= mock->write_buf_used; pos += YAMUX_HEADER_SIZE + header.length) {
+        assert_true(yamux_decode_header(mock->write_buf + pos, YAMUX_HEADER_SIZE, &header) == YAMUX_OK,
+                    "Failed to decode sent frame");
+        if (header.type == YAMUX_GO_AWAY) {
+            break;
+        }
+    }
+    assert_true(header.type == YAMUX_GO_AWAY, "Overrun should send GoAway");
+    assert_true(yamux_decode_u32(mock->write_buf + pos + YAMUX_HEADER_SIZE) == YAMUX_PROTOCOL_ERROR,
+                "GoAway should carry PROTOCOL_ERROR");
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* Reset mode: only the stream goes, and the frames after it are still read */
+    config.on_window_violation = YAMUX_WINDOW_VIOLATION_RESET_STREAM;
+    mock = mock_io_init(4096);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 0, &config, &session) == YAMUX_OK, "Failed to create session");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept stream");
+    mock->write_buf_used = 0;
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, data, sizeof(data));
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Overrun should not fail the session");
+    assert_true(!session->shutdown, "Session should stay open");
+    assert_true(yamux_stream_get_reset_reason(stream) == YAMUX_RESET_FLOW_CONTROL,
+                "Stream should be reset for flow control");
+    assert_int_equal(yamux_stream_read(stream, buf, sizeof(buf), &bytes), YAMUX_ERR_RESET,
+                     "Reads on the reset stream should fail");
+    assert_true(yamux_decode_header(mock->write_buf, YAMUX_HEADER_SIZE, &header) == YAMUX_OK &&
+                (header.flags & YAMUX_FLAG_RST) && header.stream_id == 1, "Overrun should send RST");
+    
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 3, window, 4);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 3, data, 10);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN after overrun");
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process data after overrun");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 10,
+                "Other streams should be unaffected");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Allocation calls counted while the allocator below is installed */
+static int idle_allocs = 0;
+
+static void *counting_malloc(size_t size) {
+    idle_allocs++;
+    return malloc(size);
+}
+
+static void *counting_realloc(void *ptr, size_t size) {
+    idle_allocs++;
+    return realloc(ptr, size);
+}
+
+static const yamux_allocator_t counting_allocator = { counting_malloc, counting_realloc, free };
+
+/* Test that a stream accepted but never read holds one window and costs nothing more */
+void test_unread_stream_bounded(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    static uint8_t data[2 * YAMUX_DEFAULT_WINDOW_SIZE];
+    static uint8_t buf[YAMUX_DEFAULT_WINDOW_SIZE];
+    size_t sent = 0, bytes;
+    int round;
+    
+    memset(data, 'u', sizeof(data));
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* The peer sends until the window is used up */
+    for (round = 0; round < 8; round++) {
+        if (yamux_stream_write(client_stream, data + sent, sizeof(data) - sent, &bytes) == YAMUX_OK) {
+            sent += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    }
+    assert_true(sent == YAMUX_DEFAULT_WINDOW_SIZE, "Peer should stop after one window");
+    assert_true(server_stream->recvbuf.used - server_stream->recvbuf.pos == YAMUX_DEFAULT_WINDOW_SIZE,
+                "Exactly one window should be buffered");
+    assert_true(server_stream->recvbuf.size <= 2 * YAMUX_DEFAULT_WINDOW_SIZE,
+                "Receive buffer should stay within twice the window");
+    
+    /* Many idle cycles: no frames, no allocations, nothing queued up */
+    idle_allocs = 0;
+    yamux_set_allocator(&counting_allocator);
+    for (round = 0; round < 1000; round++) {
+        assert_int_equal(yamux_stream_write(client_stream, data, 1, &bytes), YAMUX_ERR_NO_WINDOW,
+                         "Peer should have no window");
+        assert_int_equal(yamux_session_process(server), YAMUX_ERR_IO, "Server should find nothing to read");
+        assert_int_equal(yamux_session_process(client), YAMUX_ERR_IO, "Client should find nothing to read");
+    }
+    yamux_set_allocator(NULL);
+    assert_true(idle_allocs == 0, "Idle cycles should not allocate");
+    assert_true(transport->a_to_b.count == 0 && transport->b_to_a.count == 0,
+                "Idle cycles should not send anything");
+    
+    /* Reading at last lets the peer carry on */
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == YAMUX_DEFAULT_WINDOW_SIZE, "Failed to read the buffered window");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver update");
+    assert_true(yamux_stream_get_send_window(client_stream) == YAMUX_DEFAULT_WINDOW_SIZE,
+                "Reading should grant the window back");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that the held-bytes cap pushes back on a producer while the transport is full */
+void test_send_buffer_cap(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    uint8_t data[50];
+    uint8_t buf[512];
+    size_t bytes, total;
+    int i, accepted;
+    
+    for (i = 0; i < (int)sizeof(data); i++) {
+        data[i] = (uint8_t)i;
+    }
+    config.small_frame_threshold = 64;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* Without a cap, small writes pile up while the transport is full */
+    transport->a_to_b.count = transport->a_to_b.capacity;
+    for (i = 0; i < 10; i++) {
+        assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                    "Uncapped write should be held");
+    }
+    assert_true(client_stream->sendbuf.used - client_stream->sendbuf.pos == 10 * sizeof(data),
+                "Uncapped held data should grow");
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+    
+    /* With a cap, the producer is told to wait once the cap is reached */
+    config.max_send_buffer_per_stream = 200;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    transport->a_to_b.count = transport->a_to_b.capacity;
+    accepted = 0;
+    for (i = 0; i < 10; i++) {
+        if (yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK) {
+            accepted++;
+        }
+    }
+    assert_true(accepted == 4, "Writes should be accepted up to the cap");
+    assert_true(client_stream->sendbuf.used - client_stream->sendbuf.pos == 200, "Held data should stop at the cap");
+    assert_int_equal(yamux_stream_write(client_stream, data, sizeof(data), &bytes), YAMUX_ERR_WOULD_BLOCK,
+                     "Write beyond the cap should block");
+    assert_true(bytes == 0, "A blocked write should accept nothing");
+    
+    /* Once the transport drains, the held data leaves and writes are accepted again */
+    transport->a_to_b.count = 0;
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                "Write should be accepted once the transport has room");
+    assert_true(yamux_stream_flush(client_stream) == YAMUX_OK, "Failed to flush");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    total = 0;
+    while (yamux_stream_read(server_stream, buf + total, sizeof(buf) - total, &bytes) == YAMUX_OK && bytes > 0) {
+        total += bytes;
+    }
+    assert_true(total == 5 * sizeof(data), "Every accepted write should arrive");
+    for (i = 0; i < 5; i++) {
+        assert_true(memcmp(buf + i * sizeof(data), data, sizeof(data)) == 0, "Data should arrive intact");
+    }
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that write_ready reports window and send-buffer limits without side effects */
+void test_stream_write_ready(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    uint8_t data[50];
+    size_t bytes, held;
+    uint32_t window;
+    int i;
+    
+    memset(data, 0x5A, sizeof(data));
+    config.small_frame_threshold = 64;
+    config.max_send_buffer_per_stream = 200;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    assert_int_equal(yamux_stream_write_ready(NULL, 1), YAMUX_ERR_INVALID, "NULL stream should be invalid");
+    
+    /* Ready: room in the window and nothing held */
+    window = client_stream->send_window;
+    assert_int_equal(yamux_stream_write_ready(client_stream, sizeof(data)), YAMUX_OK, "Write should be ready");
+    assert_int_equal(yamux_stream_write_ready(client_stream, window), YAMUX_OK, "A write of the whole window should be ready");
+    
+    /* Window-limited: longer than the send window */
+    assert_int_equal(yamux_stream_write_ready(client_stream, (size_t)window + 1), YAMUX_ERR_NO_WINDOW,
+                     "A write past the window should not be ready");
+    
+    /* Buffer-full: held data at the cap while the transport is full */
+    transport->a_to_b.count = transport->a_to_b.capacity;
+    for (i = 0; i < 4; i++) {
+        assert_int_equal(yamux_stream_write_ready(client_stream, sizeof(data)), YAMUX_OK, "Write below the cap should be ready");
+        assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                    "Write below the cap should be held");
+    }
+    held = client_stream->sendbuf.used - client_stream->sendbuf.pos;
+    window = client_stream->send_window;
+    assert_true(held == 200, "Held data should be at the cap");
+    assert_int_equal(yamux_stream_write_ready(client_stream, sizeof(data)), YAMUX_ERR_WOULD_BLOCK,
+                     "Write past the cap should not be ready");
+    assert_int_equal(yamux_stream_write(client_stream, data, sizeof(data), &bytes), YAMUX_ERR_WOULD_BLOCK,
+                     "The write itself should agree");
+    
+    /* Asking changed nothing */
+    assert_true(client_stream->sendbuf.used - client_stream->sendbuf.pos == held, "Check should not touch held data");
+    assert_true(client_stream->send_window == window, "Check should not take window");
+    assert_true(client_stream->largest_write == sizeof(data), "Check should not count as a write");
+    
+    /* Once the held data is sent, writes are ready again */
+    transport->a_to_b.count = 0;
+    assert_true(yamux_stream_flush(client_stream) == YAMUX_OK, "Failed to flush");
+    assert_int_equal(yamux_stream_write_ready(client_stream, sizeof(data)), YAMUX_OK, "Write should be ready after a flush");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    
+    /* Held data at the cap with room in the transport: the write sends it first and succeeds */
+    client->config.small_frame_threshold = 256;
+    for (i = 0; i < 4; i++) {
+        assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                    "Write below the cap should be held");
+    }
+    assert_true(client_stream->sendbuf.used - client_stream->sendbuf.pos == 200, "Held data should be at the cap");
+    assert_int_equal(yamux_stream_write_ready(client_stream, sizeof(data)), YAMUX_OK,
+                     "Write past the cap should be ready while the transport has room");
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                "The write itself should agree");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    
+    /* A pending interrupt is reported but left for the write to consume */
+    assert_true(yamux_stream_interrupt(client_stream) == YAMUX_OK, "Failed to interrupt");
+    assert_int_equal(yamux_stream_write_ready(client_stream, 1), YAMUX_ERR_INTERRUPTED, "Interrupt should be reported");
+    assert_int_equal(yamux_stream_write_ready(client_stream, 1), YAMUX_ERR_INTERRUPTED, "Check should not consume it");
+    assert_int_equal(yamux_stream_write(client_stream, data, 1, &bytes), YAMUX_ERR_INTERRUPTED,
+                     "The write should consume it");
+    assert_int_equal(yamux_stream_write_ready(client_stream, 1), YAMUX_OK, "Write should be ready again");
+    
+    /* A dead peer or a failed transport refuses writes the same way */
+    client->keepalive_failed = 1;
+    assert_int_equal(yamux_stream_write_ready(client_stream, 1), YAMUX_ERR_TIMEOUT, "Dead peer should not be ready");
+    assert_int_equal(yamux_stream_write(client_stream, data, 1, &bytes), YAMUX_ERR_TIMEOUT, "The write should agree");
+    client->keepalive_failed = 0;
+    client->transport_failed = 1;
+    assert_int_equal(yamux_stream_write_ready(client_stream, 1), YAMUX_ERR_CLOSED, "Failed session should not be ready");
+    assert_int_equal(yamux_stream_write(client_stream, data, 1, &bytes), YAMUX_ERR_CLOSED, "The write should agree");
+    client->transport_failed = 0;
+    
+    /* A stream the peer reset can never be written */
+    assert_true(yamux_stream_close(server_stream, 1) == YAMUX_OK, "Failed to reset stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver reset");
+    assert_int_equal(yamux_stream_write_ready(client_stream, 1), YAMUX_ERR_RESET, "Reset stream should not be ready");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that auto_flush sends small writes at once instead of batching them */
+void test_auto_flush(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    uint8_t data[5] = {1, 2, 3, 4, 5};
+    uint8_t buf[16];
+    size_t bytes;
+    int auto_flush;
+    
+    for (auto_flush = 0; auto_flush <= 1; auto_flush++) {
+        config.small_frame_threshold = 64;
+        config.auto_flush = (uint32_t)auto_flush;
+        transport = test_transport_pair(4096, &client_io, &server_io);
+        assert_true(transport != NULL, "Failed to create transport pair");
+        assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+        assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+        assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+        assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+        
+        /* A small write is batched without auto_flush and reaches the transport at once with it */
+        assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                    "Small write should be accepted");
+        if (auto_flush) {
+            assert_true(count_data_frames(&transport->a_to_b) == 1, "Write should be sent at once with auto_flush");
+            assert_true(client_stream->sendbuf.used == client_stream->sendbuf.pos, "Nothing should stay held");
+        } else {
+            assert_true(count_data_frames(&transport->a_to_b) == 0, "Write should be batched without auto_flush");
+        }
+        
+        /* Either way it arrives intact within one process cycle */
+        (void)yamux_session_process(client);
+        assert_true(count_data_frames(&transport->a_to_b) == 1, "Held data should be sent by processing");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+        assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                    bytes == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0, "Data should arrive intact");
+        
+        /* A full transport still holds the write; it leaves once there is room */
+        transport->a_to_b.count = transport->a_to_b.capacity;
+        assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                    "Write to a full transport should be held");
+        assert_true(client_stream->sendbuf.used - client_stream->sendbuf.pos == sizeof(data), "Write should be held");
+        transport->a_to_b.count = 0;
+        (void)yamux_session_process(client);
+        assert_true(count_data_frames(&transport->a_to_b) == 1, "Held data should be sent once there is room");
+        
+        yamux_session_close(client, YAMUX_NORMAL);
+        yamux_session_close(server, YAMUX_NORMAL);
+        yamux_session_free(client);
+        yamux_session_free(server);
+        test_transport_free(transport);
+    }
+}
+
+/* Test that held writes are sent once the oldest reaches the age bound */
+void test_send_buffer_age(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    uint8_t data[5] = {1, 2, 3, 4, 5};
+    uint8_t buf[16];
+    size_t bytes;
+    
+    config.small_frame_threshold = 64;
+    config.max_send_buffer_age_ms = 50;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* A lone small write is held until the clock passes the bound, with no process call */
+    assert_int_equal(yamux_session_keepalive(client, 1000), YAMUX_OK, "Failed to start the clock");
+    assert_true(yamux_stream_write(client_stream, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                "Small write should be accepted");
+    assert_int_equal(yamux_session_keepalive(client, 1049), YAMUX_OK, "Failed to advance the clock");
+    assert_true(count_data_frames(&transport->a_to_b) == 0, "Write should be held within the bound");
+    assert_int_equal(yamux_session_keepalive(client, 1050), YAMUX_OK, "Failed to advance the clock");
+    assert_true(count_data_frames(&transport->a_to_b) == 1, "Write should be sent once it reaches the bound");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0, "Data should arrive intact");
+    
+    /* Held data the transport refused is sent with the next write once it is too old */
+    assert_true(yamux_stream_write(client_stream, data, 2, &bytes) == YAMUX_OK, "Small write failed");
+    transport->a_to_b.count = transport->a_to_b.capacity;
+    assert_int_equal(yamux_session_keepalive(client, 1100), YAMUX_OK, "Failed to advance the clock");
+    assert_true(client_stream->sendbuf.used - client_stream->sendbuf.pos == 2, "Refused flush should keep data held");
+    transport->a_to_b.count = 0;
+    assert_true(yamux_stream_write(client_stream, data + 2, 3, &bytes) == YAMUX_OK, "Small write failed");
+    assert_true(count_data_frames(&transport->a_to_b) == 1, "Old held data should go out with the next write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == sizeof(data) && memcmp(buf, data, sizeof(data)) == 0, "Data should arrive in one piece");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that frames within the buffer pool are processed without allocating */
+void test_frame_buffer_pool(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    static uint8_t data[4000];
+    static uint8_t buf[4000];
+    size_t len, bytes, total;
+    uint32_t pool;
+    int i;
+    
+    memset(data, 'p', sizeof(data));
+    for (pool = 0; pool <= 2; pool += 2) {
+        config.frame_buffer_pool_size = pool;
+        transport = test_transport_pair(64 * 1024, &client_io, &server_io);
+        assert_true(transport != NULL, "Failed to create transport pair");
+        assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+        assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+        assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+        assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+        
+        /* Frames that keep growing, each read before the next, count only the server's work */
+        idle_allocs = 0;
+        for (i = 0; i < 40; i++) {
+            len = 100 + (size_t)i * 97;
+            assert_true(yamux_stream_write(client_stream, data, len, &bytes) == YAMUX_OK && bytes == len,
+                        "Failed to write");
+            yamux_set_allocator(&counting_allocator);
+            assert_true(yamux_session_process(server) == YAMUX_OK, "Failed to process frame");
+            total = 0;
+            while (yamux_stream_read(server_stream, buf + total, sizeof(buf) - total, &bytes) == YAMUX_OK && bytes > 0) {
+                total += bytes;
+            }
+            yamux_set_allocator(NULL);
+            assert_true(total == len, "Frame should arrive whole");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver updates");
+        }
+        
+        if (pool) {
+            assert_true(idle_allocs == 0, "Frames within the pool should not allocate");
+            assert_true(server->frame_pool_available == pool, "Every pool buffer should be returned");
+        } else {
+            assert_true(idle_allocs > 0, "Without a pool the scratch buffer grows with the frames");
+        }
+        
+        yamux_session_close(client, YAMUX_NORMAL);
+        yamux_session_close(server, YAMUX_NORMAL);
+        yamux_session_free(client);
+        yamux_session_free(server);
+        test_transport_free(transport);
+    }
+}
@@ -10,10 +10,97 @@ void test_frame_decoding(void);
 void test_stream_io(void);
 void test_session_creation(void);
 void test_session_ping(void);
+void test_session_open_after_go_away(void);
+void test_session_stream_id_parity(void);
+void test_session_reflected_syn(void);
+void test_session_pending_accepts(void);
+void test_session_is_client(void);
+void test_session_io_contexts(void);
+void test_session_process_after_close(void);
+void test_session_unknown_go_away_code(void);
+void test_session_last_acked_stream(void);
+void test_session_health(void);
+void test_session_control_stream(void);
+void test_session_stream_id_bounds(void);
+void test_session_snapshot_restore(void);
+void test_session_keepalive(void);
+void test_session_keepalive_idle(void);
+void test_session_set_config(void);
+void test_session_drain_ping(void);
+void test_session_go_away_code(void);
+void test_session_now_ms(void);
+void test_ping_during_transfer(void);
+void test_accept_stream_timeout(void);
+void test_accept_overflow_policy(void);
+void test_accept_backlog_exceeded(void);
+void test_accept_stream_priority(void);
 void test_flow_control(void);
+void test_recommended_window(void);
+void test_stream_peer_window(void);
+void test_configured_stream_window(void);
+void test_write_no_window(void);
+void test_zero_initial_window(void);
+void test_accept_window_bonus(void);
+void test_window_before_accept(void);
+void test_window_update_after_stall(void);
+void test_session_reset_windows(void);
+void test_stream_inflight_bytes(void);
+void test_small_write_coalescing(void);
+void test_send_ordering(void);
+void test_auto_flush(void);
+void test_send_buffer_age(void);
+void test_send_buffer_cap(void);
+void test_stream_write_ready(void);
+void test_window_stall_timeout(void);
+void test_redundant_window_updates(void);
+void test_window_update_callback(void);
+void test_stream_pause_recv(void);
+void test_data_callback_backpressure(void);
+void test_stream_write_stats(void);
+void test_window_violation(void);
+void test_unread_stream_bounded(void);
+void test_frame_buffer_pool(void);
 void test_stream_lifecycle(void);
+void test_stream_peer_fin_callback(void);
+void test_stream_interrupt(void);
+void test_stream_syn_then_fin(void);
+void test_stream_late_fin(void);
+void test_stream_simultaneous_close(void);
+void test_stream_window_fin_close(void);
+void test_stream_reject_data_on_syn(void);
+void test_stream_reset_by_peer(void);
+void test_write_after_peer_reset(void);
+void test_stream_drain_recv(void);
+void test_stream_read_timeout(void);
+void test_stream_read_message(void);
+void test_stream_tlv(void);
+void test_stream_churn(void);
 void test_concurrent_streams(void);
+void test_open_streams_batch(void);
+void test_max_num_streams(void);
+void test_stream_table_churn(void);
+void test_session_foreach_stream(void);
+void test_stream_open_rate_limit(void);
+void test_interleaved_frames_demux(void);
 void test_error_handling(void);
+void test_allocation_failure(void);
+void test_session_memory_limit(void);
+void test_connection_reset(void);
+void test_write_overstated(void);
+void test_write_cut_frame(void);
+void test_process_both_blocked(void);
+void test_diagnostics(void);
+void test_replay_frames(void);
+void test_stream_labels(void);
+void test_session_debug_dump(void);
+void test_frame_trace(void);
+void test_frame_trace_budget(void);
+void test_end_to_end(void);
+void test_end_to_end_ping(void);
+void test_end_to_end_ping_rtt(void);
+void test_zero_length_write(void);
+void test_session_teardown(void);
+void test_destroy_flush(void);
 
 /* Test runner */
 typedef struct {
@@ -33,10 +120,97 @@ int main(void) {
         {"Stream I/O", test_stream_io},
         {"Session Creation", test_session_creation},
         {"Session Ping", test_session_ping},
+        {"Session Open After GoAway", test_session_open_after_go_away},
+        {"Session Unknown GoAway Code", test_session_unknown_go_away_code},
+        {"Session Last ACKed Stream", test_session_last_acked_stream},
+        {"Session Health", test_session_health},
+        {"Session Stream ID Parity", test_session_stream_id_parity},
+        {"Session Reflected SYN", test_session_reflected_syn},
+        {"Session Stream ID Bounds", test_session_stream_id_bounds},
+        {"Session Snapshot Restore", test_session_snapshot_restore},
+        {"Session Pending Accepts", test_session_pending_accepts},
+        {"Session Control Stream", test_session_control_stream},
+        {"Session Is Client", test_session_is_client},
+        {"Session IO Contexts", test_session_io_contexts},
+        {"Session Process After Close", test_session_process_after_close},
+        {"Session Keepalive", test_session_keepalive},
+        {"Session Keepalive Idle", test_session_keepalive_idle},
+        {"Session Set Config", test_session_set_config},
+        {"Session Drain Ping", test_session_drain_ping},
+        {"Session GoAway Code", test_session_go_away_code},
+        {"Session Now Ms", test_session_now_ms},
+        {"Ping During Transfer", test_ping_during_transfer},
+        {"Accept Stream Timeout", test_accept_stream_timeout},
+        {"Accept Overflow Policy", test_accept_overflow_policy},
+        {"Accept Backlog Exceeded", test_accept_backlog_exceeded},
+        {"Accept Stream Priority", test_accept_stream_priority},
         {"Flow Control", test_flow_control},
+        {"Recommended Window", test_recommended_window},
+        {"Stream Peer Window", test_stream_peer_window},
+        {"Configured Stream Window", test_configured_stream_window},
+        {"Write No Window", test_write_no_window},
+        {"Zero Initial Window", test_zero_initial_window},
+        {"Accept Window Bonus", test_accept_window_bonus},
+        {"Window Before Accept", test_window_before_accept},
+        {"Window Update After Stall", test_window_update_after_stall},
+        {"Session Reset Windows", test_session_reset_windows},
+        {"Stream Inflight Bytes", test_stream_inflight_bytes},
+        {"Small Write Coalescing", test_small_write_coalescing},
+        {"Send Ordering", test_send_ordering},
+        {"Auto Flush", test_auto_flush},
+        {"Send Buffer Age", test_send_buffer_age},
+        {"Send Buffer Cap", test_send_buffer_cap},
+        {"Stream Write Ready", test_stream_write_ready},
+        {"Window Stall Timeout", test_window_stall_timeout},
+        {"Redundant Window Updates", test_redundant_window_updates},
+        {"Window Update Callback", test_window_update_callback},
+        {"Stream Pause Recv", test_stream_pause_recv},
+        {"Data Callback Backpressure", test_data_callback_backpressure},
+        {"Stream Write Stats", test_stream_write_stats},
+        {"Window Violation", test_window_violation},
+        {"Unread Stream Bounded", test_unread_stream_bounded},
+        {"Frame Buffer Pool", test_frame_buffer_pool},
         {"Stream Lifecycle", test_stream_lifecycle},
+        {"Stream Peer FIN Callback", test_stream_peer_fin_callback},
+        {"Stream Interrupt", test_stream_interrupt},
+        {"Stream SYN Then FIN", test_stream_syn_then_fin},
+        {"Stream Late FIN", test_stream_late_fin},
+        {"Stream Simultaneous Close", test_stream_simultaneous_close},
+        {"Window Update FIN Close", test_stream_window_fin_close},
+        {"Stream Reject Data On SYN", test_stream_reject_data_on_syn},
+        {"Stream Reset By Peer", test_stream_reset_by_peer},
+        {"Write After Peer Reset", test_write_after_peer_reset},
+        {"Stream Drain Recv", test_stream_drain_recv},
+        {"Stream Read Timeout", test_stream_read_timeout},
+        {"Stream Read Message", test_stream_read_message},
+        {"Stream TLV", test_stream_tlv},
+        {"Stream Churn", test_stream_churn},
         {"Concurrent Streams", test_concurrent_streams},
-        {"Error Handling", test_error_handling}
+        {"Open Streams Batch", test_open_streams_batch},
+        {"Max Num Streams", test_max_num_streams},
+        {"Stream Table Churn", test_stream_table_churn},
+        {"Session Foreach Stream", test_session_foreach_stream},
+        {"Stream Open Rate Limit", test_stream_open_rate_limit},
+        {"Interleaved Frames Demux", test_interleaved_frames_demux},
+        {"Error Handling", test_error_handling},
+        {"Allocation Failure", test_allocation_failure},
+        {"Session Memory Limit", test_session_memory_limit},
+        {"Connection Reset", test_connection_reset},
+        {"Write Overstated", test_write_overstated},
+        {"Write Cut Frame", test_write_cut_frame},
+        {"Process Both Blocked", test_process_both_blocked},
+        {"Diagnostics", test_diagnostics},
+        {"Replay Frames", test_replay_frames},
+        {"Stream Labels", test_stream_labels},
+        {"Session Debug Dump", test_session_debug_dump},
+        {"Frame Trace", test_frame_trace},
+        {"Frame Trace Budget", test_frame_trace_budget},
+        {"End To End", test_end_to_end},
+        {"End To End Ping", test_end_to_end_ping},
+        {"End To End Ping RTT", test_end_to_end_ping_rtt},
+        {"Zero Length Write", test_zero_length_write},
+        {"Session Teardown", test_session_teardown},
+        {"Destroy Flush", test_destroy_flush}
     };
     
     int num_tests = sizeof(tests) / sizeof(test_case_t);
@@ -6,6 +6,7 @@
 #include "test_common.h"
 #include "test_main.h"
 #include "mock_io.h"
+#include "test_transport.h"
 
 /* Test session creation and basic operations */
 void test_session_creation(void) {
@@ -33,6 +34,7 @@ void test_session_creation(void) {
     /* Close session */
     result = yamux_session_close(session, YAMUX_NORMAL);
     assert(result == YAMUX_OK);
+    yamux_session_free(session);
     
     /* Create server session */
     result = yamux_session_create(&io, 0, NULL, &session);
@@ -42,6 +44,7 @@ void test_session_creation(void) {
     /* Close session */
     result = yamux_session_close(session, YAMUX_NORMAL);
     assert(result == YAMUX_OK);
+    yamux_session_free(session);
     
     /* Free IO context */
     pipe_io_context_free(io_ctx);
@@ -113,6 +116,8 @@ void test_session_ping(void) {
     
     result = yamux_session_close(server_session, YAMUX_NORMAL);
     assert_true(result == YAMUX_OK, "Failed to close server session");
+    yamux_session_free(client_session);
+    yamux_session_free(server_session);
     
     /* Free mock IO resources */
     mock_io_free(client_mock);
@@ -121,6 +126,1427 @@ void test_session_ping(void) {
     printf("Session ping test completed successfully!\n");
 }
 
+/* Test that opening a stream after the peer's GoAway fails fast */
+void test_session_open_after_go_away(void) {
+    yamux_session_t *client_session, *server_session;
+    yamux_stream_t *stream = NULL;
+    yamux_io_t client_io, server_io;
+    mock_io_t *client_mock, *server_mock;
+    yamux_result_t result;
+    
+    client_mock = mock_io_init(1024);
+    server_mock = mock_io_init(1024);
+    
+    client_io.read = mock_read;
+    client_io.write = mock_write;
+    client_io.ctx = client_mock;
+    
+    server_io.read = mock_read;
+    server_io.write = mock_write;
+    server_io.ctx = server_mock;
+    
+    result = yamux_session_create(&client_io, 1, NULL, &client_session);
+    assert_true(result == YAMUX_OK, "Failed to create client session");
+    
+    result = yamux_session_create(&server_io, 0, NULL, &server_session);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    
+    /* Server shuts down and sends GoAway */
+    result = yamux_session_close(server_session, YAMUX_NORMAL);
+    assert_true(result == YAMUX_OK, "Failed to close server session");
+    
+    /* Exchange data server -> client */
+    mock_io_swap_buffers(server_mock, client_mock);
+    
+    result = yamux_session_process(client_session);
+    assert_true(result == YAMUX_OK, "Failed to process GoAway on client");
+    
+    /* Opening now fails with a distinct error and nothing goes on the wire */
+    client_mock->write_buf_used = 0;
+    result = yamux_stream_open_detailed(client_session, 0, &stream);
+    assert_int_equal(result, YAMUX_ERR_REMOTE_GOAWAY, "Open after GoAway should fail fast");
+    assert_true(stream == NULL, "No stream should be returned after GoAway");
+    assert_true(client_mock->write_buf_used == 0, "No SYN should be sent after GoAway");
+    
+    /* A locally closed session still reports plain CLOSED */
+    result = yamux_session_close(client_session, YAMUX_NORMAL);
+    assert_true(result == YAMUX_OK, "Failed to close client session");
+    result = yamux_stream_open_detailed(client_session, 0, &stream);
+    assert_int_equal(result, YAMUX_ERR_CLOSED, "Open on closed session should report CLOSED");
+    
+    yamux_session_free(client_session);
+    yamux_session_free(server_session);
+    mock_io_free(client_mock);
+    mock_io_free(server_mock);
+}
+
+/* Test that a GoAway with an unknown code still closes gracefully */
+void test_session_unknown_go_away_code(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream, *late = NULL;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t payload[4];
+    uint8_t buf[16];
+    size_t bytes_read, written;
+    uint32_t code = 0;
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_int_equal(yamux_session_remote_go_away(session, &code), YAMUX_ERR_WOULD_BLOCK,
+                     "No GoAway code before the peer sends one");
+    
+    /* An established stream with data still unread */
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    yamux_encode_u32(262144, payload);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 1, payload, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN-ACK");
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, (const uint8_t *)"tail", 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process DATA");
+    
+    /* A code from a future protocol version is not an error */
+    written = mock->write_buf_used;
+    yamux_encode_u32(0x12345678, payload);
+    mock_io_inject_frame(mock, YAMUX_GO_AWAY, 0, 0, payload, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Unknown GoAway code should be accepted");
+    assert_true(mock->write_buf_used == written, "No protocol-error GoAway should be sent back");
+    assert_int_equal(yamux_session_remote_go_away(session, &code), YAMUX_OK, "GoAway code should be available");
+    assert_true(code == 0x12345678, "Raw GoAway code should be kept");
+    
+    /* The session winds down as for a normal GoAway */
+    assert_int_equal(yamux_stream_open_detailed(session, 0, &late), YAMUX_ERR_REMOTE_GOAWAY,
+                     "No new streams after GoAway");
+    assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes_read) == YAMUX_OK &&
+                bytes_read == 4 && memcmp(buf, "tail", 4) == 0,
+                "Data received before GoAway should still be readable");
+    assert_int_equal(yamux_session_remote_go_away(NULL, &code), YAMUX_ERR_INVALID, "NULL session should be rejected");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that the highest ACKed stream tells which opens to retry after GoAway */
+void test_session_last_acked_stream(void) {
+    yamux_session_t *session;
+    yamux_stream_t *streams[4];
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    uint32_t id = 0;
+    int i;
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_int_equal(yamux_session_last_acked_stream(session, &id), YAMUX_ERR_WOULD_BLOCK,
+                     "Nothing should be reported before any ACK");
+    
+    /* Streams 1, 3, 5 and 7; the peer ACKs 3 and then 1 before going away */
+    for (i = 0; i < 4; i++) {
+        assert_true(yamux_stream_open_detailed(session, 0, &streams[i]) == YAMUX_OK, "Failed to open stream");
+    }
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 3, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 1, window, 4);
+    yamux_encode_u32(YAMUX_NORMAL, window);
+    mock_io_inject_frame(mock, YAMUX_GO_AWAY, 0, 0, window, 4);
+    while (mock->read_pos < mock->read_buf_used) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process frames");
+    }
+    
+    /* A later, lower ACK does not lower the reported ID */
+    assert_int_equal(yamux_session_last_acked_stream(session, &id), YAMUX_OK, "Last ACKed stream should be known");
+    assert_true(id == 3, "Highest ACKed stream should be reported");
+    
+    /* Everything above it is still waiting, so it is safe to retry elsewhere */
+    for (i = 0; i < 4; i++) {
+        if (streams[i]->id > id) {
+            assert_true(streams[i]->state == YAMUX_STREAM_SYN_SENT, "Streams above the last ACK should be unanswered");
+        } else {
+            assert_true(streams[i]->state == YAMUX_STREAM_ESTABLISHED, "Streams up to the last ACK should be open");
+        }
+    }
+    
+    assert_int_equal(yamux_session_last_acked_stream(NULL, &id), YAMUX_ERR_INVALID, "NULL session should be rejected");
+    assert_int_equal(yamux_session_last_acked_stream(session, NULL), YAMUX_ERR_INVALID, "NULL id should be rejected");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that the health summary follows the session through its life */
+void test_session_health(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_config_t config = yamux_default_config;
+    yamux_health_t health;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    size_t bytes;
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    config.small_frame_threshold = 64;
+    assert_true(yamux_session_create(&io, 1, &config, &session) == YAMUX_OK, "Failed to create session");
+    
+    assert_int_equal(yamux_session_health(session, &health), YAMUX_OK, "Failed to get health");
+    assert_true(!health.is_closed && !health.has_remote_goaway && health.pending_pings == 0 &&
+                health.last_activity_ms_ago == 0 && health.num_streams == 0 && health.buffered_bytes == 0,
+                "A new session should report nothing");
+    
+    /* Two pings out, then the peer answers one and sends data on an opened stream */
+    assert_int_equal(yamux_session_keepalive(session, 1000), YAMUX_OK, "Failed to start the clock");
+    assert_int_equal(yamux_session_ping(session), YAMUX_OK, "Failed to ping");
+    assert_int_equal(yamux_session_ping(session), YAMUX_OK, "Failed to ping");
+    assert_int_equal(yamux_session_health(session, &health), YAMUX_OK, "Failed to get health");
+    assert_true(health.pending_pings == 2, "Both pings should be pending");
+    
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 1, window, 4);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, (const uint8_t *)"hello", 5);
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_ACK, 0, NULL, 0);
+    assert_int_equal(yamux_session_keepalive(session, 1500), YAMUX_OK, "Failed to advance the clock");
+    while (mock->read_pos < mock->read_buf_used) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process frames");
+    }
+    assert_true(yamux_stream_write(stream, (const uint8_t *)"abc", 3, &bytes) == YAMUX_OK && bytes == 3,
+                "Failed to hold a small write");
+    
+    assert_int_equal(yamux_session_keepalive(session, 1750), YAMUX_OK, "Failed to advance the clock");
+    assert_int_equal(yamux_session_health(session, &health), YAMUX_OK, "Failed to get health");
+    assert_true(health.pending_pings == 1, "The answered ping should no longer be pending");
+    assert_true(health.last_activity_ms_ago == 250, "Activity should date from the last frame");
+    assert_true(health.num_streams == 1, "The open stream should be counted");
+    assert_true(health.buffered_bytes == 8, "Unread and held bytes should both count");
+    assert_true(!health.is_closed && !health.has_remote_goaway, "Session should still be open");
+    
+    /* The peer goes away, then we close */
+    yamux_encode_u32(YAMUX_NORMAL, window);
+    mock_io_inject_frame(mock, YAMUX_GO_AWAY, 0, 0, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process GoAway");
+    assert_int_equal(yamux_session_health(session, &health), YAMUX_OK, "Failed to get health");
+    assert_true(health.has_remote_goaway && !health.is_closed, "GoAway should be reported before the close");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    assert_int_equal(yamux_session_health(session, &health), YAMUX_OK, "Failed to get health");
+    assert_true(health.is_closed, "Closed session should report it");
+    
+    assert_int_equal(yamux_session_health(NULL, &health), YAMUX_ERR_INVALID, "NULL session should be rejected");
+    assert_int_equal(yamux_session_health(session, NULL), YAMUX_ERR_INVALID, "NULL output should be rejected");
+    
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test the boundary between session-level and stream-level frames */
+void test_session_stream_id_bounds(void) {
+    yamux_session_t *session;
+    yamux_stream_t *low, *mid, *top, *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_header_t go_away;
+    uint8_t window[4];
+    uint8_t buf[16];
+    size_t bytes;
+    
+    io.read = mock_read;
+    io.write = mock_write;
+    yamux_encode_u32(262144, window);
+    
+    /* DATA on stream 0 is a protocol error, not a lookup miss */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 0, (const uint8_t *)"zero", 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_PROTOCOL, "DATA on stream 0 should be rejected");
+    assert_true(yamux_decode_header(mock->write_buf, mock->write_buf_used, &go_away) == YAMUX_OK &&
+                go_away.type == YAMUX_GO_AWAY &&
+                yamux_decode_u32(mock->write_buf + YAMUX_HEADER_SIZE) == YAMUX_PROTOCOL_ERROR,
+                "GoAway with PROTOCOL_ERROR should be sent");
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_CLOSED, "Session should be closed");
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* IDs up to the 32-bit maximum are routed to exactly their stream */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_stream_open_detailed(session, 1, &low) == YAMUX_OK, "Failed to open stream 1");
+    assert_true(yamux_stream_open_detailed(session, 0x7FFFFFFF, &mid) == YAMUX_OK, "Failed to open stream 0x7FFFFFFF");
+    assert_int_equal(yamux_stream_open_detailed(session, 0xFFFFFFFF, &top), YAMUX_ERR_INVALID,
+                     "0xFFFFFFFF is reserved and cannot be opened locally");
+    assert_true(yamux_stream_open_detailed(session, 0xFFFFFFFD, &top) == YAMUX_OK, "Failed to open stream 0xFFFFFFFD");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 0xFFFFFFFD, window, 4);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 0xFFFFFFFD, (const uint8_t *)"top", 3);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 0x7FFFFFFF, (const uint8_t *)"mid", 3);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, (const uint8_t *)"low", 3);
+    while (mock->read_pos < mock->read_buf_used) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process high-ID frames");
+    }
+    assert_true(yamux_stream_read(top, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 3 &&
+                memcmp(buf, "top", 3) == 0, "Stream 0xFFFFFFFD should get its own data");
+    assert_true(yamux_stream_read(mid, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 3 &&
+                memcmp(buf, "mid", 3) == 0, "Stream 0x7FFFFFFF should get its own data");
+    assert_true(yamux_stream_read(low, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 3 &&
+                memcmp(buf, "low", 3) == 0, "Stream 1 should get its own data");
+    
+    /* A high ID that is not open is not confused with one that is */
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 0xFFFFFFFB, (const uint8_t *)"lost", 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_INVALID_STREAM,
+                     "DATA for an unknown high ID should not be routed");
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* A server accepts a stream the client opens at the top of the range */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 0, NULL, &session) == YAMUX_OK, "Failed to create server session");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 0xFFFFFFFF, window, 4);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 0xFFFFFFFF, (const uint8_t *)"max", 3);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN");
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process DATA");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK &&
+                yamux_stream_get_id(stream) == 0xFFFFFFFF, "Stream 0xFFFFFFFF should be accepted");
+    assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 3 &&
+                memcmp(buf, "max", 3) == 0, "Accepted stream should get its data");
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that a SYN with the wrong stream ID parity is rejected with GoAway */
+void test_session_stream_id_parity(void) {
+    yamux_session_t *session;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_config_t config;
+    yamux_result_t result;
+    uint8_t window[4];
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    yamux_encode_u32(262144, window);
+    
+    /* A server only accepts odd (client-opened) stream IDs */
+    result = yamux_session_create(&io, 0, NULL, &session);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    result = yamux_session_process(session);
+    assert_int_equal(result, YAMUX_OK, "Odd SYN should be accepted by a server");
+    
+    /* An even ID means the peer is also a server */
+    mock->write_buf_used = 0;
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 2, window, 4);
+    result = yamux_session_process(session);
+    assert_int_equal(result, YAMUX_ERR_PROTOCOL, "Even SYN should be rejected by a server");
+    assert_true(mock->write_buf_used >= YAMUX_HEADER_SIZE + 4, "GoAway should be sent");
+    {
+        yamux_header_t go_away;
+        assert_true(yamux_decode_header(mock->write_buf, mock->write_buf_used, &go_away) == YAMUX_OK,
+                    "Failed to decode GoAway");
+        assert_true(go_away.type == YAMUX_GO_AWAY, "First frame should be GoAway");
+        assert_true(yamux_decode_u32(mock->write_buf + YAMUX_HEADER_SIZE) == YAMUX_PROTOCOL_ERROR,
+                    "GoAway should carry PROTOCOL_ERROR");
+    }
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_CLOSED,
+                     "Session should be closed after the violation");
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* Client side: odd IDs are our own, so a SYN for one is rejected */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    result = yamux_session_create(&io, 1, NULL, &session);
+    assert_true(result == YAMUX_OK, "Failed to create client session");
+    mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_SYN, 3, NULL, 0);
+    result = yamux_session_process(session);
+    assert_int_equal(result, YAMUX_ERR_PROTOCOL, "Odd SYN should be rejected by a client");
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* The check can be turned off */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    memset(&config, 0, sizeof(config));
+    config.accept_backlog = 128;
+    config.max_stream_window_size = 262144;
+    config.verify_stream_id_parity = 0;
+    result = yamux_session_create(&io, 0, &config, &session);
+    assert_true(result == YAMUX_OK, "Failed to create unchecked server session");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 2, window, 4);
+    result = yamux_session_process(session);
+    assert_int_equal(result, YAMUX_OK, "Disabled check should accept an even SYN");
+
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that a SYN reflected back with our own stream ID cannot collide with our streams */
+void test_session_reflected_syn(void) {
+    yamux_session_t *session;
+    yamux_stream_t *local, *remote;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_config_t config;
+    uint8_t window[4];
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    yamux_encode_u32(262144, window);
+    
+    /* A server's own SYN echoed back by a reflector is a protocol error */
+    assert_true(yamux_session_create(&io, 0, NULL, &session) == YAMUX_OK, "Failed to create server session");
+    assert_true(yamux_stream_open_detailed(session, 0, &local) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_get_id(local) == 2, "Server should open stream 2 first");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 2, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_PROTOCOL, "Reflected SYN should be rejected");
+    assert_true(yamux_session_pending_accepts(session) == 0, "Reflected SYN should not queue a stream");
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_CLOSED,
+                     "Session should be closed after the violation");
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* The same holds for a client, including an ID it has not used yet */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create client session");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_PROTOCOL,
+                     "SYN for the client's next ID should be rejected");
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* With the check off, a local open steps over an ID the peer already took */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    memset(&config, 0, sizeof(config));
+    config.accept_backlog = 128;
+    config.max_stream_window_size = 262144;
+    config.verify_stream_id_parity = 0;
+    assert_true(yamux_session_create(&io, 0, &config, &session) == YAMUX_OK,
+                "Failed to create unchecked server session");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 2, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Disabled check should accept an even SYN");
+    assert_true(yamux_stream_open_detailed(session, 0, &local) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_get_id(local) == 4, "Local open should skip the peer's stream 2");
+    assert_true(yamux_stream_accept(session, &remote) == YAMUX_OK && yamux_stream_get_id(remote) == 2,
+                "Peer's stream 2 should still be accepted");
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test counting streams waiting to be accepted */
+void test_session_pending_accepts(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_result_t result;
+    uint8_t window[4];
+    uint32_t id;
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    yamux_encode_u32(262144, window);
+    
+    result = yamux_session_create(&io, 0, NULL, &session);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    assert_int_equal(yamux_session_pending_accepts(session), 0, "New session should have no pending accepts");
+    
+    /* Peer opens several streams that we do not accept yet */
+    for (id = 1; id <= 9; id += 2) {
+        mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, id, window, 4);
+        result = yamux_session_process(session);
+        assert_true(result == YAMUX_OK, "Failed to process SYN");
+    }
+    assert_int_equal(yamux_session_pending_accepts(session), 5, "All SYNs should be pending");
+    
+    /* Accepting drains the backlog one at a time */
+    result = yamux_stream_accept(session, &stream);
+    assert_true(result == YAMUX_OK && yamux_stream_get_id(stream) == 1, "Should accept the oldest stream");
+    assert_int_equal(yamux_session_pending_accepts(session), 4, "Accept should reduce the backlog");
+    while (yamux_stream_accept(session, &stream) == YAMUX_OK) {
+    }
+    assert_int_equal(yamux_session_pending_accepts(session), 0, "Backlog should be empty");
+    
+    assert_int_equal(yamux_session_pending_accepts(NULL), 0, "NULL session should report 0");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+typedef struct {
+    uint8_t data[64];
+    size_t len;
+    uint32_t stream_id;
+} control_capture_t;
+
+static void capture_control(void *ctx, yamux_stream_t *stream, const uint8_t *data, size_t len) {
+    control_capture_t *capture = (control_capture_t *)ctx;
+    size_t written;
+    
+    if (capture->len + len <= sizeof(capture->data)) {
+        memcpy(capture->data + capture->len, data, len);
+        capture->len += len;
+    }
+    capture->stream_id = yamux_stream_get_id(stream);
+    yamux_stream_write(stream, (const uint8_t *)"pong", 4, &written);
+}
+
+/* Test that the control stream bypasses accept and delivers via its callback */
+void test_session_control_stream(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    control_capture_t capture;
+    yamux_header_t header;
+    uint8_t window[4];
+    uint8_t buf[16];
+    size_t bytes_read, offset;
+    int replied = 0;
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 0, NULL, &session) == YAMUX_OK, "Failed to create server session");
+    memset(&capture, 0, sizeof(capture));
+    assert_int_equal(yamux_set_control_stream(session, 2, capture_control, &capture), YAMUX_ERR_INVALID,
+                     "The client never opens an even stream");
+    assert_int_equal(yamux_set_control_stream(session, 1, capture_control, &capture), YAMUX_OK,
+                     "Failed to reserve the control stream");
+    
+    /* The client opens the control stream and a regular one */
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 3, window, 4);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, (const uint8_t *)"ping", 4);
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 3, (const uint8_t *)"data", 4);
+    mock->write_buf_used = 0;
+    while (mock->read_pos < mock->read_buf_used) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process frames");
+    }
+    
+    /* Control data arrives via the callback, which can reply */
+    assert_true(capture.len == 4 && memcmp(capture.data, "ping", 4) == 0,
+                "Control data should reach the callback");
+    assert_true(capture.stream_id == 1, "Callback should get the control stream");
+    for (offset = 0; offset + YAMUX_HEADER_SIZE <= mock->write_buf_used;
+         offset += YAMUX_HEADER_SIZE + header.length) {
+        assert_true(yamux_decode_header(mock->write_buf + offset, YAMUX_HEADER_SIZE, &header) == YAMUX_OK,
+                    "Failed to decode written frame");
+        if (header.type == YAMUX_DATA && header.stream_id == 1 && header.length == 4 &&
+            memcmp(mock->write_buf + offset + YAMUX_HEADER_SIZE, "pong", 4) == 0) {
+            replied = 1;
+        }
+    }
+    assert_true(replied, "Reply should be sent on the control stream");
+    
+    /* Only the regular stream is queued, and it reads as usual */
+    assert_int_equal(yamux_session_pending_accepts(session), 1, "Only the regular stream should be queued");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept regular stream");
+    assert_true(yamux_stream_get_id(stream) == 3, "Accepted stream should be the regular one");
+    assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes_read) == YAMUX_OK &&
+                bytes_read == 4 && memcmp(buf, "data", 4) == 0, "Regular stream should read its data");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test reporting the session role */
+void test_session_is_client(void) {
+    yamux_session_t *client, *server;
+    yamux_io_t io;
+    mock_io_t *mock;
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    
+    assert_true(yamux_session_create(&io, 1, NULL, &client) == YAMUX_OK, "Failed to create client session");
+    assert_true(yamux_session_create(&io, 0, NULL, &server) == YAMUX_OK, "Failed to create server session");
+    assert_int_equal(yamux_session_is_client(client), 1, "Client session should report client");
+    assert_int_equal(yamux_session_is_client(server), 0, "Server session should report server");
+    assert_int_equal(yamux_session_is_client(NULL), 0, "NULL session should report 0");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    mock_io_free(mock);
+}
+
+/* Test that split IO contexts route reads and writes to their own handles */
+void test_session_io_contexts(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_header_t header;
+    yamux_io_t io;
+    mock_io_t *rx, *tx;
+    uint8_t ping[4] = {0, 0, 0, 7};
+    
+    rx = mock_io_init(1024);
+    tx = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = rx;
+    
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_int_equal(yamux_session_set_io_contexts(NULL, rx, tx), YAMUX_ERR_INVALID, "NULL session should be rejected");
+    assert_true(yamux_session_set_io_contexts(session, rx, tx) == YAMUX_OK, "Failed to set IO contexts");
+    
+    /* A ping is read from one handle and answered on the other */
+    mock_io_inject_frame(rx, YAMUX_PING, YAMUX_FLAG_SYN, 0, ping, sizeof(ping));
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process ping");
+    assert_true(rx->write_buf_used == 0, "Nothing should be written to the read handle");
+    assert_true(yamux_decode_header(tx->write_buf, tx->write_buf_used, &header) == YAMUX_OK &&
+                header.type == YAMUX_PING && (header.flags & YAMUX_FLAG_ACK),
+                "Ping ACK should go to the write handle");
+    
+    /* Frames sent by stream calls take the same route */
+    tx->write_buf_used = 0;
+    assert_true(yamux_stream_open_detailed(session, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(rx->write_buf_used == 0, "SYN should not go to the read handle");
+    assert_true(yamux_decode_header(tx->write_buf, tx->write_buf_used, &header) == YAMUX_OK &&
+                (header.flags & YAMUX_FLAG_SYN) && header.stream_id == stream->id,
+                "SYN should go to the write handle");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(rx);
+    mock_io_free(tx);
+}
+
+/* Process a closed session repeatedly; it must not touch the transport */
+static void assert_stays_closed(yamux_session_t *session, mock_io_t *mock, const char *message) {
+    size_t read_pos = mock->read_pos;
+    size_t written = mock->write_buf_used;
+    int i;
+    
+    for (i = 0; i < 3; i++) {
+        assert_int_equal(yamux_session_process(session), YAMUX_ERR_CLOSED, message);
+    }
+    assert_true(mock->read_pos == read_pos, "Closed session should not read");
+    assert_true(mock->write_buf_used == written, "Closed session should not write");
+}
+
+/* Test that processing a closed session keeps returning CLOSED */
+void test_session_process_after_close(void) {
+    yamux_session_t *session;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t ping[8] = {0};
+    void *ctx;
+    int i;
+    
+    io.read = mock_read;
+    io.write = mock_write;
+    
+    /* Closed locally */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    yamux_session_close(session, YAMUX_NORMAL);
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+    assert_stays_closed(session, mock, "Locally closed session should report CLOSED");
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* The peer's GoAway does not close the session; it keeps serving the peer's drain */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    mock_io_inject_frame(mock, YAMUX_GO_AWAY, 0, 0, ping, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "GoAway should be processed");
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Ping after GoAway should be processed");
+    assert_true(mock->write_buf_used == YAMUX_HEADER_SIZE, "Ping after GoAway should be answered");
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* Transport failure */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    mock->should_fail_read = 1;
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_IO, "Failed read should report IO");
+    mock->should_fail_read = 0;
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+    assert_stays_closed(session, mock, "Session with a failed transport should report CLOSED");
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* Fatal protocol error */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    mock_io_inject_frame(mock, 0x7, 0, 0, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_PROTOCOL, "Bad frame should report PROTOCOL");
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+    assert_stays_closed(session, mock, "Session after a protocol error should report CLOSED");
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* An empty read is not a close */
+    mock = mock_io_init(1024);
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create session");
+    assert_int_equal(yamux_session_process(session), YAMUX_ERR_IO, "Empty read should report IO");
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Session should still process frames");
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* The handle API reports the same */
+    mock = mock_io_init(1024);
+    ctx = yamux_init(mock_read, mock_write, mock, 1);
+    assert_true(ctx != NULL, "Failed to init session");
+    mock_io_inject_frame(mock, 0x7, 0, 0, NULL, 0);
+    assert_int_equal(yamux_process(ctx), YAMUX_ERR_PROTOCOL, "Bad frame should report PROTOCOL");
+    for (i = 0; i < 3; i++) {
+        assert_int_equal(yamux_process(ctx), YAMUX_ERR_CLOSED, "yamux_process should keep reporting CLOSED");
+    }
+    yamux_destroy(ctx);
+    mock_io_free(mock);
+}
+
+/* Test that the library reports the time the application fed it */
+void test_session_now_ms(void) {
+    yamux_session_t *session;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_config_t config = yamux_default_config;
+    
+    mock = mock_io_init(1024);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    
+    config.keepalive_interval = 1000;
+    assert_true(yamux_session_create(&io, 1, &config, &session) == YAMUX_OK, "Failed to create session");
+    assert_true(yamux_session_now_ms(NULL) == 0, "NULL session should report 0");
+    assert_true(yamux_session_now_ms(session) == 0, "No time reported yet");
+    
+    /* A fake clock: the accessor follows whatever the application reports */
+    yamux_session_keepalive(session, 5000);
+    assert_true(yamux_session_now_ms(session) == 5000, "Should report the injected time");
+    yamux_session_keepalive(session, 5500);
+    assert_true(yamux_session_now_ms(session) == 5500, "Should follow the injected clock");
+    assert_true(mock->write_buf_used == 0, "No ping is due yet");
+    yamux_session_keepalive(session, 6000);
+    assert_true(yamux_session_now_ms(session) == 6000 && mock->write_buf_used == YAMUX_HEADER_SIZE,
+                "The ping should be due at the reported time");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that pings interleave with a bulk transfer without disturbing it */
+void test_ping_during_transfer(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    static uint8_t data[64 * 1024];
+    static uint8_t received[64 * 1024];
+    size_t sent = 0, got = 0, bytes, chunk;
+    uint32_t now = 1000, rtt;
+    int round, pings = 0, answered = 0;
+    size_t i;
+    
+    config.enable_keepalive = 0;   /* Pings are sent by hand below */
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_session_rtt(client, &rtt) == YAMUX_ERR_WOULD_BLOCK, "No RTT before a ping");
+    assert_true(yamux_session_rtt(NULL, &rtt) == YAMUX_ERR_INVALID, "NULL session should be rejected");
+    
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    for (i = 0; i < sizeof(data); i++) {
+        data[i] = (uint8_t)(i * 7);
+    }
+    
+    for (round = 0; got < sizeof(data); round++) {
+        assert_true(round < 1000, "Transfer should make progress");
+        yamux_session_keepalive(client, now);
+        yamux_session_keepalive(server, now);
+        
+        /* Fill the link with data, leaving room for a ping */
+        chunk = 1000;
+        while (sent < sizeof(data) &&
+               transport->a_to_b.capacity - transport->a_to_b.count >= chunk + 2 * YAMUX_HEADER_SIZE) {
+            if (chunk > sizeof(data) - sent) {
+                chunk = sizeof(data) - sent;
+            }
+            assert_true(yamux_stream_write(client_stream, data + sent, chunk, &bytes) == YAMUX_OK && bytes == chunk,
+                        "Bulk write failed");
+            sent += bytes;
+        }
+        
+        /* Every few rounds, ping from whichever side */
+        if (round % 3 == 0) {
+            assert_true(yamux_session_ping((round % 2) ? server : client) == YAMUX_OK, "Ping failed");
+            pings++;
+        }
+        
+        /* The link takes 5 ms to deliver */
+        now += 5;
+        yamux_session_keepalive(client, now);
+        yamux_session_keepalive(server, now);
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver frames");
+        
+        while (yamux_stream_read(server_stream, received + got, sizeof(received) - got, &bytes) == YAMUX_OK &&
+               bytes > 0) {
+            got += bytes;
+        }
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver updates");
+        
+        if (round % 3 == 0) {
+            assert_true(!((round % 2) ? server : client)->ping_timing, "Ping should be answered within the round");
+            assert_true(yamux_session_rtt((round % 2) ? server : client, &rtt) == YAMUX_OK,
+                        "Answered ping should give an RTT");
+            assert_true(rtt == 5, "RTT should match the simulated link delay");
+            answered++;
+        }
+    }
+    
+    assert_true(pings > 5 && answered == pings, "Every ping should be answered");
+    assert_true(memcmp(received, data, sizeof(data)) == 0, "Bulk data should arrive intact");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that a missed keepalive fails pending opens at once */
+void test_session_keepalive(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *established, *pending[3], *late;
+    yamux_config_t config = yamux_default_config;
+    uint8_t data[] = "x";
+    size_t bytes;
+    uint32_t now = 0xFFFFF000u;   /* Start near wraparound */
+    int i;
+    
+    config.keepalive_interval = 1000;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    
+    assert_true(yamux_stream_open_detailed(client, 0, &established) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    
+    /* A live peer answers every ping */
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Failed to start keepalive");
+    assert_true(transport->a_to_b.count == 0, "Starting the clock should not ping");
+    assert_true(yamux_session_keepalive(client, now + 999) == YAMUX_OK, "Keepalive before the interval");
+    assert_true(transport->a_to_b.count == 0, "No ping before the interval");
+    for (i = 1; i <= 3; i++) {
+        now += 1000;
+        assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Keepalive with a live peer");
+        assert_true(transport->a_to_b.count == YAMUX_HEADER_SIZE, "Keepalive should send a ping");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange ping");
+    }
+    
+    /* The peer goes silent with opens in flight */
+    for (i = 0; i < 3; i++) {
+        assert_true(yamux_stream_open_detailed(client, 0, &pending[i]) == YAMUX_OK, "Failed to open stream");
+    }
+    now += 1000;
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Ping to a silent peer");
+    assert_true(yamux_stream_get_state(pending[0]) == YAMUX_STREAM_SYN_SENT, "Opens still pending");
+    now += 1000;
+    assert_int_equal(yamux_session_keepalive(client, now), YAMUX_ERR_TIMEOUT, "Missed ping should time out");
+    
+    for (i = 0; i < 3; i++) {
+        assert_true(yamux_stream_get_state(pending[i]) == YAMUX_STREAM_CLOSED, "Pending open should fail");
+        assert_int_equal(yamux_stream_write(pending[i], data, sizeof(data), &bytes), YAMUX_ERR_CLOSED,
+                         "Write on a failed open should report CLOSED");
+    }
+    assert_true(yamux_stream_get_state(established) == YAMUX_STREAM_ESTABLISHED,
+                "Established streams are left to the application");
+    assert_int_equal(yamux_stream_open_detailed(client, 0, &late), YAMUX_ERR_CLOSED,
+                     "Open after a missed keepalive should fail");
+    assert_int_equal(yamux_session_keepalive(client, now + 5000), YAMUX_ERR_TIMEOUT,
+                     "Timeout should be sticky");
+    
+    /* Disabled keepalive never pings */
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(server);
+    config.enable_keepalive = 0;
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+    transport->b_to_a.count = 0;
+    assert_true(yamux_session_keepalive(server, 0) == YAMUX_OK &&
+                yamux_session_keepalive(server, 5000) == YAMUX_OK, "Disabled keepalive should do nothing");
+    assert_true(transport->b_to_a.count == 0, "Disabled keepalive should not ping");
+    assert_int_equal(yamux_session_keepalive(NULL, 0), YAMUX_ERR_INVALID, "NULL session should be invalid");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that keepalive pings only an idle peer and gives up after its timeout */
+void test_session_keepalive_idle(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config = yamux_default_config;
+    uint8_t buf[16];
+    size_t bytes;
+    
+    config.keepalive_interval = 1000;
+    config.keepalive_timeout_ms = 300;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_session_keepalive(client, 0) == YAMUX_OK, "Failed to start keepalive");
+    
+    /* Data from the peer at 600 ms puts the ping off until 1600 ms */
+    assert_true(yamux_session_keepalive(client, 600) == YAMUX_OK, "Keepalive with traffic");
+    assert_true(yamux_stream_write(server_stream, (const uint8_t *)"busy", 4, &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    assert_true(yamux_stream_read(client_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 4, "Failed to read");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to return window");
+    assert_true(yamux_session_keepalive(client, 1000) == YAMUX_OK, "Keepalive after recent traffic");
+    assert_true(transport->a_to_b.count == 0, "A busy connection should not be pinged");
+    assert_true(yamux_session_keepalive(client, 1600) == YAMUX_OK, "Keepalive on an idle connection");
+    assert_true(transport->a_to_b.count == YAMUX_HEADER_SIZE, "An idle connection should be pinged");
+    
+    /* The answer arrives with some last data, then the peer goes silent */
+    assert_true(yamux_stream_write(server_stream, (const uint8_t *)"tail", 4, &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange ping");
+    assert_true(yamux_session_keepalive(client, 2599) == YAMUX_OK && transport->a_to_b.count == 0,
+                "No ping within an interval of the answer");
+    assert_true(yamux_session_keepalive(client, 2600) == YAMUX_OK && transport->a_to_b.count == YAMUX_HEADER_SIZE,
+                "Ping once the interval passes");
+    assert_true(yamux_session_keepalive(client, 2899) == YAMUX_OK, "Ping not yet overdue");
+    assert_int_equal(yamux_session_keepalive(client, 2900), YAMUX_ERR_TIMEOUT, "Unanswered ping should time out");
+    
+    /* Buffered data is still delivered; after that the stream reports the timeout */
+    assert_true(yamux_stream_read(client_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 4 &&
+                memcmp(buf, "tail", 4) == 0, "Buffered data should still be readable");
+    assert_int_equal(yamux_stream_read(client_stream, buf, sizeof(buf), &bytes), YAMUX_ERR_TIMEOUT,
+                     "Read after a missed keepalive should time out");
+    assert_int_equal(yamux_stream_write(client_stream, buf, 1, &bytes), YAMUX_ERR_TIMEOUT,
+                     "Write after a missed keepalive should time out");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that a new keepalive interval applies to a running session */
+void test_session_set_config(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_config_t config = yamux_default_config;
+    uint32_t now = 0;
+    
+    config.keepalive_interval = 1000;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, &config, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    
+    /* Pings go out every second to begin with */
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Failed to start keepalive");
+    now += 1000;
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Keepalive with a live peer");
+    assert_true(transport->a_to_b.count == YAMUX_HEADER_SIZE, "Keepalive should ping after one second");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange ping");
+    
+    /* Stretching the interval holds the next ping back until five seconds have passed */
+    config.keepalive_interval = 5000;
+    assert_true(yamux_session_set_config(client, &config) == YAMUX_OK, "Failed to change config");
+    now += 1000;
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Keepalive before the new interval");
+    assert_true(transport->a_to_b.count == 0, "Old interval should no longer apply");
+    now += 4000;
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Keepalive at the new interval");
+    assert_true(transport->a_to_b.count == YAMUX_HEADER_SIZE, "New interval should ping");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange ping");
+    
+    /* Turning keepalive off stops pings; turning it back on restarts its clock */
+    config.enable_keepalive = 0;
+    assert_true(yamux_session_set_config(client, &config) == YAMUX_OK, "Failed to disable keepalive");
+    now += 10000;
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Disabled keepalive");
+    assert_true(transport->a_to_b.count == 0, "Disabled keepalive should not ping");
+    config.enable_keepalive = 1;
+    assert_true(yamux_session_set_config(client, &config) == YAMUX_OK, "Failed to enable keepalive");
+    now += 10000;
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Re-enabled keepalive");
+    assert_true(transport->a_to_b.count == 0, "Re-enabling should start the clock, not ping at once");
+    
+    /* Fields fixed at creation are refused, and nothing else changes with them */
+    config.keepalive_interval = 100;
+    config.frame_buffer_pool_size = 4;
+    assert_int_equal(yamux_session_set_config(client, &config), YAMUX_ERR_INVALID,
+                     "Changing the frame buffer pool should be refused");
+    now += 100;
+    assert_true(yamux_session_keepalive(client, now) == YAMUX_OK, "Keepalive after a refused change");
+    assert_true(transport->a_to_b.count == 0, "A refused change should not apply in part");
+    assert_int_equal(yamux_session_set_config(NULL, &config), YAMUX_ERR_INVALID, "NULL session should be invalid");
+    assert_int_equal(yamux_session_set_config(client, NULL), YAMUX_ERR_INVALID, "NULL config should be invalid");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Count the frames of a type a mock session has written, with all of the given flags */
+static int count_sent_frames(mock_io_t *mock, uint8_t type, uint16_t flags) {
+    yamux_header_t header;
+    size_t pos = 0;
+    int count = 0;
+    
+    while (pos + YAMUX_HEADER_SIZE <= mock->write_buf_used &&
+           yamux_decode_header(mock->write_buf + pos, YAMUX_HEADER_SIZE, &header) == YAMUX_OK) {
+        if (header.type == type && (header.flags & flags) == flags) {
+            count++;
+        }
+        pos += YAMUX_HEADER_SIZE + header.length;
+    }
+    
+    return count;
+}
+
+/* Test that pings and keepalive keep working while a session drains after GoAway */
+void test_session_drain_ping(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream, *extra;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    uint8_t buf[16];
+    size_t bytes;
+    
+    config.keepalive_interval = 1000;
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 0, &config, &session) == YAMUX_OK, "Failed to create session");
+    yamux_encode_u32(YAMUX_DEFAULT_WINDOW_SIZE, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_session_keepalive(session, 0) == YAMUX_OK, "Failed to start keepalive");
+    
+    assert_int_equal(yamux_session_go_away(NULL, YAMUX_NORMAL), YAMUX_ERR_INVALID, "NULL session should be rejected");
+    assert_int_equal(yamux_session_go_away(session, (yamux_error_t)3), YAMUX_ERR_INVALID,
+                     "Unknown GoAway code should be rejected");
+    assert_true(count_sent_frames(mock, YAMUX_GO_AWAY, 0) == 0, "A rejected code should send nothing");
+    assert_true(yamux_session_go_away(session, YAMUX_NORMAL) == YAMUX_OK, "Failed to start draining");
+    assert_true(yamux_session_go_away(session, YAMUX_NORMAL) == YAMUX_OK, "Draining twice should be harmless");
+    assert_true(count_sent_frames(mock, YAMUX_GO_AWAY, 0) == 1, "Draining should send one GoAway");
+    
+    /* The peer's pings are answered */
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_SYN, 0, NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Ping during drain should be handled");
+    assert_true(count_sent_frames(mock, YAMUX_PING, YAMUX_FLAG_ACK) == 1, "Ping during drain should be answered");
+    
+    /* Our keepalive carries on and sees the peer's answers */
+    assert_true(yamux_session_keepalive(session, 1000) == YAMUX_OK, "Keepalive during drain");
+    assert_true(count_sent_frames(mock, YAMUX_PING, YAMUX_FLAG_SYN) == 1, "Keepalive should ping during drain");
+    mock_io_inject_frame(mock, YAMUX_PING, YAMUX_FLAG_ACK, 0, NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Pong during drain should be handled");
+    assert_true(yamux_session_keepalive(session, 2000) == YAMUX_OK, "Answered keepalive should not time out");
+    
+    /* New streams are refused both ways */
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 3, window, 4);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "SYN during drain should not fail the session");
+    assert_true(yamux_session_pending_accepts(session) == 0, "SYN during drain should not be queued");
+    assert_true(count_sent_frames(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_RST) == 1, "SYN during drain should be reset");
+    assert_int_equal(yamux_stream_open_detailed(session, 0, &extra), YAMUX_ERR_SESSION_SHUTDOWN,
+                     "Open during drain should be refused");
+    
+    /* The open stream finishes normally */
+    mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_FIN, 1, (const uint8_t *)"bye", 3);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Data during drain should be handled");
+    assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 3 &&
+                memcmp(buf, "bye", 3) == 0, "Data during drain should be readable");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_FIN_RECV, "Peer should have finished");
+    assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to close stream");
+    assert_true(count_sent_frames(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_RST) == 1 &&
+                count_sent_frames(mock, YAMUX_DATA, YAMUX_FLAG_RST) == 0, "Drained stream should not be reset");
+    
+    /* Closing after the drain sends no second GoAway */
+    assert_true(yamux_session_close(session, YAMUX_NORMAL) == YAMUX_OK, "Failed to close session");
+    assert_true(count_sent_frames(mock, YAMUX_GO_AWAY, 0) == 1, "Close after drain should not repeat GoAway");
+    assert_int_equal(yamux_session_go_away(session, YAMUX_NORMAL), YAMUX_ERR_CLOSED, "Draining a closed session should fail");
+    
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that the GoAway code reaches the peer and both sides stop opening streams */
+void test_session_go_away_code(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *stream, *accepted, *extra;
+    uint8_t buf[8];
+    size_t bytes;
+    uint32_t code;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump SYN");
+    assert_true(yamux_stream_accept(server, &accepted) == YAMUX_OK, "Failed to accept stream");
+    
+    /* The server drains with a non-normal code */
+    assert_true(yamux_session_remote_go_away(client, &code) != YAMUX_OK, "No GoAway has arrived yet");
+    assert_true(yamux_session_go_away(server, YAMUX_INTERNAL_ERROR) == YAMUX_OK, "Failed to start draining");
+    assert_int_equal(yamux_stream_open_detailed(server, 0, &extra), YAMUX_ERR_SESSION_SHUTDOWN,
+                     "Server should not open streams after its GoAway");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump GoAway");
+    assert_true(yamux_session_remote_go_away(client, &code) == YAMUX_OK && code == YAMUX_INTERNAL_ERROR,
+                "Client should see the server's code");
+    assert_int_equal(yamux_stream_open_detailed(client, 0, &extra), YAMUX_ERR_REMOTE_GOAWAY,
+                     "Client should not open streams after the peer's GoAway");
+    
+    /* The stream opened before the GoAway still carries data */
+    assert_true(yamux_stream_write(stream, (const uint8_t *)"late", 4, &bytes) == YAMUX_OK && bytes == 4,
+                "Existing stream should still write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump data");
+    assert_true(yamux_stream_read(accepted, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 4 &&
+                memcmp(buf, "late", 4) == 0, "Existing stream should still read");
+    
+    /* The side that received the GoAway keeps servicing the stream until it finishes */
+    assert_true(yamux_stream_write(accepted, (const uint8_t *)"resp", 4, &bytes) == YAMUX_OK && bytes == 4,
+                "Draining side should still write");
+    assert_true(yamux_stream_close(accepted, 0) == YAMUX_OK, "Failed to close stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump reply");
+    assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 4 &&
+                memcmp(buf, "resp", 4) == 0, "Reply should reach the side that received GoAway");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_FIN_RECV, "FIN should reach the client");
+    assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to close stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump FIN");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Wait callback over the in-memory transport with a simulated clock */
+typedef struct {
+    test_transport_t *transport;
+    yamux_session_t *peer;      /* Opens a stream during the first wait if set */
+    uint32_t clock_ms;
+    int waits;
+} accept_wait_t;
+
+static int accept_wait(void *ctx, uint32_t timeout_ms, uint32_t *elapsed_ms) {
+    accept_wait_t *w = (accept_wait_t *)ctx;
+    yamux_stream_t *stream;
+    
+    w->waits++;
+    if (w->peer) {
+        /* The peer's SYN arrives 20 ms into the wait */
+        yamux_stream_open_detailed(w->peer, 0, &stream);
+        w->peer = NULL;
+        *elapsed_ms = 20;
+    } else if (w->transport->a_to_b.count > 0) {
+        *elapsed_ms = 0;
+    } else {
+        *elapsed_ms = timeout_ms;
+    }
+    w->clock_ms += *elapsed_ms;
+    
+    return w->transport->a_to_b.count > 0 ? 1 : 0;
+}
+
+/* Test accepting with a bounded wait */
+void test_accept_stream_timeout(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *opened, *accepted;
+    accept_wait_t wait;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    
+    /* Without a wait callback nothing blocks */
+    assert_int_equal(yamux_accept_stream_timeout(server, 1000, &accepted), YAMUX_ERR_TIMEOUT,
+                     "Accept without a wait callback should not wait");
+    
+    memset(&wait, 0, sizeof(wait));
+    wait.transport = transport;
+    assert_true(yamux_set_wait_callback(server, accept_wait, &wait) == YAMUX_OK, "Failed to set wait callback");
+    
+    /* Idle: times out after the full timeout */
+    assert_int_equal(yamux_accept_stream_timeout(server, 500, &accepted), YAMUX_ERR_TIMEOUT,
+                     "Idle accept should time out");
+    assert_true(wait.clock_ms == 500 && wait.waits == 1, "Idle accept should wait out the timeout once");
+    
+    /* A SYN already buffered is accepted without waiting */
+    wait.clock_ms = 0;
+    assert_true(yamux_stream_open_detailed(client, 0, &opened) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_accept_stream_timeout(server, 500, &accepted) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_get_id(accepted) == yamux_stream_get_id(opened), "Accepted the wrong stream");
+    assert_true(wait.clock_ms == 0, "Buffered SYN should be accepted at once");
+    
+    /* A SYN that arrives mid-wait is accepted as soon as it lands */
+    wait.clock_ms = 0;
+    wait.peer = client;
+    assert_true(yamux_accept_stream_timeout(server, 500, &accepted) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_get_id(accepted) == 3, "Should accept the stream opened during the wait");
+    assert_true(wait.clock_ms == 20, "Accept should return promptly on arrival");
+    
+    /* A stream already queued needs no wait even with a zero timeout */
+    assert_true(yamux_stream_open_detailed(client, 0, &opened) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_session_process(server) == YAMUX_OK, "Failed to process SYN");
+    assert_true(yamux_accept_stream_timeout(server, 0, &accepted) == YAMUX_OK, "Queued stream should be accepted");
+    assert_int_equal(yamux_accept_stream_timeout(server, 0, &accepted), YAMUX_ERR_TIMEOUT,
+                     "Zero timeout should not wait");
+    assert_int_equal(yamux_accept_stream_timeout(NULL, 0, &accepted), YAMUX_ERR_INVALID,
+                     "NULL session should be invalid");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that a full accept queue refuses new streams or withholds their SYN-ACK */
+void test_accept_overflow_policy(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_config_t config = yamux_default_config;
+    yamux_session_t *client, *server;
+    yamux_stream_t *first, *second, *accepted;
+    size_t bytes;
+    int policy;
+    
+    config.accept_backlog = 1;
+    for (policy = YAMUX_ACCEPT_OVERFLOW_RESET; policy <= YAMUX_ACCEPT_OVERFLOW_DEFER_ACK; policy++) {
+        config.accept_overflow_policy = (uint32_t)policy;
+        transport = test_transport_pair(4096, &client_io, &server_io);
+        assert_true(transport != NULL, "Failed to create transport pair");
+        assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+        assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+        
+        /* The second stream arrives while the first still waits for accept */
+        assert_true(yamux_stream_open_detailed(client, 0, &first) == YAMUX_OK, "Failed to open stream");
+        assert_true(yamux_stream_open_detailed(client, 0, &second) == YAMUX_OK, "Failed to open stream");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+        assert_true(yamux_stream_get_state(first) == YAMUX_STREAM_ESTABLISHED, "First stream should be acknowledged");
+        
+        if (policy == YAMUX_ACCEPT_OVERFLOW_RESET) {
+            /* The opener sees a refusal and only the first stream is queued */
+            assert_true(yamux_stream_get_reset_reason(second) == YAMUX_RESET_REFUSED,
+                        "Overflowing stream should be refused");
+            assert_true(yamux_stream_accept(server, &accepted) == YAMUX_OK && yamux_stream_get_id(accepted) == 1,
+                        "Failed to accept first stream");
+            assert_int_equal(yamux_stream_accept(server, &accepted), YAMUX_ERR_TIMEOUT,
+                             "Refused stream should not be queued");
+        } else {
+            /* The opener is left waiting for a SYN-ACK that comes once there is room */
+            assert_true(yamux_stream_get_state(second) == YAMUX_STREAM_SYN_SENT,
+                        "Overflowing stream should wait for its SYN-ACK");
+            assert_true(yamux_stream_get_reset_reason(second) == YAMUX_RESET_NONE, "Deferred stream is not refused");
+            assert_true(yamux_stream_write(second, (const uint8_t *)"early", 5, &bytes) == YAMUX_OK && bytes == 5,
+                        "Opener may still write within its initial window");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+            assert_true(yamux_stream_get_state(second) == YAMUX_STREAM_SYN_SENT, "Data should not release the SYN-ACK");
+            
+            assert_true(yamux_stream_accept(server, &accepted) == YAMUX_OK && yamux_stream_get_id(accepted) == 1,
+                        "Failed to accept first stream");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver SYN-ACK");
+            assert_true(yamux_stream_get_state(second) == YAMUX_STREAM_ESTABLISHED,
+                        "Accepting should release the withheld SYN-ACK");
+            assert_true(yamux_stream_get_send_window(second) == config.max_stream_window_size - 5,
+                        "SYN-ACK should grant what is left of the window");
+            assert_true(yamux_stream_accept(server, &accepted) == YAMUX_OK && yamux_stream_get_id(accepted) == 3,
+                        "Deferred stream should then be accepted");
+        }
+        
+        yamux_session_close(client, YAMUX_NORMAL);
+        yamux_session_close(server, YAMUX_NORMAL);
+        yamux_session_free(client);
+        yamux_session_free(server);
+        test_transport_free(transport);
+    }
+}
+
+/* Test that a peer opening past accept_backlog can end the session with a specific error */
+void test_accept_backlog_exceeded(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_config_t config = yamux_default_config;
+    yamux_session_t *client, *server;
+    yamux_stream_t *first, *second;
+    uint32_t code;
+    
+    config.accept_backlog = 1;
+    config.accept_overflow_policy = YAMUX_ACCEPT_OVERFLOW_CLOSE_SESSION;
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_session_last_error(server) == YAMUX_OK, "A new session has no error");
+    
+    /* The second SYN arrives while the first stream still waits for accept */
+    assert_true(yamux_stream_open_detailed(client, 0, &first) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(client, 0, &second) == YAMUX_OK, "Failed to open stream");
+    assert_int_equal(yamux_session_process(server), YAMUX_OK, "First stream fits the backlog");
+    assert_int_equal(yamux_session_process(server), YAMUX_ERR_ACK_BACKLOG_EXCEEDED,
+                     "Second stream should exceed the backlog");
+    assert_int_equal(yamux_session_process(server), YAMUX_ERR_CLOSED, "Session should be closed");
+    assert_int_equal(yamux_session_last_error(server), YAMUX_ERR_ACK_BACKLOG_EXCEEDED,
+                     "The specific cause should be kept");
+    
+    /* The peer gets the SYN-ACK for the first stream, then a GoAway with a protocol error */
+    assert_int_equal(yamux_session_process(client), YAMUX_OK, "SYN-ACK should be processed");
+    (void)yamux_session_process(client);
+    assert_true(yamux_session_remote_go_away(client, &code) == YAMUX_OK && code == YAMUX_PROTOCOL_ERROR,
+                "Peer should see a protocol-error GoAway");
+    assert_true(yamux_session_last_error(client) == YAMUX_OK, "The peer's own close has no local error");
+    assert_true(yamux_session_last_error(NULL) == YAMUX_ERR_INVALID, "NULL session should be invalid");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Classifies streams 5 and 9 as control streams */
+typedef struct {
+    int calls;
+} classify_log_t;
+
+static int classify_control(void *ctx, yamux_stream_t *stream) {
+    uint32_t id = yamux_stream_get_id(stream);
+    
+    ((classify_log_t *)ctx)->calls++;
+    return (id == 5 || id == 9) ? 10 : 0;
+}
+
+/* Test that high-priority streams are accepted ahead of earlier low-priority ones */
+void test_accept_stream_priority(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    classify_log_t log;
+    uint8_t window[4];
+    uint32_t id;
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    yamux_encode_u32(262144, window);
+    assert_true(yamux_session_create(&io, 0, NULL, &session) == YAMUX_OK, "Failed to create server session");
+    assert_int_equal(yamux_set_accept_classify_callback(NULL, classify_control, &log), YAMUX_ERR_INVALID,
+                     "NULL session should be rejected");
+    assert_int_equal(yamux_accept_stream_priority(NULL, 0, &stream), YAMUX_ERR_INVALID,
+                     "NULL session should be rejected");
+    
+    /* Without a classifier every stream has priority 0, in arrival order */
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 3, window, 4);
+    for (id = 0; id < 2; id++) {
+        assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN");
+    }
+    assert_int_equal(yamux_accept_stream_priority(session, 1, &stream), YAMUX_ERR_TIMEOUT,
+                     "Unclassified streams should be below priority 1");
+    assert_true(yamux_accept_stream_priority(session, 0, &stream) == YAMUX_OK &&
+                yamux_stream_get_id(stream) == 1, "Equal priorities should keep arrival order");
+    
+    /* Control streams 5 and 9 arrive after bulk streams 3 and 7 */
+    memset(&log, 0, sizeof(log));
+    assert_true(yamux_set_accept_classify_callback(session, classify_control, &log) == YAMUX_OK,
+                "Failed to set classify callback");
+    for (id = 5; id <= 9; id += 2) {
+        mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, id, window, 4);
+        assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN");
+    }
+    assert_true(yamux_session_pending_accepts(session) == 4, "Four streams should be waiting");
+    
+    assert_true(yamux_accept_stream_priority(session, 10, &stream) == YAMUX_OK &&
+                yamux_stream_get_id(stream) == 5, "First control stream should be accepted first");
+    assert_true(yamux_accept_stream_priority(session, 10, &stream) == YAMUX_OK &&
+                yamux_stream_get_id(stream) == 9, "Second control stream should be next");
+    assert_int_equal(yamux_accept_stream_priority(session, 10, &stream), YAMUX_ERR_TIMEOUT,
+                     "Bulk streams should not satisfy a control-only accept");
+    
+    /* Stream 3 was looked at before the classifier was set, so it stays at 0 */
+    assert_true(log.calls == 3, "Each stream should be classified once");
+    assert_true(yamux_accept_stream_priority(session, 0, &stream) == YAMUX_OK &&
+                yamux_stream_get_id(stream) == 3, "Bulk streams should follow in arrival order");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK && yamux_stream_get_id(stream) == 7,
+                "Plain accept should take what is left");
+    assert_true(log.calls == 3, "Accepting should not classify again");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
 /* 
  * Note: Helper function for data transfer has been removed as it's no longer used.
  * This functionality is now handled by the new portable API in yamux_port.c
@@ -225,6 +1651,8 @@ void test_stream_data_transfer(void) {
     
     result = yamux_session_close(server_session, YAMUX_NORMAL);
     assert_true(result == YAMUX_OK, "Failed to close server session");
+    yamux_session_free(client_session);
+    yamux_session_free(server_session);
     
     /* Free mock IO resources */
     stream_io_mock_destroy(client_mock);
@@ -233,4 +1661,111 @@ void test_stream_data_transfer(void) {
     printf("Stream data transfer tests passed!\n");
 }
 
+/* Write callback for a session that is being abandoned, e.g. by an exiting process */
+static int discard_write(void *ctx, const uint8_t *buf, size_t len) {
+    (void)ctx;
+    (void)buf;
+    return (int)len;
+}
+
+/* Count the streams a session tracks */
+static int count_streams(void *ctx, yamux_stream_t *stream) {
+    (void)stream;
+    (*(int *)ctx)++;
+    return 0;
+}
+
+/* Test that a server restored from a snapshot carries on with the same peer */
+void test_session_snapshot_restore(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server, *restored;
+    yamux_stream_t *client_streams[3], *server_streams[2], *stream, *extra;
+    yamux_stream_state_t state;
+    uint8_t snapshot[256];
+    uint8_t buf[32];
+    size_t written, needed, bytes;
+    int i, count = 0;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    for (i = 0; i < 3; i++) {
+        assert_true(yamux_stream_open_detailed(client, 0, &client_streams[i]) == YAMUX_OK, "Failed to open stream");
+    }
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    for (i = 0; i < 2; i++) {
+        assert_true(yamux_stream_accept(server, &server_streams[i]) == YAMUX_OK, "Failed to accept stream");
+    }
+    
+    /* Unread data blocks the snapshot until it is drained */
+    assert_true(yamux_stream_write(client_streams[0], (const uint8_t *)"before", 6, &bytes) == YAMUX_OK,
+                "Failed to write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    assert_int_equal(yamux_session_snapshot(server, snapshot, sizeof(snapshot), &written), YAMUX_ERR_WOULD_BLOCK,
+                     "Snapshot with unread data should be refused");
+    assert_true(yamux_stream_read(server_streams[0], buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 6,
+                "Failed to read");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to pump");
+    
+    assert_int_equal(yamux_session_snapshot(server, NULL, 0, &needed), YAMUX_ERR_NOMEM, "Size query should report NOMEM");
+    assert_true(needed > 0 && needed <= sizeof(snapshot), "Size query should report the snapshot size");
+    assert_true(yamux_session_snapshot(server, snapshot, sizeof(snapshot), &written) == YAMUX_OK, "Failed to snapshot");
+    assert_true(written == needed, "Snapshot should be the reported size");
+    
+    /* Malformed snapshots are refused */
+    assert_int_equal(yamux_session_restore(&server_io, NULL, snapshot, written - 1, &restored), YAMUX_ERR_INVALID,
+                     "Truncated snapshot should be rejected");
+    snapshot[0] ^= 0xFF;
+    assert_int_equal(yamux_session_restore(&server_io, NULL, snapshot, written, &restored), YAMUX_ERR_INVALID,
+                     "Bad magic should be rejected");
+    snapshot[0] ^= 0xFF;
+    assert_true(transport->b_to_a.count == 0, "A failed restore must not write to the transport");
+    
+    /* The old process goes away without a word; the new one restores */
+    state = yamux_stream_get_state(server_streams[0]);
+    server->io.write = discard_write;
+    yamux_session_free(server);
+    assert_true(yamux_session_restore(&server_io, NULL, snapshot, written, &restored) == YAMUX_OK, "Failed to restore");
+    assert_true(transport->b_to_a.count == 0, "Restore must not write to the transport");
+    assert_true(yamux_session_is_client(restored) == 0, "Role should be restored");
+    assert_true(yamux_session_foreach_stream(restored, count_streams, &count) == 0 && count == 3,
+                "All streams should be restored");
+    assert_true(yamux_session_pending_accepts(restored) == 1, "The unaccepted stream should be queued again");
+    assert_true(yamux_stream_accept(restored, &stream) == YAMUX_OK &&
+                yamux_stream_get_id(stream) == yamux_stream_get_id(client_streams[2]),
+                "Queued stream should be accepted after restore");
+    
+    /* Existing streams carry on in both directions */
+    stream = yamux_get_stream(restored, yamux_stream_get_id(client_streams[0]));
+    assert_true(stream != NULL && yamux_stream_get_state(stream) == state,
+                "Stream should be restored in its old state");
+    assert_true(yamux_stream_write(client_streams[0], (const uint8_t *)"after", 5, &bytes) == YAMUX_OK,
+                "Failed to write after restore");
+    assert_true(test_transport_pump(transport, client, restored) == YAMUX_OK, "Failed to deliver after restore");
+    assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 5 &&
+                memcmp(buf, "after", 5) == 0, "Data should arrive after restore");
+    assert_true(yamux_stream_write(stream, (const uint8_t *)"reply", 5, &bytes) == YAMUX_OK,
+                "Restored stream should write");
+    assert_true(test_transport_pump(transport, client, restored) == YAMUX_OK, "Failed to deliver reply");
+    assert_true(yamux_stream_read(client_streams[0], buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 5 &&
+                memcmp(buf, "reply", 5) == 0, "Reply should arrive at the client");
+    
+    /* New streams from either side use fresh IDs */
+    assert_true(yamux_stream_open_detailed(client, 0, &extra) == YAMUX_OK, "Client failed to open");
+    assert_true(test_transport_pump(transport, client, restored) == YAMUX_OK, "Failed to exchange SYN");
+    assert_true(yamux_stream_accept(restored, &stream) == YAMUX_OK &&
+                yamux_stream_get_id(stream) == yamux_stream_get_id(extra), "Restored server should accept");
+    assert_true(yamux_stream_open_detailed(restored, 0, &stream) == YAMUX_OK &&
+                yamux_stream_get_id(stream) == 2, "Restored server should open its first stream");
+    assert_true(test_transport_pump(transport, client, restored) == YAMUX_OK, "Failed to exchange SYN");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(restored, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(restored);
+    test_transport_free(transport);
+}
+
 /* Test runner moved to test_main.c */
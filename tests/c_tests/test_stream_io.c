@@ -234,7 +234,7 @@ void test_stream_io(void) {
     printf("DEBUG: Client calling yamux_process() to handle server's SYN-ACK...\n"); fflush(stdout);
     // IMPORTANT: Pass client_ctx (the handle), not client_ctx->session
     result = yamux_process(client_ctx); // Ensure this is client_ctx
-    printf("DEBUG: yamux_process on client (for SYN-ACK) returned %d. Client stream state: %d\n", result, client_stream ? client_stream->state : -1); fflush(stdout);
+    printf("DEBUG: yamux_process on client (for SYN-ACK) returned %d. Client stream state: %d\n", result, client_stream ? (int)client_stream->state : -1); fflush(stdout);
     if (result < 0 && result != YAMUX_ERR_WOULD_BLOCK) { 
         printf("ERROR: Client failed to process server's SYN-ACK, result=%d\n", result);
         goto cleanup;
@@ -257,7 +257,7 @@ void test_stream_io(void) {
     printf("DEBUG: (J) After declaring read_buffer\n"); fflush(stdout);
 
     printf("DEBUG: Client writing data: '%s' (%zu bytes). Client stream state: %d, send_window: %u\n", 
-           test_data_client, test_data_client_len, client_stream ? client_stream->state : -1, client_stream ? client_stream->send_window : 0); 
+           test_data_client, test_data_client_len, client_stream ? (int)client_stream->state : -1, client_stream ? client_stream->send_window : 0); 
     fflush(stdout);
 
     // Use size_t for bytes_written for yamux_stream_write's out parameter
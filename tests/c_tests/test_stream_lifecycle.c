@@ -3,10 +3,16 @@
 #include <string.h>
 #include <stdlib.h>
 #include <assert.h>
+#include <pthread.h>
+#include <unistd.h>
+#include <poll.h>
+#include <time.h>
 #include "mock_io.h"
+#include "test_transport.h"
 
 /* External assert function declaration */
 void assert_true(int condition, const char *message);
+void assert_int_equal(int a, int b, const char *message);
 
 /* Stream state strings for debugging */
 static MAYBE_UNUSED const char *stream_state_str(yamux_stream_state_t state) {
@@ -109,8 +115,7 @@ void test_stream_lifecycle(void) {
     window_header.stream_id = client_stream->id;
     window_header.length = 4;
     yamux_encode_header(&window_header, window_frame);
-    uint32_t window_size = htonl(262144); /* Set an appropriate window size */
-    memcpy(window_frame + YAMUX_HEADER_SIZE, &window_size, 4);
+    yamux_encode_u32(262144, window_frame + YAMUX_HEADER_SIZE); /* Set an appropriate window size */
     client_mock->write_buf_used = 0; /* Clear any existing data */
     memcpy(client_mock->write_buf, window_frame, sizeof(window_frame));
     client_mock->write_buf_used = sizeof(window_frame);
@@ -172,11 +177,8 @@ void test_stream_lifecycle(void) {
     assert_true(state == YAMUX_STREAM_ESTABLISHED, 
                 "Server stream should remain in ESTABLISHED state after read");
     
-    /* Exchange data server -> client */
-    mock_io_swap_buffers(server_mock, client_mock);
-    
-    result = yamux_session_process(client_session);
-    assert_true(result == YAMUX_OK, "Failed to process client session");
+    /* A small read frees too little credit to be worth a window update */
+    assert_true(server_mock->write_buf_used == 0, "Small read should not send a window update");
     
     /* TEST 5: FIN_SENT (client closes stream) */
     result = yamux_stream_close(client_stream, 0);
@@ -202,13 +204,11 @@ void test_stream_lifecycle(void) {
     assert_true(result == YAMUX_OK && bytes_read == 0, 
                 "Read after FIN should return EOF (0 bytes)");
     
-    /* TEST 7: Server closes its side */
+    /* TEST 7: Server closes its side, which finishes and frees the stream */
     result = yamux_stream_close(server_stream, 0);
     assert_true(result == YAMUX_OK, "Failed to close server stream");
-    
-    state = yamux_stream_get_state(server_stream);
-    assert_true(state == YAMUX_STREAM_CLOSED, 
-                "Server stream should be in CLOSED state");
+    assert_true(yamux_get_stream(server_session, 1) == NULL,
+                "Server stream should leave the session once both sides closed");
     
     /* Exchange data server -> client */
     mock_io_swap_buffers(server_mock, client_mock);
@@ -221,14 +221,1327 @@ void test_stream_lifecycle(void) {
     assert_true(state == YAMUX_STREAM_CLOSED, 
                 "Client stream should be in CLOSED state");
     
+    /* The opener closed first, so it still holds the stream until it closes it again */
+    assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to release client stream");
+    assert_true(yamux_get_stream(client_session, 1) == NULL, "Released stream should leave the session");
+    
     /* TEST 9: Clean up */
     result = yamux_session_close(client_session, 0);
     assert_true(result == YAMUX_OK, "Failed to close client session");
     
     result = yamux_session_close(server_session, 0);
     assert_true(result == YAMUX_OK, "Failed to close server session");
+    yamux_session_free(client_session);
+    yamux_session_free(server_session);
     
     /* Free resources */
     mock_io_free(client_mock);
     mock_io_free(server_mock);
 }
+
+/* Peer FIN callback bookkeeping */
+typedef struct {
+    int calls;
+    yamux_stream_t *stream;
+    size_t buffered_at_fin;
+} peer_fin_record_t;
+
+static void record_peer_fin(void *ctx, yamux_stream_t *stream) {
+    peer_fin_record_t *rec = (peer_fin_record_t *)ctx;
+    
+    rec->calls++;
+    rec->stream = stream;
+    rec->buffered_at_fin = stream->recvbuf.used - stream->recvbuf.pos;
+}
+
+/* Test peer half-close callback timing */
+void test_stream_peer_fin_callback(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_config_t config;
+    yamux_result_t result;
+    peer_fin_record_t rec;
+    uint8_t window[4];
+    uint8_t body[] = "request body";
+    uint8_t read_buf[64];
+    size_t bytes_read;
+    size_t bytes_written;
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    
+    memset(&config, 0, sizeof(config));
+    config.accept_backlog = 128;
+    config.max_stream_window_size = 262144;
+    
+    result = yamux_session_create(&io, 0, &config, &session);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    
+    memset(&rec, 0, sizeof(rec));
+    result = yamux_set_stream_peer_fin_callback(session, record_peer_fin, &rec);
+    assert_true(result == YAMUX_OK, "Failed to set peer FIN callback");
+    assert_true(yamux_set_stream_peer_fin_callback(NULL, record_peer_fin, &rec) == YAMUX_ERR_INVALID,
+                "NULL session should be rejected");
+    
+    /* Peer opens stream 1 and acknowledges our SYN-ACK */
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_ACK, 1, NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process ACK");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_ESTABLISHED,
+                "Stream should be ESTABLISHED");
+    assert_true(rec.calls == 0, "Callback must not fire before FIN");
+    
+    /* Peer sends its last data together with FIN */
+    mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_FIN, 1, body, sizeof(body));
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process DATA|FIN");
+    assert_true(rec.calls == 1, "Callback should fire once on peer FIN");
+    assert_true(rec.stream == stream, "Callback received wrong stream");
+    assert_true(rec.buffered_at_fin == sizeof(body),
+                "All peer data should be buffered when callback fires");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_FIN_RECV,
+                "Stream should be FIN_RECV after peer FIN");
+    
+    /* Data is still readable and our write side is still open */
+    result = yamux_stream_read(stream, read_buf, sizeof(read_buf), &bytes_read);
+    assert_true(result == YAMUX_OK && bytes_read == sizeof(body), "Failed to read peer data");
+    assert_true(memcmp(read_buf, body, sizeof(body)) == 0, "Peer data mismatch");
+    result = yamux_stream_write(stream, body, sizeof(body), &bytes_written);
+    assert_true(result == YAMUX_OK, "Write side should remain open after peer FIN");
+    
+    /* A repeated FIN must not fire the callback again */
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_FIN, 1, NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process repeated FIN");
+    assert_true(rec.calls == 1, "Callback should fire exactly once per stream");
+    
+    /* If we closed first, the peer's FIN completes the close and is not a half-close */
+    memset(&rec, 0, sizeof(rec));
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 3, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_ACK, 3, NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process second SYN");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept second stream");
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process second ACK");
+    assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to close second stream");
+    mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_FIN, 3, NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process FIN on closed stream");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_CLOSED,
+                "Stream should be CLOSED after both sides sent FIN");
+    assert_true(rec.calls == 0, "Callback must not fire when our side closed first");
+    
+    yamux_session_close(session, 0);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Wait callback that really blocks, on a self-pipe the wake callback writes to */
+typedef struct {
+    int pipe_fds[2];
+    pthread_mutex_t lock;
+    pthread_cond_t cond;
+    int waiting;                   /* The reader is blocked in poll() */
+} interrupt_wait_t;
+
+static void interrupt_wake(void *ctx) {
+    interrupt_wait_t *w = (interrupt_wait_t *)ctx;
+    uint8_t byte = 1;
+    ssize_t written;
+    
+    written = write(w->pipe_fds[1], &byte, 1);
+    (void)written;
+}
+
+static uint32_t interrupt_now_ms(void) {
+    struct timespec ts;
+    
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (uint32_t)(ts.tv_sec * 1000 + ts.tv_nsec / 1000000);
+}
+
+static int interrupt_wait(void *ctx, uint32_t timeout_ms, uint32_t *elapsed_ms) {
+    interrupt_wait_t *w = (interrupt_wait_t *)ctx;
+    struct pollfd pfd;
+    uint32_t start = interrupt_now_ms();
+    uint8_t byte;
+    ssize_t drained;
+    int ready;
+    
+    pthread_mutex_lock(&w->lock);
+    w->waiting = 1;
+    pthread_cond_signal(&w->cond);
+    pthread_mutex_unlock(&w->lock);
+    
+    pfd.fd = w->pipe_fds[0];
+    pfd.events = POLLIN;
+    pfd.revents = 0;
+    ready = poll(&pfd, 1, (int)timeout_ms);
+    if (ready > 0) {
+        drained = read(w->pipe_fds[0], &byte, 1);
+        (void)drained;
+    }
+    *elapsed_ms = interrupt_now_ms() - start;
+    
+    /* Only a wake ends this wait; the transport never has input */
+    return ready < 0 ? -1 : 0;
+}
+
+/* Reader thread state for the interrupt test */
+typedef struct {
+    yamux_stream_t *stream;
+    yamux_result_t result;
+    uint32_t waited_ms;
+} interrupt_reader_t;
+
+/* Block in yamux_stream_read until data, timeout or interrupt */
+static void *interrupt_reader_thread(void *arg) {
+    interrupt_reader_t *reader = (interrupt_reader_t *)arg;
+    uint8_t buf[16];
+    size_t bytes_read;
+    uint32_t start = interrupt_now_ms();
+    
+    reader->result = yamux_stream_read(reader->stream, buf, sizeof(buf), &bytes_read);
+    reader->waited_ms = interrupt_now_ms() - start;
+    return NULL;
+}
+
+/* Test interrupting a pending read from another thread */
+void test_stream_interrupt(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    yamux_config_t config;
+    yamux_result_t result;
+    interrupt_reader_t reader;
+    interrupt_wait_t wait;
+    pthread_t thread;
+    uint8_t window[4];
+    uint8_t body[] = "after";
+    uint8_t read_buf[16];
+    size_t bytes_read;
+    size_t bytes_written;
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    
+    memset(&config, 0, sizeof(config));
+    config.accept_backlog = 128;
+    config.max_stream_window_size = 262144;
+    
+    result = yamux_session_create(&io, 0, &config, &session);
+    assert_true(result == YAMUX_OK, "Failed to create server session");
+    
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_ACK, 1, NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN");
+    assert_true(yamux_stream_accept(session, &stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process ACK");
+    
+    assert_true(yamux_stream_interrupt(NULL) == YAMUX_ERR_INVALID, "NULL stream should be rejected");
+    
+    /* A reader blocked in the wait callback returns promptly once interrupted */
+    memset(&wait, 0, sizeof(wait));
+    assert_true(pipe(wait.pipe_fds) == 0, "Failed to create wake pipe");
+    pthread_mutex_init(&wait.lock, NULL);
+    pthread_cond_init(&wait.cond, NULL);
+    assert_true(yamux_set_wait_callback(session, interrupt_wait, &wait) == YAMUX_OK, "Failed to set wait callback");
+    assert_true(yamux_set_wake_callback(session, interrupt_wake, &wait) == YAMUX_OK, "Failed to set wake callback");
+    assert_true(yamux_stream_set_read_timeout(stream, 10000) == YAMUX_OK, "Failed to set read timeout");
+    
+    memset(&reader, 0, sizeof(reader));
+    reader.stream = stream;
+    assert_true(pthread_create(&thread, NULL, interrupt_reader_thread, &reader) == 0,
+                "Failed to start reader thread");
+    pthread_mutex_lock(&wait.lock);
+    while (!wait.waiting) {
+        pthread_cond_wait(&wait.cond, &wait.lock);
+    }
+    pthread_mutex_unlock(&wait.lock);
+    
+    assert_true(yamux_stream_interrupt(stream) == YAMUX_OK, "Failed to interrupt stream");
+    pthread_join(thread, NULL);
+    assert_true(reader.result == YAMUX_ERR_INTERRUPTED, "Reader should see YAMUX_ERR_INTERRUPTED");
+    assert_true(reader.waited_ms < 5000, "Interrupt should end the wait well before the timeout");
+    
+    assert_true(yamux_set_wait_callback(session, NULL, NULL) == YAMUX_OK, "Failed to clear wait callback");
+    assert_true(yamux_set_wake_callback(session, NULL, NULL) == YAMUX_OK, "Failed to clear wake callback");
+    assert_true(yamux_stream_set_read_timeout(stream, 0) == YAMUX_OK, "Failed to clear read timeout");
+    
+    /* The write side was interrupted too; each side fires once */
+    result = yamux_stream_write(stream, body, sizeof(body), &bytes_written);
+    assert_true(result == YAMUX_ERR_INTERRUPTED, "Next write should be interrupted");
+    result = yamux_stream_write(stream, body, sizeof(body), &bytes_written);
+    assert_true(result == YAMUX_OK, "Interrupt should not persist after one write");
+    
+    /* The stream keeps working afterwards */
+    mock_io_inject_frame(mock, YAMUX_DATA, 0, 1, body, sizeof(body));
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process DATA");
+    result = yamux_stream_read(stream, read_buf, sizeof(read_buf), &bytes_read);
+    assert_true(result == YAMUX_OK && bytes_read == sizeof(body), "Read should resume after interrupt");
+    
+    yamux_stream_close(stream, 0);
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+    pthread_cond_destroy(&wait.cond);
+    pthread_mutex_destroy(&wait.lock);
+    close(wait.pipe_fds[0]);
+    close(wait.pipe_fds[1]);
+}
+
+/* Find a frame with the given flags among those written to a mock transport */
+static int wrote_frame(const mock_io_t *mock, uint32_t stream_id, uint16_t flags) {
+    yamux_header_t header;
+    size_t pos = 0;
+    
+    while (pos + YAMUX_HEADER_SIZE <= mock->write_buf_used &&
+           yamux_decode_header(mock->write_buf + pos, YAMUX_HEADER_SIZE, &header) == YAMUX_OK) {
+        if (header.stream_id == stream_id && header.flags == flags) {
+            return 1;
+        }
+        pos += YAMUX_HEADER_SIZE + (header.type == YAMUX_GO_AWAY ? 4 : header.length);
+    }
+    
+    return 0;
+}
+
+/* Test that a stream the peer opens and closes at once is accepted and reads EOF */
+void test_stream_syn_then_fin(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    uint8_t buf[16];
+    size_t bytes;
+    int combined;
+    
+    yamux_encode_u32(262144, window);
+    for (combined = 0; combined <= 1; combined++) {
+        mock = mock_io_init(4096);
+        io.read = mock_read;
+        io.write = mock_write;
+        io.ctx = mock;
+        assert_true(yamux_session_create(&io, 0, NULL, &session) == YAMUX_OK, "Failed to create server session");
+        
+        /* SYN then an empty FIN, or both flags on one frame */
+        if (combined) {
+            mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_FIN, 1, window, 4);
+        } else {
+            mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+            mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_FIN, 1, NULL, 0);
+        }
+        while (mock->read_pos < mock->read_buf_used) {
+            assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN and FIN");
+        }
+        assert_true(wrote_frame(mock, 1, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK), "Stream should be acknowledged");
+        
+        /* Accepting works as for any stream, and the first read is EOF */
+        assert_int_equal(yamux_stream_accept(session, &stream), YAMUX_OK, "Half-closed stream should be accepted");
+        assert_true(yamux_stream_get_id(stream) == 1, "Accepted stream should be the one opened");
+        assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_FIN_RECV, "Stream should be half-closed");
+        assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 0,
+                    "First read should be EOF");
+        
+        /* Our side can still answer, then close */
+        mock->write_buf_used = 0;
+        assert_true(yamux_stream_write(stream, (const uint8_t *)"ok", 2, &bytes) == YAMUX_OK && bytes == 2,
+                    "Write on a half-closed stream should succeed");
+        assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to close stream");
+        assert_true(wrote_frame(mock, 1, YAMUX_FLAG_FIN), "Close should send our FIN");
+        assert_true(yamux_get_stream(session, 1) == NULL, "Closed stream should leave the session");
+        
+        yamux_session_close(session, YAMUX_NORMAL);
+        yamux_session_free(session);
+        mock_io_free(mock);
+    }
+}
+
+/* Test that a FIN arriving after its stream was reaped is dropped quietly */
+void test_stream_late_fin(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_config_t config;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    int strict;
+    
+    yamux_encode_u32(262144, window);
+    for (strict = 0; strict <= 1; strict++) {
+        mock = mock_io_init(4096);
+        io.read = mock_read;
+        io.write = mock_write;
+        io.ctx = mock;
+        config = yamux_default_config;
+        config.on_unknown_fin = strict ? YAMUX_UNKNOWN_FIN_CLOSE_SESSION : YAMUX_UNKNOWN_FIN_IGNORE;
+        assert_true(yamux_session_create(&io, 0, &config, &session) == YAMUX_OK, "Failed to create server session");
+        
+        /* The peer opens and half-closes stream 1, and we close and reap it */
+        mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_FIN, 1, window, 4);
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN|FIN");
+        assert_int_equal(yamux_stream_accept(session, &stream), YAMUX_OK, "Failed to accept stream");
+        assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to close stream");
+        assert_true(yamux_get_stream(session, 1) == NULL, "Closed stream should be reaped");
+        mock->write_buf_used = 0;
+        
+        /* A duplicate FIN, then one on a DATA frame with a payload */
+        mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_FIN, 1, NULL, 0);
+        mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_FIN, 1, (const uint8_t *)"late", 4);
+        if (strict) {
+            assert_int_equal(yamux_session_process(session), YAMUX_ERR_PROTOCOL,
+                             "Strict policy should fail the session");
+            assert_true(session->shutdown, "Strict policy should close the session");
+        } else {
+            assert_int_equal(yamux_session_process(session), YAMUX_OK, "Late FIN should be ignored");
+            assert_int_equal(yamux_session_process(session), YAMUX_OK, "Late DATA|FIN should be ignored");
+            assert_true(mock->write_buf_used == 0, "Late FINs should draw no RST or FIN-ACK");
+            assert_true(yamux_get_stream(session, 1) == NULL, "Late FIN should not revive the stream");
+            
+            /* Framing held: the next stream opens normally */
+            mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 3, window, 4);
+            assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN after late FIN");
+            assert_int_equal(yamux_stream_accept(session, &stream), YAMUX_OK, "Failed to accept next stream");
+            assert_true(yamux_stream_get_id(stream) == 3, "Next stream should be the one opened");
+            assert_true(!session->shutdown, "Session should stay open");
+        }
+        
+        yamux_session_close(session, YAMUX_NORMAL);
+        yamux_session_free(session);
+        mock_io_free(mock);
+    }
+}
+
+/* Check whether a transport direction holds a frame with the RST flag */
+static int ring_has_rst(const test_ring_t *ring) {
+    uint8_t raw[YAMUX_HEADER_SIZE];
+    yamux_header_t header;
+    size_t pos = 0;
+    size_t i;
+    
+    while (pos + YAMUX_HEADER_SIZE <= ring->count) {
+        for (i = 0; i < YAMUX_HEADER_SIZE; i++) {
+            raw[i] = ring->data[(ring->head + pos + i) % ring->capacity];
+        }
+        if (yamux_decode_header(raw, YAMUX_HEADER_SIZE, &header) != YAMUX_OK) {
+            return 0;
+        }
+        if (header.flags & YAMUX_FLAG_RST) {
+            return 1;
+        }
+        pos += YAMUX_HEADER_SIZE + (header.type == YAMUX_DATA ? header.length : 0);
+    }
+    
+    return 0;
+}
+
+/* Test that both sides closing at once ends cleanly with no RST */
+void test_stream_simultaneous_close(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    uint8_t buf[16];
+    size_t bytes;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* Each side writes a last message and closes before seeing the other's FIN */
+    assert_true(yamux_stream_write(client_stream, (const uint8_t *)"bye", 3, &bytes) == YAMUX_OK && bytes == 3,
+                "Failed to write from client");
+    assert_true(yamux_stream_write(server_stream, (const uint8_t *)"later", 5, &bytes) == YAMUX_OK && bytes == 5,
+                "Failed to write from server");
+    assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to close client stream");
+    assert_true(yamux_stream_close(server_stream, 0) == YAMUX_OK, "Failed to close server stream");
+    assert_true(yamux_stream_get_state(client_stream) == YAMUX_STREAM_FIN_SENT, "Client should wait for the peer");
+    assert_true(yamux_stream_get_state(server_stream) == YAMUX_STREAM_FIN_SENT, "Server should wait for the peer");
+    
+    /* The FINs cross: both end CLOSED and neither side answers with an RST */
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FINs");
+    assert_true(yamux_stream_get_state(client_stream) == YAMUX_STREAM_CLOSED, "Client stream should be closed");
+    assert_true(yamux_stream_get_state(server_stream) == YAMUX_STREAM_CLOSED, "Server stream should be closed");
+    assert_true(yamux_stream_get_reset_reason(client_stream) == YAMUX_RESET_NONE, "Client should see no reset");
+    assert_true(yamux_stream_get_reset_reason(server_stream) == YAMUX_RESET_NONE, "Server should see no reset");
+    assert_true(!ring_has_rst(&transport->a_to_b) && !ring_has_rst(&transport->b_to_a),
+                "Neither side should send an RST");
+    assert_true(transport->a_to_b.count == 0 && transport->b_to_a.count == 0, "Both sides should be quiet");
+    
+    /* The peer's last message is still readable, then the stream reports closed */
+    assert_true(yamux_stream_read(client_stream, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == 5 && memcmp(buf, "later", 5) == 0, "Client should read the server's last message");
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == 3 && memcmp(buf, "bye", 3) == 0, "Server should read the client's last message");
+    assert_int_equal(yamux_stream_read(client_stream, buf, sizeof(buf), &bytes), YAMUX_ERR_CLOSED,
+                     "Drained closed stream should report closed");
+    assert_true(transport->a_to_b.count == 0 && transport->b_to_a.count == 0,
+                "Reading a closed stream should not grant window");
+    
+    /* Closing again is harmless */
+    assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Second close should succeed");
+    assert_true(yamux_stream_close(server_stream, 0) == YAMUX_OK, "Second close should succeed");
+    assert_true(transport->a_to_b.count == 0 && transport->b_to_a.count == 0, "Second close should send nothing");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    assert_true(!ring_has_rst(&transport->a_to_b) && !ring_has_rst(&transport->b_to_a),
+                "Session close should not reset closed streams");
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Test that a FIN on a WINDOW_UPDATE, as Go peers send it, closes like one on DATA */
+void test_stream_window_fin_close(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    uint8_t buf[16];
+    size_t bytes;
+    
+    yamux_encode_u32(262144, window);
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    assert_true(yamux_session_create(&io, 0, NULL, &session) == YAMUX_OK, "Failed to create server session");
+    
+    /* Our FIN crosses the peer's: the stream ends CLOSED and nothing is sent back */
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 1, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN");
+    assert_int_equal(yamux_stream_accept(session, &stream), YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to close stream");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_FIN_SENT, "Stream should wait for the peer");
+    mock->write_buf_used = 0;
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_FIN, 1, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process crossing FIN");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_CLOSED, "Crossing FIN should complete the close");
+    assert_true(mock->write_buf_used == 0, "Crossing FIN should draw no FIN-ACK or RST");
+    assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to release stream");
+    assert_true(yamux_get_stream(session, 1) == NULL, "Released stream should leave the session");
+    
+    /* The peer closes first: our side is half-closed, still unanswered */
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 3, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN");
+    assert_int_equal(yamux_stream_accept(session, &stream), YAMUX_OK, "Failed to accept stream");
+    mock->write_buf_used = 0;
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_FIN, 3, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process FIN");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_FIN_RECV, "Peer FIN should half-close the stream");
+    assert_true(mock->write_buf_used == 0, "Peer FIN should draw no FIN-ACK");
+    assert_true(yamux_stream_read(stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 0, "Read should be EOF");
+    
+    /* A repeated FIN leaves the half-closed stream as it is */
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_FIN, 3, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process repeated FIN");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_FIN_RECV, "Repeated FIN should change nothing");
+    assert_true(mock->write_buf_used == 0, "Repeated FIN should draw nothing");
+    assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to close stream");
+    assert_true(yamux_get_stream(session, 3) == NULL, "Closed stream should leave the session");
+    
+    /* A FIN after a reset keeps the stream closed with its reason */
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 5, window, 4);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process SYN");
+    assert_int_equal(yamux_stream_accept(session, &stream), YAMUX_OK, "Failed to accept stream");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_RST, 5, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process RST");
+    mock->write_buf_used = 0;
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_FIN, 5, NULL, 0);
+    assert_int_equal(yamux_session_process(session), YAMUX_OK, "Failed to process FIN after RST");
+    assert_true(yamux_stream_get_state(stream) == YAMUX_STREAM_CLOSED, "Reset stream should stay closed");
+    assert_true(yamux_stream_get_reset_reason(stream) == YAMUX_RESET_PEER, "Reset reason should be kept");
+    assert_true(mock->write_buf_used == 0, "FIN after a reset should draw nothing");
+    assert_true(yamux_stream_close(stream, 0) == YAMUX_OK, "Failed to release reset stream");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that a strict server resets a stream opened with data on its SYN */
+void test_stream_reject_data_on_syn(void) {
+    yamux_session_t *session;
+    yamux_stream_t *stream;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    const uint8_t body[] = "hello";
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    config.reject_data_on_syn = 1;
+    assert_true(yamux_session_create(&io, 0, &config, &session) == YAMUX_OK, "Failed to create server session");
+    
+    /* A stream opened with data, then one opened the usual way */
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_SYN, 1, body, sizeof(body));
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN, 3, window, 4);
+    while (mock->read_pos < mock->read_buf_used) {
+        assert_int_equal(yamux_session_process(session), YAMUX_OK, "Refusing data on SYN should not fail the session");
+    }
+    
+    /* The first is reset with its payload skipped, the second accepted */
+    assert_true(wrote_frame(mock, 1, YAMUX_FLAG_RST), "Stream opened with data should be reset");
+    assert_true(yamux_get_stream(session, 1) == NULL, "Refused stream should not be tracked");
+    assert_true(wrote_frame(mock, 3, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK), "Later stream should be acknowledged");
+    assert_int_equal(yamux_stream_accept(session, &stream), YAMUX_OK, "Later stream should be accepted");
+    assert_true(yamux_stream_get_id(stream) == 3, "Only the later stream should be queued");
+    assert_int_equal(yamux_stream_accept(session, &stream), YAMUX_ERR_TIMEOUT, "Refused stream should not be queued");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Test that a peer RST is reported as a reset with its reason */
+void test_stream_reset_by_peer(void) {
+    yamux_session_t *session;
+    yamux_stream_t *refused, *established;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    uint8_t data[] = "data";
+    uint8_t buf[16];
+    size_t bytes;
+    void *ctx, *handle;
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    yamux_encode_u32(262144, window);
+    assert_true(yamux_session_create(&io, 1, NULL, &session) == YAMUX_OK, "Failed to create client session");
+    
+    /* The peer refuses our SYN */
+    assert_true(yamux_stream_open_detailed(session, 0, &refused) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_get_reset_reason(refused) == YAMUX_RESET_NONE, "New stream should not be reset");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_RST, yamux_stream_get_id(refused), NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process RST");
+    assert_true(yamux_stream_get_state(refused) == YAMUX_STREAM_CLOSED, "Refused stream should be closed");
+    assert_true(yamux_stream_get_reset_reason(refused) == YAMUX_RESET_REFUSED, "Reason should be REFUSED");
+    assert_true(yamux_stream_write(refused, data, sizeof(data), &bytes) == YAMUX_ERR_RESET,
+                "Write on a refused stream should report RESET");
+    assert_true(yamux_stream_read(refused, buf, sizeof(buf), &bytes) == YAMUX_ERR_RESET,
+                "Read on a refused stream should report RESET");
+    
+    /* The peer resets an established stream with a DATA frame */
+    assert_true(yamux_stream_open_detailed(session, 0, &established) == YAMUX_OK, "Failed to open stream");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK,
+                         yamux_stream_get_id(established), window, 4);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN-ACK");
+    mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_RST, yamux_stream_get_id(established), NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process RST");
+    assert_true(yamux_stream_get_reset_reason(established) == YAMUX_RESET_PEER, "Reason should be PEER");
+    assert_true(yamux_stream_write(established, data, sizeof(data), &bytes) == YAMUX_ERR_RESET,
+                "Write on a reset stream should report RESET");
+    
+    /* Closing a reset stream releases it */
+    assert_true(yamux_stream_close(refused, 0) == YAMUX_OK, "Failed to close refused stream");
+    assert_true(yamux_get_stream(session, 1) == NULL, "Closed reset stream should leave the session");
+    assert_true(yamux_get_stream(session, 3) != NULL, "Unclosed reset stream should stay until closed");
+    
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+    
+    /* The handle API reports the reset from yamux_write */
+    mock = mock_io_init(4096);
+    ctx = yamux_init(mock_read, mock_write, mock, 1);
+    assert_true(ctx != NULL, "Failed to init session");
+    handle = yamux_open_stream(ctx);
+    assert_true(handle != NULL, "Failed to open stream handle");
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_RST, yamux_get_stream_id(handle), NULL, 0);
+    assert_true(yamux_process(ctx) == YAMUX_OK, "Failed to process RST");
+    assert_true(yamux_write(handle, data, sizeof(data)) == YAMUX_ERR_RESET,
+                "yamux_write on a refused stream should report RESET");
+    yamux_close_stream(handle, 0);
+    yamux_destroy(ctx);
+    mock_io_free(mock);
+}
+
+/* Test that writes after a peer reset fail at once and nothing is sent */
+void test_write_after_peer_reset(void) {
+    yamux_session_t *session;
+    yamux_stream_t *held, *starved;
+    yamux_config_t config = yamux_default_config;
+    yamux_io_t io;
+    mock_io_t *mock;
+    uint8_t window[4];
+    uint8_t data[] = "data";
+    size_t bytes, written;
+    
+    mock = mock_io_init(4096);
+    io.read = mock_read;
+    io.write = mock_write;
+    io.ctx = mock;
+    config.small_frame_threshold = 64;
+    assert_true(yamux_session_create(&io, 1, &config, &session) == YAMUX_OK, "Failed to create client session");
+    
+    /* One stream holds a small write, the other has no send window */
+    assert_true(yamux_stream_open_detailed(session, 0, &held) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(session, 0, &starved) == YAMUX_OK, "Failed to open stream");
+    yamux_encode_u32(262144, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 1, window, 4);
+    yamux_encode_u32(0, window);
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_SYN | YAMUX_FLAG_ACK, 3, window, 4);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN-ACK");
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process SYN-ACK");
+    assert_true(yamux_stream_write(held, data, sizeof(data), &bytes) == YAMUX_OK && bytes == sizeof(data),
+                "Small write should be held");
+    assert_true(yamux_stream_write(starved, data, sizeof(data), &bytes) == YAMUX_ERR_NO_WINDOW,
+                "Write without window should wait for credit");
+    
+    /* The peer resets both */
+    mock_io_inject_frame(mock, YAMUX_WINDOW_UPDATE, YAMUX_FLAG_RST, 1, NULL, 0);
+    mock_io_inject_frame(mock, YAMUX_DATA, YAMUX_FLAG_RST, 3, NULL, 0);
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process RST");
+    assert_true(yamux_session_process(session) == YAMUX_OK, "Failed to process RST");
+    written = mock->write_buf_used;
+    
+    /* Every write fails with RESET before anything is sent or held */
+    assert_int_equal(yamux_stream_write(held, data, sizeof(data), &bytes), YAMUX_ERR_RESET,
+                     "Write after reset should fail at once");
+    assert_true(bytes == 0, "Nothing should be accepted after a reset");
+    assert_int_equal(yamux_stream_write(held, data, 0, &bytes), YAMUX_ERR_RESET,
+                     "Zero-length write after reset should fail too");
+    yamux_stream_interrupt(held);
+    assert_int_equal(yamux_stream_write(held, data, sizeof(data), &bytes), YAMUX_ERR_RESET,
+                     "Reset should take precedence over an interrupt");
+    assert_int_equal(yamux_stream_write(starved, data, sizeof(data), &bytes), YAMUX_ERR_RESET,
+                     "Write waiting for window should now fail with RESET");
+    assert_true(yamux_stream_get_reset_reason(held) == YAMUX_RESET_PEER &&
+                yamux_stream_get_reset_reason(starved) == YAMUX_RESET_PEER,
+                "Reason should be preserved as PEER");
+    
+    /* Data held before the reset is dropped, not sent later */
+    assert_int_equal(yamux_stream_flush(held), YAMUX_ERR_RESET, "Flush after reset should report RESET");
+    yamux_session_process(session);
+    assert_true(mock->write_buf_used == written, "Nothing should be sent for reset streams");
+    
+    yamux_stream_close(held, 0);
+    yamux_stream_close(starved, 0);
+    yamux_session_close(session, YAMUX_NORMAL);
+    yamux_session_free(session);
+    mock_io_free(mock);
+}
+
+/* Peer side of the drain test, driven from the server's wait callback */
+typedef struct {
+    test_transport_t *transport;
+    yamux_session_t *client;
+    yamux_stream_t *stream;
+    const uint8_t *data;
+    size_t len;
+    size_t sent;
+    int waits;
+} drain_peer_t;
+
+/* Let the peer take window updates, send what it can and FIN at the end */
+static int drain_peer_wait(void *ctx, uint32_t timeout_ms, uint32_t *elapsed_ms) {
+    drain_peer_t *peer = (drain_peer_t *)ctx;
+    size_t bytes;
+    
+    (void)timeout_ms;
+    *elapsed_ms = 1;
+    peer->waits++;
+    
+    while (peer->transport->b_to_a.count > 0) {
+        if (yamux_session_process(peer->client) != YAMUX_OK) {
+            return -1;
+        }
+    }
+    if (peer->sent < peer->len &&
+        yamux_stream_write(peer->stream, peer->data + peer->sent, peer->len - peer->sent, &bytes) == YAMUX_OK) {
+        peer->sent += bytes;
+        if (peer->sent == peer->len) {
+            yamux_stream_close(peer->stream, 0);
+        }
+    }
+    
+    return peer->transport->a_to_b.count > 0;
+}
+
+/* Test that draining lets the peer finish a trailing burst and close cleanly */
+void test_stream_drain_recv(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *server_stream, *idle_client, *idle_server;
+    static uint8_t data[3 * YAMUX_DEFAULT_WINDOW_SIZE];
+    drain_peer_t peer;
+    
+    memset(data, 'd', sizeof(data));
+    transport = test_transport_pair(2 * YAMUX_DEFAULT_WINDOW_SIZE, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    
+    memset(&peer, 0, sizeof(peer));
+    peer.transport = transport;
+    peer.client = client;
+    peer.data = data;
+    peer.len = sizeof(data);
+    assert_true(yamux_stream_open_detailed(client, 0, &peer.stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(yamux_stream_open_detailed(client, 0, &idle_client) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    assert_true(yamux_stream_accept(server, &idle_server) == YAMUX_OK, "Failed to accept stream");
+    
+    /* Without a wait callback only what has arrived is discarded */
+    assert_int_equal(yamux_stream_drain_recv(NULL, 100), YAMUX_ERR_INVALID, "NULL stream should be rejected");
+    assert_true(yamux_stream_write(idle_client, data, 100, &peer.sent) == YAMUX_OK, "Failed to write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data");
+    assert_int_equal(yamux_stream_drain_recv(idle_server, 100), YAMUX_ERR_TIMEOUT,
+                     "A peer that has not finished should time out");
+    assert_true(idle_server->recvbuf.used == idle_server->recvbuf.pos, "Arrived data should be discarded");
+    
+    /* The peer sends three windows' worth and then FIN while we only drain */
+    peer.sent = 0;
+    assert_true(yamux_stream_pause_recv(server_stream) == YAMUX_OK, "Failed to pause");
+    assert_true(yamux_set_wait_callback(server, drain_peer_wait, &peer) == YAMUX_OK, "Failed to set wait callback");
+    assert_true(yamux_stream_drain_recv(server_stream, 100000) == YAMUX_OK, "Drain should end at the peer's FIN");
+    assert_true(peer.sent == sizeof(data), "The peer should have sent everything");
+    assert_true(yamux_stream_get_state(server_stream) == YAMUX_STREAM_FIN_RECV, "Server should have the peer's FIN");
+    
+    /* Our FIN completes a clean close on both sides */
+    assert_true(yamux_stream_close(server_stream, 0) == YAMUX_OK, "Failed to close");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+    assert_true(yamux_stream_get_state(peer.stream) == YAMUX_STREAM_CLOSED, "Client stream should be closed");
+    assert_true(yamux_stream_get_reset_reason(peer.stream) == YAMUX_RESET_NONE, "Close should not be a reset");
+    
+    /* Without a FIN the wait runs out */
+    peer.waits = 0;
+    assert_int_equal(yamux_stream_drain_recv(idle_server, 5), YAMUX_ERR_TIMEOUT, "Drain should time out");
+    assert_true(peer.waits > 0 && peer.waits <= 5, "Drain should stop waiting at the timeout");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Wait callback on a fake clock; the peer optionally writes partway through */
+typedef struct {
+    test_transport_t *transport;
+    yamux_stream_t *peer_stream;   /* Writes "tick" during the next wait if set */
+    yamux_stream_t *interrupt;     /* Interrupted during the next wait if set */
+    int woken;                     /* The wake callback ran; the wait ends early */
+    int wakes;
+    uint32_t clock_ms;
+    int waits;
+} read_wait_t;
+
+static void read_wake(void *ctx) {
+    read_wait_t *w = (read_wait_t *)ctx;
+    
+    w->wakes++;
+    w->woken = 1;
+}
+
+static int read_wait(void *ctx, uint32_t timeout_ms, uint32_t *elapsed_ms) {
+    read_wait_t *w = (read_wait_t *)ctx;
+    size_t bytes;
+    
+    w->waits++;
+    if (w->interrupt) {
+        yamux_stream_interrupt(w->interrupt);
+        w->interrupt = NULL;
+    }
+    if (w->woken) {
+        w->woken = 0;
+        *elapsed_ms = 10;
+    } else if (w->peer_stream) {
+        yamux_stream_write(w->peer_stream, (const uint8_t *)"tick", 4, &bytes);
+        w->peer_stream = NULL;
+        *elapsed_ms = 30;
+    } else if (w->transport->a_to_b.count > 0) {
+        *elapsed_ms = 0;
+    } else {
+        *elapsed_ms = timeout_ms;
+    }
+    w->clock_ms += *elapsed_ms;
+    
+    return w->transport->a_to_b.count > 0 ? 1 : 0;
+}
+
+/* Test that each read waits at most its own timeout */
+void test_stream_read_timeout(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    read_wait_t wait;
+    uint8_t buf[16];
+    size_t bytes;
+    int i;
+    
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* By default an empty read returns at once with nothing */
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 0,
+                "Reads should not wait by default");
+    assert_int_equal(yamux_stream_set_read_timeout(NULL, 100), YAMUX_ERR_INVALID, "NULL stream should be rejected");
+    assert_true(yamux_stream_set_read_timeout(server_stream, 100) == YAMUX_OK, "Failed to set read timeout");
+    assert_int_equal(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes), YAMUX_ERR_TIMEOUT,
+                     "Without a wait callback an empty read times out at once");
+    
+    memset(&wait, 0, sizeof(wait));
+    wait.transport = transport;
+    assert_true(yamux_set_wait_callback(server, read_wait, &wait) == YAMUX_OK, "Failed to set wait callback");
+    
+    /* Every read gets the full timeout again, whatever earlier reads did */
+    for (i = 1; i <= 3; i++) {
+        assert_int_equal(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes), YAMUX_ERR_TIMEOUT,
+                         "Idle read should time out");
+        assert_true(wait.clock_ms == 100 * (uint32_t)i, "Each read should wait its own timeout");
+    }
+    
+    /* Data arriving mid-wait ends the read early, and the next read times out afresh */
+    wait.clock_ms = 0;
+    wait.peer_stream = client_stream;
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK &&
+                bytes == 4 && memcmp(buf, "tick", 4) == 0, "Read should return data that arrives in time");
+    assert_true(wait.clock_ms == 30, "Read should return as soon as data arrives");
+    wait.clock_ms = 0;
+    assert_int_equal(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes), YAMUX_ERR_TIMEOUT,
+                     "Read after a timed-out one should still work");
+    assert_true(wait.clock_ms == 100, "Timeout should not carry over from the previous read");
+    
+    /* An interrupt wakes a read blocked in the wait, though the wait found nothing */
+    assert_true(yamux_set_wake_callback(server, read_wake, &wait) == YAMUX_OK, "Failed to set wake callback");
+    wait.clock_ms = 0;
+    wait.interrupt = server_stream;
+    assert_int_equal(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes), YAMUX_ERR_INTERRUPTED,
+                     "Interrupt during the wait should end the read");
+    assert_true(wait.wakes == 1 && wait.clock_ms == 10, "Wake callback should cut the wait short");
+    
+    /* Nothing is left pending for the next read */
+    wait.clock_ms = 0;
+    assert_int_equal(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes), YAMUX_ERR_TIMEOUT,
+                     "Read after an interrupted one should wait normally");
+    assert_true(wait.clock_ms == 100, "Interrupted read should not shorten the next one");
+    
+    /* An interrupt that comes first ends the read before it waits */
+    assert_true(yamux_stream_interrupt(server_stream) == YAMUX_OK, "Failed to interrupt");
+    wait.woken = 0;
+    wait.waits = 0;
+    assert_int_equal(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes), YAMUX_ERR_INTERRUPTED,
+                     "Pending interrupt should end the read");
+    assert_true(wait.waits == 0, "Interrupted read should not wait");
+    
+    /* Buffered data and EOF are returned without waiting */
+    assert_true(yamux_stream_write(client_stream, (const uint8_t *)"last", 4, &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to close");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data and FIN");
+    wait.waits = 0;
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 4,
+                "Buffered data should be read at once");
+    assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 0,
+                "EOF should be read at once");
+    assert_true(wait.waits == 0, "Neither read should wait");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Write a message with a big-endian 16-bit length prefix */
+static void write_message16(yamux_stream_t *stream, const uint8_t *body, size_t len) {
+    uint8_t prefix[2];
+    size_t bytes;
+    
+    prefix[0] = (uint8_t)(len >> 8);
+    prefix[1] = (uint8_t)len;
+    assert_true(yamux_stream_write(stream, prefix, sizeof(prefix), &bytes) == YAMUX_OK && bytes == 2,
+                "Failed to write prefix");
+    if (len > 0) {
+        assert_true(yamux_stream_write(stream, body, len, &bytes) == YAMUX_OK && bytes == len,
+                    "Failed to write body");
+    }
+}
+
+/* Test that length-prefixed messages are read whole and one at a time */
+void test_stream_read_message(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    static const size_t sizes[] = { 0, 1, 5, 300, 1000 };
+    static const uint8_t le_msg[] = { 3, 0, 0, 0, 'a', 'b', 'c' };
+    uint8_t body[1024];
+    uint8_t buf[1024];
+    read_wait_t wait;
+    size_t msg_len;
+    size_t bytes;
+    size_t i, j;
+    
+    transport = test_transport_pair(8192, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    assert_int_equal(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 0, 1),
+                     YAMUX_ERR_INVALID, "A zero-byte prefix should be rejected");
+    assert_int_equal(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 5, 1),
+                     YAMUX_ERR_INVALID, "A prefix wider than 4 bytes should be rejected");
+    
+    /* Back-to-back messages of varying sizes come out with their boundaries intact */
+    for (i = 0; i < sizeof(body); i++) {
+        body[i] = (uint8_t)(i * 7);
+    }
+    for (i = 0; i < sizeof(sizes) / sizeof(sizes[0]); i++) {
+        write_message16(client_stream, body + i, sizes[i]);
+    }
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver messages");
+    for (i = 0; i < sizeof(sizes) / sizeof(sizes[0]); i++) {
+        assert_true(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 2, 1) == YAMUX_OK,
+                    "Failed to read message");
+        assert_true(msg_len == sizes[i], "Message length should match the prefix");
+        for (j = 0; j < sizes[i]; j++) {
+            assert_true(buf[j] == body[i + j], "Message body should match what was sent");
+        }
+    }
+    assert_int_equal(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 2, 1),
+                     YAMUX_ERR_TIMEOUT, "With nothing buffered and no timeout the read should give up");
+    
+    /* An oversized message is reported and left unread */
+    write_message16(client_stream, body, 50);
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver message");
+    assert_int_equal(yamux_stream_read_message(server_stream, buf, 16, &msg_len, 2, 1),
+                     YAMUX_ERR_NOMEM, "A message longer than the buffer should be refused");
+    assert_true(msg_len == 50, "The refused message's length should be reported");
+    assert_true(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 2, 1) == YAMUX_OK &&
+                msg_len == 50 && memcmp(buf, body, 50) == 0, "The refused message should still be readable");
+    
+    /* A little-endian 4-byte prefix */
+    assert_true(yamux_stream_write(client_stream, le_msg, sizeof(le_msg), &bytes) == YAMUX_OK, "Failed to write");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver message");
+    assert_true(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 4, 0) == YAMUX_OK &&
+                msg_len == 3 && memcmp(buf, "abc", 3) == 0, "Failed to read little-endian message");
+    
+    /* A body still in flight is waited for within the read timeout */
+    memset(&wait, 0, sizeof(wait));
+    wait.transport = transport;
+    assert_true(yamux_set_wait_callback(server, read_wait, &wait) == YAMUX_OK, "Failed to set wait callback");
+    assert_true(yamux_stream_set_read_timeout(server_stream, 100) == YAMUX_OK, "Failed to set read timeout");
+    buf[0] = 0;
+    buf[1] = 4;
+    assert_true(yamux_stream_write(client_stream, buf, 2, &bytes) == YAMUX_OK, "Failed to write prefix");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver prefix");
+    wait.peer_stream = client_stream;
+    assert_true(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 2, 1) == YAMUX_OK &&
+                msg_len == 4 && memcmp(buf, "tick", 4) == 0, "Body arriving in time should complete the message");
+    assert_true(wait.clock_ms == 30, "Read should return as soon as the body arrives");
+    
+    /* EOF between messages is a clean end; EOF inside one is not */
+    write_message16(client_stream, body, 2);
+    assert_true(yamux_stream_write(client_stream, (const uint8_t *)"\0\tabc", 5, &bytes) == YAMUX_OK,
+                "Failed to write truncated message");
+    assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to close");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver data and FIN");
+    assert_true(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 2, 1) == YAMUX_OK &&
+                msg_len == 2, "Messages before EOF should still be read");
+    assert_int_equal(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 2, 1),
+                     YAMUX_ERR_PROTOCOL, "EOF inside a message should be reported");
+    assert_int_equal(yamux_stream_read_message(server_stream, buf, sizeof(buf), &msg_len, 2, 1),
+                     YAMUX_ERR_CLOSED, "EOF between messages should be reported as closed");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Peer of a blocked TLV writer: the server reads what arrived, granting window back */
+typedef struct {
+    yamux_session_t *server;
+    yamux_stream_t *stream;
+    test_transport_t *transport;
+    uint8_t got[4096];
+    size_t got_len;
+} tlv_wait_t;
+
+static int tlv_wait(void *ctx, uint32_t timeout_ms, uint32_t *elapsed_ms) {
+    tlv_wait_t *w = (tlv_wait_t *)ctx;
+    size_t bytes;
+    
+    (void)timeout_ms;
+    while (w->transport->a_to_b.count > 0) {
+        (void)yamux_session_process(w->server);
+    }
+    while (yamux_stream_read(w->stream, w->got + w->got_len, sizeof(w->got) - w->got_len, &bytes) == YAMUX_OK &&
+           bytes > 0) {
+        w->got_len += bytes;
+    }
+    *elapsed_ms = 10;
+    
+    return w->transport->b_to_a.count > 0 ? 1 : 0;
+}
+
+/* Test TLV records round-trip, and that a long one waits for window */
+void test_stream_tlv(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    yamux_config_t config;
+    static uint8_t value[3000];
+    static tlv_wait_t wait;
+    uint8_t buf[1024];
+    uint8_t type;
+    uint32_t elapsed;
+    size_t val_len;
+    size_t i;
+    static const struct {
+        uint8_t type;
+        size_t len;
+    } records[] = { {1, 0}, {2, 2}, {0xff, 1000}, {7, 300}, {0, 1} };
+    
+    for (i = 0; i < sizeof(value); i++) {
+        value[i] = (uint8_t)(i * 7);
+    }
+    transport = test_transport_pair(64 * 1024, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    config = yamux_default_config;
+    config.max_stream_window_size = 1024;
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, &config, &server) == YAMUX_OK, "Failed to create server");
+    assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to exchange SYNs");
+    assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+    
+    /* Records of several types and lengths, each read back as written */
+    for (i = 0; i < sizeof(records) / sizeof(records[0]); i++) {
+        assert_true(yamux_stream_write_tlv(client_stream, records[i].type, value, records[i].len, 0) == YAMUX_OK,
+                    "Failed to write TLV");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver TLV");
+        assert_true(yamux_stream_read_tlv(server_stream, &type, buf, sizeof(buf), &val_len) == YAMUX_OK,
+                    "Failed to read TLV");
+        assert_true(type == records[i].type && val_len == records[i].len &&
+                    memcmp(buf, value, val_len) == 0, "TLV should round-trip");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to return window");
+    }
+    assert_true(yamux_stream_read_tlv(server_stream, &type, buf, sizeof(buf), &val_len) == YAMUX_ERR_TIMEOUT,
+                "No record should be left");
+    assert_true(yamux_stream_write_tlv(client_stream, 1, NULL, 1, 0) == YAMUX_ERR_INVALID, "NULL value should be invalid");
+    assert_true(yamux_stream_read_tlv(server_stream, NULL, buf, sizeof(buf), &val_len) == YAMUX_ERR_INVALID,
+                "NULL type should be invalid");
+    
+    /* A value too big for the buffer is left unread with its length reported */
+    assert_true(yamux_stream_write_tlv(client_stream, 9, value, 100, 0) == YAMUX_OK, "Failed to write TLV");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver TLV");
+    assert_true(yamux_stream_read_tlv(server_stream, &type, buf, 10, &val_len) == YAMUX_ERR_NOMEM && val_len == 100,
+                "Oversized value should be refused");
+    assert_true(yamux_stream_read_tlv(server_stream, &type, buf, sizeof(buf), &val_len) == YAMUX_OK &&
+                type == 9 && val_len == 100, "Oversized value should still be readable");
+    assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to return window");
+    
+    /* Longer than the window: refused whole without a timeout, even with a read timeout set */
+    wait.server = server;
+    wait.stream = server_stream;
+    wait.transport = transport;
+    wait.got_len = 0;
+    assert_true(yamux_set_wait_callback(client, tlv_wait, &wait) == YAMUX_OK, "Failed to set wait callback");
+    assert_true(yamux_stream_set_read_timeout(client_stream, 1000) == YAMUX_OK, "Failed to set timeout");
+    assert_true(yamux_stream_write_tlv(client_stream, 3, value, sizeof(value), 0) == YAMUX_ERR_NO_WINDOW,
+                "Record beyond the window should be refused");
+    assert_true(transport->a_to_b.count == 0, "A refused record should write nothing");
+    
+    /* With a write timeout it is sent in pieces, even with non-blocking reads */
+    assert_true(yamux_stream_set_read_timeout(client_stream, 0) == YAMUX_OK, "Failed to clear timeout");
+    assert_true(yamux_stream_write_tlv(client_stream, 3, value, sizeof(value), 1000) == YAMUX_OK,
+                "Record should be written as window comes back");
+    tlv_wait(&wait, 0, &elapsed);
+    assert_true(wait.got_len == 5 + sizeof(value) && wait.got[0] == 3 &&
+                yamux_decode_u32(wait.got + 1) == sizeof(value) && memcmp(wait.got + 5, value, sizeof(value)) == 0,
+                "Peer should receive the whole record");
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+}
+
+/* Allocations not yet freed while the allocator below is installed */
+static long churn_live = 0;
+
+static void *churn_malloc(size_t size) {
+    void *ptr = malloc(size);
+    if (ptr) {
+        churn_live++;
+    }
+    return ptr;
+}
+
+static void *churn_realloc(void *ptr, size_t size) {
+    void *grown = realloc(ptr, size);
+    if (grown && !ptr) {
+        churn_live++;
+    }
+    return grown;
+}
+
+static void churn_free(void *ptr) {
+    if (ptr) {
+        churn_live--;
+    }
+    free(ptr);
+}
+
+static const yamux_allocator_t churn_allocator = { churn_malloc, churn_realloc, churn_free };
+
+/* Test thousands of open/write/close cycles for leaks and accounting drift */
+void test_stream_churn(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    yamux_session_t *client, *server;
+    yamux_stream_t *client_stream, *server_stream;
+    void *client_ctx, *server_ctx;
+    void *client_handle, *server_handle;
+    uint8_t data[64];
+    uint8_t buf[128];
+    size_t len, bytes, total;
+    uint32_t window;
+    long baseline = -1;
+    int i;
+    
+    churn_live = 0;
+    yamux_set_allocator(&churn_allocator);
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    assert_true(yamux_session_create(&client_io, 1, NULL, &client) == YAMUX_OK, "Failed to create client");
+    assert_true(yamux_session_create(&server_io, 0, NULL, &server) == YAMUX_OK, "Failed to create server");
+    
+    /*
+     * Half the streams end with an RST, from either side, and half with a
+     * FIN from each side, either side closing first. The side that closes
+     * first holds its stream until the peer's FIN, then releases it.
+     */
+    for (i = 0; i < 5000; i++) {
+        len = 1 + (size_t)i % sizeof(data);
+        memset(data, (uint8_t)i, len);
+        
+        assert_true(yamux_stream_open_detailed(client, 0, &client_stream) == YAMUX_OK, "Failed to open stream");
+        assert_true(client_stream->id == 1 + 2 * (uint32_t)i, "Stream IDs should advance by two");
+        window = client_stream->send_window;
+        assert_true(yamux_stream_write(client_stream, data, len, &bytes) == YAMUX_OK && bytes == len,
+                    "Failed to write payload");
+        assert_true(client_stream->send_window == window - len, "Write should take exactly its length in window");
+        
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver stream");
+        assert_true(yamux_stream_accept(server, &server_stream) == YAMUX_OK, "Failed to accept stream");
+        assert_true(server_stream->id == client_stream->id, "Peer should see the same stream ID");
+        total = 0;
+        while (yamux_stream_read(server_stream, buf + total, sizeof(buf) - total, &bytes) == YAMUX_OK && bytes > 0) {
+            total += bytes;
+        }
+        assert_true(total == len && memcmp(buf, data, len) == 0, "Payload should arrive intact");
+        assert_true(client_stream->send_window == yamux_default_config.max_stream_window_size,
+                    "Every SYN-ACK should grant the same window");
+        
+        if (i % 4 == 0) {
+            assert_true(yamux_stream_close(client_stream, 1) == YAMUX_OK, "Failed to reset client stream");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver RST");
+            assert_true(server_stream->reset_reason == YAMUX_RESET_PEER, "Server should see the reset");
+            assert_true(yamux_stream_close(server_stream, 0) == YAMUX_OK, "Failed to release server stream");
+        } else if (i % 4 == 1) {
+            assert_true(yamux_stream_close(server_stream, 1) == YAMUX_OK, "Failed to reset server stream");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver RST");
+            assert_true(client_stream->reset_reason == YAMUX_RESET_PEER, "Client should see the reset");
+            assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to release client stream");
+        } else if (i % 4 == 2) {
+            assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to close client stream");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+            assert_true(yamux_stream_read(server_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 0,
+                        "Server should see EOF");
+            assert_true(yamux_stream_close(server_stream, 0) == YAMUX_OK, "Failed to close server stream");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+            assert_true(client_stream->state == YAMUX_STREAM_CLOSED, "Client should see the close complete");
+            assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to release client stream");
+        } else {
+            assert_true(yamux_stream_close(server_stream, 0) == YAMUX_OK, "Failed to close server stream");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+            assert_true(yamux_stream_read(client_stream, buf, sizeof(buf), &bytes) == YAMUX_OK && bytes == 0,
+                        "Client should see EOF");
+            assert_true(yamux_stream_close(client_stream, 0) == YAMUX_OK, "Failed to close client stream");
+            assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+            assert_true(server_stream->state == YAMUX_STREAM_CLOSED, "Server should see the close complete");
+            assert_true(yamux_stream_close(server_stream, 0) == YAMUX_OK, "Failed to release server stream");
+        }
+        
+        /* Nothing is left behind by a finished stream */
+        assert_true(client->stream_count == 0 && server->stream_count == 0, "Closed streams should leave the sessions");
+        assert_true(client->accept_queue == NULL && server->accept_queue == NULL, "Accept queues should be empty");
+        if (i == 10) {
+            baseline = churn_live;
+        } else if (i > 10) {
+            assert_true(churn_live <= baseline, "Allocations should not grow with each stream");
+        }
+    }
+    
+    yamux_session_close(client, YAMUX_NORMAL);
+    yamux_session_close(server, YAMUX_NORMAL);
+    yamux_session_free(client);
+    yamux_session_free(server);
+    test_transport_free(transport);
+    
+    /* A closed handle is gone at once; the stream goes when the peer's FIN arrives */
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    client_ctx = yamux_init(client_io.read, client_io.write, client_io.ctx, 1);
+    server_ctx = yamux_init(server_io.read, server_io.write, server_io.ctx, 0);
+    assert_true(client_ctx && server_ctx, "Failed to create handle sessions");
+    client = ((yamux_context_t *)client_ctx)->session;
+    server = ((yamux_context_t *)server_ctx)->session;
+    for (i = 0; i < 1000; i++) {
+        client_handle = yamux_open_stream(client_ctx);
+        assert_true(client_handle != NULL, "Failed to open stream handle");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver stream");
+        server_handle = yamux_accept_stream(server_ctx);
+        assert_true(server_handle != NULL, "Failed to accept stream handle");
+        assert_true(yamux_close_stream(client_handle, 0) == 0, "Failed to close client handle");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+        assert_true(yamux_close_stream(server_handle, 0) == 0, "Failed to close server handle");
+        assert_true(test_transport_pump(transport, client, server) == YAMUX_OK, "Failed to deliver FIN");
+        assert_true(client->stream_count == 0 && server->stream_count == 0,
+                    "Streams closed through handles should leave the sessions");
+    }
+    yamux_destroy(client_ctx);
+    yamux_destroy(server_ctx);
+    test_transport_free(transport);
+    
+    yamux_set_allocator(NULL);
+    assert_true(churn_live == 0, "Every allocation should be freed");
+}
@@ -0,0 +1,236 @@
+/**
+ * @file test_teardown.c
+ * @brief Test destroying sessions with live streams and callbacks
+ *
+ * Build with -DYAMUX_ASAN=ON to have AddressSanitizer check the teardown
+ * paths for use-after-free and leaks.
+ */
+
+#include "../../src/yamux_internal.h"
+#include <stdio.h>
+#include <string.h>
+#include "test_transport.h"
+
+/* External assert function declaration */
+void assert_true(int condition, const char *message);
+
+#define TEARDOWN_STREAMS 24
+
+/* Callback state */
+typedef struct {
+    int calls;
+    void *destroy;      /* Session handle to destroy from the callback */
+} teardown_record_t;
+
+static void teardown_peer_fin(void *ctx, yamux_stream_t *stream) {
+    teardown_record_t *rec = (teardown_record_t *)ctx;
+
+    (void)stream;
+    rec->calls++;
+    if (rec->destroy) {
+        yamux_destroy(rec->destroy);
+        rec->destroy = NULL;
+    }
+}
+
+/* Process until the transport is idle or a side stops, using the handle API */
+static void teardown_pump(test_transport_t *t, void *client, void *server) {
+    int progress = 1;
+
+    while (progress) {
+        progress = 0;
+        if (client && t->b_to_a.count > 0 && yamux_process(client) == 0) {
+            progress = 1;
+        }
+        if (server && t->a_to_b.count > 0 && yamux_process(server) == 0) {
+            progress = 1;
+        }
+    }
+}
+
+/* Test that destroy is safe with live streams, handles and callbacks */
+void test_session_teardown(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    void *client, *server;
+    void *client_streams[TEARDOWN_STREAMS];
+    void *server_streams[TEARDOWN_STREAMS];
+    teardown_record_t rec;
+    uint8_t data[] = "payload";
+    uint8_t buf[16];
+    int accepted = 0;
+    int i;
+
+    /* Many streams in every state: accepted, queued, half-closed, with data */
+    transport = test_transport_pair(64 * 1024, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    client = yamux_init(client_io.read, client_io.write, client_io.ctx, 1);
+    server = yamux_init(server_io.read, server_io.write, server_io.ctx, 0);
+    assert_true(client && server, "Failed to create sessions");
+
+    memset(&rec, 0, sizeof(rec));
+    yamux_set_stream_peer_fin_callback(((yamux_context_t *)server)->session, teardown_peer_fin, &rec);
+
+    for (i = 0; i < TEARDOWN_STREAMS; i++) {
+        client_streams[i] = yamux_open_stream(client);
+        assert_true(client_streams[i] != NULL, "Failed to open stream");
+    }
+    teardown_pump(transport, client, server);
+    for (i = 0; i < TEARDOWN_STREAMS / 2; i++) {
+        server_streams[i] = yamux_accept_stream(server);
+        assert_true(server_streams[i] != NULL, "Failed to accept stream");
+        accepted++;
+    }
+    for (i = 0; i < TEARDOWN_STREAMS; i++) {
+        assert_true(yamux_write(client_streams[i], data, sizeof(data)) == (int)sizeof(data),
+                    "Failed to write");
+    }
+    yamux_close_stream(client_streams[0], 0);
+    client_streams[0] = NULL;
+    teardown_pump(transport, client, server);
+    assert_true(rec.calls == 1, "Peer FIN callback should fire before teardown");
+
+    yamux_destroy(server);
+
+    /* Handles outlive the session: they fail cleanly and can be released */
+    assert_true(yamux_read(server_streams[1], buf, sizeof(buf)) < 0, "Read on detached handle should fail");
+    assert_true(yamux_write(server_streams[1], data, sizeof(data)) < 0, "Write on detached handle should fail");
+    assert_true(yamux_get_stream_id(server_streams[1]) == 0, "Detached handle should have no stream");
+    for (i = 0; i < accepted; i++) {
+        assert_true(yamux_close_stream(server_streams[i], 0) == YAMUX_ERR_CLOSED,
+                    "Closing a detached handle should report CLOSED");
+    }
+
+    /* The client sees the GoAway and tears down its own streams */
+    teardown_pump(transport, client, NULL);
+    assert_true(rec.calls == 1, "No callback should fire during teardown");
+    yamux_destroy(client);
+    for (i = 1; i < TEARDOWN_STREAMS; i++) {
+        yamux_close_stream(client_streams[i], 1);
+    }
+    test_transport_free(transport);
+
+    /* Destroying the session from inside its own callback is deferred */
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    client = yamux_init(client_io.read, client_io.write, client_io.ctx, 1);
+    server = yamux_init(server_io.read, server_io.write, server_io.ctx, 0);
+    assert_true(client && server, "Failed to create sessions");
+
+    memset(&rec, 0, sizeof(rec));
+    rec.destroy = server;
+    yamux_set_stream_peer_fin_callback(((yamux_context_t *)server)->session, teardown_peer_fin, &rec);
+
+    client_streams[0] = yamux_open_stream(client);
+    client_streams[1] = yamux_open_stream(client);
+    teardown_pump(transport, client, server);
+    server_streams[0] = yamux_accept_stream(server);
+    assert_true(server_streams[0] != NULL, "Failed to accept stream");
+
+    assert_true(yamux_write(client_streams[0], data, sizeof(data)) == (int)sizeof(data), "Failed to write");
+    yamux_close_stream(client_streams[0], 0);
+    assert_true(yamux_process(server) == 0, "Failed to process data");
+    assert_true(yamux_process(server) == YAMUX_ERR_CLOSED,
+                "Processing the FIN that destroys the session should report CLOSED");
+    assert_true(rec.calls == 1 && rec.destroy == NULL, "Callback should have destroyed the session");
+    assert_true(yamux_close_stream(server_streams[0], 0) == YAMUX_ERR_CLOSED,
+                "Handle should be detached after deferred destroy");
+
+    yamux_close_stream(client_streams[1], 1);
+    yamux_destroy(client);
+    test_transport_free(transport);
+}
+
+/* Wait callback that makes room in the transport, or times out */
+typedef struct {
+    test_ring_t *ring;
+    int drain;          /* Empty the ring instead of timing out */
+    int calls;
+} flush_wait_t;
+
+static int flush_wait(void *ctx, uint32_t timeout_ms, uint32_t *elapsed_ms) {
+    flush_wait_t *wait = (flush_wait_t *)ctx;
+
+    wait->calls++;
+    if (wait->drain) {
+        wait->ring->count = 0;
+        *elapsed_ms = 1;
+        return 1;
+    }
+    *elapsed_ms = timeout_ms;
+    return 0;
+}
+
+/* Read everything a server handle receives until EOF */
+static int flush_read_all(void *stream, uint8_t *buf, size_t cap) {
+    size_t total = 0;
+    int n;
+
+    while ((n = yamux_read(stream, buf + total, cap - total)) > 0) {
+        total += (size_t)n;
+    }
+    return n < 0 ? n : (int)total;
+}
+
+/* Test that destroying with flush delivers data the peer has not read yet */
+void test_destroy_flush(void) {
+    test_transport_t *transport;
+    yamux_io_t client_io, server_io;
+    void *client, *server, *stream, *accepted;
+    teardown_record_t rec;
+    flush_wait_t wait;
+    uint8_t data[48];
+    uint8_t buf[128];
+    int i;
+
+    for (i = 0; i < (int)sizeof(data); i++) {
+        data[i] = (uint8_t)(i + 1);
+    }
+    assert_true(yamux_destroy_flush(NULL, 0) == YAMUX_ERR_INVALID, "NULL session should be rejected");
+
+    /* Held data goes out, followed by a FIN rather than an RST */
+    transport = test_transport_pair(4096, &client_io, &server_io);
+    assert_true(transport != NULL, "Failed to create transport pair");
+    client = yamux_init(client_io.read, client_io.write, client_io.ctx, 1);
+    server = yamux_init(server_io.read, server_io.write, server_io.ctx, 0);
+    assert_true(client && server, "Failed to create sessions");
+    ((yamux_context_t *)client)->session->config.small_frame_threshold = 64;
+    memset(&rec, 0, sizeof(rec));
+    yamux_set_stream_peer_fin_callback(((yamux_context_t *)server)->session, teardown_peer_fin, &rec);
+    stream = yamux_open_stream(client);
+    teardown_pump(transport, client, server);
+    accepted = yamux_accept_stream(server);
+    assert_true(accepted != NULL, "Failed to accept stream");
+    assert_true(yamux_write(stream, data, 32) == 32, "Failed to write");
+    assert_true(yamux_write(stream, data + 32, 16) == 16, "Failed to write");
+    assert_true(yamux_destroy_flush(client, 0) == 0, "Nothing should be dropped");
+    teardown_pump(transport, NULL, server);
+    assert_true(flush_read_all(accepted, buf, sizeof(buf)) == (int)sizeof(data), "Peer should read to EOF");
+    assert_true(memcmp(buf, data, sizeof(data)) == 0, "Peer should receive the data intact");
+    assert_true(rec.calls == 1, "Peer should see a FIN");
+    yamux_close_stream(accepted, 0);
+    yamux_close_stream(stream, 0);
+    yamux_destroy(server);
+    test_transport_free(transport);
+
+    /* A full transport gets until the timeout; what is still held is reported */
+    for (i = 0; i < 2; i++) {
+        transport = test_transport_pair(4096, &client_io, &server_io);
+        assert_true(transport != NULL, "Failed to create transport pair");
+        client = yamux_init(client_io.read, client_io.write, client_io.ctx, 1);
+        assert_true(client != NULL, "Failed to create session");
+        ((yamux_context_t *)client)->session->config.small_frame_threshold = 64;
+        memset(&wait, 0, sizeof(wait));
+        wait.ring = &transport->a_to_b;
+        wait.drain = i;
+        assert_true(yamux_set_wait(client, flush_wait, &wait) == 0, "Failed to set wait callback");
+        stream = yamux_open_stream(client);
+        assert_true(yamux_write(stream, data, 40) == 40, "Failed to write");
+        transport->a_to_b.count = transport->a_to_b.capacity;
+        assert_true(yamux_destroy_flush(client, 100) == (i ? 0 : 40),
+                    i ? "Data should go out once the transport drains" : "Held data should be reported dropped");
+        assert_true(wait.calls == 1, "Flush should wait for the transport");
+        yamux_close_stream(stream, 0);
+        test_transport_free(transport);
+    }
+}
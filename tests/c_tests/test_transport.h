@@ -0,0 +1,143 @@
+/**
+ * @file test_transport.h
+ * @brief Deterministic in-memory transport for driving two sessions
+ *
+ * test_transport_pair() returns two connected yamux_io_t endpoints backed
+ * by a pair of ring buffers: bytes written on one side are read on the
+ * other. Reads return 0 when nothing is buffered and writes accept only
+ * what fits, like a nonblocking socket, but there are no threads, file
+ * descriptors or EAGAIN handling involved.
+ */
+
+#ifndef TEST_TRANSPORT_H
+#define TEST_TRANSPORT_H
+
+#include "test_common.h"
+
+/* One direction of the transport */
+typedef struct {
+    uint8_t *data;
+    size_t capacity;
+    size_t head;        /* Next byte to read */
+    size_t count;       /* Bytes buffered */
+} test_ring_t;
+
+/* One side of the transport */
+typedef struct {
+    test_ring_t *rx;    /* Ring this side reads from */
+    test_ring_t *tx;    /* Ring this side writes to */
+} test_endpoint_t;
+
+/* A connected pair of endpoints */
+typedef struct {
+    test_ring_t a_to_b;
+    test_ring_t b_to_a;
+    test_endpoint_t a;
+    test_endpoint_t b;
+} test_transport_t;
+
+/* Read callback */
+static MAYBE_UNUSED int test_transport_read(void *ctx, uint8_t *buf, size_t len) {
+    test_ring_t *ring = ((test_endpoint_t *)ctx)->rx;
+    size_t n = 0;
+
+    while (n < len && ring->count > 0) {
+        buf[n++] = ring->data[ring->head];
+        ring->head = (ring->head + 1) % ring->capacity;
+        ring->count--;
+    }
+
+    return (int)n;
+}
+
+/* Write callback */
+static MAYBE_UNUSED int test_transport_write(void *ctx, const uint8_t *buf, size_t len) {
+    test_ring_t *ring = ((test_endpoint_t *)ctx)->tx;
+    size_t n = 0;
+
+    while (n < len && ring->count < ring->capacity) {
+        ring->data[(ring->head + ring->count) % ring->capacity] = buf[n++];
+        ring->count++;
+    }
+
+    return (int)n;
+}
+
+/* Free a transport created by test_transport_pair */
+static MAYBE_UNUSED void test_transport_free(test_transport_t *t) {
+    if (t) {
+        free(t->a_to_b.data);
+        free(t->b_to_a.data);
+        free(t);
+    }
+}
+
+/**
+ * Create a connected transport pair
+ *
+ * @param capacity Bytes each direction can buffer
+ * @param a Output I/O for the first endpoint
+ * @param b Output I/O for the second endpoint
+ * @return Transport to pass to test_transport_free, or NULL on error
+ */
+static MAYBE_UNUSED test_transport_t *test_transport_pair(size_t capacity, yamux_io_t *a, yamux_io_t *b) {
+    test_transport_t *t = (test_transport_t *)calloc(1, sizeof(test_transport_t));
+    if (!t) {
+        return NULL;
+    }
+
+    t->a_to_b.data = (uint8_t *)malloc(capacity);
+    t->b_to_a.data = (uint8_t *)malloc(capacity);
+    if (!t->a_to_b.data || !t->b_to_a.data) {
+        test_transport_free(t);
+        return NULL;
+    }
+    t->a_to_b.capacity = capacity;
+    t->b_to_a.capacity = capacity;
+
+    t->a.rx = &t->b_to_a;
+    t->a.tx = &t->a_to_b;
+    t->b.rx = &t->a_to_b;
+    t->b.tx = &t->b_to_a;
+
+    a->read = test_transport_read;
+    a->write = test_transport_write;
+    a->ctx = &t->a;
+    b->read = test_transport_read;
+    b->write = test_transport_write;
+    b->ctx = &t->b;
+
+    return t;
+}
+
+/**
+ * Process buffered frames on both sessions until neither side has input
+ *
+ * @param t Transport connecting the sessions
+ * @param a Session using endpoint a
+ * @param b Session using endpoint b
+ * @return YAMUX_OK, or the first error returned by yamux_session_process
+ */
+static MAYBE_UNUSED yamux_result_t test_transport_pump(test_transport_t *t,
+                                                       yamux_session_t *a, yamux_session_t *b) {
+    yamux_result_t result;
+
+    while (t->b_to_a.count > 0 || t->a_to_b.count > 0) {
+        if (t->b_to_a.count > 0) {
+            result = yamux_session_process(a);
+            if (result != YAMUX_OK) {
+                return result;
+            }
+        }
+        if (t->a_to_b.count > 0) {
+            result = yamux_session_process(b);
+            if (result != YAMUX_OK) {
+                return result;
+            }
+        }
+    }
+
+    return YAMUX_OK;
+}
+
+#endif /* TEST_TRANSPORT_H */
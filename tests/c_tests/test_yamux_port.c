@@ -222,11 +222,15 @@ void *server_thread(void *arg) {
     
     printf("Server: Yamux initialized\n");
     
-    /* Process any initial messages */
-    yamux_process(session);
-    
-    /* Accept a stream */
-    stream = yamux_accept_stream(session);
+    /* Process incoming messages until the client's stream arrives */
+    stream = NULL;
+    for (int attempt = 0; attempt < 200 && !stream; attempt++) {
+        yamux_process(session);
+        stream = yamux_accept_stream(session);
+        if (!stream) {
+            usleep(10000); /* 10ms */
+        }
+    }
     if (!stream) {
         printf("Failed to accept stream\n");
         yamux_destroy(session);